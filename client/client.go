@@ -6,11 +6,35 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/websocket"
 
+	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// DefaultSendTimeout is the time Send waits for the acknowledgement of the server.
+const DefaultSendTimeout = 10 * time.Second
+
+// ErrSendTimeout is returned by Send, if the server did not acknowledge the message in time.
+var ErrSendTimeout = errors.New("client: no acknowledgement of the sent message")
+
+// SendError is returned by Send, if the server rejected the message.
+type SendError struct {
+	// Type is the type of the error, one of the protocol.SEND_ERROR_* constants
+	Type string
+
+	// Message is the error text of the server
+	Message string
+}
+
+func (e *SendError) Error() string {
+	return e.Message
+}
+
 var logger = log.WithFields(log.Fields{
 	"module": "client",
 })
@@ -43,8 +67,9 @@ type Client interface {
 	Subscribe(path string) error
 	Unsubscribe(path string) error
 
-	Send(path string, body string, header string) error
-	SendBytes(path string, body []byte, header string) error
+	Send(path string, body string, header string) (*protocol.SendAck, error)
+	SendBytes(path string, body []byte, header string) (*protocol.SendAck, error)
+	SetSendTimeout(timeout time.Duration)
 
 	WriteRawMessage(message []byte) error
 	Messages() chan *protocol.Message
@@ -69,6 +94,18 @@ type client struct {
 	wSConnectionFactory func(url string, origin string) (WSConnection, error)
 	// flag, to indicate if the client is connected
 	connected bool
+
+	// the last publisher message id, and the channels waiting for the acknowledgements by the ids
+	lastPublisherMessageID uint64
+	acksMu                 sync.Mutex
+	acks                   map[string]chan *protocol.NotificationMessage
+	sendTimeout            time.Duration
+
+	// the received messages not yet passed to the messages channel, so that the reading of the connection
+	// (and of the acknowledgements) does not wait for the consumer of the messages
+	pendingMu  sync.Mutex
+	pending    []*protocol.Message
+	delivering bool
 }
 
 // Open is a shortcut for New() and Start()
@@ -88,9 +125,18 @@ func New(url, origin string, channelSize int, autoReconnect bool) Client {
 		origin:         origin,
 		shouldStopChan: make(chan bool, 1),
 		autoReconnect:  autoReconnect,
+		acks:           make(map[string]chan *protocol.NotificationMessage),
+		sendTimeout:    DefaultSendTimeout,
 	}
 }
 
+// SetSendTimeout sets the time Send waits for the acknowledgement of the server (DefaultSendTimeout by default).
+func (c *client) SetSendTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendTimeout = timeout
+}
+
 func (c *client) SetWSConnectionFactory(connection WSConnectionFactory) {
 	c.wSConnectionFactory = connection
 }
@@ -195,8 +241,9 @@ func (c *client) handleIncomingMessage(msg []byte) {
 
 	switch message := parsed.(type) {
 	case *protocol.Message:
-		c.messages <- message
+		c.deliver(message)
 	case *protocol.NotificationMessage:
+		c.handleAck(message)
 		if message.IsError {
 			select {
 			case c.errors <- message:
@@ -211,6 +258,35 @@ func (c *client) handleIncomingMessage(msg []byte) {
 	}
 }
 
+// deliver passes the message to the messages channel, in the order of the received messages,
+// without waiting for the consumer.
+func (c *client) deliver(message *protocol.Message) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	c.pending = append(c.pending, message)
+	if !c.delivering {
+		c.delivering = true
+		go c.deliverPending()
+	}
+}
+
+func (c *client) deliverPending() {
+	for {
+		c.pendingMu.Lock()
+		if len(c.pending) == 0 {
+			c.delivering = false
+			c.pendingMu.Unlock()
+			return
+		}
+		message := c.pending[0]
+		c.pending[0] = nil
+		c.pending = c.pending[1:]
+		c.pendingMu.Unlock()
+
+		c.messages <- message
+	}
+}
+
 func (c *client) Subscribe(path string) error {
 	cmd := &protocol.Cmd{
 		Name: protocol.CmdReceive,
@@ -229,19 +305,74 @@ func (c *client) Unsubscribe(path string) error {
 	return err
 }
 
-func (c *client) Send(path string, body string, header string) error {
+// Send publishes a message, and waits for the acknowledgement of the server.
+// It returns the acknowledgement with the id assigned to the message, a *SendError if the server rejected it,
+// or ErrSendTimeout if there was no acknowledgement in time.
+func (c *client) Send(path string, body string, header string) (*protocol.SendAck, error) {
 	return c.SendBytes(path, []byte(body), header)
 }
 
-func (c *client) SendBytes(path string, body []byte, header string) error {
+// SendBytes is like Send, with a body of bytes.
+func (c *client) SendBytes(path string, body []byte, header string) (*protocol.SendAck, error) {
+	id := strconv.FormatUint(atomic.AddUint64(&c.lastPublisherMessageID, 1), 10)
 	cmd := &protocol.Cmd{
 		Name:       protocol.CmdSend,
-		Arg:        path,
+		Arg:        path + " " + id,
 		Body:       body,
 		HeaderJSON: header,
 	}
 
-	return c.WriteRawMessage(cmd.Bytes())
+	ackC := make(chan *protocol.NotificationMessage, 1)
+	c.acksMu.Lock()
+	c.acks[id] = ackC
+	c.acksMu.Unlock()
+	defer func() {
+		c.acksMu.Lock()
+		delete(c.acks, id)
+		c.acksMu.Unlock()
+	}()
+
+	if err := c.WriteRawMessage(cmd.Bytes()); err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	timeout := c.sendTimeout
+	c.mu.RUnlock()
+	select {
+	case notification := <-ackC:
+		ack := &protocol.SendAck{}
+		if err := json.Unmarshal([]byte(notification.Json), ack); err != nil {
+			return nil, err
+		}
+		if notification.IsError {
+			return nil, &SendError{Type: ack.ErrorType, Message: strings.TrimPrefix(notification.Arg, id+" ")}
+		}
+		return ack, nil
+	case <-time.After(timeout):
+		return nil, ErrSendTimeout
+	}
+}
+
+// handleAck passes the notification answering a send command to the Send waiting for it.
+func (c *client) handleAck(message *protocol.NotificationMessage) {
+	switch message.Name {
+	case protocol.SUCCESS_SEND, protocol.ERROR_SEND, protocol.ERROR_QUOTA_EXCEEDED:
+	default:
+		return
+	}
+	ack := &protocol.SendAck{}
+	if err := json.Unmarshal([]byte(message.Json), ack); err != nil || ack.PublisherMessageID == "" {
+		return
+	}
+	c.acksMu.Lock()
+	defer c.acksMu.Unlock()
+	if ackC, ok := c.acks[ack.PublisherMessageID]; ok {
+		select {
+		case ackC <- message:
+		default:
+		}
+	}
 }
 
 func (c *client) WriteRawMessage(message []byte) error {
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"github.com/smancke/guble/protocol"
 	"github.com/smancke/guble/testutil"
 
 	"fmt"
@@ -219,14 +220,21 @@ func TestReceiveAMessage(t *testing.T) {
 func TestSendAMessage(t *testing.T) {
 	ctrl, finish := testutil.NewMockCtrl(t)
 	defer finish()
-	//	a := assert.New(t)
+	a := assert.New(t)
 
 	// given a client
 	c := New("url", "origin", 1, true)
 
-	// when expects a message
+	// when expects a message, which is acknowledged by the server
 	connMock := NewMockWSConnection(ctrl)
-	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("> /foo\n{}\nTest"))
+	sent := make(chan bool, 1)
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("> /foo 1\n{}\nTest")).
+		Do(func(messageType int, data []byte) { sent <- true })
+	connMock.EXPECT().
+		ReadMessage().
+		Do(func() { <-sent }).
+		Return(websocket.BinaryMessage, []byte("#send 1\n"+
+			`{"publisherMessageId":"1","path":"/foo","sequenceId":42,"messagePublishingTime":1420110000}`), nil)
 	connMock.EXPECT().
 		ReadMessage().
 		Return(websocket.BinaryMessage, []byte(aNormalMessage), nil).
@@ -238,9 +246,148 @@ func TestSendAMessage(t *testing.T) {
 
 	c.Start()
 	// then the expectation is meet by sending it
-	c.Send("/foo", "Test", "{}")
-	// stop client after 200ms
-	time.AfterFunc(time.Millisecond*200, func() { c.Close() })
+	ack, err := c.Send("/foo", "Test", "{}")
+	a.NoError(err)
+	a.Equal(&protocol.SendAck{
+		PublisherMessageID: "1",
+		Path:               "/foo",
+		SequenceID:         42,
+		Time:               1420110000,
+	}, ack)
+
+	connMock.EXPECT().Close()
+	c.Close()
+}
+
+func TestSendARejectedMessage(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a client
+	c := New("url", "origin", 1, true)
+
+	// when expects a message, which is rejected by the server
+	connMock := NewMockWSConnection(ctrl)
+	sent := make(chan bool, 1)
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("> /foo 1\n{}\nTest")).
+		Do(func(messageType int, data []byte) { sent <- true })
+	connMock.EXPECT().
+		ReadMessage().
+		Do(func() { <-sent }).
+		Return(websocket.BinaryMessage, []byte("!error-send 1 Access Denied\n"+
+			`{"publisherMessageId":"1","path":"/foo","errorType":"permission-denied"}`), nil)
+	connMock.EXPECT().
+		ReadMessage().
+		Return(websocket.BinaryMessage, []byte(aNormalMessage), nil).
+		Do(func() {
+			time.Sleep(time.Millisecond * 50)
+		}).
+		AnyTimes()
+	c.SetWSConnectionFactory(MockConnectionFactory(connMock))
+
+	c.Start()
+	// then the error of the server is returned
+	ack, err := c.Send("/foo", "Test", "{}")
+	a.Nil(ack)
+	a.Equal(&SendError{Type: protocol.SEND_ERROR_PERMISSION_DENIED, Message: "Access Denied"}, err)
+	// and the error notification is received as well
+	select {
+	case m := <-c.Errors():
+		a.Equal(protocol.ERROR_SEND, m.Name)
+	case <-time.After(time.Millisecond * 10):
+		a.Fail("timeout while waiting for the error notification")
+	}
+
+	connMock.EXPECT().Close()
+	c.Close()
+}
+
+func TestSendWhileMessagesAreNotConsumed(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a client, whose messages are not consumed
+	c := New("url", "origin", 1, true)
+	c.SetSendTimeout(time.Second)
+
+	// when the acknowledgement is received after more messages than the channel holds
+	connMock := NewMockWSConnection(ctrl)
+	sent := make(chan bool, 1)
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("> /foo 1\n{}\nTest")).
+		Do(func(messageType int, data []byte) { sent <- true })
+	first := connMock.EXPECT().
+		ReadMessage().
+		Do(func() { <-sent }).
+		Return(websocket.BinaryMessage, []byte(aNormalMessage), nil)
+	second := connMock.EXPECT().
+		ReadMessage().
+		Return(websocket.BinaryMessage, []byte(aNormalMessage), nil).
+		After(first)
+	ack := connMock.EXPECT().
+		ReadMessage().
+		Return(websocket.BinaryMessage, []byte("#send 1\n"+
+			`{"publisherMessageId":"1","path":"/foo","sequenceId":42,"messagePublishingTime":1420110000}`), nil).
+		After(second)
+	connMock.EXPECT().
+		ReadMessage().
+		Return(websocket.BinaryMessage, []byte(aNormalMessage), nil).
+		Do(func() {
+			time.Sleep(time.Millisecond * 50)
+		}).
+		After(ack).
+		AnyTimes()
+	c.SetWSConnectionFactory(MockConnectionFactory(connMock))
+
+	c.Start()
+	// then the acknowledgement is not blocked by the messages
+	sendAck, err := c.Send("/foo", "Test", "{}")
+	a.NoError(err)
+	if a.NotNil(sendAck) {
+		a.Equal(uint64(42), sendAck.SequenceID)
+	}
+
+	// and the messages are received in order, when they are consumed
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-c.Messages():
+			a.Equal(uint64(42), m.ID)
+		case <-time.After(time.Second):
+			a.Fail("timeout while waiting for the message")
+		}
+	}
+
+	connMock.EXPECT().Close()
+	c.Close()
+}
+
+func TestSendTimeout(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a client without acknowledgements of the server
+	c := New("url", "origin", 1, true)
+	c.SetSendTimeout(time.Millisecond * 20)
+
+	connMock := NewMockWSConnection(ctrl)
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("> /foo 1\n{}\nTest"))
+	connMock.EXPECT().
+		ReadMessage().
+		Return(websocket.BinaryMessage, []byte(aNormalMessage), nil).
+		Do(func() {
+			time.Sleep(time.Millisecond * 50)
+		}).
+		AnyTimes()
+	c.SetWSConnectionFactory(MockConnectionFactory(connMock))
+
+	c.Start()
+	_, err := c.Send("/foo", "Test", "{}")
+	a.Equal(ErrSendTimeout, err)
+
+	connMock.EXPECT().Close()
+	c.Close()
 }
 
 func TestSendSubscribeMessage(t *testing.T) {
@@ -7,6 +7,8 @@ import (
 	"github.com/golang/mock/gomock"
 
 	"github.com/smancke/guble/protocol"
+
+	"time"
 )
 
 // Mock of WSConnection interface
@@ -121,26 +123,36 @@ func (_mr *_MockClientRecorder) Messages() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Messages")
 }
 
-func (_m *MockClient) Send(_param0 string, _param1 string, _param2 string) error {
+func (_m *MockClient) Send(_param0 string, _param1 string, _param2 string) (*protocol.SendAck, error) {
 	ret := _m.ctrl.Call(_m, "Send", _param0, _param1, _param2)
-	ret0, _ := ret[0].(error)
-	return ret0
+	ret0, _ := ret[0].(*protocol.SendAck)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 func (_mr *_MockClientRecorder) Send(arg0, arg1, arg2 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Send", arg0, arg1, arg2)
 }
 
-func (_m *MockClient) SendBytes(_param0 string, _param1 []byte, _param2 string) error {
+func (_m *MockClient) SendBytes(_param0 string, _param1 []byte, _param2 string) (*protocol.SendAck, error) {
 	ret := _m.ctrl.Call(_m, "SendBytes", _param0, _param1, _param2)
-	ret0, _ := ret[0].(error)
-	return ret0
+	ret0, _ := ret[0].(*protocol.SendAck)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 func (_mr *_MockClientRecorder) SendBytes(arg0, arg1, arg2 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SendBytes", arg0, arg1, arg2)
 }
 
+func (_m *MockClient) SetSendTimeout(_param0 time.Duration) {
+	_m.ctrl.Call(_m, "SetSendTimeout", _param0)
+}
+
+func (_mr *_MockClientRecorder) SetSendTimeout(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetSendTimeout", arg0)
+}
+
 func (_m *MockClient) SetWSConnectionFactory(_param0 WSConnectionFactory) {
 	_m.ctrl.Call(_m, "SetWSConnectionFactory", _param0)
 }
@@ -138,9 +138,40 @@ const (
 	SUCCESS_CANCELED      = "canceled"
 	ERROR_SUBSCRIBED_TO   = "error-subscribed-to"
 	ERROR_BAD_REQUEST     = "error-bad-request"
+	ERROR_SEND            = "error-send"
+	ERROR_QUOTA_EXCEEDED  = "error-quota-exceeded"
+	ERROR_LIMIT_EXCEEDED  = "error-limit-exceeded"
 	ERROR_INTERNAL_SERVER = "error-server-internal"
 )
 
+// Valid constants for the SendAck.ErrorType
+const (
+	SEND_ERROR_PERMISSION_DENIED = "permission-denied"
+	SEND_ERROR_STOPPING          = "stopping"
+	SEND_ERROR_STORAGE           = "storage"
+	SEND_ERROR_QUOTA_EXCEEDED    = "quota-exceeded"
+)
+
+// SendAck is the json data of the notification answering a send command,
+// which is SUCCESS_SEND, or ERROR_SEND and ERROR_QUOTA_EXCEEDED if the message was rejected.
+type SendAck struct {
+
+	// The optional id given by the publisher with the send command, to correlate the notification
+	PublisherMessageID string `json:"publisherMessageId,omitempty"`
+
+	// The path of the message
+	Path Path `json:"path"`
+
+	// The id assigned to the stored message
+	SequenceID uint64 `json:"sequenceId,omitempty"`
+
+	// The publishing time assigned to the stored message, as unix timestamp
+	Time int64 `json:"messagePublishingTime,omitempty"`
+
+	// The type of the error, one of the SEND_ERROR_* constants, if the message was rejected
+	ErrorType string `json:"errorType,omitempty"`
+}
+
 // NotificationMessage is a representation of a status messages or error message, sent from the server
 type NotificationMessage struct {
 
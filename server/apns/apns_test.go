@@ -66,7 +66,8 @@ func TestConn_HandleResponse(t *testing.T) {
 	mSubscriber.EXPECT().SetLastID(gomock.Any())
 	mSubscriber.EXPECT().Key().Return("key").AnyTimes()
 	mSubscriber.EXPECT().Encode().Return([]byte("{}"), nil).AnyTimes()
-	mKVS.EXPECT().Put(schema, "key", []byte("{}")).Times(2)
+	mKVS.EXPECT().CompareAndSwap(schema, "key", []byte(nil), []byte("{}")).Return(true, nil)
+	mKVS.EXPECT().CompareAndSwap(schema, "key", []byte("{}"), []byte("{}")).Return(true, nil)
 
 	c.Manager().Add(mSubscriber)
 
@@ -112,7 +113,8 @@ func TestNew_HandleResponseHandleSubscriber(t *testing.T) {
 		mSubscriber.EXPECT().Cancel()
 		mSubscriber.EXPECT().Key().Return("key").AnyTimes()
 		mSubscriber.EXPECT().Encode().Return([]byte("{}"), nil).AnyTimes()
-		mKVS.EXPECT().Put(schema, "key", []byte("{}")).Times(2)
+		mKVS.EXPECT().CompareAndSwap(schema, "key", []byte(nil), []byte("{}")).Return(true, nil)
+		mKVS.EXPECT().CompareAndSwap(schema, "key", []byte("{}"), []byte("{}")).Return(true, nil)
 		mKVS.EXPECT().Delete(schema, "key")
 
 		c.Manager().Add(mSubscriber)
@@ -175,7 +177,8 @@ func TestNew_HandleResponseDoNotHandleSubscriber(t *testing.T) {
 		mSubscriber.EXPECT().Key().Return("key").AnyTimes()
 		mSubscriber.EXPECT().Encode().Return([]byte("{}"), nil).AnyTimes()
 		mSubscriber.EXPECT().Cancel()
-		mKVS.EXPECT().Put(schema, "key", []byte("{}")).Times(2)
+		mKVS.EXPECT().CompareAndSwap(schema, "key", []byte(nil), []byte("{}")).Return(true, nil)
+		mKVS.EXPECT().CompareAndSwap(schema, "key", []byte("{}"), []byte("{}")).Return(true, nil)
 		mKVS.EXPECT().Delete(schema, "key")
 
 		c.Manager().Add(mSubscriber)
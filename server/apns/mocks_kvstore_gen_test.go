@@ -4,7 +4,10 @@
 package apns
 
 import (
+	context "context"
 	gomock "github.com/golang/mock/gomock"
+	kvstore "github.com/smancke/guble/server/kvstore"
+	time "time"
 )
 
 // Mock of KVStore interface
@@ -28,6 +31,27 @@ func (_m *MockKVStore) EXPECT() *_MockKVStoreRecorder {
 	return _m.recorder
 }
 
+func (_m *MockKVStore) Batch(_param0 []kvstore.Operation) error {
+	ret := _m.ctrl.Call(_m, "Batch", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKVStoreRecorder) Batch(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Batch", arg0)
+}
+
+func (_m *MockKVStore) CompareAndSwap(_param0 string, _param1 string, _param2 []byte, _param3 []byte) (bool, error) {
+	ret := _m.ctrl.Call(_m, "CompareAndSwap", _param0, _param1, _param2, _param3)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKVStoreRecorder) CompareAndSwap(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CompareAndSwap", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockKVStore) Delete(_param0 string, _param1 string) error {
 	ret := _m.ctrl.Call(_m, "Delete", _param0, _param1)
 	ret0, _ := ret[0].(error)
@@ -70,6 +94,18 @@ func (_mr *_MockKVStoreRecorder) IterateKeys(arg0, arg1 interface{}) *gomock.Cal
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "IterateKeys", arg0, arg1)
 }
 
+func (_m *MockKVStore) IteratePage(_param0 context.Context, _param1 string, _param2 string, _param3 string, _param4 int) ([][2]string, string, error) {
+	ret := _m.ctrl.Call(_m, "IteratePage", _param0, _param1, _param2, _param3, _param4)
+	ret0, _ := ret[0].([][2]string)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKVStoreRecorder) IteratePage(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "IteratePage", arg0, arg1, arg2, arg3, arg4)
+}
+
 func (_m *MockKVStore) Put(_param0 string, _param1 string, _param2 []byte) error {
 	ret := _m.ctrl.Call(_m, "Put", _param0, _param1, _param2)
 	ret0, _ := ret[0].(error)
@@ -79,3 +115,24 @@ func (_m *MockKVStore) Put(_param0 string, _param1 string, _param2 []byte) error
 func (_mr *_MockKVStoreRecorder) Put(arg0, arg1, arg2 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Put", arg0, arg1, arg2)
 }
+
+func (_m *MockKVStore) PutWithTTL(_param0 string, _param1 string, _param2 []byte, _param3 time.Duration) error {
+	ret := _m.ctrl.Call(_m, "PutWithTTL", _param0, _param1, _param2, _param3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKVStoreRecorder) PutWithTTL(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PutWithTTL", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKVStore) Watch(_param0 string, _param1 string) (chan kvstore.Event, func()) {
+	ret := _m.ctrl.Call(_m, "Watch", _param0, _param1)
+	ret0, _ := ret[0].(chan kvstore.Event)
+	ret1, _ := ret[1].(func())
+	return ret0, ret1
+}
+
+func (_mr *_MockKVStoreRecorder) Watch(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Watch", arg0, arg1)
+}
@@ -0,0 +1,141 @@
+package audit
+
+import (
+	"github.com/smancke/guble/protocol"
+
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The actions of the audit events recorded by the router and the connectors.
+// The admin API records its actions with their own names, like "delete-messages".
+const (
+	ActionPublish              = "publish"
+	ActionSubscribe            = "subscribe"
+	ActionUnsubscribe          = "unsubscribe"
+	ActionConnectorSubscribe   = "connector-subscribe"
+	ActionConnectorUnsubscribe = "connector-unsubscribe"
+	ActionConnectorSubstitute  = "connector-substitute"
+)
+
+const (
+	// ResultOK is the result of a successful action.
+	ResultOK = "ok"
+
+	// ResultDenied is the result of an action which was not permitted.
+	ResultDenied = "denied"
+)
+
+// Event is an audited action: who did what on which path, and with which result.
+type Event struct {
+	// Seq and PrevHash chain the event to the previous one, they are set by the Recorder.
+	Seq      uint64 `json:"seq"`
+	PrevHash string `json:"prevHash"`
+
+	Time       time.Time              `json:"time"`
+	Action     string                 `json:"action"`
+	UserID     string                 `json:"userId,omitempty"`
+	RemoteAddr string                 `json:"remoteAddr,omitempty"`
+	Path       protocol.Path          `json:"path,omitempty"`
+	MessageID  uint64                 `json:"messageId,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+	Result     string                 `json:"result"`
+
+	// BodyDigest is the SHA-256 digest of the Body, if the Recorder records it.
+	BodyDigest string `json:"bodyDigest,omitempty"`
+
+	// Body is the body of a published message. It is never recorded itself.
+	Body []byte `json:"-"`
+
+	// ApplicationID is the application ID of a published message. It is not recorded,
+	// but tells the publishes of the audit events by the Recorder.
+	ApplicationID string `json:"-"`
+}
+
+// Recorder records the audit events.
+type Recorder interface {
+	Record(e *Event)
+}
+
+// ErrTopicReserved is returned for the messages published by clients to the audit topic.
+var ErrTopicReserved = errors.New("audit: the audit topic is reserved for the audit events")
+
+// topicPublisher is a Recorder publishing the events to a topic, like a FileRecorder.
+type topicPublisher interface {
+	Topic() protocol.Path
+}
+
+// ownPublisher is a Recorder telling apart its own publishes of the events, like a FileRecorder.
+type ownPublisher interface {
+	Publishes(message *protocol.Message) bool
+}
+
+var (
+	mutex    sync.RWMutex
+	recorder Recorder
+)
+
+// SetRecorder sets the Recorder of all the audit events. The events are dropped if it is nil.
+func SetRecorder(r Recorder) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	recorder = r
+}
+
+// Enabled returns true if the events are recorded, so that the events do not have to be created otherwise.
+func Enabled() bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return recorder != nil
+}
+
+// Record records the event, if a Recorder is set. The time of the event is set if it is missing.
+func Record(e *Event) {
+	mutex.RLock()
+	r := recorder
+	mutex.RUnlock()
+	if r == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	r.Record(e)
+}
+
+// CheckPublish returns ErrTopicReserved if the path is (below) the topic to which the Recorder publishes the events.
+// It has to be called for the messages published by the clients, so that they can not fake audit events.
+func CheckPublish(path protocol.Path) error {
+	mutex.RLock()
+	r := recorder
+	mutex.RUnlock()
+	p, ok := r.(topicPublisher)
+	if !ok {
+		return nil
+	}
+	topic := p.Topic()
+	if topic != "" && (path == topic || strings.HasPrefix(string(path), string(topic)+"/")) {
+		return ErrTopicReserved
+	}
+	return nil
+}
+
+// IsOwnPublish returns true if the message is an audit event published by the Recorder to its topic.
+// These messages are not published by a client, so that the access to the topic is not checked for them.
+func IsOwnPublish(message *protocol.Message) bool {
+	mutex.RLock()
+	r := recorder
+	mutex.RUnlock()
+	p, ok := r.(ownPublisher)
+	return ok && p.Publishes(message)
+}
+
+// Result returns the result of an action, given by its error.
+func Result(err error) string {
+	if err == nil {
+		return ResultOK
+	}
+	return err.Error()
+}
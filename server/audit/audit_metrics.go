@@ -0,0 +1,12 @@
+package audit
+
+import (
+	"github.com/smancke/guble/server/metrics"
+)
+
+var (
+	mTotalEvents      = metrics.NewInt("audit.total_events")
+	mTotalWriteErrors = metrics.NewInt("audit.total_write_errors")
+	mTotalRotations   = metrics.NewInt("audit.total_rotations")
+	mTotalTopicDrops  = metrics.NewInt("audit.total_topic_drops")
+)
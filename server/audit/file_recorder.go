@@ -0,0 +1,318 @@
+package audit
+
+import (
+	"github.com/smancke/guble/protocol"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rs/xid"
+
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Content is the content of the audit events recorded for the published messages.
+type Content string
+
+const (
+	// ContentMetadata records only the metadata of the messages, like the user, the path and the message ID.
+	ContentMetadata Content = "metadata"
+
+	// ContentDigest records the SHA-256 digest of the message bodies as well.
+	ContentDigest Content = "digest"
+)
+
+const (
+	// DefaultMaxFileSize is the size of the audit log file, above which it is rotated.
+	DefaultMaxFileSize = 100 << 20
+
+	// TopicUserID is the user publishing the audit events to the audit topic.
+	TopicUserID = "guble-audit"
+
+	topicBufferSize = 1000
+)
+
+// MessageHandler handles the messages published to the audit topic, e.g. a router.Router.
+type MessageHandler interface {
+	HandleMessage(message *protocol.Message) error
+}
+
+// Config is the configuration of a FileRecorder.
+type Config struct {
+	// Filename is the audit log file. The rotated files are named by the sequence number of their last event,
+	// like "audit.log.00000000000000001234".
+	Filename string
+
+	// MaxFileSize is the size above which the file is rotated (DefaultMaxFileSize if 0).
+	MaxFileSize int64
+
+	// Content is ContentMetadata (default) or ContentDigest.
+	Content Content
+}
+
+// FileRecorder appends the audit events as JSON lines to a file, which is rotated when it reaches its maximum size.
+// Each event contains the hash of the previous event, and ends with its own hash, covering the previous hash,
+// so that a modified, removed or inserted event breaks the hash chain, see Verify.
+// The chain is continued across the rotated files and restarts.
+type FileRecorder struct {
+	config Config
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+	seq   uint64
+	hash  string
+
+	topic    protocol.Path
+	handler  MessageHandler
+	messages chan []byte
+	wg       sync.WaitGroup
+
+	// publishing are the application IDs of the audit events currently published to the topic
+	publishing map[string]bool
+}
+
+// NewFileRecorder opens the audit log file, continuing the hash chain of its last event (or of the last rotated file).
+func NewFileRecorder(config Config) (*FileRecorder, error) {
+	if config.Filename == "" {
+		return nil, errors.New("audit: no audit log file given")
+	}
+	if config.MaxFileSize <= 0 {
+		config.MaxFileSize = DefaultMaxFileSize
+	}
+	switch config.Content {
+	case "":
+		config.Content = ContentMetadata
+	case ContentMetadata, ContentDigest:
+	default:
+		return nil, fmt.Errorf("audit: unknown content %q", config.Content)
+	}
+
+	r := &FileRecorder{config: config, publishing: make(map[string]bool)}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// PublishTo publishes the recorded events to the topic as well, by the user TopicUserID.
+// The events are published asynchronously, and dropped if the handler can not keep up.
+// The publishing of the events to the topic are not recorded themselves.
+func (r *FileRecorder) PublishTo(topic protocol.Path, handler MessageHandler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.topic = topic
+	r.handler = handler
+	r.messages = make(chan []byte, topicBufferSize)
+	r.wg.Add(1)
+	go r.publish(r.messages)
+}
+
+// Topic returns the topic to which the events are published, or "" if they are not published.
+func (r *FileRecorder) Topic() protocol.Path {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.topic
+}
+
+// Publishes returns true if the message is an audit event currently published by this recorder to its topic.
+func (r *FileRecorder) Publishes(message *protocol.Message) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.isOwnPublish(message.Path, message.UserID, message.ApplicationID)
+}
+
+// isOwnPublish has to be called while holding the mutex.
+func (r *FileRecorder) isOwnPublish(path protocol.Path, userID, applicationID string) bool {
+	return r.topic != "" && path == r.topic && userID == TopicUserID && r.publishing[applicationID]
+}
+
+// Record is an implementation of the Recorder interface.
+// An event which can not be written is logged, and not part of the hash chain.
+func (r *FileRecorder) Record(e *Event) {
+	if r.config.Content == ContentDigest && e.Body != nil {
+		digest := sha256.Sum256(e.Body)
+		e.BodyDigest = hex.EncodeToString(digest[:])
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if e.Action == ActionPublish && r.isOwnPublish(e.Path, e.UserID, e.ApplicationID) {
+		// the publish of an audit event by this recorder
+		return
+	}
+	if r.file == nil {
+		logger.WithField("action", e.Action).Error("Audit event recorded after stopping")
+		return
+	}
+	e.Seq = r.seq + 1
+	e.PrevHash = r.hash
+	line, hash, err := encode(e)
+	if err == nil && r.size > 0 && r.size+int64(len(line)) > r.config.MaxFileSize {
+		err = r.rotate()
+	}
+	if err == nil {
+		_, err = r.file.Write(line)
+		r.size += int64(len(line))
+	}
+	if err != nil {
+		mTotalWriteErrors.Add(1)
+		logger.WithError(err).WithFields(log.Fields{
+			"action": e.Action,
+			"userId": e.UserID,
+			"path":   e.Path,
+		}).Error("Error writing the audit event")
+		return
+	}
+	mTotalEvents.Add(1)
+	r.seq, r.hash = e.Seq, hash
+
+	if r.messages != nil {
+		select {
+		case r.messages <- line[:len(line)-1]:
+		default:
+			mTotalTopicDrops.Add(1)
+		}
+	}
+}
+
+// Stop publishing to the topic and close the file.
+func (r *FileRecorder) Stop() error {
+	r.mutex.Lock()
+	if r.messages != nil {
+		close(r.messages)
+		r.messages = nil
+	}
+	r.mutex.Unlock()
+	r.wg.Wait()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *FileRecorder) publish(messages chan []byte) {
+	defer r.wg.Done()
+	for body := range messages {
+		applicationID := xid.New().String()
+		r.mutex.Lock()
+		r.publishing[applicationID] = true
+		r.mutex.Unlock()
+
+		err := r.handler.HandleMessage(&protocol.Message{
+			Path:          r.topic,
+			UserID:        TopicUserID,
+			ApplicationID: applicationID,
+			HeaderJSON:    "{}",
+			Body:          body,
+		})
+
+		r.mutex.Lock()
+		delete(r.publishing, applicationID)
+		r.mutex.Unlock()
+		if err != nil {
+			logger.WithError(err).Error("Error publishing the audit event to the audit topic")
+		}
+	}
+}
+
+// open opens the file for appending, and loads the sequence number and hash of the last event.
+func (r *FileRecorder) open() error {
+	file, err := os.OpenFile(r.config.Filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	last := r.config.Filename
+	if info.Size() == 0 {
+		rotated, err := rotatedFiles(r.config.Filename)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		last = ""
+		if len(rotated) > 0 {
+			last = rotated[len(rotated)-1]
+		}
+	}
+	if last != "" {
+		if r.seq, r.hash, err = lastEvent(last); err != nil {
+			file.Close()
+			return fmt.Errorf("audit: can not continue the hash chain of %s: %v", last, err)
+		}
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+// rotate renames the file by the sequence number of its last event, and opens a new file.
+// If the file can not be renamed, the events are still appended to it.
+func (r *FileRecorder) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	renameErr := os.Rename(r.config.Filename, rotatedName(r.config.Filename, r.seq))
+	file, err := os.OpenFile(r.config.Filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		r.file = nil
+		return err
+	}
+	r.file = file
+	if renameErr != nil {
+		logger.WithError(renameErr).Error("Error rotating the audit log file")
+		return nil
+	}
+	mTotalRotations.Add(1)
+	r.size = 0
+	return nil
+}
+
+// lastEvent returns the sequence number and hash of the last event of the file.
+func lastEvent(filename string) (uint64, string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+
+	// read the end of the file, until it contains the complete last line
+	for window := int64(64 << 10); ; window *= 2 {
+		offset := info.Size() - window
+		if offset < 0 {
+			offset = 0
+		}
+		data := make([]byte, info.Size()-offset)
+		if _, err := file.ReadAt(data, offset); err != nil && err != io.EOF {
+			return 0, "", err
+		}
+		data = bytes.TrimRight(data, "\n")
+		start := bytes.LastIndexByte(data, '\n')
+		if start < 0 && offset > 0 {
+			continue
+		}
+		entry, hash, err := decode(data[start+1:])
+		if err != nil {
+			return 0, "", err
+		}
+		return entry.Seq, hash, nil
+	}
+}
@@ -0,0 +1,297 @@
+package audit
+
+import (
+	"github.com/smancke/guble/protocol"
+
+	"github.com/stretchr/testify/assert"
+
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func tempAuditFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "guble_audit_test")
+	assert.NoError(t, err)
+	return filepath.Join(dir, "audit.log"), func() { os.RemoveAll(dir) }
+}
+
+func readEvents(t *testing.T, filename string) []map[string]interface{} {
+	data, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	var events []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		event := make(map[string]interface{})
+		assert.NoError(t, json.Unmarshal([]byte(line), &event))
+		events = append(events, event)
+	}
+	return events
+}
+
+func recordEvents(r *FileRecorder, n int) {
+	for i := 0; i < n; i++ {
+		r.Record(&Event{
+			Time:   time.Now(),
+			Action: ActionPublish,
+			UserID: "user01",
+			Path:   "/chat/room",
+			Result: ResultOK,
+			Body:   []byte("secret"),
+		})
+	}
+}
+
+func TestFileRecorder_HashChain(t *testing.T) {
+	a := assert.New(t)
+	filename, remove := tempAuditFile(t)
+	defer remove()
+
+	r, err := NewFileRecorder(Config{Filename: filename})
+	a.NoError(err)
+	recordEvents(r, 3)
+	a.NoError(r.Stop())
+
+	events := readEvents(t, filename)
+	a.Len(events, 3)
+	a.Equal(float64(1), events[0]["seq"])
+	a.Equal("", events[0]["prevHash"])
+	a.Equal("user01", events[0]["userId"])
+	a.Equal("/chat/room", events[0]["path"])
+	a.Nil(events[0]["bodyDigest"], "only the metadata is recorded by default")
+	a.NotContains(events[0], "body")
+	for i := 1; i < len(events); i++ {
+		a.Equal(float64(i+1), events[i]["seq"])
+		a.Equal(events[i-1]["hash"], events[i]["prevHash"])
+	}
+
+	count, err := Verify(filename)
+	a.NoError(err)
+	a.Equal(3, count)
+
+	// a restarted recorder continues the chain
+	r, err = NewFileRecorder(Config{Filename: filename})
+	a.NoError(err)
+	recordEvents(r, 1)
+	a.NoError(r.Stop())
+	events = readEvents(t, filename)
+	a.Equal(float64(4), events[3]["seq"])
+	a.Equal(events[2]["hash"], events[3]["prevHash"])
+	count, err = Verify(filename)
+	a.NoError(err)
+	a.Equal(4, count)
+}
+
+func TestFileRecorder_BodyDigest(t *testing.T) {
+	a := assert.New(t)
+	filename, remove := tempAuditFile(t)
+	defer remove()
+
+	r, err := NewFileRecorder(Config{Filename: filename, Content: ContentDigest})
+	a.NoError(err)
+	recordEvents(r, 1)
+	a.NoError(r.Stop())
+
+	digest := sha256.Sum256([]byte("secret"))
+	a.Equal(hex.EncodeToString(digest[:]), readEvents(t, filename)[0]["bodyDigest"])
+
+	_, err = NewFileRecorder(Config{Filename: filename, Content: "body"})
+	a.Error(err)
+}
+
+func TestVerify_DetectsTampering(t *testing.T) {
+	filename, remove := tempAuditFile(t)
+	defer remove()
+
+	r, err := NewFileRecorder(Config{Filename: filename})
+	assert.NoError(t, err)
+	recordEvents(r, 3)
+	assert.NoError(t, r.Stop())
+	original, _ := ioutil.ReadFile(filename)
+	lines := bytes.SplitAfter(original, []byte("\n"))
+
+	testCases := map[string][]byte{
+		"modified":  bytes.Replace(original, []byte(`"userId":"user01"`), []byte(`"userId":"user02"`), 1),
+		"removed":   bytes.Join([][]byte{lines[0], lines[2]}, nil),
+		"reordered": bytes.Join([][]byte{lines[1], lines[0], lines[2]}, nil),
+		"no hash":   append(append([]byte{}, original...), []byte(`{"seq":4,"action":"publish"}`+"\n")...),
+	}
+	for name, data := range testCases {
+		assert.NoError(t, ioutil.WriteFile(filename, data, 0600))
+		_, err := Verify(filename)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestFileRecorder_Rotation(t *testing.T) {
+	a := assert.New(t)
+	filename, remove := tempAuditFile(t)
+	defer remove()
+
+	r, err := NewFileRecorder(Config{Filename: filename, MaxFileSize: 500})
+	a.NoError(err)
+	recordEvents(r, 10)
+	a.NoError(r.Stop())
+
+	rotated, err := rotatedFiles(filename)
+	a.NoError(err)
+	a.True(len(rotated) > 1)
+	for _, name := range append(rotated, filename) {
+		info, err := os.Stat(name)
+		a.NoError(err)
+		a.True(info.Size() <= 500, name)
+	}
+	count, err := Verify(filename)
+	a.NoError(err)
+	a.Equal(10, count)
+
+	// the chain is continued from the last rotated file, and does not need the removed older files
+	a.NoError(os.Remove(rotated[0]))
+	a.NoError(os.Rename(filename, rotatedName(filename, 10)))
+	r, err = NewFileRecorder(Config{Filename: filename, MaxFileSize: 500})
+	a.NoError(err)
+	recordEvents(r, 1)
+	a.NoError(r.Stop())
+	events := readEvents(t, filename)
+	a.Equal(float64(11), events[0]["seq"])
+	_, err = Verify(filename)
+	a.NoError(err)
+}
+
+type testHandler struct {
+	mutex    sync.Mutex
+	messages []*protocol.Message
+	r        *FileRecorder
+}
+
+func (h *testHandler) HandleMessage(message *protocol.Message) error {
+	h.mutex.Lock()
+	h.messages = append(h.messages, message)
+	h.mutex.Unlock()
+	// the router records the publish of the audit event
+	h.r.Record(&Event{Action: ActionPublish, UserID: message.UserID, Path: message.Path, Result: ResultOK, ApplicationID: message.ApplicationID})
+	return nil
+}
+
+func TestFileRecorder_PublishTo(t *testing.T) {
+	a := assert.New(t)
+	filename, remove := tempAuditFile(t)
+	defer remove()
+
+	r, err := NewFileRecorder(Config{Filename: filename})
+	a.NoError(err)
+	handler := &testHandler{r: r}
+	r.PublishTo("/audit", handler)
+	recordEvents(r, 2)
+	a.NoError(r.Stop())
+
+	a.Len(readEvents(t, filename), 2, "the publishes of the audit events are not recorded")
+	a.Len(handler.messages, 2)
+	for i, message := range handler.messages {
+		a.Equal(protocol.Path("/audit"), message.Path)
+		a.Equal(TopicUserID, message.UserID)
+		event := make(map[string]interface{})
+		a.NoError(json.Unmarshal(message.Body, &event))
+		a.Equal(float64(i+1), event["seq"])
+		a.NotEmpty(event["hash"])
+	}
+}
+
+func TestFileRecorder_RecordsPublishesByOthers(t *testing.T) {
+	a := assert.New(t)
+	filename, remove := tempAuditFile(t)
+	defer remove()
+
+	r, err := NewFileRecorder(Config{Filename: filename})
+	a.NoError(err)
+	r.PublishTo("/audit", &testHandler{r: r})
+
+	// a publish pretending to be by the recorder is recorded
+	r.Record(&Event{Action: ActionPublish, UserID: TopicUserID, Path: "/audit", Result: ResultOK, ApplicationID: "fake"})
+	a.NoError(r.Stop())
+
+	events := readEvents(t, filename)
+	a.Len(events, 1)
+	a.Equal(TopicUserID, events[0]["userId"])
+}
+
+// ownPublishHandler records whether the messages are the own publishes of the recorder, like the router.
+type ownPublishHandler struct {
+	own chan bool
+}
+
+func (h *ownPublishHandler) HandleMessage(message *protocol.Message) error {
+	h.own <- IsOwnPublish(message)
+	return nil
+}
+
+func TestIsOwnPublish(t *testing.T) {
+	a := assert.New(t)
+	filename, remove := tempAuditFile(t)
+	defer remove()
+
+	r, err := NewFileRecorder(Config{Filename: filename})
+	a.NoError(err)
+	SetRecorder(r)
+	defer SetRecorder(nil)
+	handler := &ownPublishHandler{own: make(chan bool, 1)}
+	r.PublishTo("/audit", handler)
+
+	recordEvents(r, 1)
+	a.True(<-handler.own)
+	a.NoError(r.Stop())
+
+	// the messages pretending to be published by the recorder are not
+	a.False(IsOwnPublish(&protocol.Message{Path: "/audit", UserID: TopicUserID, ApplicationID: "fake"}))
+}
+
+func TestCheckPublish(t *testing.T) {
+	a := assert.New(t)
+	filename, remove := tempAuditFile(t)
+	defer remove()
+
+	a.NoError(CheckPublish("/audit"))
+
+	r, err := NewFileRecorder(Config{Filename: filename})
+	a.NoError(err)
+	defer r.Stop()
+	SetRecorder(r)
+	defer SetRecorder(nil)
+	a.NoError(CheckPublish("/audit"), "the events are not published")
+
+	r.PublishTo("/audit", &testHandler{r: r})
+	a.Equal(ErrTopicReserved, CheckPublish("/audit"))
+	a.Equal(ErrTopicReserved, CheckPublish("/audit/sub"))
+	a.NoError(CheckPublish("/auditing"))
+	a.NoError(CheckPublish("/foo"))
+}
+
+func TestRecord(t *testing.T) {
+	a := assert.New(t)
+	filename, remove := tempAuditFile(t)
+	defer remove()
+
+	a.False(Enabled())
+	Record(&Event{Action: ActionSubscribe})
+
+	r, err := NewFileRecorder(Config{Filename: filename})
+	a.NoError(err)
+	SetRecorder(r)
+	defer SetRecorder(nil)
+	a.True(Enabled())
+	Record(&Event{Action: ActionSubscribe, Result: Result(nil)})
+	a.NoError(r.Stop())
+
+	events := readEvents(t, filename)
+	a.Len(events, 1)
+	a.Equal(ActionSubscribe, events[0]["action"])
+	a.Equal(ResultOK, events[0]["result"])
+	a.NotEmpty(events[0]["time"], "the time is set if it is missing")
+}
@@ -0,0 +1,147 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	hashPrefix = `,"hash":"`
+	// hashSuffixLength is the length of the hash field at the end of each line: ,"hash":"<64 hex digits>"}
+	hashSuffixLength = len(hashPrefix) + sha256.Size*2 + 2
+
+	rotatedSuffixLength = 20
+	maxLineLength       = 64 << 20
+)
+
+var errNoHash = errors.New("the event has no hash")
+
+// chainLink are the fields of an event, which chain it to the previous event.
+type chainLink struct {
+	Seq      uint64 `json:"seq"`
+	PrevHash string `json:"prevHash"`
+}
+
+// encode returns the event as JSON line ending with its hash, and the hash.
+// The hash is the SHA-256 digest of the previous hash followed by the JSON of the event without the hash.
+func encode(e *Event) ([]byte, string, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, "", err
+	}
+	hash := hashOf(e.PrevHash, data)
+	line := make([]byte, 0, len(data)+hashSuffixLength)
+	line = append(line, data[:len(data)-1]...)
+	line = append(line, hashPrefix...)
+	line = append(line, hash...)
+	line = append(line, "\"}\n"...)
+	return line, hash, nil
+}
+
+// decode returns the chain link and the hash of an encoded event, after checking that the hash matches the event.
+func decode(line []byte) (chainLink, string, error) {
+	var link chainLink
+	n := len(line) - hashSuffixLength
+	if n < 1 || !bytes.HasPrefix(line[n:], []byte(hashPrefix)) || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return link, "", errNoHash
+	}
+	hash := string(line[n+len(hashPrefix) : len(line)-2])
+	data := append(append([]byte{}, line[:n]...), '}')
+	if err := json.Unmarshal(data, &link); err != nil {
+		return link, "", err
+	}
+	if hashOf(link.PrevHash, data) != hash {
+		return link, "", errors.New("the hash does not match the event")
+	}
+	return link, hash, nil
+}
+
+func hashOf(prevHash string, data []byte) string {
+	h := sha256.New()
+	h.Write([]byte(prevHash))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify checks the hash chain of the audit log file and of its rotated files, and returns the number of events.
+// The first event of the oldest file starts the chain, so that older files can be removed.
+// The returned error locates the first event which was modified, or after which events were removed or inserted.
+func Verify(filename string) (int, error) {
+	files, err := rotatedFiles(filename)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := os.Stat(filename); err == nil {
+		files = append(files, filename)
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	count := 0
+	var prev *chainLink
+	var prevHash string
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			return count, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64<<10), maxLineLength)
+		for lineNumber := 1; scanner.Scan(); lineNumber++ {
+			link, hash, err := decode(scanner.Bytes())
+			if err == nil && prev != nil && (link.Seq != prev.Seq+1 || link.PrevHash != prevHash) {
+				err = fmt.Errorf("the event %d does not follow the event %d", link.Seq, prev.Seq)
+			}
+			if err != nil {
+				file.Close()
+				return count, fmt.Errorf("audit: %s line %d: %v", name, lineNumber, err)
+			}
+			prev, prevHash = &link, hash
+			count++
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return count, fmt.Errorf("audit: %s: %v", name, err)
+		}
+	}
+	return count, nil
+}
+
+// rotatedName returns the name of the rotated file, with the sequence number of its last event.
+func rotatedName(filename string, seq uint64) string {
+	return fmt.Sprintf("%s.%0*d", filename, rotatedSuffixLength, seq)
+}
+
+// rotatedFiles returns the rotated files of the audit log file, from the oldest to the newest.
+func rotatedFiles(filename string) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Dir(filename))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(filename) + "."
+	var files []string
+	for _, info := range infos {
+		suffix := strings.TrimPrefix(info.Name(), prefix)
+		if info.IsDir() || suffix == info.Name() || len(suffix) != rotatedSuffixLength {
+			continue
+		}
+		if _, err := strconv.ParseUint(suffix, 10, 64); err != nil {
+			continue
+		}
+		files = append(files, filepath.Join(filepath.Dir(filename), info.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,7 @@
+package audit
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+var logger = log.WithField("module", "audit")
@@ -15,7 +15,27 @@ const (
 	WRITE
 )
 
+func (accessType AccessType) String() string {
+	if accessType == WRITE {
+		return "write"
+	}
+	return "read"
+}
+
 // AccessManager interface allows to provide a custom authentication mechanism
 type AccessManager interface {
 	IsAllowed(accessType AccessType, userID string, path protocol.Path) bool
 }
+
+// Authenticator is implemented by the AccessManagers which identify the users by a token (e.g. a signed JWT),
+// instead of trusting the user IDs given in the requests.
+type Authenticator interface {
+	// Authenticate validates the token, and returns the ID of its user and the permissions granted by it.
+	Authenticate(token string) (userID string, permissions AccessManager, err error)
+}
+
+// Explainer is implemented by the AccessManagers which can explain their decisions.
+type Explainer interface {
+	// Explain returns the decision on the access, and its reason.
+	Explain(accessType AccessType, userID string, path protocol.Path) Explanation
+}
@@ -4,7 +4,9 @@ import (
 	"github.com/stretchr/testify/assert"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func Test_AllowAllAccessManager(t *testing.T) {
@@ -23,7 +25,7 @@ func Test_RestAccessManagerAllowed(t *testing.T) {
 
 	defer ts.Close()
 	a := assert.New(t)
-	am := NewRestAccessManager(ts.URL)
+	am := NewRestAccessManager(RestAccessManagerConfig{URL: ts.URL})
 	a.True(am.IsAllowed(READ, "foo", "/foo"))
 	a.True(am.IsAllowed(WRITE, "foo", "/foo"))
 }
@@ -34,7 +36,7 @@ func Test_RestAccessManagerNotAllowed(t *testing.T) {
 	}))
 
 	defer ts.Close()
-	am := NewRestAccessManager(ts.URL)
+	am := NewRestAccessManager(RestAccessManagerConfig{URL: ts.URL})
 	a := assert.New(t)
 	a.False(am.IsAllowed(READ, "user", "/foo"))
 }
@@ -45,7 +47,7 @@ func Test_RestAccessManagerNotAllowedWithServerNotStarted(t *testing.T) {
 	}))
 
 	defer ts.Close()
-	am := NewRestAccessManager(ts.URL)
+	am := NewRestAccessManager(RestAccessManagerConfig{URL: ts.URL})
 	a := assert.New(t)
 	a.False(am.IsAllowed(READ, "user", "/foo"))
 }
@@ -57,7 +59,148 @@ func Test_RestAccessManagerNotAllowedHttpReturningStatusForbidden(t *testing.T)
 
 	defer ts.Close()
 	a := assert.New(t)
-	am := NewRestAccessManager(ts.URL)
+	am := NewRestAccessManager(RestAccessManagerConfig{URL: ts.URL})
 	a.False(am.IsAllowed(READ, "foo", "/foo"))
 	a.False(am.IsAllowed(WRITE, "foo", "/foo"))
 }
+
+func Test_RestAccessManagerSendsQueryParameters(t *testing.T) {
+	a := assert.New(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.Equal("write", r.URL.Query().Get("type"))
+		a.Equal("user", r.URL.Query().Get("userId"))
+		a.Equal("/foo", r.URL.Query().Get("path"))
+		w.Write([]byte("true"))
+	}))
+
+	defer ts.Close()
+	am := NewRestAccessManager(RestAccessManagerConfig{URL: ts.URL})
+	a.True(am.IsAllowed(WRITE, "user", "/foo"))
+}
+
+func Test_RestAccessManagerCachesDecisions(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Query().Get("path") == "/allowed" {
+			w.Write([]byte("true"))
+		} else {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+
+	defer ts.Close()
+	a := assert.New(t)
+	am := NewRestAccessManager(RestAccessManagerConfig{
+		URL:      ts.URL,
+		AllowTTL: time.Hour,
+		DenyTTL:  50 * time.Millisecond,
+	})
+
+	a.True(am.IsAllowed(READ, "user", "/allowed"))
+	a.True(am.IsAllowed(READ, "user", "/allowed"))
+	a.False(am.IsAllowed(READ, "user", "/denied"))
+	a.False(am.IsAllowed(READ, "user", "/denied"))
+	a.Equal(int32(2), atomic.LoadInt32(&requests))
+
+	// the decisions are cached per access type
+	a.True(am.IsAllowed(WRITE, "user", "/allowed"))
+	a.Equal(int32(3), atomic.LoadInt32(&requests))
+
+	// the denied decision expires first
+	time.Sleep(100 * time.Millisecond)
+	a.True(am.IsAllowed(READ, "user", "/allowed"))
+	a.False(am.IsAllowed(READ, "user", "/denied"))
+	a.Equal(int32(4), atomic.LoadInt32(&requests))
+}
+
+func Test_RestAccessManagerCoalescesRequests(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		w.Write([]byte("true"))
+	}))
+
+	defer ts.Close()
+	a := assert.New(t)
+	am := NewRestAccessManager(RestAccessManagerConfig{URL: ts.URL})
+
+	results := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			results <- am.IsAllowed(READ, "user", "/foo")
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < 10; i++ {
+		a.True(<-results)
+	}
+	a.Equal(int32(1), atomic.LoadInt32(&requests))
+}
+
+func Test_RestAccessManagerCircuitBreaker(t *testing.T) {
+	var requests int32
+	var failing int32 = 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("true"))
+	}))
+
+	defer ts.Close()
+	a := assert.New(t)
+	am := NewRestAccessManager(RestAccessManagerConfig{
+		URL:              ts.URL,
+		AllowTTL:         time.Hour,
+		FailureThreshold: 3,
+		OpenTimeout:      100 * time.Millisecond,
+	})
+
+	for i := 0; i < 5; i++ {
+		a.False(am.IsAllowed(READ, "user", "/foo"))
+	}
+	// no requests are made while the circuit is open
+	a.Equal(int32(3), atomic.LoadInt32(&requests))
+
+	// a failing trial request opens the circuit again
+	time.Sleep(150 * time.Millisecond)
+	a.False(am.IsAllowed(READ, "user", "/foo"))
+	a.False(am.IsAllowed(READ, "user", "/foo"))
+	a.Equal(int32(4), atomic.LoadInt32(&requests))
+
+	// a successful trial request closes the circuit
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(150 * time.Millisecond)
+	a.True(am.IsAllowed(READ, "user", "/foo"))
+	a.True(am.IsAllowed(READ, "user", "/bar"))
+	a.Equal(int32(6), atomic.LoadInt32(&requests))
+}
+
+func Test_RestAccessManagerFailOpen(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("false"))
+	}))
+
+	defer ts.Close()
+	a := assert.New(t)
+	am := NewRestAccessManager(RestAccessManagerConfig{
+		URL:      ts.URL,
+		Timeout:  20 * time.Millisecond,
+		DenyTTL:  time.Hour,
+		FailOpen: true,
+	})
+
+	// the timed out requests are decided by the policy, and not cached
+	a.True(am.IsAllowed(READ, "user", "/foo"))
+	a.Equal(0, len(am.cache))
+
+	am.config.FailOpen = false
+	a.False(am.IsAllowed(READ, "user", "/foo"))
+}
@@ -0,0 +1,304 @@
+package auth
+
+import (
+	"github.com/smancke/guble/protocol"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// UserIDPlaceholder is replaced by the ID of the user in the path patterns of the ACL rules.
+	UserIDPlaceholder = "{user_id}"
+
+	// AnyUser in the users of an ACL rule matches all the users.
+	AnyUser = "*"
+)
+
+// ACLReloadInterval is the interval between the checks for changes of the ACL file.
+var ACLReloadInterval = 2 * time.Second
+
+// ACLRule grants (or denies, if Deny is set) the access types on the paths matching the patterns,
+// to the users and to the members of the groups.
+type ACLRule struct {
+	Users  []string `json:"users,omitempty" yaml:"users"`
+	Groups []string `json:"groups,omitempty" yaml:"groups"`
+	Access []string `json:"access" yaml:"access"`
+	Paths  []string `json:"paths" yaml:"paths"`
+	Deny   bool     `json:"deny,omitempty" yaml:"deny"`
+}
+
+// ACL is the content of an ACL file: the members of the groups, and the rules.
+type ACL struct {
+	Groups map[string][]string `json:"groups,omitempty" yaml:"groups"`
+	Rules  []ACLRule           `json:"rules" yaml:"rules"`
+}
+
+// ACLAccessManager grants the permissions defined by the rules of an ACL file (YAML, or JSON if not named *.yaml or *.yml).
+// A deny rule takes precedence over the allow rules, and the access is denied if no rule matches:
+//
+//	groups:
+//	  admins: [alice, bob]
+//	rules:
+//	  - users: ["*"]
+//	    access: [read, write]
+//	    paths: ["/user/{user_id}/*"]
+//	  - groups: [admins]
+//	    access: [read]
+//	    paths: ["*"]
+//	  - users: [mallory]
+//	    access: [read, write]
+//	    paths: ["*"]
+//	    deny: true
+//
+// A path pattern ending with "*" matches all the paths starting with it, other patterns match only the same path.
+// The file is reloaded when it changes, while the ACLAccessManager is started.
+// If the changed file is not valid, the previous rules are kept.
+type ACLAccessManager struct {
+	filename string
+	logger   *log.Entry
+
+	mutex sync.RWMutex
+	acl   *ACL
+	data  []byte
+
+	stopC chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Explanation is the reason of an access decision.
+type Explanation struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+
+	// Rule is the matching rule which decided, if there is one.
+	Rule      *ACLRule `json:"rule,omitempty"`
+	RuleIndex int      `json:"ruleIndex"`
+
+	// Role and Group are the role granting the access, and the group of the user having the role (RBACAccessManager).
+	Role  string `json:"role,omitempty"`
+	Group string `json:"group,omitempty"`
+}
+
+// NewACLAccessManager returns a new ACLAccessManager with the rules of the file.
+func NewACLAccessManager(filename string) (*ACLAccessManager, error) {
+	am := &ACLAccessManager{
+		filename: filename,
+		logger:   logger.WithField("acl", filename),
+	}
+	if _, err := am.reload(); err != nil {
+		return nil, err
+	}
+	return am, nil
+}
+
+// Start the reloading of the ACL file after changes.
+func (am *ACLAccessManager) Start() error {
+	am.stopC = make(chan struct{})
+	am.wg.Add(1)
+	go am.watch()
+	return nil
+}
+
+// Stop the reloading of the ACL file.
+func (am *ACLAccessManager) Stop() error {
+	if am.stopC != nil {
+		close(am.stopC)
+		am.wg.Wait()
+		am.stopC = nil
+	}
+	return nil
+}
+
+// IsAllowed is an implementation of the AccessManager interface.
+func (am *ACLAccessManager) IsAllowed(accessType AccessType, userID string, path protocol.Path) bool {
+	return am.Explain(accessType, userID, path).Allowed
+}
+
+// Decide is an implementation of the Decider interface: it abstains if no rule matches.
+func (am *ACLAccessManager) Decide(accessType AccessType, userID string, path protocol.Path) Decision {
+	explanation := am.Explain(accessType, userID, path)
+	if explanation.Rule == nil {
+		return Abstain
+	}
+	return boolDecision(explanation.Allowed)
+}
+
+// Explain is an implementation of the Explainer interface.
+func (am *ACLAccessManager) Explain(accessType AccessType, userID string, path protocol.Path) Explanation {
+	am.mutex.RLock()
+	acl := am.acl
+	am.mutex.RUnlock()
+
+	allowIndex := -1
+	for i := range acl.Rules {
+		rule := &acl.Rules[i]
+		if !rule.matches(acl.Groups, accessType, userID, path) {
+			continue
+		}
+		if rule.Deny {
+			return Explanation{
+				Allowed:   false,
+				Reason:    fmt.Sprintf("denied by rule %d", i),
+				Rule:      rule,
+				RuleIndex: i,
+			}
+		}
+		if allowIndex < 0 {
+			allowIndex = i
+		}
+	}
+	if allowIndex < 0 {
+		return Explanation{Allowed: false, Reason: "no rule matches", RuleIndex: -1}
+	}
+	return Explanation{
+		Allowed:   true,
+		Reason:    fmt.Sprintf("allowed by rule %d", allowIndex),
+		Rule:      &acl.Rules[allowIndex],
+		RuleIndex: allowIndex,
+	}
+}
+
+func (am *ACLAccessManager) watch() {
+	defer am.wg.Done()
+	ticker := time.NewTicker(ACLReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if reloaded, err := am.reload(); err != nil {
+				am.logger.WithError(err).Error("Error reloading the ACL file, keeping the previous rules")
+			} else if reloaded {
+				am.logger.Info("Reloaded the ACL file")
+			}
+		case <-am.stopC:
+			return
+		}
+	}
+}
+
+// reload loads the ACL file, if its content was changed since it was loaded.
+// The content is compared, since the modification times may be too coarse to detect quick changes.
+func (am *ACLAccessManager) reload() (bool, error) {
+	data, err := ioutil.ReadFile(am.filename)
+	if err != nil {
+		return false, err
+	}
+	am.mutex.RLock()
+	unchanged := am.acl != nil && bytes.Equal(data, am.data)
+	am.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	acl, err := ParseACL(am.filename, data)
+	if err != nil {
+		return false, err
+	}
+	am.mutex.Lock()
+	am.acl, am.data = acl, data
+	am.mutex.Unlock()
+	return true, nil
+}
+
+// ParseACL parses and validates the content of an ACL file, in the format given by the extension of its name.
+func ParseACL(filename string, data []byte) (*ACL, error) {
+	var err error
+	acl := &ACL{}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, acl)
+	default:
+		err = json.Unmarshal(data, acl)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("auth: invalid ACL file %s: %v", filename, err)
+	}
+	if err := acl.validate(); err != nil {
+		return nil, fmt.Errorf("auth: invalid ACL file %s: %v", filename, err)
+	}
+	return acl, nil
+}
+
+func (acl *ACL) validate() error {
+	for i, rule := range acl.Rules {
+		if len(rule.Users) == 0 && len(rule.Groups) == 0 {
+			return fmt.Errorf("rule %d has no users and no groups", i)
+		}
+		if len(rule.Paths) == 0 {
+			return fmt.Errorf("rule %d has no paths", i)
+		}
+		if len(rule.Access) == 0 {
+			return fmt.Errorf("rule %d has no access types", i)
+		}
+		for _, access := range rule.Access {
+			if access != READ.String() && access != WRITE.String() {
+				return fmt.Errorf("rule %d has an unknown access type %q", i, access)
+			}
+		}
+		for _, group := range rule.Groups {
+			if _, ok := acl.Groups[group]; !ok {
+				return fmt.Errorf("rule %d has an unknown group %q", i, group)
+			}
+		}
+	}
+	return nil
+}
+
+func (rule *ACLRule) matches(groups map[string][]string, accessType AccessType, userID string, path protocol.Path) bool {
+	return contains(rule.Access, accessType.String()) &&
+		rule.matchesUser(groups, userID) &&
+		rule.matchesPath(userID, path)
+}
+
+func (rule *ACLRule) matchesUser(groups map[string][]string, userID string) bool {
+	if contains(rule.Users, AnyUser) || contains(rule.Users, userID) {
+		return true
+	}
+	for _, group := range rule.Groups {
+		if contains(groups[group], userID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *ACLRule) matchesPath(userID string, path protocol.Path) bool {
+	return matchUserPathPatterns(rule.Paths, userID, path)
+}
+
+// matchUserPathPatterns returns true if one of the patterns matches the path,
+// after replacing the UserIDPlaceholder in the patterns by the user ID.
+func matchUserPathPatterns(patterns []string, userID string, path protocol.Path) bool {
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, UserIDPlaceholder) {
+			// an anonymous user has no own paths, and a user ID must not extend the pattern
+			if userID == "" || strings.ContainsAny(userID, "/*") {
+				continue
+			}
+			pattern = strings.Replace(pattern, UserIDPlaceholder, userID, -1)
+		}
+		if matchPathPattern(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testACL = `
+groups:
+  admins: [alice, bob]
+rules:
+  - users: ["*"]
+    access: [read, write]
+    paths: ["/user/{user_id}/*"]
+  - groups: [admins]
+    access: [read]
+    paths: ["*"]
+  - users: [bob]
+    access: [read]
+    paths: ["/secret"]
+    deny: true
+  - users: [carol]
+    access: [write]
+    paths: ["/news"]
+`
+
+func writeACLFile(t *testing.T, dir, name, content string) string {
+	filename := filepath.Join(dir, name)
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(content), 0600))
+	return filename
+}
+
+func TestACLAccessManager_IsAllowed(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_acl_test")
+	defer os.RemoveAll(dir)
+
+	am, err := NewACLAccessManager(writeACLFile(t, dir, "acl.yaml", testACL))
+	a.NoError(err)
+
+	a.True(am.IsAllowed(READ, "marvin", "/user/marvin/inbox"))
+	a.True(am.IsAllowed(WRITE, "marvin", "/user/marvin/inbox"))
+	a.False(am.IsAllowed(READ, "marvin", "/user/alice/inbox"))
+	a.False(am.IsAllowed(READ, "", "/user//inbox"))
+	a.False(am.IsAllowed(READ, "mar*", "/user/marvin/inbox"))
+	a.False(am.IsAllowed(READ, "alice/inbox", "/user/alice/inbox/x"))
+
+	a.True(am.IsAllowed(READ, "alice", "/user/marvin/inbox"))
+	a.True(am.IsAllowed(READ, "alice", "/secret"))
+	a.False(am.IsAllowed(WRITE, "alice", "/news"))
+
+	// the deny rule takes precedence
+	a.True(am.IsAllowed(READ, "bob", "/news"))
+	a.False(am.IsAllowed(READ, "bob", "/secret"))
+
+	a.True(am.IsAllowed(WRITE, "carol", "/news"))
+	a.False(am.IsAllowed(WRITE, "carol", "/news/sports"))
+}
+
+func TestACLAccessManager_Explain(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_acl_test")
+	defer os.RemoveAll(dir)
+
+	am, err := NewACLAccessManager(writeACLFile(t, dir, "acl.yml", testACL))
+	a.NoError(err)
+
+	explanation := am.Explain(READ, "bob", "/secret")
+	a.False(explanation.Allowed)
+	a.Equal(2, explanation.RuleIndex)
+	a.Equal("denied by rule 2", explanation.Reason)
+	a.True(explanation.Rule.Deny)
+
+	explanation = am.Explain(READ, "bob", "/news")
+	a.True(explanation.Allowed)
+	a.Equal(1, explanation.RuleIndex)
+	a.Equal([]string{"admins"}, explanation.Rule.Groups)
+
+	explanation = am.Explain(WRITE, "dave", "/news")
+	a.False(explanation.Allowed)
+	a.Equal(-1, explanation.RuleIndex)
+	a.Nil(explanation.Rule)
+}
+
+func TestACLAccessManager_JSON(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_acl_test")
+	defer os.RemoveAll(dir)
+
+	am, err := NewACLAccessManager(writeACLFile(t, dir, "acl.json",
+		`{"rules": [{"users": ["marvin"], "access": ["write"], "paths": ["/chat/*"]}]}`))
+	a.NoError(err)
+	a.True(am.IsAllowed(WRITE, "marvin", "/chat/room1"))
+	a.False(am.IsAllowed(READ, "marvin", "/chat/room1"))
+}
+
+func TestACLAccessManager_InvalidFiles(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_acl_test")
+	defer os.RemoveAll(dir)
+
+	for _, content := range []string{
+		`{"rules": [`,
+		`{"rules": [{"access": ["read"], "paths": ["*"]}]}`,
+		`{"rules": [{"users": ["*"], "access": ["read"]}]}`,
+		`{"rules": [{"users": ["*"], "paths": ["*"]}]}`,
+		`{"rules": [{"users": ["*"], "access": ["delete"], "paths": ["*"]}]}`,
+		`{"rules": [{"groups": ["unknown"], "access": ["read"], "paths": ["*"]}]}`,
+	} {
+		_, err := NewACLAccessManager(writeACLFile(t, dir, "acl.json", content))
+		a.Error(err, content)
+	}
+
+	_, err := NewACLAccessManager(filepath.Join(dir, "missing.json"))
+	a.Error(err)
+}
+
+func TestACLAccessManager_Reload(t *testing.T) {
+	a := assert.New(t)
+	defer func(interval time.Duration) { ACLReloadInterval = interval }(ACLReloadInterval)
+	ACLReloadInterval = 10 * time.Millisecond
+
+	dir, _ := ioutil.TempDir("", "guble_acl_test")
+	defer os.RemoveAll(dir)
+	filename := writeACLFile(t, dir, "acl.json", `{"rules": [{"users": ["marvin"], "access": ["read"], "paths": ["/a"]}]}`)
+
+	am, err := NewACLAccessManager(filename)
+	a.NoError(err)
+	a.NoError(am.Start())
+	defer am.Stop()
+	a.True(am.IsAllowed(READ, "marvin", "/a"))
+
+	writeACLFile(t, dir, "acl.json", `{"rules": [{"users": ["marvin"], "access": ["read"], "paths": ["/a", "/b"]}]}`)
+	a.True(waitFor(func() bool { return am.IsAllowed(READ, "marvin", "/b") }))
+
+	// an invalid file does not replace the rules
+	writeACLFile(t, dir, "acl.json", `{"rules": [`)
+	time.Sleep(50 * time.Millisecond)
+	a.True(am.IsAllowed(READ, "marvin", "/b"))
+}
+
+func waitFor(condition func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
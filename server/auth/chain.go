@@ -0,0 +1,333 @@
+package auth
+
+import (
+	"github.com/smancke/guble/protocol"
+
+	log "github.com/Sirupsen/logrus"
+
+	"errors"
+	"fmt"
+	"strings"
+	"text/scanner"
+)
+
+// Decision is the decision of a step of a Chain.
+type Decision int
+
+const (
+	// Abstain leaves the decision to the other steps.
+	Abstain Decision = iota
+
+	// Allow grants the access.
+	Allow
+
+	// Deny refuses the access.
+	Deny
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Allow:
+		return "allow"
+	case Deny:
+		return "deny"
+	}
+	return "abstain"
+}
+
+// Decider is an AccessManager which can abstain from a decision, e.g. if none of its rules matches.
+// The decision of an AccessManager which is not a Decider is Allow or Deny, given by IsAllowed.
+type Decider interface {
+	AccessManager
+	Decide(accessType AccessType, userID string, path protocol.Path) Decision
+}
+
+// ChainMode is the combination of the decisions of the steps of a Chain.
+type ChainMode string
+
+const (
+	// AllOf allows the access if all the steps allow it, and denies it if a step denies it.
+	AllOf ChainMode = "all"
+
+	// AnyOf allows the access if a step allows it, and denies it if a step denies it and no step allows it.
+	AnyOf ChainMode = "any"
+
+	// FirstDecisive takes the decision of the first step which does not abstain.
+	FirstDecisive ChainMode = "first"
+)
+
+// ChainStep is a named AccessManager in a Chain.
+type ChainStep struct {
+	Name          string
+	AccessManager AccessManager
+}
+
+// Chain combines the decisions of its steps, which can be chains as well.
+// The Chain abstains if the steps do not decide (e.g. all of them abstain), and IsAllowed grants only an allowed access.
+// The decision of each step is logged with the debug level.
+type Chain struct {
+	mode  ChainMode
+	steps []ChainStep
+}
+
+// authenticatingChain is a Chain with a step authenticating the users by their tokens.
+type authenticatingChain struct {
+	*Chain
+}
+
+// NewChain returns a new Chain of the steps. If one of the steps is an Authenticator,
+// the returned Chain is an Authenticator too.
+func NewChain(mode ChainMode, steps ...ChainStep) (AccessManager, error) {
+	if mode != AllOf && mode != AnyOf && mode != FirstDecisive {
+		return nil, fmt.Errorf("auth: unknown chain mode %q", mode)
+	}
+	if len(steps) == 0 {
+		return nil, errors.New("auth: a chain needs at least one step")
+	}
+	c := &Chain{mode: mode, steps: steps}
+	if c.authenticatorIndex() >= 0 {
+		return authenticatingChain{c}, nil
+	}
+	return c, nil
+}
+
+// Steps returns the steps of the Chain.
+func (c *Chain) Steps() []ChainStep {
+	return c.steps
+}
+
+// Start the steps which are startable.
+func (c *Chain) Start() error {
+	for _, step := range c.steps {
+		if s, ok := step.AccessManager.(interface {
+			Start() error
+		}); ok {
+			if err := s.Start(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Stop the steps which are stoppable.
+func (c *Chain) Stop() error {
+	var err error
+	for _, step := range c.steps {
+		if s, ok := step.AccessManager.(interface {
+			Stop() error
+		}); ok {
+			if stepErr := s.Stop(); stepErr != nil {
+				err = stepErr
+			}
+		}
+	}
+	return err
+}
+
+// IsAllowed is an implementation of the AccessManager interface.
+func (c *Chain) IsAllowed(accessType AccessType, userID string, path protocol.Path) bool {
+	return c.Decide(accessType, userID, path) == Allow
+}
+
+// Decide is an implementation of the Decider interface.
+func (c *Chain) Decide(accessType AccessType, userID string, path protocol.Path) Decision {
+	decision, _ := c.decide(accessType, userID, path, false)
+	return decision
+}
+
+// Explain is an implementation of the Explainer interface, listing the decisions of the steps.
+func (c *Chain) Explain(accessType AccessType, userID string, path protocol.Path) Explanation {
+	decision, reasons := c.decide(accessType, userID, path, true)
+	return Explanation{
+		Allowed:   decision == Allow,
+		Reason:    fmt.Sprintf("%s: %s", c.mode, strings.Join(reasons, "; ")),
+		RuleIndex: -1,
+	}
+}
+
+// decide combines the decisions of the steps, stopping at the first decisive step if the mode allows it.
+// The reasons of the steps are returned if explain is set.
+func (c *Chain) decide(accessType AccessType, userID string, path protocol.Path, explain bool) (Decision, []string) {
+	var reasons []string
+	result := Abstain
+	allowedAll := true
+	for _, step := range c.steps {
+		decision, reason := decideStep(step.AccessManager, accessType, userID, path, explain)
+		logger.WithFields(log.Fields{
+			"chain":       c.mode,
+			"step":        step.Name,
+			"decision":    decision,
+			"access_type": accessType,
+			"userId":      userID,
+			"path":        path,
+		}).Debug("Access chain step")
+		if explain {
+			reasons = append(reasons, fmt.Sprintf("%s %s (%s)", step.Name, decision, reason))
+		}
+
+		if decision != Allow {
+			allowedAll = false
+		}
+		switch c.mode {
+		case AllOf:
+			if decision == Deny {
+				return Deny, reasons
+			}
+		case AnyOf:
+			if decision == Allow {
+				return Allow, reasons
+			}
+			if decision == Deny {
+				result = Deny
+			}
+		case FirstDecisive:
+			if decision != Abstain {
+				return decision, reasons
+			}
+		}
+	}
+	if c.mode == AllOf && allowedAll {
+		return Allow, reasons
+	}
+	return result, reasons
+}
+
+func decideStep(am AccessManager, accessType AccessType, userID string, path protocol.Path, explain bool) (Decision, string) {
+	if explain {
+		if explainer, ok := am.(Explainer); ok {
+			explanation := explainer.Explain(accessType, userID, path)
+			if decider, ok := am.(Decider); ok {
+				return decider.Decide(accessType, userID, path), explanation.Reason
+			}
+			return boolDecision(explanation.Allowed), explanation.Reason
+		}
+	}
+	if decider, ok := am.(Decider); ok {
+		decision := decider.Decide(accessType, userID, path)
+		return decision, decision.String()
+	}
+	decision := boolDecision(am.IsAllowed(accessType, userID, path))
+	return decision, decision.String()
+}
+
+func boolDecision(allowed bool) Decision {
+	if allowed {
+		return Allow
+	}
+	return Deny
+}
+
+// authenticatorIndex returns the index of the first step which is an Authenticator, or -1.
+func (c *Chain) authenticatorIndex() int {
+	for i, step := range c.steps {
+		if _, ok := step.AccessManager.(Authenticator); ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// Authenticate is an implementation of the Authenticator interface, by the first authenticating step.
+// The returned permissions are the chain, with the permissions of the user in place of the authenticating step.
+func (c authenticatingChain) Authenticate(token string) (string, AccessManager, error) {
+	i := c.authenticatorIndex()
+	userID, permissions, err := c.steps[i].AccessManager.(Authenticator).Authenticate(token)
+	if err != nil {
+		return "", nil, err
+	}
+	steps := make([]ChainStep, len(c.steps))
+	copy(steps, c.steps)
+	steps[i] = ChainStep{Name: steps[i].Name, AccessManager: permissions}
+	return userID, &Chain{mode: c.mode, steps: steps}, nil
+}
+
+// ParseChain parses a chain expression, like "all(jwt, any(acl, rbac))": a name of an access manager,
+// or a mode (all, any or first) with a list of chain expressions as steps.
+// The access managers are returned by the create func, and each name can only be used once,
+// so that the access managers are started and stopped once.
+func ParseChain(expression string, create func(name string) (AccessManager, error)) (AccessManager, error) {
+	p := &chainParser{create: create, managers: make(map[string]AccessManager)}
+	p.s.Init(strings.NewReader(expression))
+	p.s.Mode = scanner.ScanIdents
+	p.s.IsIdentRune = func(ch rune, i int) bool {
+		return ch == '-' || ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')
+	}
+	p.s.Error = func(s *scanner.Scanner, msg string) {}
+	p.next()
+
+	_, am, err := p.parseStep()
+	if err != nil {
+		return nil, err
+	}
+	if p.token != scanner.EOF {
+		return nil, fmt.Errorf("auth: unexpected %q in the access chain", p.s.TokenText())
+	}
+	return am, nil
+}
+
+type chainParser struct {
+	s        scanner.Scanner
+	token    rune
+	create   func(name string) (AccessManager, error)
+	managers map[string]AccessManager
+}
+
+func (p *chainParser) next() {
+	p.token = p.s.Scan()
+}
+
+// parseStep parses a name or a chain, and returns it with its name.
+func (p *chainParser) parseStep() (string, AccessManager, error) {
+	if p.token != scanner.Ident {
+		return "", nil, p.unexpected("a name")
+	}
+	name := p.s.TokenText()
+	p.next()
+	if p.token != '(' {
+		am, err := p.manager(name)
+		return name, am, err
+	}
+
+	p.next()
+	var steps []ChainStep
+	for {
+		stepName, am, err := p.parseStep()
+		if err != nil {
+			return "", nil, err
+		}
+		steps = append(steps, ChainStep{Name: stepName, AccessManager: am})
+		if p.token == ')' {
+			p.next()
+			break
+		}
+		if p.token != ',' {
+			return "", nil, p.unexpected(`"," or ")"`)
+		}
+		p.next()
+	}
+	chain, err := NewChain(ChainMode(name), steps...)
+	if err != nil {
+		return "", nil, err
+	}
+	return name, chain, nil
+}
+
+func (p *chainParser) manager(name string) (AccessManager, error) {
+	if _, ok := p.managers[name]; ok {
+		return nil, fmt.Errorf("auth: %s is used twice in the access chain", name)
+	}
+	am, err := p.create(name)
+	if err != nil {
+		return nil, err
+	}
+	p.managers[name] = am
+	return am, nil
+}
+
+func (p *chainParser) unexpected(expected string) error {
+	if p.token == scanner.EOF {
+		return fmt.Errorf("auth: unexpected end of the access chain, expected %s", expected)
+	}
+	return fmt.Errorf("auth: unexpected %q in the access chain, expected %s", p.s.TokenText(), expected)
+}
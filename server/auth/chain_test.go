@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/kvstore"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// testDecider decides by the paths.
+type testDecider map[protocol.Path]Decision
+
+func (d testDecider) IsAllowed(accessType AccessType, userID string, path protocol.Path) bool {
+	return d[path] == Allow
+}
+
+func (d testDecider) Decide(accessType AccessType, userID string, path protocol.Path) Decision {
+	return d[path]
+}
+
+func testChain(t *testing.T, mode ChainMode, steps ...AccessManager) AccessManager {
+	var chainSteps []ChainStep
+	for _, step := range steps {
+		chainSteps = append(chainSteps, ChainStep{Name: "step", AccessManager: step})
+	}
+	chain, err := NewChain(mode, chainSteps...)
+	assert.NoError(t, err)
+	return chain
+}
+
+func TestChain_Modes(t *testing.T) {
+	a := assert.New(t)
+	allow := NewAllowAllAccessManager(true)
+	deny := NewAllowAllAccessManager(false)
+	abstain := testDecider{}
+
+	for _, c := range []struct {
+		mode     ChainMode
+		steps    []AccessManager
+		decision Decision
+	}{
+		{AllOf, []AccessManager{allow, allow}, Allow},
+		{AllOf, []AccessManager{allow, deny}, Deny},
+		{AllOf, []AccessManager{allow, abstain}, Abstain},
+		{AnyOf, []AccessManager{deny, allow}, Allow},
+		{AnyOf, []AccessManager{abstain, deny}, Deny},
+		{AnyOf, []AccessManager{abstain, abstain}, Abstain},
+		{FirstDecisive, []AccessManager{abstain, deny, allow}, Deny},
+		{FirstDecisive, []AccessManager{abstain, allow, deny}, Allow},
+		{FirstDecisive, []AccessManager{abstain}, Abstain},
+	} {
+		chain := testChain(t, c.mode, c.steps...)
+		a.Equal(c.decision, chain.(Decider).Decide(READ, "user01", "/foo"), "%s %v", c.mode, c.steps)
+		a.Equal(c.decision == Allow, chain.IsAllowed(READ, "user01", "/foo"))
+	}
+
+	_, err := NewChain("none", ChainStep{Name: "allow", AccessManager: allow})
+	a.Error(err)
+	_, err = NewChain(AllOf)
+	a.Error(err)
+}
+
+func TestChain_Explain(t *testing.T) {
+	a := assert.New(t)
+	am := NewRBACAccessManager(kvstore.NewMemoryKVStore())
+	testRoles(t, am)
+
+	chain, err := NewChain(FirstDecisive,
+		ChainStep{Name: "rbac", AccessManager: am},
+		ChainStep{Name: "deny", AccessManager: NewAllowAllAccessManager(false)})
+	a.NoError(err)
+
+	explanation := chain.(Explainer).Explain(READ, "marvin", "/news")
+	a.True(explanation.Allowed)
+	a.Equal("first: rbac allow (allowed by role reader of group everyone)", explanation.Reason)
+
+	explanation = chain.(Explainer).Explain(READ, "marvin", "/private")
+	a.False(explanation.Allowed)
+	a.Equal("first: rbac abstain (no role grants the access); deny deny (deny)", explanation.Reason)
+
+	roleManager, ok := FindRoleManager(chain)
+	a.True(ok)
+	a.Equal(am, roleManager)
+}
+
+func TestChain_Authenticate(t *testing.T) {
+	a := assert.New(t)
+	keyFile := writeTempFile(t, testSecret)
+	defer os.Remove(keyFile)
+	jwtAM, err := NewJWTAccessManager(JWTConfig{Algorithm: HS256, KeyFile: keyFile})
+	a.NoError(err)
+
+	// the token must allow the access, and the other step too
+	chain, err := NewChain(AllOf,
+		ChainStep{Name: "jwt", AccessManager: jwtAM},
+		ChainStep{Name: "paths", AccessManager: testDecider{"/chat/room1": Allow, "/news": Deny}})
+	a.NoError(err)
+	authenticator, ok := chain.(Authenticator)
+	a.True(ok)
+
+	userID, permissions, err := authenticator.Authenticate(signToken(t, jwt.SigningMethodHS256, testSecret, "", testClaims(time.Hour)))
+	a.NoError(err)
+	a.Equal("user01", userID)
+	a.True(permissions.IsAllowed(READ, "user01", "/chat/room1"))
+	a.False(permissions.IsAllowed(READ, "user01", "/news"))
+	a.False(permissions.IsAllowed(WRITE, "user01", "/chat/room1"))
+
+	_, _, err = authenticator.Authenticate("")
+	a.Equal(errMissingToken, err)
+
+	// a chain without an authenticating step is not an Authenticator
+	_, ok = testChain(t, AllOf, NewAllowAllAccessManager(true)).(Authenticator)
+	a.False(ok)
+}
+
+func TestParseChain(t *testing.T) {
+	a := assert.New(t)
+	managers := map[string]AccessManager{
+		"allow": NewAllowAllAccessManager(true),
+		"deny":  NewAllowAllAccessManager(false),
+		"none":  testDecider{},
+	}
+	create := func(name string) (AccessManager, error) {
+		if am, ok := managers[name]; ok {
+			return am, nil
+		}
+		return nil, errors.New("unknown")
+	}
+
+	am, err := ParseChain("deny", create)
+	a.NoError(err)
+	a.Equal(managers["deny"], am)
+
+	am, err = ParseChain("all(allow, first(none, deny))", create)
+	a.NoError(err)
+	a.False(am.IsAllowed(READ, "user01", "/foo"))
+	steps := am.(*Chain).Steps()
+	a.Equal("allow", steps[0].Name)
+	a.Equal("first", steps[1].Name)
+
+	am, err = ParseChain(" any( deny,allow ) ", create)
+	a.NoError(err)
+	a.True(am.IsAllowed(READ, "user01", "/foo"))
+
+	for _, invalid := range []string{"", "all(", "all()", "all(allow", "all(allow,)", "all(allow) deny", "unknown", "other(allow)", "any(allow, allow)", "all(allow; deny)"} {
+		_, err := ParseChain(invalid, create)
+		a.Error(err, invalid)
+	}
+}
@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"github.com/smancke/guble/protocol"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	// HS256 is the algorithm of the tokens signed with a shared secret.
+	HS256 = "HS256"
+
+	// RS256 is the algorithm of the tokens signed with a RSA private key.
+	RS256 = "RS256"
+)
+
+var (
+	errMissingToken   = errors.New("auth: missing token")
+	errMissingSubject = errors.New("auth: the token has no subject")
+	errUnknownKey     = errors.New("auth: the token is signed with an unknown key")
+)
+
+// JWTConfig is the configuration of the keys verifying the signatures of the tokens.
+type JWTConfig struct {
+	// Algorithm is the only accepted signing algorithm: HS256 or RS256.
+	Algorithm string
+
+	// KeyFile contains the shared secret (HS256) or the PEM-encoded RSA public key (RS256).
+	KeyFile string
+
+	// JWKSFile contains a JSON Web Key Set, of which the key is selected by the "kid" header of the token.
+	JWKSFile string
+}
+
+// JWTAccessManager authenticates the users by signed JSON Web Tokens.
+// The user ID is the subject ("sub") of the token, and the paths which the user may read and write
+// are given by the patterns in the "read" and "write" claims.
+// A pattern ending with "*" matches all the paths starting with it, other patterns match exactly one path:
+//
+//	{"sub": "user01", "exp": 1490000000, "read": ["/chat/*", "/news"], "write": ["/chat/user01/*"]}
+//
+// The websocket and REST handlers check the permissions of the tokens.
+// IsAllowed decides only on the requests without a token, which are made by the server modules
+// (e.g. the subscriptions of the connectors), and allows them.
+type JWTAccessManager struct {
+	algorithm string
+	key       interface{}
+	keys      map[string]interface{}
+}
+
+// jwtClaims are the claims of the tokens accepted by the JWTAccessManager.
+type jwtClaims struct {
+	jwt.StandardClaims
+	Read  []string `json:"read,omitempty"`
+	Write []string `json:"write,omitempty"`
+}
+
+// NewJWTAccessManager returns a new JWTAccessManager, with the keys read from the configured files.
+func NewJWTAccessManager(config JWTConfig) (*JWTAccessManager, error) {
+	if config.Algorithm != HS256 && config.Algorithm != RS256 {
+		return nil, fmt.Errorf("auth: unsupported JWT algorithm %q", config.Algorithm)
+	}
+	if config.KeyFile == "" && config.JWKSFile == "" {
+		return nil, errors.New("auth: a JWT key file or JWKS file is required")
+	}
+
+	am := &JWTAccessManager{algorithm: config.Algorithm}
+	if config.KeyFile != "" {
+		data, err := ioutil.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if am.key, err = parseJWTKey(config.Algorithm, data); err != nil {
+			return nil, err
+		}
+	}
+	if config.JWKSFile != "" {
+		data, err := ioutil.ReadFile(config.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		if am.keys, err = parseJWKS(config.Algorithm, data); err != nil {
+			return nil, err
+		}
+	}
+	return am, nil
+}
+
+// IsAllowed is an implementation of the AccessManager interface.
+// It allows the requests of the server modules, since the requests of the users are checked with their tokens.
+func (am *JWTAccessManager) IsAllowed(accessType AccessType, userID string, path protocol.Path) bool {
+	return true
+}
+
+// Authenticate is an implementation of the Authenticator interface.
+// The returned permissions are valid until the token expires.
+func (am *JWTAccessManager) Authenticate(token string) (string, AccessManager, error) {
+	if token == "" {
+		return "", nil, errMissingToken
+	}
+	claims := &jwtClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, am.verificationKey); err != nil {
+		return "", nil, err
+	}
+	if claims.Subject == "" {
+		return "", nil, errMissingSubject
+	}
+
+	permissions := &tokenPermissions{
+		userID: claims.Subject,
+		read:   claims.Read,
+		write:  claims.Write,
+	}
+	if claims.ExpiresAt != 0 {
+		permissions.expiresAt = time.Unix(claims.ExpiresAt, 0)
+	}
+	return claims.Subject, permissions, nil
+}
+
+// verificationKey returns the key verifying the signature of the token, if it is signed with the configured algorithm.
+func (am *JWTAccessManager) verificationKey(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() != am.algorithm {
+		return nil, fmt.Errorf("auth: unexpected signing algorithm %q", token.Method.Alg())
+	}
+	if kid, ok := token.Header["kid"].(string); ok && am.keys != nil {
+		if key, ok := am.keys[kid]; ok {
+			return key, nil
+		}
+	}
+	if am.key == nil {
+		return nil, errUnknownKey
+	}
+	return am.key, nil
+}
+
+// tokenPermissions are the permissions granted by a token to its user.
+type tokenPermissions struct {
+	userID    string
+	read      []string
+	write     []string
+	expiresAt time.Time
+}
+
+// IsAllowed is an implementation of the AccessManager interface.
+func (p *tokenPermissions) IsAllowed(accessType AccessType, userID string, path protocol.Path) bool {
+	if userID != p.userID || (!p.expiresAt.IsZero() && time.Now().After(p.expiresAt)) {
+		return false
+	}
+	patterns := p.read
+	if accessType == WRITE {
+		patterns = p.write
+	}
+	for _, pattern := range patterns {
+		if matchPathPattern(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPathPattern(pattern string, path protocol.Path) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(string(path), strings.TrimSuffix(pattern, "*"))
+	}
+	return string(path) == pattern
+}
+
+func parseJWTKey(algorithm string, data []byte) (interface{}, error) {
+	if algorithm == RS256 {
+		return jwt.ParseRSAPublicKeyFromPEM(data)
+	}
+	secret := []byte(strings.TrimSpace(string(data)))
+	if len(secret) == 0 {
+		return nil, errors.New("auth: the JWT secret is empty")
+	}
+	return secret, nil
+}
+
+// jsonWebKey is a key of a JWKS: a RSA public key ("kty": "RSA"), or a shared secret ("kty": "oct").
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	K   string `json:"k"`
+}
+
+// parseJWKS returns the keys of the JWKS usable with the algorithm, by their IDs.
+func parseJWKS(algorithm string, data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		switch {
+		case algorithm == RS256 && k.Kty == "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("auth: invalid modulus of the JWK %q: %v", k.Kid, err)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				return nil, fmt.Errorf("auth: invalid exponent of the JWK %q: %v", k.Kid, err)
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case algorithm == HS256 && k.Kty == "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil {
+				return nil, fmt.Errorf("auth: invalid secret of the JWK %q: %v", k.Kid, err)
+			}
+			keys[k.Kid] = secret
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("auth: the JWKS contains no key for %s", algorithm)
+	}
+	return keys, nil
+}
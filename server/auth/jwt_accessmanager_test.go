@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("a secret of the tests")
+
+func writeTempFile(t *testing.T, data []byte) string {
+	f, err := ioutil.TempFile("", "guble_auth_test")
+	assert.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write(data)
+	assert.NoError(t, err)
+	return f.Name()
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.Claims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return signed
+}
+
+func testClaims(expiresIn time.Duration) *jwtClaims {
+	return &jwtClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "user01",
+			ExpiresAt: time.Now().Add(expiresIn).Unix(),
+		},
+		Read:  []string{"/chat/*", "/news"},
+		Write: []string{"/chat/user01/*"},
+	}
+}
+
+func TestJWTAccessManager_Permissions(t *testing.T) {
+	a := assert.New(t)
+	keyFile := writeTempFile(t, testSecret)
+	defer os.Remove(keyFile)
+
+	am, err := NewJWTAccessManager(JWTConfig{Algorithm: HS256, KeyFile: keyFile})
+	a.NoError(err)
+
+	userID, permissions, err := am.Authenticate(signToken(t, jwt.SigningMethodHS256, testSecret, "", testClaims(time.Hour)))
+	a.NoError(err)
+	a.Equal("user01", userID)
+
+	a.True(permissions.IsAllowed(READ, "user01", "/chat/room1"))
+	a.True(permissions.IsAllowed(READ, "user01", "/news"))
+	a.False(permissions.IsAllowed(READ, "user01", "/news/sports"))
+	a.False(permissions.IsAllowed(READ, "user02", "/chat/room1"))
+	a.True(permissions.IsAllowed(WRITE, "user01", "/chat/user01/room1"))
+	a.False(permissions.IsAllowed(WRITE, "user01", "/chat/room1"))
+
+	// the requests of the server modules are allowed
+	a.True(am.IsAllowed(READ, "user02", "/private"))
+}
+
+func TestJWTAccessManager_InvalidTokens(t *testing.T) {
+	a := assert.New(t)
+	keyFile := writeTempFile(t, testSecret)
+	defer os.Remove(keyFile)
+
+	am, err := NewJWTAccessManager(JWTConfig{Algorithm: HS256, KeyFile: keyFile})
+	a.NoError(err)
+
+	_, _, err = am.Authenticate("")
+	a.Equal(errMissingToken, err)
+
+	_, _, err = am.Authenticate("not a token")
+	a.Error(err)
+
+	_, _, err = am.Authenticate(signToken(t, jwt.SigningMethodHS256, testSecret, "", testClaims(-time.Minute)))
+	a.Error(err, "expired token")
+
+	_, _, err = am.Authenticate(signToken(t, jwt.SigningMethodHS256, []byte("other secret"), "", testClaims(time.Hour)))
+	a.Error(err, "wrong signature")
+
+	_, _, err = am.Authenticate(signToken(t, jwt.SigningMethodHS384, testSecret, "", testClaims(time.Hour)))
+	a.Error(err, "other algorithm")
+
+	claims := testClaims(time.Hour)
+	claims.Subject = ""
+	_, _, err = am.Authenticate(signToken(t, jwt.SigningMethodHS256, testSecret, "", claims))
+	a.Equal(errMissingSubject, err)
+}
+
+func TestJWTAccessManager_ExpiredPermissions(t *testing.T) {
+	permissions := &tokenPermissions{
+		userID:    "user01",
+		read:      []string{"*"},
+		expiresAt: time.Now().Add(-time.Second),
+	}
+	assert.False(t, permissions.IsAllowed(READ, "user01", "/chat"))
+}
+
+func TestJWTAccessManager_RS256(t *testing.T) {
+	a := assert.New(t)
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	a.NoError(err)
+	publicKey, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	a.NoError(err)
+	keyFile := writeTempFile(t, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey}))
+	defer os.Remove(keyFile)
+
+	am, err := NewJWTAccessManager(JWTConfig{Algorithm: RS256, KeyFile: keyFile})
+	a.NoError(err)
+
+	userID, _, err := am.Authenticate(signToken(t, jwt.SigningMethodRS256, privateKey, "", testClaims(time.Hour)))
+	a.NoError(err)
+	a.Equal("user01", userID)
+
+	// a token signed with the public key as HMAC secret is rejected
+	_, _, err = am.Authenticate(signToken(t, jwt.SigningMethodHS256, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey}), "", testClaims(time.Hour)))
+	a.Error(err)
+}
+
+func TestJWTAccessManager_JWKS(t *testing.T) {
+	a := assert.New(t)
+	key1, err := rsa.GenerateKey(rand.Reader, 2048)
+	a.NoError(err)
+	key2, err := rsa.GenerateKey(rand.Reader, 2048)
+	a.NoError(err)
+
+	jwk := func(kid string, key *rsa.PrivateKey) string {
+		return fmt.Sprintf(`{"kty":"RSA","kid":%q,"n":%q,"e":%q}`, kid,
+			base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()))
+	}
+	jwksFile := writeTempFile(t, []byte(`{"keys":[`+jwk("key1", key1)+`,`+jwk("key2", key2)+`,{"kty":"oct","kid":"key3","k":"c2VjcmV0"}]}`))
+	defer os.Remove(jwksFile)
+
+	am, err := NewJWTAccessManager(JWTConfig{Algorithm: RS256, JWKSFile: jwksFile})
+	a.NoError(err)
+
+	_, _, err = am.Authenticate(signToken(t, jwt.SigningMethodRS256, key1, "key1", testClaims(time.Hour)))
+	a.NoError(err)
+	_, _, err = am.Authenticate(signToken(t, jwt.SigningMethodRS256, key2, "key2", testClaims(time.Hour)))
+	a.NoError(err)
+	_, _, err = am.Authenticate(signToken(t, jwt.SigningMethodRS256, key1, "key2", testClaims(time.Hour)))
+	a.Error(err)
+	_, _, err = am.Authenticate(signToken(t, jwt.SigningMethodRS256, key1, "unknown", testClaims(time.Hour)))
+	a.Error(err)
+}
+
+func TestNewJWTAccessManager_InvalidConfig(t *testing.T) {
+	a := assert.New(t)
+
+	_, err := NewJWTAccessManager(JWTConfig{Algorithm: "none", KeyFile: "secret"})
+	a.Error(err)
+
+	_, err = NewJWTAccessManager(JWTConfig{Algorithm: HS256})
+	a.Error(err)
+
+	_, err = NewJWTAccessManager(JWTConfig{Algorithm: HS256, KeyFile: "/does/not/exist"})
+	a.Error(err)
+}
+
+func TestTokenFromRequest(t *testing.T) {
+	a := assert.New(t)
+
+	req, _ := http.NewRequest(http.MethodGet, "/stream/?access_token=fromQuery", nil)
+	a.Equal("fromQuery", TokenFromRequest(req))
+
+	req.Header.Set("Authorization", "Bearer fromHeader")
+	a.Equal("fromHeader", TokenFromRequest(req))
+
+	req, _ = http.NewRequest(http.MethodGet, "/stream/", nil)
+	a.Equal("", TokenFromRequest(req))
+}
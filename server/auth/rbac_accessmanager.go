@@ -0,0 +1,376 @@
+package auth
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/kvstore"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// RolesSchema is the schema of the roles in the KVStore, stored as JSON by their names.
+	RolesSchema = "auth_roles"
+
+	// GroupsSchema is the schema of the groups in the KVStore, stored as JSON by their names.
+	GroupsSchema = "auth_groups"
+)
+
+const reasonNoRole = "no role grants the access"
+
+var (
+	// ErrRoleNotFound is returned when a role does not exist.
+	ErrRoleNotFound = errors.New("auth: role not found")
+
+	// ErrGroupNotFound is returned when a group does not exist.
+	ErrGroupNotFound = errors.New("auth: group not found")
+
+	// ErrInvalidName is returned for an empty name of a role or group, or a name containing "/" or "*".
+	ErrInvalidName = errors.New("auth: invalid name")
+
+	// ErrEmptyPathPattern is returned for a role with an empty path pattern.
+	ErrEmptyPathPattern = errors.New("auth: empty path pattern")
+)
+
+// Role grants the read and write access on the paths matching the patterns.
+// A pattern ending with "*" matches all the paths starting with it, other patterns match only the same path,
+// and the UserIDPlaceholder is replaced by the ID of the user.
+type Role struct {
+	Read  []string `json:"read,omitempty"`
+	Write []string `json:"write,omitempty"`
+}
+
+// Group gives its roles to its members.
+type Group struct {
+	Members []string `json:"members"`
+	Roles   []string `json:"roles"`
+}
+
+// RoleManager is an AccessManager deciding by the roles of the groups of the users, which it manages.
+type RoleManager interface {
+	AccessManager
+
+	// Roles returns all the roles by their names.
+	Roles() (map[string]Role, error)
+
+	// PutRole creates or replaces a role.
+	PutRole(name string, role Role) error
+
+	// DeleteRole deletes a role, or returns ErrRoleNotFound.
+	DeleteRole(name string) error
+
+	// Groups returns all the groups by their names.
+	Groups() (map[string]Group, error)
+
+	// PutGroup creates or replaces a group.
+	PutGroup(name string, group Group) error
+
+	// DeleteGroup deletes a group, or returns ErrGroupNotFound.
+	DeleteGroup(name string) error
+}
+
+// FindRoleManager returns the access manager if it manages roles, or else the first step managing roles
+// of the access manager, if it is a Chain.
+func FindRoleManager(am AccessManager) (RoleManager, bool) {
+	if roleManager, ok := am.(RoleManager); ok {
+		return roleManager, true
+	}
+	if chain, ok := am.(interface {
+		Steps() []ChainStep
+	}); ok {
+		for _, step := range chain.Steps() {
+			if roleManager, ok := FindRoleManager(step.AccessManager); ok {
+				return roleManager, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// RBACAccessManager grants the permissions of the roles of the groups of which the user is a member.
+// The roles and groups are stored in the KVStore, so that they are shared by all the nodes using it.
+// The decisions are cached, until a role or group is changed (by any node, while the RBACAccessManager is started).
+type RBACAccessManager struct {
+	kvStore kvstore.KVStore
+
+	mutex sync.RWMutex
+	// model is nil if it has to be loaded from the KVStore.
+	model *rbacModel
+	// generation is incremented by each invalidation, so that decisions of an older model are not cached.
+	generation uint64
+	decisions  map[decisionKey]Explanation
+
+	stopC chan struct{}
+	wg    sync.WaitGroup
+}
+
+// rbacModel are the roles and groups loaded from the KVStore.
+type rbacModel struct {
+	roles  map[string]Role
+	groups map[string]Group
+	// groupNames are the sorted names of the groups, so that the explanations are deterministic.
+	groupNames []string
+}
+
+// NewRBACAccessManager returns a new RBACAccessManager, with the roles and groups stored in the KVStore.
+func NewRBACAccessManager(kvStore kvstore.KVStore) *RBACAccessManager {
+	return &RBACAccessManager{
+		kvStore:   kvStore,
+		decisions: make(map[decisionKey]Explanation),
+	}
+}
+
+// Start watching the changes of the roles and groups in the KVStore.
+func (am *RBACAccessManager) Start() error {
+	am.stopC = make(chan struct{})
+	for _, schema := range []string{RolesSchema, GroupsSchema} {
+		events, cancel := am.kvStore.Watch(schema, "")
+		am.wg.Add(1)
+		go am.watch(schema, events, cancel)
+	}
+	// the changes before watching were not seen
+	am.invalidate()
+	return nil
+}
+
+// Stop watching the changes of the roles and groups.
+func (am *RBACAccessManager) Stop() error {
+	if am.stopC != nil {
+		close(am.stopC)
+		am.wg.Wait()
+		am.stopC = nil
+	}
+	return nil
+}
+
+// IsAllowed is an implementation of the AccessManager interface.
+func (am *RBACAccessManager) IsAllowed(accessType AccessType, userID string, path protocol.Path) bool {
+	return am.Explain(accessType, userID, path).Allowed
+}
+
+// Decide is an implementation of the Decider interface: it abstains if no role grants the access,
+// since the roles only grant accesses.
+func (am *RBACAccessManager) Decide(accessType AccessType, userID string, path protocol.Path) Decision {
+	explanation := am.Explain(accessType, userID, path)
+	if explanation.Allowed {
+		return Allow
+	}
+	if explanation.Reason == reasonNoRole {
+		return Abstain
+	}
+	return Deny
+}
+
+// Explain is an implementation of the Explainer interface.
+// The access is denied if the roles can not be loaded from the KVStore.
+func (am *RBACAccessManager) Explain(accessType AccessType, userID string, path protocol.Path) Explanation {
+	key := decisionKey{accessType, userID, path}
+	am.mutex.RLock()
+	explanation, cached := am.decisions[key]
+	am.mutex.RUnlock()
+	if cached {
+		return explanation
+	}
+
+	model, generation, err := am.currentModel()
+	if err != nil {
+		logger.WithError(err).Error("Error loading the roles and groups")
+		return Explanation{Allowed: false, Reason: "the roles can not be loaded", RuleIndex: -1}
+	}
+	explanation = model.explain(accessType, userID, path)
+
+	am.mutex.Lock()
+	if generation == am.generation {
+		if len(am.decisions) >= maxCachedDecisions {
+			am.decisions = make(map[decisionKey]Explanation)
+		}
+		am.decisions[key] = explanation
+	}
+	am.mutex.Unlock()
+	return explanation
+}
+
+// Roles is an implementation of the RoleManager interface.
+func (am *RBACAccessManager) Roles() (map[string]Role, error) {
+	roles := make(map[string]Role)
+	for entry := range am.kvStore.Iterate(RolesSchema, "") {
+		var role Role
+		if err := json.Unmarshal([]byte(entry[1]), &role); err != nil {
+			return nil, fmt.Errorf("auth: invalid role %q: %v", entry[0], err)
+		}
+		roles[entry[0]] = role
+	}
+	return roles, nil
+}
+
+// PutRole is an implementation of the RoleManager interface.
+func (am *RBACAccessManager) PutRole(name string, role Role) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	for _, pattern := range append(append([]string{}, role.Read...), role.Write...) {
+		if pattern == "" {
+			return ErrEmptyPathPattern
+		}
+	}
+	return am.put(RolesSchema, name, role)
+}
+
+// DeleteRole is an implementation of the RoleManager interface.
+func (am *RBACAccessManager) DeleteRole(name string) error {
+	return am.delete(RolesSchema, name, ErrRoleNotFound)
+}
+
+// Groups is an implementation of the RoleManager interface.
+func (am *RBACAccessManager) Groups() (map[string]Group, error) {
+	groups := make(map[string]Group)
+	for entry := range am.kvStore.Iterate(GroupsSchema, "") {
+		var group Group
+		if err := json.Unmarshal([]byte(entry[1]), &group); err != nil {
+			return nil, fmt.Errorf("auth: invalid group %q: %v", entry[0], err)
+		}
+		groups[entry[0]] = group
+	}
+	return groups, nil
+}
+
+// PutGroup is an implementation of the RoleManager interface.
+// The roles of the group do not have to exist yet, missing roles grant nothing.
+func (am *RBACAccessManager) PutGroup(name string, group Group) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	return am.put(GroupsSchema, name, group)
+}
+
+// DeleteGroup is an implementation of the RoleManager interface.
+func (am *RBACAccessManager) DeleteGroup(name string) error {
+	return am.delete(GroupsSchema, name, ErrGroupNotFound)
+}
+
+func (am *RBACAccessManager) put(schema, name string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if err := am.kvStore.Put(schema, name, data); err != nil {
+		return err
+	}
+	am.invalidate()
+	return nil
+}
+
+func (am *RBACAccessManager) delete(schema, name string, errNotFound error) error {
+	_, exists, err := am.kvStore.Get(schema, name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errNotFound
+	}
+	if err := am.kvStore.Delete(schema, name); err != nil {
+		return err
+	}
+	am.invalidate()
+	return nil
+}
+
+// invalidate drops the cached decisions and the model, which is loaded again by the next check.
+func (am *RBACAccessManager) invalidate() {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	am.model = nil
+	am.generation++
+	am.decisions = make(map[decisionKey]Explanation)
+}
+
+// currentModel returns the model, loading it if it was invalidated, and the generation of the model.
+func (am *RBACAccessManager) currentModel() (*rbacModel, uint64, error) {
+	am.mutex.RLock()
+	model, generation := am.model, am.generation
+	am.mutex.RUnlock()
+	if model != nil {
+		return model, generation, nil
+	}
+
+	roles, err := am.Roles()
+	if err != nil {
+		return nil, 0, err
+	}
+	groups, err := am.Groups()
+	if err != nil {
+		return nil, 0, err
+	}
+	model = &rbacModel{roles: roles, groups: groups}
+	for name := range groups {
+		model.groupNames = append(model.groupNames, name)
+	}
+	sort.Strings(model.groupNames)
+
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	// the model is only kept if nothing changed while loading it
+	if am.generation == generation {
+		am.model = model
+	}
+	return model, generation, nil
+}
+
+// watch invalidates the model on each change of the schema.
+func (am *RBACAccessManager) watch(schema string, events chan kvstore.Event, cancel func()) {
+	defer am.wg.Done()
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				logger.WithField("schema", schema).Warn("Watching the roles was interrupted, watching again")
+				// changes may have been lost until watching again
+				events, cancel = am.kvStore.Watch(schema, "")
+			}
+			am.invalidate()
+		case <-am.stopC:
+			cancel()
+			return
+		}
+	}
+}
+
+func (model *rbacModel) explain(accessType AccessType, userID string, path protocol.Path) Explanation {
+	for _, groupName := range model.groupNames {
+		group := model.groups[groupName]
+		if !contains(group.Members, userID) && !contains(group.Members, AnyUser) {
+			continue
+		}
+		for _, roleName := range group.Roles {
+			role, ok := model.roles[roleName]
+			if !ok {
+				continue
+			}
+			patterns := role.Read
+			if accessType == WRITE {
+				patterns = role.Write
+			}
+			if matchUserPathPatterns(patterns, userID, path) {
+				return Explanation{
+					Allowed:   true,
+					Reason:    fmt.Sprintf("allowed by role %s of group %s", roleName, groupName),
+					RuleIndex: -1,
+					Role:      roleName,
+					Group:     groupName,
+				}
+			}
+		}
+	}
+	return Explanation{Allowed: false, Reason: reasonNoRole, RuleIndex: -1}
+}
+
+func validateName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/*") {
+		return ErrInvalidName
+	}
+	return nil
+}
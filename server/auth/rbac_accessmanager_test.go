@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"github.com/smancke/guble/server/kvstore"
+
+	"github.com/stretchr/testify/assert"
+
+	"testing"
+)
+
+func testRoles(t *testing.T, am *RBACAccessManager) {
+	a := assert.New(t)
+	a.NoError(am.PutRole("owner", Role{Read: []string{"/user/{user_id}/*"}, Write: []string{"/user/{user_id}/*"}}))
+	a.NoError(am.PutRole("reader", Role{Read: []string{"/news", "/chat/*"}}))
+	a.NoError(am.PutRole("writer", Role{Write: []string{"/chat/*"}}))
+	a.NoError(am.PutGroup("everyone", Group{Members: []string{AnyUser}, Roles: []string{"owner", "reader"}}))
+	a.NoError(am.PutGroup("editors", Group{Members: []string{"alice"}, Roles: []string{"writer", "missing"}}))
+}
+
+func TestRBACAccessManager_IsAllowed(t *testing.T) {
+	a := assert.New(t)
+	am := NewRBACAccessManager(kvstore.NewMemoryKVStore())
+	testRoles(t, am)
+
+	a.True(am.IsAllowed(READ, "marvin", "/user/marvin/inbox"))
+	a.True(am.IsAllowed(WRITE, "marvin", "/user/marvin/inbox"))
+	a.False(am.IsAllowed(READ, "marvin", "/user/alice/inbox"))
+	a.True(am.IsAllowed(READ, "marvin", "/chat/room1"))
+	a.False(am.IsAllowed(WRITE, "marvin", "/chat/room1"))
+	a.False(am.IsAllowed(READ, "marvin", "/news/sports"))
+	a.True(am.IsAllowed(WRITE, "alice", "/chat/room1"))
+
+	explanation := am.Explain(WRITE, "alice", "/chat/room1")
+	a.True(explanation.Allowed)
+	a.Equal("writer", explanation.Role)
+	a.Equal("editors", explanation.Group)
+	a.Equal("allowed by role writer of group editors", explanation.Reason)
+
+	explanation = am.Explain(WRITE, "marvin", "/chat/room1")
+	a.False(explanation.Allowed)
+	a.Equal("no role grants the access", explanation.Reason)
+}
+
+func TestRBACAccessManager_InvalidatesCache(t *testing.T) {
+	a := assert.New(t)
+	kvStore := kvstore.NewMemoryKVStore()
+	am := NewRBACAccessManager(kvStore)
+	testRoles(t, am)
+
+	a.False(am.IsAllowed(WRITE, "bob", "/chat/room1"))
+	a.Equal(1, len(am.decisions))
+
+	// a change by this manager invalidates the cache immediately
+	a.NoError(am.PutGroup("editors", Group{Members: []string{"alice", "bob"}, Roles: []string{"writer"}}))
+	a.True(am.IsAllowed(WRITE, "bob", "/chat/room1"))
+
+	// a change by another manager (e.g. of another node) is watched
+	a.NoError(am.Start())
+	defer am.Stop()
+	other := NewRBACAccessManager(kvStore)
+	a.NoError(other.DeleteRole("writer"))
+	a.True(waitFor(func() bool { return !am.IsAllowed(WRITE, "bob", "/chat/room1") }))
+
+	a.NoError(other.DeleteGroup("editors"))
+	a.True(waitFor(func() bool {
+		groups, err := am.Groups()
+		return err == nil && len(groups) == 1
+	}))
+}
+
+func TestRBACAccessManager_Management(t *testing.T) {
+	a := assert.New(t)
+	am := NewRBACAccessManager(kvstore.NewMemoryKVStore())
+	testRoles(t, am)
+
+	roles, err := am.Roles()
+	a.NoError(err)
+	a.Equal(3, len(roles))
+	a.Equal([]string{"/news", "/chat/*"}, roles["reader"].Read)
+
+	groups, err := am.Groups()
+	a.NoError(err)
+	a.Equal([]string{"alice"}, groups["editors"].Members)
+
+	a.Equal(ErrInvalidName, am.PutRole("", Role{}))
+	a.Equal(ErrInvalidName, am.PutGroup("a/b", Group{}))
+	a.Equal(ErrEmptyPathPattern, am.PutRole("empty", Role{Write: []string{""}}))
+	a.Equal(ErrRoleNotFound, am.DeleteRole("unknown"))
+	a.Equal(ErrGroupNotFound, am.DeleteGroup("unknown"))
+}
@@ -5,53 +5,286 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 )
 
-// RestAccessManager is a url for which the access is allowed or not.
-type RestAccessManager string
+const (
+	// DefaultRestTimeout is the default timeout of the requests to the auth service.
+	DefaultRestTimeout = 2 * time.Second
+
+	// DefaultFailureThreshold is the default number of consecutive failed requests opening the circuit.
+	DefaultFailureThreshold = 5
+
+	// DefaultOpenTimeout is the default duration for which the circuit stays open, before a request is tried again.
+	DefaultOpenTimeout = 10 * time.Second
+
+	// maxCachedDecisions bounds the size of the decision cache.
+	maxCachedDecisions = 100000
+)
+
+// RestAccessManagerConfig is the configuration of a RestAccessManager.
+type RestAccessManagerConfig struct {
+	// URL of the auth service, called with the query parameters type (read | write), userId and path.
+	URL string
+
+	// Timeout of the requests (default: DefaultRestTimeout).
+	Timeout time.Duration
+
+	// AllowTTL and DenyTTL are the durations for which the allowed and denied decisions are cached.
+	// A decision is not cached if its TTL is zero.
+	AllowTTL time.Duration
+	DenyTTL  time.Duration
+
+	// FailureThreshold is the number of consecutive failed requests opening the circuit (default: DefaultFailureThreshold).
+	FailureThreshold int
+
+	// OpenTimeout is the duration for which the circuit stays open (default: DefaultOpenTimeout).
+	OpenTimeout time.Duration
+
+	// FailOpen allows the access while the auth service fails or the circuit is open. Else the access is denied.
+	FailOpen bool
+}
+
+// RestAccessManager asks an auth service over HTTP if the access is allowed.
+// The service answers with the body "true" (and status 200) if the access is allowed.
+//
+// The decisions are cached, and concurrent checks of the same access share one request.
+// A request failing by a transport error, a timeout or a server error (5xx) counts as a failure of the service.
+// After FailureThreshold consecutive failures the circuit opens: no requests are made for the OpenTimeout,
+// then a single request is tried, closing the circuit if it succeeds.
+// While the service fails, the access is decided by the FailOpen policy, and not cached.
+type RestAccessManager struct {
+	config  RestAccessManagerConfig
+	client  *http.Client
+	breaker *circuitBreaker
+
+	mutex    sync.Mutex
+	cache    map[decisionKey]cachedDecision
+	inFlight map[decisionKey]*decisionCall
+}
+
+type decisionKey struct {
+	accessType AccessType
+	userID     string
+	path       protocol.Path
+}
+
+type cachedDecision struct {
+	allowed bool
+	expires time.Time
+}
+
+// decisionCall is a request in flight, of which the decision is shared with the concurrent checks of the same access.
+type decisionCall struct {
+	done    chan struct{}
+	allowed bool
+}
 
 // NewRestAccessManager returns a new RestAccessManager.
-func NewRestAccessManager(url string) RestAccessManager {
-	return RestAccessManager(url)
+func NewRestAccessManager(config RestAccessManagerConfig) *RestAccessManager {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultRestTimeout
+	}
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = DefaultFailureThreshold
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = DefaultOpenTimeout
+	}
+	return &RestAccessManager{
+		config:   config,
+		client:   &http.Client{Timeout: config.Timeout},
+		breaker:  &circuitBreaker{threshold: config.FailureThreshold, openTimeout: config.OpenTimeout},
+		cache:    make(map[decisionKey]cachedDecision),
+		inFlight: make(map[decisionKey]*decisionCall),
+	}
 }
 
 // IsAllowed is an implementation of the AccessManager interface.
 // The boolean result is based on matching between the desired AccessType, the userId and the path.
-func (ram RestAccessManager) IsAllowed(accessType AccessType, userId string, path protocol.Path) bool {
+func (ram *RestAccessManager) IsAllowed(accessType AccessType, userId string, path protocol.Path) bool {
+	key := decisionKey{accessType, userId, path}
 
-	u, _ := url.Parse(string(ram))
-	q := u.Query()
-	if accessType == READ {
-		q.Set("type", "read")
-	} else {
-		q.Set("type", "write")
+	ram.mutex.Lock()
+	if d, ok := ram.cache[key]; ok {
+		if time.Now().Before(d.expires) {
+			ram.mutex.Unlock()
+			mTotalCacheHits.Add(1)
+			return d.allowed
+		}
+		delete(ram.cache, key)
 	}
+	mTotalCacheMisses.Add(1)
+	if call, ok := ram.inFlight[key]; ok {
+		ram.mutex.Unlock()
+		mTotalCoalescedChecks.Add(1)
+		<-call.done
+		return call.allowed
+	}
+	call := &decisionCall{done: make(chan struct{})}
+	ram.inFlight[key] = call
+	ram.mutex.Unlock()
+
+	allowed, cacheable := ram.decide(key)
+	call.allowed = allowed
+
+	ram.mutex.Lock()
+	delete(ram.inFlight, key)
+	if cacheable {
+		ram.store(key, allowed)
+	}
+	ram.mutex.Unlock()
+	close(call.done)
+	return allowed
+}
 
-	q.Set("userId", userId)
-	q.Set("path", string(path))
+// decide returns the decision of the auth service, and if it can be cached.
+// If the service fails or the circuit is open, the decision of the FailOpen policy is returned.
+func (ram *RestAccessManager) decide(key decisionKey) (allowed bool, cacheable bool) {
+	if !ram.breaker.allow() {
+		mTotalCircuitOpenRejections.Add(1)
+		return ram.config.FailOpen, false
+	}
 
-	resp, err := http.DefaultClient.Get(u.String())
+	start := time.Now()
+	allowed, err := ram.request(key)
+	mTotalRequests.Add(1)
+	mTotalRequestLatencyNanos.Add(time.Since(start).Nanoseconds())
 
 	if err != nil {
-		logger.WithError(err).WithField("module", "RestAccessManager").Warn("Write message failed")
-		return false
+		mTotalRequestErrors.Add(1)
+		if ram.breaker.failure() {
+			logger.WithError(err).WithField("url", ram.config.URL).Error("The auth service is failing, opened the circuit")
+		} else {
+			logger.WithError(err).WithField("url", ram.config.URL).Warn("Error getting permission")
+		}
+		return ram.config.FailOpen, false
+	}
+	ram.breaker.success()
+	return allowed, true
+}
+
+// request asks the auth service for the decision. Only the failures of the service are returned as errors,
+// other responses than "true" with status 200 deny the access.
+func (ram *RestAccessManager) request(key decisionKey) (bool, error) {
+	u, err := url.Parse(ram.config.URL)
+	if err != nil {
+		return false, err
+	}
+	q := u.Query()
+	q.Set("type", key.accessType.String())
+	q.Set("userId", key.userID)
+	q.Set("path", string(key.path))
+	u.RawQuery = q.Encode()
+
+	resp, err := ram.client.Get(u.String())
+	if err != nil {
+		return false, err
 	}
 	defer resp.Body.Close()
 	responseBody, err := ioutil.ReadAll(resp.Body)
-
-	if err != nil || resp.StatusCode != 200 {
-		logger.WithError(err).WithField("httpCode", resp.StatusCode).Info("Error getting permission")
-		logger.WithField("responseBody", responseBody).Debug("HTTP Response Body")
-		return false
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return false, fmt.Errorf("auth: the auth service responded with status %d", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		logger.WithField("httpCode", resp.StatusCode).Info("Error getting permission")
+		logger.WithField("responseBody", string(responseBody)).Debug("HTTP Response Body")
+		return false, nil
 	}
 	logger.WithFields(log.Fields{
-		"access_type":  accessType,
-		"userId":       userId,
-		"path":         path,
+		"access_type":  key.accessType,
+		"userId":       key.userID,
+		"path":         key.path,
 		"responseBody": string(responseBody),
 	}).Debug("Access allowed")
-	return "true" == string(responseBody)
+	return "true" == string(responseBody), nil
+}
+
+// store caches the decision for its TTL. The caller must hold the mutex.
+func (ram *RestAccessManager) store(key decisionKey, allowed bool) {
+	ttl := ram.config.DenyTTL
+	if allowed {
+		ttl = ram.config.AllowTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	if len(ram.cache) >= maxCachedDecisions {
+		for k, d := range ram.cache {
+			if !now.Before(d.expires) {
+				delete(ram.cache, k)
+			}
+		}
+		if len(ram.cache) >= maxCachedDecisions {
+			ram.cache = make(map[decisionKey]cachedDecision)
+		}
+	}
+	ram.cache[key] = cachedDecision{allowed: allowed, expires: now.Add(ttl)}
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker stops the requests to a failing service for a while.
+type circuitBreaker struct {
+	threshold   int
+	openTimeout time.Duration
+
+	mutex    sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+// allow returns true if a request can be made.
+// After the open timeout, only a single trial request is allowed until its result is known.
+func (cb *circuitBreaker) allow() bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		if time.Since(cb.openedAt) < cb.openTimeout {
+			return false
+		}
+		cb.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		return false
+	}
+	return true
+}
+
+func (cb *circuitBreaker) success() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.state = circuitClosed
+	cb.failures = 0
+}
+
+// failure records a failed request, and returns true if it opened the circuit.
+func (cb *circuitBreaker) failure() bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.failures++
+	if cb.state == circuitHalfOpen || cb.failures >= cb.threshold {
+		opened := cb.state != circuitOpen
+		cb.state = circuitOpen
+		cb.openedAt = time.Now()
+		return opened
+	}
+	return false
 }
@@ -0,0 +1,15 @@
+package auth
+
+import (
+	"github.com/smancke/guble/server/metrics"
+)
+
+var (
+	mTotalCacheHits             = metrics.NewInt("auth.rest.total_cache_hits")
+	mTotalCacheMisses           = metrics.NewInt("auth.rest.total_cache_misses")
+	mTotalCoalescedChecks       = metrics.NewInt("auth.rest.total_coalesced_checks")
+	mTotalRequests              = metrics.NewInt("auth.rest.total_requests")
+	mTotalRequestErrors         = metrics.NewInt("auth.rest.total_request_errors")
+	mTotalRequestLatencyNanos   = metrics.NewInt("auth.rest.total_request_latency_nanos")
+	mTotalCircuitOpenRejections = metrics.NewInt("auth.rest.total_circuit_open_rejections")
+)
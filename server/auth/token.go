@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// TokenQueryParam is the query parameter for passing the token, for the clients which can not set headers
+// (e.g. the websocket clients of browsers).
+const TokenQueryParam = "access_token"
+
+// TokenFromRequest returns the token given as `Authorization: Bearer <token>` header, or as query parameter.
+func TokenFromRequest(r *http.Request) string {
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimPrefix(authorization, "Bearer ")
+	}
+	return r.URL.Query().Get(TokenQueryParam)
+}
+
+type contextKey int
+
+const userIDContextKey contextKey = iota
+
+// WithUserID returns a copy of the context with the ID of the user authenticated by the transport
+// (e.g. by a client certificate). An empty user ID is an anonymous user, if the transport identifies the users,
+// but could not authenticate this one (e.g. if the client certificate is optional).
+func WithUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userIDContextKey, userID)
+}
+
+// UserIDFromContext returns the ID of the user authenticated by the transport, or "" if there is none.
+func UserIDFromContext(ctx context.Context) string {
+	userID, _ := ctx.Value(userIDContextKey).(string)
+	return userID
+}
+
+// UserIDFromTransport returns the ID of the user authenticated by the transport, and whether the transport
+// identifies the users. If it does, the user ID must not be taken from the request: it is "" for an anonymous user.
+func UserIDFromTransport(ctx context.Context) (string, bool) {
+	userID, ok := ctx.Value(userIDContextKey).(string)
+	return userID, ok
+}
@@ -18,7 +18,8 @@ const (
 type sender func(c client.Client) error
 
 func sendMessageSample(c client.Client) error {
-	return c.Send(testTopic, "test-body", "{id:id}")
+	_, err := c.Send(testTopic, "test-body", "{id:id}")
+	return err
 }
 
 type benchParams struct {
@@ -36,7 +36,8 @@ func Benchmark_E2E_Fetch_HelloWorld_Messages(b *testing.B) {
 	a.NoError(err)
 
 	for i := 1; i <= b.N; i++ {
-		a.NoError(c.Send("/hello", fmt.Sprintf("Hello %v", i), ""))
+		_, err := c.Send("/hello", fmt.Sprintf("Hello %v", i), "")
+		a.NoError(err)
 		select {
 		case <-c.StatusMessages():
 			// wait for, but ignore
@@ -87,10 +87,10 @@ func Test_Cluster_Integration(t *testing.T) {
 
 	numSent := 3
 	for i := 0; i < numSent; i++ {
-		err := client1.Send("/testTopic/m", "body", "{jsonHeader:1}")
+		_, err := client1.Send("/testTopic/m", "body", "{jsonHeader:1}")
 		a.NoError(err)
 
-		err = client3.Send("/testTopic/m", "body", "{jsonHeader:4}")
+		_, err = client3.Send("/testTopic/m", "body", "{jsonHeader:4}")
 		a.NoError(err)
 	}
 
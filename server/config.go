@@ -10,19 +10,28 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/smancke/guble/server/apns"
+	"github.com/smancke/guble/server/audit"
+	"github.com/smancke/guble/server/auth"
 	"github.com/smancke/guble/server/fcm"
 	"github.com/smancke/guble/server/sms"
+	"github.com/smancke/guble/server/store/filestore"
+	"github.com/smancke/guble/server/store/memorystore"
+	"github.com/smancke/guble/server/store/migration"
 )
 
 const (
 	defaultHttpListen      = ":8080"
 	defaultHealthEndpoint  = "/admin/healthcheck"
 	defaultMetricsEndpoint = "/admin/metrics"
+	defaultAdminPrefix     = "/admin/"
 	defaultKVSBackend      = "file"
 	defaultMSBackend       = "file"
 	defaultStoragePath     = "/var/lib/guble"
+	defaultSyncInterval    = "10ms"
+	defaultArchiveAfter    = "168h"
 	defaultNodePort        = "10000"
 	development            = "dev"
 	integration            = "int"
@@ -31,6 +40,9 @@ const (
 	memProfile             = "mem"
 	cpuProfile             = "cpu"
 	blockProfile           = "block"
+	serveCommand           = "serve"
+	migrateCommand         = "migrate"
+	verifyAuditCommand     = "verify-audit"
 )
 
 var (
@@ -50,6 +62,81 @@ type (
 		Password *string
 		DbName   *string
 	}
+	// RedisConfig is used for configuring the connections to Redis.
+	RedisConfig struct {
+		Addr      *string
+		Password  *string
+		DB        *int
+		MaxIdle   *int
+		MaxActive *int
+		KeyPrefix *string
+	}
+	// MemoryStoreConfig is used for configuring the bounds of the in-memory message store.
+	MemoryStoreConfig struct {
+		MaxMessages *int
+		MaxBytes    *int64
+	}
+	// FileStoreConfig is used for configuring the durability, archival and quotas of the file message store.
+	FileStoreConfig struct {
+		Sync         *string
+		SyncInterval *time.Duration
+		ArchivePath  *string
+		ArchiveAfter *time.Duration
+		Quotas       *[]string
+		QuotaPolicy  *string
+	}
+	// MigrateConfig is used for configuring the target of the migrate command.
+	MigrateConfig struct {
+		To          *string
+		StoragePath *string
+		BatchSize   *int
+	}
+	// EncryptionConfig is used for configuring the keys for the encryption at rest.
+	EncryptionConfig struct {
+		KeyFile *string
+		Keys    *string
+	}
+	// JWTConfig is used for configuring the keys of the JWT authentication.
+	JWTConfig struct {
+		Algorithm *string
+		KeyFile   *string
+		JWKSFile  *string
+	}
+	// RestAuthConfig is used for configuring the access checks by an external auth service.
+	RestAuthConfig struct {
+		URL              *string
+		Timeout          *time.Duration
+		AllowTTL         *time.Duration
+		DenyTTL          *time.Duration
+		FailureThreshold *int
+		OpenTimeout      *time.Duration
+		FailOpen         *bool
+	}
+	// TLSConfig is used for configuring the TLS listener of the HTTP server.
+	TLSConfig struct {
+		CertFile           *string
+		KeyFile            *string
+		ClientCAFile       *string
+		ClientCertOptional *bool
+		ClientCertUserID   *bool
+	}
+	// WebSocketConfig is used for configuring the limits of the websocket connections.
+	WebSocketConfig struct {
+		MaxConnectionsPerUser *int
+		MaxConnectionsPerIP   *int
+		MaxSubscriptions      *int
+		MaxMessageSize        *int64
+		CommandRate           *float64
+		CommandBurst          *int
+		MaxViolations         *int
+	}
+	// AuditConfig is used for configuring the audit log.
+	AuditConfig struct {
+		File        *string
+		MaxFileSize *int64
+		Content     *string
+		Topic       *string
+	}
 	// ClusterConfig is used for configuring the cluster component.
 	ClusterConfig struct {
 		NodeID   *uint8
@@ -61,13 +148,30 @@ type (
 		Log             *string
 		EnvName         *string
 		HttpListen      *string
+		TLS             TLSConfig
+		WS              WebSocketConfig
 		KVS             *string
 		MS              *string
 		StoragePath     *string
 		HealthEndpoint  *string
 		MetricsEndpoint *string
+		AdminAPIKey     *string
+		APIKeys         *string
+		APIKeysFile     *string
+		PublicHealth    *bool
 		Profile         *string
 		Postgres        PostgresConfig
+		Redis           RedisConfig
+		MemoryStore     MemoryStoreConfig
+		FileStore       FileStoreConfig
+		Encryption      EncryptionConfig
+		JWT             JWTConfig
+		ACLFile         *string
+		RestAuth        RestAuthConfig
+		RBAC            *bool
+		AccessChain     *string
+		Audit           AuditConfig
+		Migrate         MigrateConfig
 		FCM             fcm.Config
 		APNS            apns.Config
 		SMS             sms.Config
@@ -78,6 +182,13 @@ type (
 var (
 	parsed = false
 
+	// command is the command selected on the command line
+	command string
+
+	serveCmd       = kingpin.Command(serveCommand, "Start the guble server").Default()
+	migrateCmd     = kingpin.Command(migrateCommand, "Copy all the messages from the message store selected by --ms to another message store")
+	verifyAuditCmd = kingpin.Command(verifyAuditCommand, "Verify the hash chain of the audit log selected by --audit-file")
+
 	// Config is the active configuration of guble (used when starting-up the server)
 	Config = &GubleConfig{
 		Log: kingpin.Flag("log", "Log level").
@@ -92,16 +203,58 @@ var (
 			Default(defaultHttpListen).
 			Envar("GUBLE_HTTP_LISTEN").
 			String(),
-		KVS: kingpin.Flag("kvs", "The storage backend for the key-value store to use : file | memory | postgres ").
+		TLS: TLSConfig{
+			CertFile: kingpin.Flag("tls-cert-file", "The PEM encoded TLS certificate (chain) of the HTTP server. Enables TLS, together with the key file").
+				Envar("GUBLE_TLS_CERT_FILE").
+				String(),
+			KeyFile: kingpin.Flag("tls-key-file", "The PEM encoded private key of the TLS certificate").
+				Envar("GUBLE_TLS_KEY_FILE").
+				String(),
+			ClientCAFile: kingpin.Flag("tls-client-ca-file", "The PEM encoded certificates of the CAs verifying the client certificates. Enables mutual TLS").
+				Envar("GUBLE_TLS_CLIENT_CA_FILE").
+				String(),
+			ClientCertOptional: kingpin.Flag("tls-client-cert-optional", "Accept the TLS connections without a client certificate").
+				Envar("GUBLE_TLS_CLIENT_CERT_OPTIONAL").
+				Bool(),
+			ClientCertUserID: kingpin.Flag("tls-client-cert-user-id", "Identify the users by the common name of their client certificates").
+				Envar("GUBLE_TLS_CLIENT_CERT_USER_ID").
+				Bool(),
+		},
+		WS: WebSocketConfig{
+			MaxConnectionsPerUser: kingpin.Flag("ws-max-connections-per-user", "The maximum number of websocket connections of a user (0: unlimited)").
+				Envar("GUBLE_WS_MAX_CONNECTIONS_PER_USER").
+				Int(),
+			MaxConnectionsPerIP: kingpin.Flag("ws-max-connections-per-ip", "The maximum number of websocket connections from an IP address (0: unlimited)").
+				Envar("GUBLE_WS_MAX_CONNECTIONS_PER_IP").
+				Int(),
+			MaxSubscriptions: kingpin.Flag("ws-max-subscriptions", "The maximum number of subscriptions of a websocket connection (0: unlimited)").
+				Envar("GUBLE_WS_MAX_SUBSCRIPTIONS").
+				Int(),
+			MaxMessageSize: kingpin.Flag("ws-max-message-size", "The maximum size in bytes of a command sent over a websocket connection (0: unlimited)").
+				Envar("GUBLE_WS_MAX_MESSAGE_SIZE").
+				Int64(),
+			CommandRate: kingpin.Flag("ws-command-rate", "The maximum average number of commands per second of a websocket connection (0: unlimited)").
+				Envar("GUBLE_WS_COMMAND_RATE").
+				Float64(),
+			CommandBurst: kingpin.Flag("ws-command-burst", "The number of commands a websocket connection can send at once, above the command rate").
+				Default("10").
+				Envar("GUBLE_WS_COMMAND_BURST").
+				Int(),
+			MaxViolations: kingpin.Flag("ws-max-violations", "The number of violated limits after which a websocket connection is closed (0: never closed)").
+				Default("10").
+				Envar("GUBLE_WS_MAX_VIOLATIONS").
+				Int(),
+		},
+		KVS: kingpin.Flag("kvs", "The storage backend for the key-value store to use : file | bolt | memory | postgres | redis ").
 			Default(defaultKVSBackend).
 			Envar("GUBLE_KVS").
 			String(),
-		MS: kingpin.Flag("ms", "The message storage backend : file | memory").
+		MS: kingpin.Flag("ms", "The message storage backend : file | memory | sqlite | postgres").
 			Default(defaultMSBackend).
-			HintOptions("file", "memory").
+			HintOptions("file", "memory", "sqlite", "postgres").
 			Envar("GUBLE_MS").
 			String(),
-		StoragePath: kingpin.Flag("storage-path", "The path for storing messages and key-value data if 'file' is selected").
+		StoragePath: kingpin.Flag("storage-path", "The path for storing messages and key-value data if 'file' (or 'bolt' for the key-value store) is selected").
 			Default(defaultStoragePath).
 			Envar("GUBLE_STORAGE_PATH").
 			ExistingDir(),
@@ -113,6 +266,19 @@ var (
 			Default(defaultMetricsEndpoint).
 			Envar("GUBLE_METRICS_ENDPOINT").
 			String(),
+		AdminAPIKey: kingpin.Flag("admin-api-key", `An API key with the admin scope, in addition to the API keys (the admin API is disabled without API keys)`).
+			Default("").
+			Envar("GUBLE_ADMIN_API_KEY").
+			String(),
+		APIKeys: kingpin.Flag("api-keys", `The API keys protecting the health, metrics, router, connector and admin endpoints, if no key file is given (format: comma separated "<scope>:<key>", scopes: admin | connector-write | read-only)`).
+			Envar("GUBLE_API_KEYS").
+			String(),
+		APIKeysFile: kingpin.Flag("api-keys-file", `The file with the API keys protecting the health, metrics, router, connector and admin endpoints (format: one "<scope>:<key>" per line)`).
+			Envar("GUBLE_API_KEYS_FILE").
+			String(),
+		PublicHealth: kingpin.Flag("health-endpoint-public", "Serve the health endpoint without an API key, if API keys are configured").
+			Envar("GUBLE_HEALTH_ENDPOINT_PUBLIC").
+			Bool(),
 		Profile: kingpin.Flag("profile", `The profiler to be used (default: none): mem | cpu | block`).
 			Default("").
 			Envar("GUBLE_PROFILE").
@@ -139,6 +305,149 @@ var (
 				Envar("GUBLE_PG_DBNAME").
 				String(),
 		},
+		Redis: RedisConfig{
+			Addr: kingpin.Flag("redis-addr", "The Redis server address (format: host:port)").
+				Default("localhost:6379").
+				Envar("GUBLE_REDIS_ADDR").
+				String(),
+			Password: kingpin.Flag("redis-password", "The Redis password").
+				Default("").
+				Envar("GUBLE_REDIS_PASSWORD").
+				String(),
+			DB: kingpin.Flag("redis-db", "The Redis database number").
+				Default("0").
+				Envar("GUBLE_REDIS_DB").
+				Int(),
+			MaxIdle: kingpin.Flag("redis-max-idle", "The maximum number of idle connections to Redis").
+				Default("10").
+				Envar("GUBLE_REDIS_MAX_IDLE").
+				Int(),
+			MaxActive: kingpin.Flag("redis-max-active", "The maximum number of connections to Redis (0: unlimited)").
+				Default("0").
+				Envar("GUBLE_REDIS_MAX_ACTIVE").
+				Int(),
+			KeyPrefix: kingpin.Flag("redis-key-prefix", "The prefix of the keys and of the notification channel in Redis").
+				Default("guble").
+				Envar("GUBLE_REDIS_KEY_PREFIX").
+				String(),
+		},
+		MemoryStore: MemoryStoreConfig{
+			MaxMessages: kingpin.Flag("ms-memory-max-messages", "(memory message store) The maximum number of messages kept per partition").
+				Default(strconv.Itoa(memorystore.DefaultMaxMessages)).
+				Envar("GUBLE_MS_MEMORY_MAX_MESSAGES").
+				Int(),
+			MaxBytes: kingpin.Flag("ms-memory-max-bytes", "(memory message store) The maximum number of bytes kept per partition").
+				Default(strconv.Itoa(memorystore.DefaultMaxBytes)).
+				Envar("GUBLE_MS_MEMORY_MAX_BYTES").
+				Int64(),
+		},
+		FileStore: FileStoreConfig{
+			Sync: kingpin.Flag("ms-sync", "(file message store) When the stored messages are synced to disk before a publish is acknowledged : none | interval | always").
+				Default(string(filestore.SyncNone)).
+				Envar("GUBLE_MS_SYNC").
+				Enum(string(filestore.SyncNone), string(filestore.SyncInterval), string(filestore.SyncAlways)),
+			SyncInterval: kingpin.Flag("ms-sync-interval", "(file message store) The interval between the syncs, if 'interval' is selected").
+				Default(defaultSyncInterval).
+				Envar("GUBLE_MS_SYNC_INTERVAL").
+				Duration(),
+			ArchivePath: kingpin.Flag("ms-archive-path", "(file message store) The directory to which old message files are moved. Archival is disabled if empty").
+				Envar("GUBLE_MS_ARCHIVE_PATH").
+				String(),
+			ArchiveAfter: kingpin.Flag("ms-archive-after", "(file message store) The duration after the last write to a message file, before it is archived").
+				Default(defaultArchiveAfter).
+				Envar("GUBLE_MS_ARCHIVE_AFTER").
+				Duration(),
+			Quotas: kingpin.Flag("ms-quota", `(file message store) A storage quota for a partition, or for each partition with a prefix ending with "*" (format: "<partition>[*]:<max bytes>:<max messages>", 0 is unlimited). Can be repeated`).
+				Envar("GUBLE_MS_QUOTA").
+				Strings(),
+			QuotaPolicy: kingpin.Flag("ms-quota-policy", "(file message store) What happens when a quota is reached: reject | evict").
+				Default(string(filestore.QuotaReject)).
+				Envar("GUBLE_MS_QUOTA_POLICY").
+				Enum(string(filestore.QuotaReject), string(filestore.QuotaEvict)),
+		},
+		Encryption: EncryptionConfig{
+			KeyFile: kingpin.Flag("encryption-key-file", `The file with the keys for encrypting the stored messages (file message store) and key-value data (format: one "<id>:<hex encoded AES key>" per line)`).
+				Envar("GUBLE_ENCRYPTION_KEY_FILE").
+				String(),
+			Keys: kingpin.Flag("encryption-keys", `The keys for encrypting the stored messages (file message store) and key-value data, if no key file is given (format: comma separated "<id>:<hex encoded AES key>")`).
+				Envar("GUBLE_ENCRYPTION_KEYS").
+				String(),
+		},
+		JWT: JWTConfig{
+			Algorithm: kingpin.Flag("jwt-algorithm", "The signing algorithm of the JWTs: HS256 | RS256").
+				Default(auth.HS256).
+				Envar("GUBLE_JWT_ALGORITHM").
+				Enum(auth.HS256, auth.RS256),
+			KeyFile: kingpin.Flag("jwt-key-file", "The file with the shared secret (HS256) or the PEM encoded public key (RS256) verifying the JWTs. Enables the JWT authentication").
+				Envar("GUBLE_JWT_KEY_FILE").
+				String(),
+			JWKSFile: kingpin.Flag("jwt-jwks-file", "The file with a JSON Web Key Set verifying the JWTs, selected by their key ID. Enables the JWT authentication").
+				Envar("GUBLE_JWT_JWKS_FILE").
+				String(),
+		},
+		ACLFile: kingpin.Flag("acl-file", "The YAML or JSON file with the access control rules, which is reloaded when it changes. Enables the ACL access manager").
+			Envar("GUBLE_ACL_FILE").
+			String(),
+		RestAuth: RestAuthConfig{
+			URL: kingpin.Flag("auth-url", "The URL of the auth service deciding if the access is allowed. Enables the REST access manager").
+				Envar("GUBLE_AUTH_URL").
+				String(),
+			Timeout: kingpin.Flag("auth-timeout", "The timeout of the requests to the auth service").
+				Default(auth.DefaultRestTimeout.String()).
+				Envar("GUBLE_AUTH_TIMEOUT").
+				Duration(),
+			AllowTTL: kingpin.Flag("auth-allow-ttl", "The duration for which an allowed access is cached (0 disables the caching)").
+				Default("0s").
+				Envar("GUBLE_AUTH_ALLOW_TTL").
+				Duration(),
+			DenyTTL: kingpin.Flag("auth-deny-ttl", "The duration for which a denied access is cached (0 disables the caching)").
+				Default("0s").
+				Envar("GUBLE_AUTH_DENY_TTL").
+				Duration(),
+			FailureThreshold: kingpin.Flag("auth-failure-threshold", "The number of consecutive failed requests to the auth service opening the circuit").
+				Default(strconv.Itoa(auth.DefaultFailureThreshold)).
+				Envar("GUBLE_AUTH_FAILURE_THRESHOLD").
+				Int(),
+			OpenTimeout: kingpin.Flag("auth-open-timeout", "The duration for which no requests are made to the auth service, after the circuit opened").
+				Default(auth.DefaultOpenTimeout.String()).
+				Envar("GUBLE_AUTH_OPEN_TIMEOUT").
+				Duration(),
+			FailOpen: kingpin.Flag("auth-fail-open", "Allow the access while the auth service fails (default: deny)").
+				Envar("GUBLE_AUTH_FAIL_OPEN").
+				Bool(),
+		},
+		RBAC: kingpin.Flag("rbac", "Decide the access by the roles of the groups of the users, managed by the admin API and stored in the key-value store").
+			Envar("GUBLE_RBAC").
+			Bool(),
+		AccessChain: kingpin.Flag("access-chain", `The chain of access managers deciding on an access, e.g. "all(jwt, any(acl, rbac))" (modes: all | any | first, access managers: jwt | acl | rest | rbac | allow | deny)`).
+			Envar("GUBLE_ACCESS_CHAIN").
+			String(),
+		Audit: AuditConfig{
+			File: kingpin.Flag("audit-file", "The file of the audit log of the publishes, subscriptions and administrative actions. Enables the audit log").
+				Envar("GUBLE_AUDIT_FILE").
+				String(),
+			MaxFileSize: kingpin.Flag("audit-max-file-size", "The size in bytes above which the audit log file is rotated").
+				Default(strconv.Itoa(audit.DefaultMaxFileSize)).
+				Envar("GUBLE_AUDIT_MAX_FILE_SIZE").
+				Int64(),
+			Content: kingpin.Flag("audit-content", "The content of the audit log for the published messages: metadata | digest (metadata and SHA-256 digest of the body)").
+				Default(string(audit.ContentMetadata)).
+				Envar("GUBLE_AUDIT_CONTENT").
+				Enum(string(audit.ContentMetadata), string(audit.ContentDigest)),
+			Topic: kingpin.Flag("audit-topic", "The topic to which the audit events are published as well").
+				Envar("GUBLE_AUDIT_TOPIC").
+				String(),
+		},
+		Migrate: MigrateConfig{
+			To: migrateCmd.Flag("to", "The target message storage backend : file | sqlite | postgres").
+				Required().
+				Enum(fileOption, sqliteOption, "postgres"),
+			StoragePath: migrateCmd.Flag("to-storage-path", "The path of the target message store if 'file' or 'sqlite' is selected (default: the storage path)").
+				String(),
+			BatchSize: migrateCmd.Flag("batch-size", "The number of messages fetched from the source message store at once").
+				Default(strconv.Itoa(migration.DefaultBatchSize)).
+				Int(),
+		},
 		FCM: fcm.Config{
 			Enabled: kingpin.Flag("fcm", "Enable the Google Firebase Cloud Messaging connector").
 				Envar("GUBLE_FCM").
@@ -235,7 +544,7 @@ func parseConfig() {
 	if parsed {
 		return
 	}
-	kingpin.Parse()
+	command = kingpin.Parse()
 	parsed = true
 	return
 }
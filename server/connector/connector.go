@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -12,18 +13,30 @@ import (
 	"github.com/gorilla/mux"
 
 	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/audit"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/kvstore"
 	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/server/scope"
 	"github.com/smancke/guble/server/service"
 )
 
 const (
 	DefaultWorkers = 1
 	SubstitutePath = "/substitute/"
+
+	// MaxListLimit is the maximum number of subscriptions in a page of the list.
+	MaxListLimit = 1000
+
+	// NextCursorHeader contains the cursor of the next page of the list, if there is one.
+	NextCursorHeader = "X-Next-Cursor"
 )
 
 var (
 	TopicParam     = "topic"
 	ConnectorParam = "connector"
+	LimitParam     = "limit"
+	CursorParam    = "cursor"
 )
 
 type Sender interface {
@@ -57,7 +70,7 @@ type Runner interface {
 type Connector interface {
 	service.Startable
 	service.Stopable
-	service.Endpoint
+	service.ScopedEndpoint
 	SenderSetter
 	ResponseHandlerSetter
 	Runner
@@ -142,25 +155,55 @@ func (c *connector) GetPrefix() string {
 	return c.config.Prefix
 }
 
-// GetList returns list of subscribers
+// RequiredScope returns the scope of the API key required by the request:
+// the listings require scope.ReadOnly, and the changes of the registrations scope.ConnectorWrite.
+// It is a part of the service.ScopedEndpoint implementation.
+func (c *connector) RequiredScope(req *http.Request) scope.Scope {
+	return scope.ReadOnlyOr(scope.ConnectorWrite)(req)
+}
+
+// GetList returns list of subscribers.
+// If a limit is given, the list is paginated: the filters are optional, and the cursor of the next page
+// is returned in the NextCursorHeader, to be passed as the cursor parameter.
 func (c *connector) GetList(w http.ResponseWriter, req *http.Request) {
 	query := req.URL.Query()
 	filters := make(map[string]string, len(query))
 
 	for key, value := range query {
-		if len(value) == 0 {
+		if len(value) == 0 || key == LimitParam || key == CursorParam {
 			continue
 		}
 		filters[key] = value[0]
 	}
 
 	c.logger.WithField("filters", filters).Info("Get list of subscriptions")
-	if len(filters) == 0 {
-		http.Error(w, `{"error":"Missing filters"}`, http.StatusBadRequest)
-		return
+	var subscribers []Subscriber
+	if query.Get(LimitParam) != "" {
+		limit, err := strconv.Atoi(query.Get(LimitParam))
+		if err != nil || limit <= 0 || limit > MaxListLimit {
+			http.Error(w, fmt.Sprintf(`{"error":"limit must be between 1 and %d"}`, MaxListLimit), http.StatusBadRequest)
+			return
+		}
+		var next string
+		subscribers, next, err = c.manager.Page(req.Context(), filters, query.Get(CursorParam), limit)
+		if err == kvstore.ErrInvalidCursor {
+			http.Error(w, `{"error":"invalid cursor"}`, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":"unknown error: %s"}`, err.Error()), http.StatusInternalServerError)
+			return
+		}
+		if next != "" {
+			w.Header().Set(NextCursorHeader, next)
+		}
+	} else {
+		if len(filters) == 0 {
+			http.Error(w, `{"error":"Missing filters"}`, http.StatusBadRequest)
+			return
+		}
+		subscribers = c.manager.Filter(filters)
 	}
 
-	subscribers := c.manager.Filter(filters)
 	topics := make([]string, 0, len(subscribers))
 	for _, s := range subscribers {
 		topics = append(topics, s.Route().Path.RemovePrefixSlash())
@@ -188,6 +231,7 @@ func (c *connector) Post(w http.ResponseWriter, req *http.Request) {
 	params[ConnectorParam] = c.config.Name
 	c.logger.WithField("params", params).WithField("topic", topic).Info("Creating subscription")
 	subscriber, err := c.manager.Create(protocol.Path("/"+topic), params)
+	c.auditRequest(req, audit.ActionConnectorSubscribe, topic, params, nil, err)
 	if err != nil {
 		if err == ErrSubscriberExists {
 			fmt.Fprintf(w, `{"error":"subscription already exists"}`)
@@ -215,11 +259,13 @@ func (c *connector) Delete(w http.ResponseWriter, req *http.Request) {
 	c.logger.WithField("params", params).WithField("topic", topic).Info("Finding subscription to delete it")
 	subscriber := c.manager.Find(GenerateKey("/"+topic, params))
 	if subscriber == nil {
+		c.auditRequest(req, audit.ActionConnectorUnsubscribe, topic, params, nil, ErrSubscriberDoesNotExist)
 		http.Error(w, `{"error":"subscription not found"}`, http.StatusNotFound)
 		return
 	}
 	c.logger.WithField("params", params).WithField("topic", topic).Info("Deleting subscription")
 	err := c.manager.Remove(subscriber)
+	c.auditRequest(req, audit.ActionConnectorUnsubscribe, topic, params, nil, err)
 	if err != nil {
 		http.Error(w, fmt.Sprintf(`{"error":"unknown error: %s"}`, err.Error()), http.StatusInternalServerError)
 		return
@@ -242,19 +288,53 @@ func (c *connector) Substitute(w http.ResponseWriter, req *http.Request) {
 	filters := map[string]string{}
 	filters[s.FieldName] = s.OldValue
 	subscribers := c.manager.Filter(filters)
-	totalSubscribersUpdated := 0
+	// all the subscribers are substituted, or none
+	substituted, err := s.copies(subscribers)
+	if err == nil {
+		err = c.manager.UpdateAll(substituted)
+	}
+	c.auditRequest(req, audit.ActionConnectorSubstitute, "", nil, map[string]interface{}{
+		"field":    s.FieldName,
+		"modified": len(subscribers),
+	}, err)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	// the running subscribers are changed only after the substitution was stored
 	for _, sub := range subscribers {
 		sub.Route().Set(s.FieldName, s.NewValue)
-		err = c.manager.Update(sub)
-		if err != nil {
-			http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusInternalServerError)
-			return
-		}
-		totalSubscribersUpdated++
 	}
 
 	c.logger.WithField("subscribers", subscribers).WithField("req", s).Info("Substituted subscriber info ")
-	fmt.Fprintf(w, `{"modified":"%d"}`, totalSubscribersUpdated)
+	fmt.Fprintf(w, `{"modified":"%d"}`, len(subscribers))
+}
+
+// auditRequest records the change of the subscriptions by the request, if the audit is enabled.
+// Only the user of the subscription is recorded from the parameters, since the others can be credentials,
+// like device tokens.
+func (c *connector) auditRequest(req *http.Request, action, topic string, params map[string]string, details map[string]interface{}, err error) {
+	if !audit.Enabled() {
+		return
+	}
+	if details == nil {
+		details = make(map[string]interface{})
+	}
+	details[ConnectorParam] = c.config.Name
+	if userID := params["user_id"]; userID != "" {
+		details["subscriber"] = userID
+	}
+	e := &audit.Event{
+		Action:     action,
+		UserID:     auth.UserIDFromContext(req.Context()),
+		RemoteAddr: req.RemoteAddr,
+		Details:    details,
+		Result:     audit.Result(err),
+	}
+	if topic != "" {
+		e.Path = protocol.Path("/" + topic)
+	}
+	audit.Record(e)
 }
 
 // Start will run start all current subscriptions and workers to process the messages
@@ -275,6 +355,9 @@ func (c *connector) Start() error {
 		go c.Run(s)
 	}
 
+	// keep the subscriptions in sync with the changes by other cluster nodes
+	c.manager.Watch(c.ctx, c)
+
 	c.logger.Info("Started connector")
 	return nil
 }
@@ -1,6 +1,7 @@
 package connector
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -10,6 +11,8 @@ import (
 
 	"github.com/golang/mock/gomock"
 	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/audit"
+	"github.com/smancke/guble/server/kvstore"
 	"github.com/smancke/guble/server/router"
 	"github.com/smancke/guble/testutil"
 	"github.com/stretchr/testify/assert"
@@ -39,6 +42,7 @@ func TestConnector_PostSubscription(t *testing.T) {
 	}, true, false)
 
 	mocks.manager.EXPECT().Load().Return(nil)
+	mocks.manager.EXPECT().Watch(gomock.Any(), gomock.Any())
 	mocks.manager.EXPECT().List().Return(make([]Subscriber, 0))
 	err := conn.Start()
 	a.NoError(err)
@@ -85,13 +89,14 @@ func TestConnector_PostSubscriptionNoMocks(t *testing.T) {
 
 	entriesC := make(chan [2]string)
 	mocks.kvstore.EXPECT().Iterate(gomock.Eq("schema"), gomock.Eq("")).Return(entriesC)
+	mocks.kvstore.EXPECT().Watch(gomock.Eq("schema"), gomock.Eq("")).Return(make(chan kvstore.Event), func() {})
 	close(entriesC)
 
-	mocks.kvstore.EXPECT().Put(gomock.Eq("schema"), gomock.Eq(GenerateKey("/topic1", map[string]string{
+	mocks.kvstore.EXPECT().CompareAndSwap(gomock.Eq("schema"), gomock.Eq(GenerateKey("/topic1", map[string]string{
 		"device_token": "device1",
 		"user_id":      "user1",
 		"connector":    "name",
-	})), gomock.Any())
+	})), gomock.Nil(), gomock.Any()).Return(true, nil)
 
 	mocks.router.EXPECT().Subscribe(gomock.Any())
 
@@ -135,6 +140,52 @@ func TestConnector_DeleteSubscription(t *testing.T) {
 	time.Sleep(200 * time.Millisecond)
 }
 
+type testAuditRecorder struct {
+	events []*audit.Event
+}
+
+func (r *testAuditRecorder) Record(e *audit.Event) {
+	r.events = append(r.events, e)
+}
+
+func TestConnector_AuditDeleteSubscription(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+	auditRecorder := &testAuditRecorder{}
+	audit.SetRecorder(auditRecorder)
+	defer audit.SetRecorder(nil)
+
+	conn, mocks := getTestConnector(t, Config{
+		Name:       "name",
+		Schema:     "schema",
+		Prefix:     "/connector/",
+		URLPattern: "/{device_token}/{user_id}/{topic:.*}",
+	}, true, false)
+
+	subscriber := NewMockSubscriber(testutil.MockCtrl)
+	mocks.manager.EXPECT().Find(gomock.Any()).Return(subscriber)
+	mocks.manager.EXPECT().Remove(subscriber).Return(nil)
+	mocks.manager.EXPECT().Find(gomock.Any()).Return(nil)
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodDelete, "/connector/device1/user1/topic1", strings.NewReader(""))
+		a.NoError(err)
+		req.RemoteAddr = "10.0.0.1:1234"
+		conn.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	a.Equal(2, len(auditRecorder.events))
+	e := auditRecorder.events[0]
+	a.Equal(audit.ActionConnectorUnsubscribe, e.Action)
+	a.Equal(protocol.Path("/topic1"), e.Path)
+	a.Equal("10.0.0.1:1234", e.RemoteAddr)
+	a.Equal(map[string]interface{}{"connector": "name", "subscriber": "user1"}, e.Details, "the device token is not recorded")
+	a.Equal(audit.ResultOK, e.Result)
+	a.Equal(ErrSubscriberDoesNotExist.Error(), auditRecorder.events[1].Result)
+}
+
 func TestConnector_GetList_And_Getters(t *testing.T) {
 	_, finish := testutil.NewMockCtrl(t)
 	defer finish()
@@ -190,6 +241,65 @@ func TestConnector_GetListWithFilters(t *testing.T) {
 	conn.ServeHTTP(recorder, req)
 }
 
+func TestConnector_GetListPaginated(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+
+	recorder := httptest.NewRecorder()
+	conn, mocks := getTestConnector(t, Config{
+		Name:       "test",
+		Schema:     "test",
+		Prefix:     "/connector/",
+		URLPattern: "/{device_token}/{user_id}/{topic:.*}",
+	}, true, false)
+
+	mocks.manager.EXPECT().Page(gomock.Any(), gomock.Eq(map[string]string{
+		"filter1": "value1",
+	}), gomock.Eq("cursor1"), gomock.Eq(2)).Return([]Subscriber{
+		NewSubscriber(protocol.Path("/topic1"), router.RouteParams{"filter1": "value1"}, 0),
+		NewSubscriber(protocol.Path("/topic2"), router.RouteParams{"filter1": "value1"}, 0),
+	}, "cursor2", nil)
+
+	req, err := http.NewRequest(
+		http.MethodGet,
+		"/connector/?filter1=value1&limit=2&cursor=cursor1",
+		strings.NewReader(""))
+	a.NoError(err)
+
+	conn.ServeHTTP(recorder, req)
+	a.Equal(http.StatusOK, recorder.Code)
+	a.JSONEq(`["topic1","topic2"]`, recorder.Body.String())
+	a.Equal("cursor2", recorder.Header().Get(NextCursorHeader))
+}
+
+func TestConnector_GetListPaginatedInvalidParameters(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+
+	conn, mocks := getTestConnector(t, Config{
+		Name:       "test",
+		Schema:     "test",
+		Prefix:     "/connector/",
+		URLPattern: "/{device_token}/{user_id}/{topic:.*}",
+	}, true, false)
+
+	mocks.manager.EXPECT().Page(gomock.Any(), gomock.Eq(map[string]string{}), gomock.Eq("invalid"), gomock.Eq(10)).
+		Return(nil, "", kvstore.ErrInvalidCursor)
+
+	for _, query := range []string{"limit=0", "limit=abc", "limit=1001", "limit=10&cursor=invalid"} {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/connector/?"+query, strings.NewReader(""))
+		a.NoError(err)
+
+		conn.ServeHTTP(recorder, req)
+		a.Equal(http.StatusBadRequest, recorder.Code, query)
+	}
+}
+
 func TestConnector_StartWithSubscriptions(t *testing.T) {
 	_, finish := testutil.NewMockCtrl(t)
 	defer finish()
@@ -204,8 +314,9 @@ func TestConnector_StartWithSubscriptions(t *testing.T) {
 
 	entriesC := make(chan [2]string)
 	mocks.kvstore.EXPECT().Iterate(gomock.Eq("test"), gomock.Eq("")).Return(entriesC)
+	mocks.kvstore.EXPECT().Watch(gomock.Eq("test"), gomock.Eq("")).Return(make(chan kvstore.Event), func() {})
 	close(entriesC)
-	mocks.kvstore.EXPECT().Put(gomock.Any(), gomock.Any(), gomock.Any()).Times(4)
+	mocks.kvstore.EXPECT().CompareAndSwap(gomock.Any(), gomock.Any(), gomock.Nil(), gomock.Any()).Return(true, nil).Times(4)
 
 	err := conn.Start()
 	a.NoError(err)
@@ -251,8 +362,9 @@ func TestConnector_Substitute(t *testing.T) {
 
 	entriesC := make(chan [2]string)
 	mocks.kvstore.EXPECT().Iterate(gomock.Eq("test"), gomock.Eq("")).Return(entriesC)
+	mocks.kvstore.EXPECT().Watch(gomock.Eq("test"), gomock.Eq("")).Return(make(chan kvstore.Event), func() {})
 	close(entriesC)
-	mocks.kvstore.EXPECT().Put(gomock.Any(), gomock.Any(), gomock.Any()).Times(4)
+	mocks.kvstore.EXPECT().CompareAndSwap(gomock.Any(), gomock.Any(), gomock.Nil(), gomock.Any()).Return(true, nil).Times(4)
 
 	err := conn.Start()
 	a.NoError(err)
@@ -273,13 +385,32 @@ func TestConnector_Substitute(t *testing.T) {
 			"new_value":"asgasgasgagasgaasg2"
 			}
 	`
-	mocks.kvstore.EXPECT().Put(gomock.Any(), gomock.Any(), gomock.Any()).Times(1)
+	substituted := func() []Subscriber {
+		return conn.Manager().Filter(map[string]string{"device_token": "asgasgasgagasgaasg2"})
+	}
+
+	// the subscribers are not changed, if the substitution is not stored
+	mocks.kvstore.EXPECT().Batch(gomock.Any()).Return(errors.New("batch failed"))
 	recorder := httptest.NewRecorder()
 	req, err := http.NewRequest(http.MethodPost, "/connector"+SubstitutePath, strings.NewReader(postBody))
 	conn.ServeHTTP(recorder, req)
 
+	a.Equal(http.StatusInternalServerError, recorder.Code)
+	a.Equal(0, len(substituted()))
+
+	mocks.kvstore.EXPECT().Batch(gomock.Any()).Do(func(operations []kvstore.Operation) {
+		a.Equal(1, len(operations))
+		a.True(operations[0].Compare)
+		a.NotNil(operations[0].OldValue)
+		a.Contains(string(operations[0].Value), "asgasgasgagasgaasg2")
+	}).Return(nil)
+	recorder = httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodPost, "/connector"+SubstitutePath, strings.NewReader(postBody))
+	conn.ServeHTTP(recorder, req)
+
 	a.Equal(http.StatusOK, recorder.Code)
 	a.Equal(`{"modified":"1"}`, recorder.Body.String())
+	a.Equal(1, len(substituted()))
 }
 
 func TestConnector_SubstituteWrongPostBody(t *testing.T) {
@@ -296,8 +427,9 @@ func TestConnector_SubstituteWrongPostBody(t *testing.T) {
 
 	entriesC := make(chan [2]string)
 	mocks.kvstore.EXPECT().Iterate(gomock.Eq("test"), gomock.Eq("")).Return(entriesC)
+	mocks.kvstore.EXPECT().Watch(gomock.Eq("test"), gomock.Eq("")).Return(make(chan kvstore.Event), func() {})
 	close(entriesC)
-	mocks.kvstore.EXPECT().Put(gomock.Any(), gomock.Any(), gomock.Any()).Times(4)
+	mocks.kvstore.EXPECT().CompareAndSwap(gomock.Any(), gomock.Any(), gomock.Nil(), gomock.Any()).Return(true, nil).Times(4)
 
 	err := conn.Start()
 	a.NoError(err)
@@ -352,6 +484,7 @@ func TestConnector_StartAndStopWithoutSubscribers(t *testing.T) {
 		URLPattern: "/{device_token}/{user_id}/{topic:.*}",
 	}, true, true)
 	mocks.manager.EXPECT().Load().Return(nil)
+	mocks.manager.EXPECT().Watch(gomock.Any(), gomock.Any())
 	mocks.manager.EXPECT().List().Return(nil)
 	mocks.queue.EXPECT().Start().Return(nil)
 	mocks.queue.EXPECT().Stop().Return(nil)
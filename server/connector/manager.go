@@ -1,6 +1,9 @@
 package connector
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"sync"
 
 	"github.com/smancke/guble/protocol"
@@ -12,12 +15,15 @@ type Manager interface {
 	Load() error
 	List() []Subscriber
 	Filter(map[string]string) []Subscriber
+	Page(ctx context.Context, filters map[string]string, cursor string, limit int) ([]Subscriber, string, error)
 	Find(string) Subscriber
 	Exists(string) bool
 	Create(protocol.Path, router.RouteParams) (Subscriber, error)
 	Add(Subscriber) error
 	Update(Subscriber) error
+	UpdateAll([]Subscriber) error
 	Remove(Subscriber) error
+	Watch(context.Context, Runner)
 }
 
 type manager struct {
@@ -25,6 +31,22 @@ type manager struct {
 	schema      string
 	kvstore     kvstore.KVStore
 	subscribers map[string]Subscriber
+
+	// stored contains the last stored data of each subscriber.
+	// A subscriber is updated in the kvstore only if it still has this data,
+	// so that changes by other workers or cluster nodes are not overwritten.
+	stored map[string][]byte
+
+	// storeMutex serializes the changes of the kvstore by this manager.
+	storeMutex sync.Mutex
+
+	// written contains the data of the changes by this manager, which were not watched yet (nil for a removal),
+	// so that their late events are not taken for changes by other managers.
+	written map[string][][]byte
+
+	// events are the changes of the schema in the kvstore, watched since the last Load.
+	events      chan kvstore.Event
+	cancelWatch func()
 }
 
 func NewManager(schema string, kvstore kvstore.KVStore) Manager {
@@ -32,10 +54,21 @@ func NewManager(schema string, kvstore kvstore.KVStore) Manager {
 		schema:      schema,
 		kvstore:     kvstore,
 		subscribers: make(map[string]Subscriber, 0),
+		stored:      make(map[string][]byte),
+		written:     make(map[string][][]byte),
 	}
 }
 
 func (m *manager) Load() error {
+	// watch before reading the entries, so that no change is missed in between
+	if m.cancelWatch != nil {
+		m.cancelWatch()
+	}
+	m.storeMutex.Lock()
+	m.events, m.cancelWatch = m.kvstore.Watch(m.schema, "")
+	m.written = make(map[string][][]byte)
+	m.storeMutex.Unlock()
+
 	// try to load s from kvstore
 	entries := m.kvstore.Iterate(m.schema, "")
 	for e := range entries {
@@ -44,6 +77,7 @@ func (m *manager) Load() error {
 			return err
 		}
 		m.subscribers[subscriber.Key()] = subscriber
+		m.setStored(subscriber.Key(), []byte(e[1]))
 	}
 	return nil
 }
@@ -102,6 +136,35 @@ func (m *manager) Filter(filters map[string]string) (subscribers []Subscriber) {
 	return
 }
 
+// Page returns at most limit subscribers matching the filters, read from the kvstore starting after the cursor,
+// and the cursor of the next page (empty after the last page).
+func (m *manager) Page(ctx context.Context, filters map[string]string, cursor string, limit int) ([]Subscriber, string, error) {
+	if limit <= 0 {
+		return nil, "", kvstore.ErrInvalidLimit
+	}
+	subscribers := make([]Subscriber, 0, limit)
+	for {
+		// only the remaining number of entries is read, so that the cursor follows the last returned subscriber
+		entries, next, err := m.kvstore.IteratePage(ctx, m.schema, "", cursor, limit-len(subscribers))
+		if err != nil {
+			return nil, "", err
+		}
+		for _, e := range entries {
+			s, err := NewSubscriberFromJSON([]byte(e[1]))
+			if err != nil {
+				return nil, "", err
+			}
+			if s.Filter(filters) {
+				subscribers = append(subscribers, s)
+			}
+		}
+		cursor = next
+		if cursor == "" || len(subscribers) == limit {
+			return subscribers, cursor, nil
+		}
+	}
+}
+
 func (m *manager) Add(s Subscriber) error {
 	logger.WithField("subscriber", s).WithField("lock", m.RWMutex).Info("Add subscriber started")
 
@@ -109,7 +172,7 @@ func (m *manager) Add(s Subscriber) error {
 		return ErrSubscriberExists
 	}
 
-	if err := m.updateStore(s); err != nil {
+	if err := m.insertStore(s); err != nil {
 		return err
 	}
 
@@ -134,6 +197,56 @@ func (m *manager) Update(s Subscriber) error {
 	return nil
 }
 
+// UpdateAll stores the subscribers in one batch: either all of them are stored, or none.
+// Like with Update, they are stored only if none of them was changed in the kvstore since it was last stored
+// by this manager. The subscribers kept by the manager are not replaced, so that copies of them can be stored,
+// and applied to the running subscribers only after they were stored.
+func (m *manager) UpdateAll(subscribers []Subscriber) error {
+	if len(subscribers) == 0 {
+		return nil
+	}
+
+	m.storeMutex.Lock()
+	defer m.storeMutex.Unlock()
+
+	operations := make([]kvstore.Operation, 0, len(subscribers))
+	for _, s := range subscribers {
+		if !m.Exists(s.Key()) {
+			return ErrSubscriberDoesNotExist
+		}
+		data, err := s.Encode()
+		if err != nil {
+			return err
+		}
+		operations = append(operations, kvstore.Operation{
+			Schema:   m.schema,
+			Key:      s.Key(),
+			Value:    data,
+			Compare:  true,
+			OldValue: m.getStored(s.Key()),
+		})
+	}
+
+	err := m.kvstore.Batch(operations)
+	if err == kvstore.ErrBatchConflict {
+		for _, s := range subscribers {
+			if err := m.refreshStored(s.Key()); err != nil {
+				return err
+			}
+		}
+		return ErrSubscriberModified
+	}
+	if err != nil {
+		return err
+	}
+	for _, op := range operations {
+		m.setStored(op.Key, op.Value)
+		m.remember(op.Key, op.Value)
+	}
+	logger.WithField("count", len(subscribers)).Info("Updated subscribers")
+	return nil
+}
+
 func (m *manager) putSubscriber(s Subscriber) {
 	m.Lock()
 	defer m.Unlock()
@@ -179,6 +292,29 @@ func (m *manager) cancelSubscriber(s Subscriber) {
 	s.Cancel()
 }
 
+// insertStore stores the new subscriber, if it is not stored yet (e.g. by another cluster node).
+func (m *manager) insertStore(s Subscriber) error {
+	data, err := s.Encode()
+	if err != nil {
+		return err
+	}
+
+	m.storeMutex.Lock()
+	defer m.storeMutex.Unlock()
+
+	swapped, err := m.kvstore.CompareAndSwap(m.schema, s.Key(), nil, data)
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		return ErrSubscriberExists
+	}
+	m.setStored(s.Key(), data)
+	m.remember(s.Key(), data)
+	return nil
+}
+
+// updateStore stores the subscriber, if it was not changed in the kvstore since it was last stored by this manager.
 func (m *manager) updateStore(s Subscriber) error {
 	data, err := s.Encode()
 	if err != nil {
@@ -186,11 +322,223 @@ func (m *manager) updateStore(s Subscriber) error {
 	}
 	//TODO MARIAN also remove this logs.
 	logger.WithField("subscriber", s).Info("UpdateStore")
-	return m.kvstore.Put(m.schema, s.Key(), data)
+
+	m.storeMutex.Lock()
+	defer m.storeMutex.Unlock()
+
+	swapped, err := m.kvstore.CompareAndSwap(m.schema, s.Key(), m.getStored(s.Key()), data)
+	if err != nil {
+		return err
+	}
+	if swapped {
+		m.setStored(s.Key(), data)
+		m.remember(s.Key(), data)
+		return nil
+	}
+
+	if err := m.refreshStored(s.Key()); err != nil {
+		return err
+	}
+	return ErrSubscriberModified
+}
+
+// refreshStored remembers the current data of a subscriber changed in the kvstore by another manager,
+// so that the next update is based on it.
+func (m *manager) refreshStored(key string) error {
+	current, exists, err := m.kvstore.Get(m.schema, key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrSubscriberDoesNotExist
+	}
+	m.setStored(key, current)
+	return nil
 }
 
 func (m *manager) removeStore(s Subscriber) error {
 	//TODO MARIAN also remove this logs.
 	logger.WithField("subscriber", s).Info("RemoveStore")
-	return m.kvstore.Delete(m.schema, s.Key())
+
+	m.storeMutex.Lock()
+	defer m.storeMutex.Unlock()
+
+	// only the removal of a stored subscriber is watched
+	existed := m.getStored(s.Key()) != nil
+	if err := m.kvstore.Delete(m.schema, s.Key()); err != nil {
+		return err
+	}
+	m.setStored(s.Key(), nil)
+	if existed {
+		m.remember(s.Key(), nil)
+	}
+	return nil
+}
+
+// remember a change written by this manager, until its event is watched.
+// It has to be called while holding the storeMutex.
+func (m *manager) remember(key string, data []byte) {
+	if m.events == nil {
+		// the changes are not watched
+		return
+	}
+	m.written[key] = append(m.written[key], data)
+}
+
+// isOwnChange returns true, if the event is a change written by this manager.
+// The change is forgotten together with the earlier changes of the subscriber, since the events are watched in order.
+// It has to be called while holding the storeMutex.
+func (m *manager) isOwnChange(event kvstore.Event) bool {
+	deleted := event.Type == kvstore.EventDelete
+	written := m.written[event.Key]
+	for i, data := range written {
+		if (data == nil) == deleted && bytes.Equal(data, event.Value) {
+			if i == len(written)-1 {
+				delete(m.written, event.Key)
+			} else {
+				m.written[event.Key] = written[i+1:]
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (m *manager) getStored(key string) []byte {
+	m.RLock()
+	defer m.RUnlock()
+	return m.stored[key]
+}
+
+// setStored sets the last stored data of the subscriber, or removes it if the data is nil.
+func (m *manager) setStored(key string, data []byte) {
+	m.Lock()
+	defer m.Unlock()
+	if data == nil {
+		delete(m.stored, key)
+		return
+	}
+	m.stored[key] = data
+}
+
+// Watch applies the changes of the subscribers stored by other managers (e.g. of other cluster nodes)
+// until the context is done, starting the added subscribers with the runner.
+// It has to be called after Load.
+func (m *manager) Watch(ctx context.Context, runner Runner) {
+	go m.watch(ctx, runner, m.events, m.cancelWatch)
+}
+
+func (m *manager) watch(ctx context.Context, runner Runner, events chan kvstore.Event, cancel func()) {
+	for {
+		select {
+		case <-ctx.Done():
+			cancel()
+			return
+		case event, ok := <-events:
+			if !ok {
+				logger.WithField("schema", m.schema).Warn("Watching subscribers was interrupted, reloading them")
+				events, cancel = m.reload(runner)
+				continue
+			}
+			m.apply(event, runner)
+		}
+	}
+}
+
+// reload watches the kvstore again, and applies the current subscribers as changes,
+// since changes may have been lost while the watching was interrupted.
+func (m *manager) reload(runner Runner) (chan kvstore.Event, func()) {
+	// the events of the changes written before are lost
+	m.storeMutex.Lock()
+	events, cancel := m.kvstore.Watch(m.schema, "")
+	m.written = make(map[string][][]byte)
+	m.storeMutex.Unlock()
+
+	current := make(map[string]bool)
+	for e := range m.kvstore.Iterate(m.schema, "") {
+		current[e[0]] = true
+		m.apply(kvstore.Event{Type: kvstore.EventPut, Schema: m.schema, Key: e[0], Value: []byte(e[1])}, runner)
+	}
+	for _, key := range m.storedKeys() {
+		if !current[key] {
+			m.apply(kvstore.Event{Type: kvstore.EventDelete, Schema: m.schema, Key: key}, runner)
+		}
+	}
+	return events, cancel
+}
+
+// apply a change of the kvstore, if it was not done by this manager.
+func (m *manager) apply(event kvstore.Event, runner Runner) {
+	// the changes by this manager are stored and remembered while holding the storeMutex,
+	// so that they are recognized here, also if their events are watched after later changes
+	m.storeMutex.Lock()
+	defer m.storeMutex.Unlock()
+
+	if m.isOwnChange(event) {
+		return
+	}
+	stored := m.getStored(event.Key)
+	if event.Type == kvstore.EventDelete {
+		if stored == nil {
+			return
+		}
+		m.setStored(event.Key, nil)
+		if s := m.Find(event.Key); s != nil {
+			logger.WithField("subscriber", s).Info("Removing subscriber removed by other manager")
+			m.cancelSubscriber(s)
+			m.deleteSubscriber(s)
+		}
+		return
+	}
+
+	if bytes.Equal(stored, event.Value) {
+		return
+	}
+	sd := SubscriberData{}
+	if err := json.Unmarshal(event.Value, &sd); err != nil {
+		logger.WithError(err).WithField("key", event.Key).Error("Error decoding subscriber changed by other manager")
+		return
+	}
+	s := NewSubscriberFromData(sd)
+	m.setStored(event.Key, event.Value)
+
+	existing := m.Find(event.Key)
+	if existing != nil {
+		if existing.Route().Path == s.Route().Path && existing.Route().RouteParams.Equal(s.Route().RouteParams) {
+			// only the state of the subscriber changed (e.g. the last sent message):
+			// it is taken over, so that the next update does not overwrite it with an older state,
+			// unless the subscriber has sent later messages meanwhile
+			if sd.LastID > lastID(existing) {
+				existing.SetLastID(sd.LastID)
+			}
+			return
+		}
+		m.cancelSubscriber(existing)
+	}
+	logger.WithField("subscriber", s).Info("Starting subscriber added or changed by other manager")
+	m.putSubscriber(s)
+	go runner.Run(s)
+}
+
+// lastID returns the last id of the subscriber, or 0 if it can not be decoded.
+func lastID(s Subscriber) uint64 {
+	data, err := s.Encode()
+	if err != nil {
+		return 0
+	}
+	sd := SubscriberData{}
+	if err := json.Unmarshal(data, &sd); err != nil {
+		return 0
+	}
+	return sd.LastID
+}
+
+func (m *manager) storedKeys() []string {
+	m.RLock()
+	defer m.RUnlock()
+	keys := make([]string, 0, len(m.stored))
+	for key := range m.stored {
+		keys = append(keys, key)
+	}
+	return keys
 }
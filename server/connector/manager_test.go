@@ -1 +1,351 @@
 package connector
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/router"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSubscriber(token string) Subscriber {
+	return NewSubscriber(protocol.Path("/topic"), router.RouteParams{"device_token": token}, 0)
+}
+
+func TestManager_AddExistingInOtherManager(t *testing.T) {
+	a := assert.New(t)
+	kvs := kvstore.NewMemoryKVStore()
+	m1 := NewManager("schema", kvs)
+	m2 := NewManager("schema", kvs)
+
+	a.NoError(m1.Add(newTestSubscriber("device1")))
+	a.Equal(ErrSubscriberExists, m2.Add(newTestSubscriber("device1")))
+}
+
+func TestManager_UpdateModifiedByOtherManager(t *testing.T) {
+	a := assert.New(t)
+	kvs := kvstore.NewMemoryKVStore()
+	m1 := NewManager("schema", kvs)
+	a.NoError(m1.Add(newTestSubscriber("device1")))
+
+	m2 := NewManager("schema", kvs)
+	a.NoError(m2.Load())
+
+	s1 := m1.List()[0]
+	s1.SetLastID(10)
+	a.NoError(m1.Update(s1))
+
+	// the update of the second manager is based on the outdated data
+	s2 := m2.List()[0]
+	s2.SetLastID(5)
+	a.Equal(ErrSubscriberModified, m2.Update(s2))
+	data, _, _ := kvs.Get("schema", s1.Key())
+	stored, err := NewSubscriberFromJSON(data)
+	a.NoError(err)
+	a.Equal(uint64(10), stored.(*subscriber).data.LastID)
+
+	// the next update is based on the current data
+	s2.SetLastID(11)
+	a.NoError(m2.Update(s2))
+}
+
+func TestManager_UpdateRemovedByOtherManager(t *testing.T) {
+	a := assert.New(t)
+	kvs := kvstore.NewMemoryKVStore()
+	m1 := NewManager("schema", kvs)
+	a.NoError(m1.Add(newTestSubscriber("device1")))
+
+	m2 := NewManager("schema", kvs)
+	a.NoError(m2.Load())
+	a.NoError(m2.Remove(m2.List()[0]))
+
+	// the removed subscriber is not stored again
+	s := m1.List()[0]
+	s.SetLastID(10)
+	a.Equal(ErrSubscriberDoesNotExist, m1.Update(s))
+	_, exists, _ := kvs.Get("schema", s.Key())
+	a.False(exists)
+}
+
+func TestManager_UpdateAll(t *testing.T) {
+	a := assert.New(t)
+	kvs := kvstore.NewMemoryKVStore()
+	m := NewManager("schema", kvs)
+	s1 := newTestSubscriber("device1")
+	s2 := newTestSubscriber("device2")
+	a.NoError(m.Add(s1))
+	a.NoError(m.Add(s2))
+
+	s1.SetLastID(1)
+	s2.SetLastID(2)
+	a.NoError(m.UpdateAll([]Subscriber{s1, s2}))
+
+	loaded := NewManager("schema", kvs)
+	a.NoError(loaded.Load())
+	a.Equal(uint64(1), loaded.Find(s1.Key()).(*subscriber).data.LastID)
+	a.Equal(uint64(2), loaded.Find(s2.Key()).(*subscriber).data.LastID)
+
+	// the updates are based on the data of the batch
+	s1.SetLastID(3)
+	a.NoError(m.Update(s1))
+
+	// nothing is stored, if one of the subscribers does not exist
+	a.Equal(ErrSubscriberDoesNotExist, m.UpdateAll([]Subscriber{s1, newTestSubscriber("device3")}))
+}
+
+func TestManager_UpdateAllModifiedByOtherManager(t *testing.T) {
+	a := assert.New(t)
+	kvs := kvstore.NewMemoryKVStore()
+	m1 := NewManager("schema", kvs)
+	s1 := newTestSubscriber("device1")
+	s2 := newTestSubscriber("device2")
+	a.NoError(m1.Add(s1))
+	a.NoError(m1.Add(s2))
+
+	m2 := NewManager("schema", kvs)
+	a.NoError(m2.Load())
+	other := m2.Find(s2.Key())
+	other.SetLastID(10)
+	a.NoError(m2.Update(other))
+
+	// nothing is stored, if one of the subscribers was modified
+	s1.SetLastID(1)
+	s2.SetLastID(2)
+	a.Equal(ErrSubscriberModified, m1.UpdateAll([]Subscriber{s1, s2}))
+	loaded := NewManager("schema", kvs)
+	a.NoError(loaded.Load())
+	a.Equal(uint64(0), loaded.Find(s1.Key()).(*subscriber).data.LastID)
+	a.Equal(uint64(10), loaded.Find(s2.Key()).(*subscriber).data.LastID)
+
+	// the next batch is based on the current data
+	s2.SetLastID(11)
+	a.NoError(m1.UpdateAll([]Subscriber{s1, s2}))
+}
+
+func TestManager_Page(t *testing.T) {
+	a := assert.New(t)
+	kvs := kvstore.NewMemoryKVStore()
+	m := NewManager("schema", kvs)
+	for i := 0; i < 5; i++ {
+		s := NewSubscriber(protocol.Path("/topic"), router.RouteParams{
+			"device_token": fmt.Sprintf("device%d", i),
+			"user_id":      fmt.Sprintf("user%d", i%2),
+		}, 0)
+		a.NoError(m.Add(s))
+	}
+
+	var tokens []string
+	pages := 0
+	cursor := ""
+	for {
+		subscribers, next, err := m.Page(context.Background(), map[string]string{"user_id": "user0"}, cursor, 2)
+		a.NoError(err)
+		a.True(len(subscribers) <= 2)
+		for _, s := range subscribers {
+			tokens = append(tokens, s.Route().Get("device_token"))
+		}
+		pages++
+		if next == "" || pages > 5 {
+			break
+		}
+		cursor = next
+	}
+	a.Equal(2, pages)
+	sort.Strings(tokens)
+	a.Equal([]string{"device0", "device2", "device4"}, tokens)
+
+	_, _, err := m.Page(context.Background(), nil, "", 0)
+	a.Equal(kvstore.ErrInvalidLimit, err)
+}
+
+// testRunner records the subscribers started by a manager.
+type testRunner chan Subscriber
+
+func (r testRunner) Run(s Subscriber) {
+	r <- s
+}
+
+func (r testRunner) assertRun(a *assert.Assertions, key string) {
+	select {
+	case s := <-r:
+		a.Equal(key, s.Key())
+	case <-time.After(time.Second):
+		a.Fail("subscriber was not started", key)
+	}
+}
+
+func TestManager_WatchChangesByOtherManager(t *testing.T) {
+	a := assert.New(t)
+	kvs := kvstore.NewMemoryKVStore()
+	m1 := NewManager("schema", kvs)
+	m2 := NewManager("schema", kvs)
+	a.NoError(m2.Load())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runner := make(testRunner, 10)
+	m2.Watch(ctx, runner)
+
+	// the subscriber added by the other manager is started
+	s1 := newTestSubscriber("device1")
+	a.NoError(m1.Add(s1))
+	runner.assertRun(a, s1.Key())
+	a.True(m2.Exists(s1.Key()))
+
+	// the changes of the state, and of the own subscribers are not started again
+	s1.SetLastID(10)
+	a.NoError(m1.Update(s1))
+	s2 := newTestSubscriber("device2")
+	a.NoError(m2.Add(s2))
+	s2.SetLastID(5)
+	a.NoError(m2.Update(s2))
+
+	// the subscriber removed by the other manager is removed
+	a.NoError(m1.Remove(s1))
+	a.NoError(m1.Add(newTestSubscriber("device3")))
+	runner.assertRun(a, newTestSubscriber("device3").Key())
+	a.False(m2.Exists(s1.Key()))
+	a.True(m2.Exists(s2.Key()))
+	a.Empty(runner)
+
+	// the updates of the watching manager are based on the changes by the other manager
+	s3 := m2.Find(newTestSubscriber("device3").Key())
+	s3.SetLastID(1)
+	a.NoError(m2.Update(s3))
+}
+
+func TestManager_WatchTakesOverStateOfOtherManager(t *testing.T) {
+	a := assert.New(t)
+	kvs := kvstore.NewMemoryKVStore()
+	m1 := NewManager("schema", kvs)
+	m2 := NewManager("schema", kvs)
+	a.NoError(m2.Load())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runner := make(testRunner, 10)
+	m2.Watch(ctx, runner)
+
+	s1 := newTestSubscriber("device1")
+	a.NoError(m1.Add(s1))
+	runner.assertRun(a, s1.Key())
+
+	s1.SetLastID(10)
+	a.NoError(m1.Update(s1))
+	// the changes are applied in order: the state is taken over when the next subscriber is started
+	a.NoError(m1.Add(newTestSubscriber("device2")))
+	runner.assertRun(a, newTestSubscriber("device2").Key())
+
+	s2 := m2.Find(s1.Key())
+	a.Equal(uint64(10), s2.(*subscriber).data.LastID)
+
+	// the next update of the watching manager does not move the last ID backwards
+	a.NoError(m2.Update(s2))
+	data, _, _ := kvs.Get("schema", s1.Key())
+	stored, err := NewSubscriberFromJSON(data)
+	a.NoError(err)
+	a.Equal(uint64(10), stored.(*subscriber).data.LastID)
+}
+
+// lateKVStore delivers the watched events late, like a kvstore notifying the changes over the network.
+type lateKVStore struct {
+	*kvstore.MemoryKVStore
+	delay time.Duration
+}
+
+func (kvs lateKVStore) Watch(schema, keyPrefix string) (chan kvstore.Event, func()) {
+	events, cancel := kvs.MemoryKVStore.Watch(schema, keyPrefix)
+
+	type received struct {
+		event kvstore.Event
+		at    time.Time
+	}
+	buffered := make(chan received, 1000)
+	go func() {
+		defer close(buffered)
+		for event := range events {
+			buffered <- received{event, time.Now()}
+		}
+	}()
+	late := make(chan kvstore.Event, 1000)
+	go func() {
+		defer close(late)
+		for r := range buffered {
+			time.Sleep(r.at.Add(kvs.delay).Sub(time.Now()))
+			late <- r.event
+		}
+	}()
+	return late, cancel
+}
+
+func TestManager_WatchIgnoresLateEventsOfOwnChanges(t *testing.T) {
+	a := assert.New(t)
+	kvs := lateKVStore{kvstore.NewMemoryKVStore(), 2 * time.Millisecond}
+	m := NewManager("schema", kvs)
+	a.NoError(m.Load())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runner := make(testRunner, 10)
+	m.Watch(ctx, runner)
+
+	s := newTestSubscriber("device1")
+	a.NoError(m.Add(s))
+
+	// the events of the earlier updates are watched while the next updates are stored
+	count := uint64(200)
+	for i := uint64(1); i <= count; i++ {
+		s.SetLastID(i)
+		a.NoError(m.Update(s))
+		time.Sleep(100 * time.Microsecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	a.Equal(count, lastID(m.Find(s.Key())))
+	s.SetLastID(count + 1)
+	a.NoError(m.Update(s))
+	data, _, _ := kvs.Get("schema", s.Key())
+	stored, err := NewSubscriberFromJSON(data)
+	a.NoError(err)
+	a.Equal(count+1, lastID(stored))
+	a.Empty(runner)
+}
+
+func TestManager_WatchReloadsAfterInterruption(t *testing.T) {
+	a := assert.New(t)
+	kvs := kvstore.NewMemoryKVStore()
+	m1 := NewManager("schema", kvs)
+	removed := newTestSubscriber("removed")
+	a.NoError(m1.Add(removed))
+
+	m2 := NewManager("schema", kvs)
+	a.NoError(m2.Load())
+
+	// more changes than the kvstore buffers for the watcher, before the manager receives them
+	a.NoError(m1.Remove(removed))
+	count := 150
+	for i := 0; i < count; i++ {
+		a.NoError(m1.Add(newTestSubscriber(fmt.Sprintf("device%d", i))))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runner := make(testRunner, count)
+	m2.Watch(ctx, runner)
+
+	for i := 0; i < count; i++ {
+		select {
+		case <-runner:
+		case <-time.After(time.Second):
+			a.FailNow("subscriber was not started")
+		}
+	}
+	a.Equal(count, len(m2.List()))
+	a.False(m2.Exists(removed.Key()))
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/smancke/guble/protocol"
 
 	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/server/scope"
 	"net/http"
 )
 
@@ -53,6 +54,16 @@ func (_mr *_MockConnectorRecorder) GetPrefix() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetPrefix")
 }
 
+func (_m *MockConnector) RequiredScope(_param0 *http.Request) scope.Scope {
+	ret := _m.ctrl.Call(_m, "RequiredScope", _param0)
+	ret0, _ := ret[0].(scope.Scope)
+	return ret0
+}
+
+func (_mr *_MockConnectorRecorder) RequiredScope(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RequiredScope", arg0)
+}
+
 func (_m *MockConnector) Manager() Manager {
 	ret := _m.ctrl.Call(_m, "Manager")
 	ret0, _ := ret[0].(Manager)
@@ -290,6 +301,18 @@ func (_mr *_MockManagerRecorder) Load() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Load")
 }
 
+func (_m *MockManager) Page(_param0 context.Context, _param1 map[string]string, _param2 string, _param3 int) ([]Subscriber, string, error) {
+	ret := _m.ctrl.Call(_m, "Page", _param0, _param1, _param2, _param3)
+	ret0, _ := ret[0].([]Subscriber)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockManagerRecorder) Page(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Page", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockManager) Remove(_param0 Subscriber) error {
 	ret := _m.ctrl.Call(_m, "Remove", _param0)
 	ret0, _ := ret[0].(error)
@@ -310,6 +333,24 @@ func (_mr *_MockManagerRecorder) Update(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Update", arg0)
 }
 
+func (_m *MockManager) UpdateAll(_param0 []Subscriber) error {
+	ret := _m.ctrl.Call(_m, "UpdateAll", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockManagerRecorder) UpdateAll(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UpdateAll", arg0)
+}
+
+func (_m *MockManager) Watch(_param0 context.Context, _param1 Runner) {
+	_m.ctrl.Call(_m, "Watch", _param0, _param1)
+}
+
+func (_mr *_MockManagerRecorder) Watch(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Watch", arg0, arg1)
+}
+
 // Mock of Queue interface
 type MockQueue struct {
 	ctrl     *gomock.Controller
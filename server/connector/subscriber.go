@@ -18,6 +18,7 @@ import (
 var (
 	ErrSubscriberExists       = errors.New("Subscriber exists.")
 	ErrSubscriberDoesNotExist = errors.New("Subscriber does not exist.")
+	ErrSubscriberModified     = errors.New("Subscriber was modified concurrently.")
 
 	ErrRouteChannelClosed = errors.New("Subscriber route channel has been closed.")
 )
@@ -1,5 +1,7 @@
 package connector
 
+import "encoding/json"
+
 type substitution struct {
 	FieldName string `json:"field"`
 	OldValue  string `json:"old_value"`
@@ -9,3 +11,29 @@ type substitution struct {
 func (s *substitution) isValid() bool {
 	return s.FieldName != "" && s.NewValue != "" && s.OldValue != ""
 }
+
+// copies returns copies of the subscribers with the new value of the field, keeping their keys.
+// The subscribers themselves are not changed, so that they keep running unchanged until the copies are stored.
+func (s *substitution) copies(subscribers []Subscriber) ([]Subscriber, error) {
+	copies := make([]Subscriber, 0, len(subscribers))
+	for _, sub := range subscribers {
+		data, err := sub.Encode()
+		if err != nil {
+			return nil, err
+		}
+		sd := SubscriberData{}
+		if err := json.Unmarshal(data, &sd); err != nil {
+			return nil, err
+		}
+		if sd.Params == nil {
+			sd.Params = make(map[string]string)
+		}
+		sd.Params[s.FieldName] = s.NewValue
+		copies = append(copies, &subscriber{
+			data:  sd,
+			key:   sub.Key(),
+			route: sd.newRoute(),
+		})
+	}
+	return copies, nil
+}
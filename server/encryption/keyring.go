@@ -0,0 +1,202 @@
+// Package encryption provides the authenticated encryption (AES-GCM) of data stored at rest.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	version    = byte(1)
+	headerSize = 3 + 1 + 4 // magic, version, key id
+)
+
+// magic is the prefix of all encrypted data.
+// It starts with a zero byte, which does not occur at the start of the plaintext data stored by guble.
+var magic = []byte{0, 'G', 'E'}
+
+var (
+	// ErrNoKeyring is returned when decrypting encrypted data without a keyring.
+	ErrNoKeyring = errors.New("Data is encrypted, but no encryption key is configured")
+
+	// ErrInvalidData is returned when the encrypted data is truncated or was modified.
+	ErrInvalidData = errors.New("Encrypted data is invalid")
+)
+
+// UnknownKeyError is returned when data was encrypted with a key which is not in the keyring.
+type UnknownKeyError struct {
+	ID uint32
+}
+
+func (e *UnknownKeyError) Error() string {
+	return fmt.Sprintf("Data is encrypted with the key id %d, which is not configured", e.ID)
+}
+
+// Keyring holds the keys used for encrypting and decrypting data.
+// New data is always encrypted with the current key, which is the key with the highest id.
+// Data encrypted with an older key stays readable, as long as the older key is kept in the keyring.
+//
+// A nil *Keyring is valid and does not encrypt anything.
+type Keyring struct {
+	currentID uint32
+	aeads     map[uint32]cipher.AEAD
+}
+
+// NewKeyring returns a keyring for the AES keys (of 16, 24 or 32 bytes) with the given ids.
+func NewKeyring(keys map[uint32][]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("No encryption key given")
+	}
+
+	k := &Keyring{aeads: make(map[uint32]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid encryption key with id %d: %v", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.aeads[id] = aead
+		if id > k.currentID {
+			k.currentID = id
+		}
+	}
+	return k, nil
+}
+
+// ParseKeyring parses keys in the format `<id>:<hex encoded key>`, separated by commas or newlines.
+// Empty lines and lines starting with # are ignored.
+func ParseKeyring(s string) (*Keyring, error) {
+	keys := make(map[uint32][]byte)
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid encryption key, expected format <id>:<hex encoded key>")
+		}
+		id, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid encryption key id %q", parts[0])
+		}
+		if _, exists := keys[uint32(id)]; exists {
+			return nil, fmt.Errorf("Duplicate encryption key id %d", id)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid encryption key with id %d: not hex encoded", id)
+		}
+		keys[uint32(id)] = key
+	}
+	return NewKeyring(keys)
+}
+
+// LoadKeyring returns the keyring from the key file, or from the keys given as string if there is no file.
+// It returns nil if neither is given, so that encryption is disabled.
+func LoadKeyring(filename, keys string) (*Keyring, error) {
+	if filename != "" {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		keys = string(data)
+	}
+	if strings.TrimSpace(keys) == "" {
+		return nil, nil
+	}
+	return ParseKeyring(keys)
+}
+
+// CurrentKeyID returns the id of the key used for encrypting new data.
+func (k *Keyring) CurrentKeyID() uint32 {
+	return k.currentID
+}
+
+// KeyIDs returns the sorted ids of all the keys in the keyring.
+func (k *Keyring) KeyIDs() []uint32 {
+	ids := make([]uint32, 0, len(k.aeads))
+	for id := range k.aeads {
+		ids = append(ids, id)
+	}
+	sort.Sort(keyIDs(ids))
+	return ids
+}
+
+// Encrypt encrypts the data with the current key.
+// Without keyring the data is returned unchanged.
+func (k *Keyring) Encrypt(data []byte) ([]byte, error) {
+	if k == nil {
+		return data, nil
+	}
+	aead := k.aeads[k.currentID]
+
+	out := make([]byte, headerSize+aead.NonceSize(), headerSize+aead.NonceSize()+len(data)+aead.Overhead())
+	copy(out, magic)
+	out[len(magic)] = version
+	binary.BigEndian.PutUint32(out[len(magic)+1:], k.currentID)
+
+	nonce := out[headerSize:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	// the header is authenticated as additional data
+	return aead.Seal(out, nonce, data, out[:headerSize]), nil
+}
+
+// Decrypt decrypts the data with the key it was encrypted with.
+// Data which is not encrypted is returned unchanged, so that data written before
+// enabling the encryption stays readable.
+func (k *Keyring) Decrypt(data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return data, nil
+	}
+	if k == nil {
+		return nil, ErrNoKeyring
+	}
+	if len(data) < headerSize || data[len(magic)] != version {
+		return nil, ErrInvalidData
+	}
+
+	id := binary.BigEndian.Uint32(data[len(magic)+1:])
+	aead, exists := k.aeads[id]
+	if !exists {
+		return nil, &UnknownKeyError{ID: id}
+	}
+	if len(data) < headerSize+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidData
+	}
+
+	nonce := data[headerSize : headerSize+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, data[headerSize+aead.NonceSize():], data[:headerSize])
+	if err != nil {
+		return nil, ErrInvalidData
+	}
+	return plaintext, nil
+}
+
+// IsEncrypted returns true if the data was encrypted by a Keyring.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+type keyIDs []uint32
+
+func (ids keyIDs) Len() int           { return len(ids) }
+func (ids keyIDs) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
+func (ids keyIDs) Less(i, j int) bool { return ids[i] < ids[j] }
@@ -0,0 +1,119 @@
+package encryption
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	key1 = "000102030405060708090a0b0c0d0e0f"
+	key2 = "101112131415161718191a1b1c1d1e1f101112131415161718191a1b1c1d1e1f"
+)
+
+func TestKeyring_EncryptDecrypt(t *testing.T) {
+	a := assert.New(t)
+	k, err := ParseKeyring("1:" + key1)
+	a.NoError(err)
+
+	plaintext := []byte("/foo,42,marvin,app,,1451236804,0\n{}\nHello")
+	encrypted, err := k.Encrypt(plaintext)
+	a.NoError(err)
+	a.True(IsEncrypted(encrypted))
+	a.NotContains(string(encrypted), "marvin")
+
+	// the same data is encrypted differently each time
+	encrypted2, err := k.Encrypt(plaintext)
+	a.NoError(err)
+	a.NotEqual(encrypted, encrypted2)
+
+	decrypted, err := k.Decrypt(encrypted)
+	a.NoError(err)
+	a.Equal(plaintext, decrypted)
+
+	// data written before enabling the encryption is readable
+	decrypted, err = k.Decrypt(plaintext)
+	a.NoError(err)
+	a.Equal(plaintext, decrypted)
+
+	// modified data is detected
+	encrypted[len(encrypted)-1]++
+	_, err = k.Decrypt(encrypted)
+	a.Equal(ErrInvalidData, err)
+	_, err = k.Decrypt(encrypted[:headerSize+2])
+	a.Equal(ErrInvalidData, err)
+}
+
+func TestKeyring_Rotation(t *testing.T) {
+	a := assert.New(t)
+	old, err := ParseKeyring("1:" + key1)
+	a.NoError(err)
+	encryptedWithOld, err := old.Encrypt([]byte("old"))
+	a.NoError(err)
+
+	rotated, err := ParseKeyring("1:" + key1 + ",2:" + key2)
+	a.NoError(err)
+	a.Equal(uint32(2), rotated.CurrentKeyID())
+	a.Equal([]uint32{1, 2}, rotated.KeyIDs())
+
+	decrypted, err := rotated.Decrypt(encryptedWithOld)
+	a.NoError(err)
+	a.Equal("old", string(decrypted))
+
+	encryptedWithNew, err := rotated.Encrypt([]byte("new"))
+	a.NoError(err)
+	_, err = old.Decrypt(encryptedWithNew)
+	a.Equal(&UnknownKeyError{ID: 2}, err)
+
+	// without keyring, encrypted data is not readable
+	var none *Keyring
+	_, err = none.Decrypt(encryptedWithNew)
+	a.Equal(ErrNoKeyring, err)
+	data, err := none.Encrypt([]byte("plain"))
+	a.NoError(err)
+	a.Equal("plain", string(data))
+}
+
+func TestParseKeyring_Errors(t *testing.T) {
+	a := assert.New(t)
+	for _, keys := range []string{
+		"",
+		"# only a comment",
+		key1,
+		"x:" + key1,
+		"1:nothex",
+		"1:0001",
+		"1:" + key1 + ",1:" + key2,
+	} {
+		_, err := ParseKeyring(keys)
+		a.Error(err, keys)
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	a := assert.New(t)
+
+	k, err := LoadKeyring("", "")
+	a.NoError(err)
+	a.Nil(k)
+
+	k, err = LoadKeyring("", "1:"+key1)
+	a.NoError(err)
+	a.Equal(uint32(1), k.CurrentKeyID())
+
+	file, err := ioutil.TempFile("", "guble_keyring_test")
+	a.NoError(err)
+	defer os.Remove(file.Name())
+	file.WriteString(strings.Join([]string{"# keys", "1:" + key1, "3:" + key2, ""}, "\n"))
+	file.Close()
+
+	k, err = LoadKeyring(file.Name(), "ignored")
+	a.NoError(err)
+	a.Equal([]uint32{1, 3}, k.KeyIDs())
+
+	_, err = LoadKeyring("/not/existing/keyfile", "")
+	a.Error(err)
+}
@@ -0,0 +1,83 @@
+package encryption
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CheckUsedKeys verifies that the keyring contains all the keys with the used ids,
+// and returns the used ids extended by the current key id of the keyring.
+//
+// The stores record the ids of all the keys they used for encrypting data (as a marker),
+// so that a missing key is detected on startup, instead of failing later when reading the data.
+func CheckUsedKeys(k *Keyring, used []uint32) ([]uint32, error) {
+	if k == nil {
+		if len(used) > 0 {
+			return nil, fmt.Errorf("The stored data is encrypted (key ids %v), but no encryption key is configured", used)
+		}
+		return used, nil
+	}
+
+	current := false
+	for _, id := range used {
+		if _, exists := k.aeads[id]; !exists {
+			return nil, fmt.Errorf("The stored data is encrypted with the key id %d, which is not configured", id)
+		}
+		current = current || id == k.currentID
+	}
+	if current {
+		return used, nil
+	}
+
+	updated := append(append([]uint32{}, used...), k.currentID)
+	sort.Sort(keyIDs(updated))
+	return updated, nil
+}
+
+// FormatKeyIDs returns the marker data for the used key ids.
+func FormatKeyIDs(ids []uint32) []byte {
+	lines := make([]string, len(ids))
+	for i, id := range ids {
+		lines[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// ParseKeyIDs parses the marker data written by FormatKeyIDs.
+func ParseKeyIDs(data []byte) ([]uint32, error) {
+	var ids []uint32
+	for _, field := range strings.Fields(string(data)) {
+		id, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key id %q in encryption marker", field)
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+// CheckMarkerFile checks the key ids recorded in the marker file against the keyring (see CheckUsedKeys),
+// and records the current key id in the marker file.
+func CheckMarkerFile(filename string, k *Keyring) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	used, err := ParseKeyIDs(data)
+	if err != nil {
+		return err
+	}
+
+	updated, err := CheckUsedKeys(k, used)
+	if err != nil {
+		return err
+	}
+	if len(updated) == len(used) {
+		return nil
+	}
+	return ioutil.WriteFile(filename, FormatKeyIDs(updated), 0600)
+}
@@ -0,0 +1,61 @@
+package encryption
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckUsedKeys(t *testing.T) {
+	a := assert.New(t)
+	k, _ := ParseKeyring("1:" + key1 + ",2:" + key2)
+
+	used, err := CheckUsedKeys(nil, nil)
+	a.NoError(err)
+	a.Nil(used)
+
+	_, err = CheckUsedKeys(nil, []uint32{1})
+	a.Error(err)
+
+	used, err = CheckUsedKeys(k, []uint32{1})
+	a.NoError(err)
+	a.Equal([]uint32{1, 2}, used)
+
+	used, err = CheckUsedKeys(k, []uint32{1, 2})
+	a.NoError(err)
+	a.Equal([]uint32{1, 2}, used)
+
+	_, err = CheckUsedKeys(k, []uint32{3})
+	a.Error(err)
+}
+
+func TestCheckMarkerFile(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_marker_test")
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "marker")
+
+	// no data was encrypted yet
+	a.NoError(CheckMarkerFile(filename, nil))
+	_, err := os.Stat(filename)
+	a.True(os.IsNotExist(err))
+
+	k1, _ := ParseKeyring("1:" + key1)
+	a.NoError(CheckMarkerFile(filename, k1))
+	a.Error(CheckMarkerFile(filename, nil))
+
+	k2, _ := ParseKeyring("2:" + key2)
+	a.Error(CheckMarkerFile(filename, k2))
+
+	rotated, _ := ParseKeyring("1:" + key1 + ",2:" + key2)
+	a.NoError(CheckMarkerFile(filename, rotated))
+
+	data, err := ioutil.ReadFile(filename)
+	a.NoError(err)
+	ids, err := ParseKeyIDs(data)
+	a.NoError(err)
+	a.Equal([]uint32{1, 2}, ids)
+}
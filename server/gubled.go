@@ -6,21 +6,28 @@ import (
 	"github.com/smancke/guble/logformatter"
 	"github.com/smancke/guble/protocol"
 	"github.com/smancke/guble/server/apns"
+	"github.com/smancke/guble/server/audit"
 	"github.com/smancke/guble/server/auth"
 	"github.com/smancke/guble/server/cluster"
+	"github.com/smancke/guble/server/encryption"
 	"github.com/smancke/guble/server/fcm"
 	"github.com/smancke/guble/server/kvstore"
 	"github.com/smancke/guble/server/metrics"
 	"github.com/smancke/guble/server/rest"
 	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/server/scope"
 	"github.com/smancke/guble/server/service"
 	"github.com/smancke/guble/server/sms"
 	"github.com/smancke/guble/server/store"
+	"github.com/smancke/guble/server/store/blobstore"
 	"github.com/smancke/guble/server/store/dummystore"
 	"github.com/smancke/guble/server/store/filestore"
+	"github.com/smancke/guble/server/store/memorystore"
+	"github.com/smancke/guble/server/store/sqlstore"
 	"github.com/smancke/guble/server/webserver"
 	"github.com/smancke/guble/server/websocket"
 
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -36,7 +43,17 @@ import (
 )
 
 const (
-	fileOption = "file"
+	fileOption   = "file"
+	sqliteOption = "sqlite"
+	boltOption   = "bolt"
+
+	// the names of the access managers in the access chain
+	allowAccess = "allow"
+	denyAccess  = "deny"
+	jwtAccess   = "jwt"
+	aclAccess   = "acl"
+	restAccess  = "rest"
+	rbacAccess  = "rbac"
 )
 
 var AfterMessageDelivery = func(m *protocol.Message) {
@@ -46,7 +63,7 @@ var AfterMessageDelivery = func(m *protocol.Message) {
 // ValidateStoragePath validates the guble configuration with regard to the storagePath
 // (which can be used by MessageStore and/or KVStore implementations).
 var ValidateStoragePath = func() error {
-	if *Config.KVS == fileOption || *Config.MS == fileOption {
+	if *Config.KVS == fileOption || *Config.KVS == boltOption || *Config.MS == fileOption || *Config.MS == sqliteOption {
 		testfile := path.Join(*Config.StoragePath, "write-test-file")
 		f, err := os.Create(testfile)
 		if err != nil {
@@ -60,9 +77,81 @@ var ValidateStoragePath = func() error {
 }
 
 // CreateAccessManager is a func which returns a auth.AccessManager implementation
-// (currently: AllowAllAccessManager).
-var CreateAccessManager = func() auth.AccessManager {
-	return auth.NewAllowAllAccessManager(true)
+// (currently: the access chain if configured, else JWTAccessManager if a JWT key is configured,
+// ACLAccessManager if an ACL file is configured, RestAccessManager if an auth service URL is configured,
+// RBACAccessManager with the roles in the KVStore if enabled, else AllowAllAccessManager).
+var CreateAccessManager = func(kvStore kvstore.KVStore) auth.AccessManager {
+	if *Config.AccessChain != "" {
+		am, err := auth.ParseChain(*Config.AccessChain, func(name string) (auth.AccessManager, error) {
+			return newAccessManager(name, kvStore)
+		})
+		if err != nil {
+			logger.WithError(err).Panic("Could not create the access chain")
+		}
+		return am
+	}
+
+	var enabled []string
+	if *Config.JWT.KeyFile != "" || *Config.JWT.JWKSFile != "" {
+		enabled = append(enabled, jwtAccess)
+	}
+	if *Config.ACLFile != "" {
+		enabled = append(enabled, aclAccess)
+	}
+	if *Config.RestAuth.URL != "" {
+		enabled = append(enabled, restAccess)
+	}
+	if *Config.RBAC {
+		enabled = append(enabled, rbacAccess)
+	}
+	if len(enabled) > 1 {
+		logger.WithField("accessManagers", enabled).Panic("Only one access manager can be enabled without an access chain")
+	}
+	if len(enabled) == 0 {
+		return auth.NewAllowAllAccessManager(true)
+	}
+	am, err := newAccessManager(enabled[0], kvStore)
+	if err != nil {
+		logger.WithError(err).WithField("accessManager", enabled[0]).Panic("Could not create the access manager")
+	}
+	return am
+}
+
+// newAccessManager returns the access manager with the name, as used in the access chain.
+func newAccessManager(name string, kvStore kvstore.KVStore) (auth.AccessManager, error) {
+	switch name {
+	case allowAccess:
+		return auth.NewAllowAllAccessManager(true), nil
+	case denyAccess:
+		return auth.NewAllowAllAccessManager(false), nil
+	case jwtAccess:
+		return auth.NewJWTAccessManager(auth.JWTConfig{
+			Algorithm: *Config.JWT.Algorithm,
+			KeyFile:   *Config.JWT.KeyFile,
+			JWKSFile:  *Config.JWT.JWKSFile,
+		})
+	case aclAccess:
+		if *Config.ACLFile == "" {
+			return nil, errors.New("The ACL access manager requires an ACL file")
+		}
+		return auth.NewACLAccessManager(*Config.ACLFile)
+	case restAccess:
+		if *Config.RestAuth.URL == "" {
+			return nil, errors.New("The REST access manager requires the URL of the auth service")
+		}
+		return auth.NewRestAccessManager(auth.RestAccessManagerConfig{
+			URL:              *Config.RestAuth.URL,
+			Timeout:          *Config.RestAuth.Timeout,
+			AllowTTL:         *Config.RestAuth.AllowTTL,
+			DenyTTL:          *Config.RestAuth.DenyTTL,
+			FailureThreshold: *Config.RestAuth.FailureThreshold,
+			OpenTimeout:      *Config.RestAuth.OpenTimeout,
+			FailOpen:         *Config.RestAuth.FailOpen,
+		}), nil
+	case rbacAccess:
+		return auth.NewRBACAccessManager(kvStore), nil
+	}
+	return nil, fmt.Errorf("Unknown access manager %q", name)
 }
 
 // CreateKVStore is a func which returns a kvstore.KVStore implementation
@@ -70,46 +159,208 @@ var CreateAccessManager = func() auth.AccessManager {
 var CreateKVStore = func() kvstore.KVStore {
 	switch *Config.KVS {
 	case "memory":
-		return kvstore.NewMemoryKVStore()
+		return encryptKVStore(kvstore.NewMemoryKVStore())
 	case "file":
 		db := kvstore.NewSqliteKVStore(path.Join(*Config.StoragePath, "kv-store.db"), true)
 		if err := db.Open(); err != nil {
 			logger.WithError(err).Panic("Could not open sqlite database connection")
 		}
-		return db
+		return encryptKVStore(db)
+	case boltOption:
+		db := kvstore.NewBoltKVStore(path.Join(*Config.StoragePath, "kv-store.bolt"))
+		if err := db.Open(); err != nil {
+			logger.WithError(err).Panic("Could not open bolt database")
+		}
+		return encryptKVStore(db)
 	case "postgres":
-		db := kvstore.NewPostgresKVStore(kvstore.PostgresConfig{
-			ConnParams: map[string]string{
-				"host":     *Config.Postgres.Host,
-				"port":     strconv.Itoa(*Config.Postgres.Port),
-				"user":     *Config.Postgres.User,
-				"password": *Config.Postgres.Password,
-				"dbname":   *Config.Postgres.DbName,
-				"sslmode":  "disable",
-			},
-			MaxIdleConns: 1,
-			MaxOpenConns: runtime.GOMAXPROCS(0),
-		})
+		db := kvstore.NewPostgresKVStore(postgresConfig())
 		if err := db.Open(); err != nil {
 			logger.WithError(err).Panic("Could not open postgres database connection")
 		}
-		return db
+		return encryptKVStore(db)
+	case "redis":
+		db := kvstore.NewRedisKVStore(redisConfig())
+		if err := db.Open(); err != nil {
+			logger.WithError(err).Panic("Could not open redis connection")
+		}
+		return encryptKVStore(db)
 	default:
 		panic(fmt.Errorf("Unknown key-value backend: %q", *Config.KVS))
 	}
 }
 
+// encryptKVStore returns a KVStore encrypting the values of the given one, if encryption keys are configured.
+// It fails if values of the KVStore were encrypted with a key which is not configured.
+func encryptKVStore(kvs kvstore.KVStore) kvstore.KVStore {
+	keyring := loadKeyring()
+	if err := kvstore.CheckEncryption(kvs, keyring); err != nil {
+		logger.WithError(err).Panic("Could not use the key-value store")
+	}
+	if keyring == nil {
+		return kvs
+	}
+	logger.WithField("keyIDs", keyring.KeyIDs()).Info("Encrypting the values of the key-value store")
+	return kvstore.NewEncryptedKVStore(kvs, keyring)
+}
+
+// loadKeyring returns the keys for the encryption at rest, or nil if no key is configured.
+func loadKeyring() *encryption.Keyring {
+	keyring, err := encryption.LoadKeyring(*Config.Encryption.KeyFile, *Config.Encryption.Keys)
+	if err != nil {
+		logger.WithError(err).Panic("Could not load the encryption keys")
+	}
+	return keyring
+}
+
+func loadAPIKeys() *webserver.APIKeys {
+	keys, err := webserver.LoadAPIKeys(*Config.APIKeysFile, *Config.APIKeys)
+	if err != nil {
+		logger.WithError(err).Panic("Could not load the API keys")
+	}
+	if *Config.AdminAPIKey != "" {
+		keys = keys.With(scope.Admin, *Config.AdminAPIKey)
+	}
+	return keys
+}
+
+// CreateAuditRecorder returns the recorder of the audit log, or nil if no audit log file is configured.
+func CreateAuditRecorder() *audit.FileRecorder {
+	if *Config.Audit.File == "" {
+		return nil
+	}
+	recorder, err := audit.NewFileRecorder(audit.Config{
+		Filename:    *Config.Audit.File,
+		MaxFileSize: *Config.Audit.MaxFileSize,
+		Content:     audit.Content(*Config.Audit.Content),
+	})
+	if err != nil {
+		logger.WithError(err).Panic("Could not open the audit log")
+	}
+	return recorder
+}
+
+// VerifyAudit verifies the hash chain of the audit log file and of its rotated files.
+func VerifyAudit() error {
+	if *Config.Audit.File == "" {
+		return errors.New("No audit log file given")
+	}
+	count, err := audit.Verify(*Config.Audit.File)
+	logger.WithField("events", count).Info("Verified the audit log")
+	return err
+}
+
+func redisConfig() kvstore.RedisConfig {
+	return kvstore.RedisConfig{
+		Addr:      *Config.Redis.Addr,
+		Password:  *Config.Redis.Password,
+		DB:        *Config.Redis.DB,
+		MaxIdle:   *Config.Redis.MaxIdle,
+		MaxActive: *Config.Redis.MaxActive,
+		KeyPrefix: *Config.Redis.KeyPrefix,
+	}
+}
+
+func postgresConfig() kvstore.PostgresConfig {
+	return kvstore.PostgresConfig{
+		ConnParams: map[string]string{
+			"host":     *Config.Postgres.Host,
+			"port":     strconv.Itoa(*Config.Postgres.Port),
+			"user":     *Config.Postgres.User,
+			"password": *Config.Postgres.Password,
+			"dbname":   *Config.Postgres.DbName,
+			"sslmode":  "disable",
+		},
+		MaxIdleConns: 1,
+		MaxOpenConns: runtime.GOMAXPROCS(0),
+	}
+}
+
 // CreateMessageStore is a func which returns a store.MessageStore implementation
 // (currently, based on guble configuration).
 var CreateMessageStore = func() store.MessageStore {
-	switch *Config.MS {
-	case "none", "memory", "":
+	return newMessageStore(*Config.MS, *Config.StoragePath)
+}
+
+// archiveBlobStore returns the blob store for archiving the old message files of the file message store,
+// or nil if archival is not configured.
+func archiveBlobStore() blobstore.BlobStore {
+	if *Config.FileStore.ArchivePath == "" {
+		return nil
+	}
+	logger.WithFields(log.Fields{
+		"archivePath":  *Config.FileStore.ArchivePath,
+		"archiveAfter": *Config.FileStore.ArchiveAfter,
+	}).Info("Archiving old message files")
+	bs, err := blobstore.NewDirBlobStore(*Config.FileStore.ArchivePath)
+	if err != nil {
+		logger.WithError(err).Panic("Could not open message archive")
+	}
+	return bs
+}
+
+// quotas returns the parsed quotas of the file message store.
+func quotas() []filestore.Quota {
+	var quotas []filestore.Quota
+	for _, s := range *Config.FileStore.Quotas {
+		q, err := filestore.ParseQuota(s)
+		if err != nil {
+			logger.WithError(err).Panic("Could not parse message store quota")
+		}
+		quotas = append(quotas, q)
+	}
+	return quotas
+}
+
+// newMessageStore returns the message store for the backend, using the storage path for the file and sqlite backends.
+func newMessageStore(backend, storagePath string) store.MessageStore {
+	switch backend {
+	case "none", "":
 		return dummystore.New(kvstore.NewMemoryKVStore())
+	case "memory":
+		logger.WithFields(log.Fields{
+			"maxMessages": *Config.MemoryStore.MaxMessages,
+			"maxBytes":    *Config.MemoryStore.MaxBytes,
+		}).Info("Using MemoryMessageStore")
+		return memorystore.New(*Config.MemoryStore.MaxMessages, *Config.MemoryStore.MaxBytes)
 	case "file":
-		logger.WithField("storagePath", *Config.StoragePath).Info("Using FileMessageStore in directory")
-		return filestore.New(*Config.StoragePath)
+		logger.WithField("storagePath", storagePath).Info("Using FileMessageStore in directory")
+		ms, err := filestore.NewWithOptions(storagePath, filestore.Options{
+			Keyring:      loadKeyring(),
+			SyncMode:     filestore.SyncMode(*Config.FileStore.Sync),
+			SyncInterval: *Config.FileStore.SyncInterval,
+			Archive:      archiveBlobStore(),
+			ArchiveAfter: *Config.FileStore.ArchiveAfter,
+			Quotas:       quotas(),
+			QuotaPolicy:  filestore.QuotaPolicy(*Config.FileStore.QuotaPolicy),
+		})
+		if err != nil {
+			logger.WithError(err).Panic("Could not open file message store")
+		}
+		return ms
+	case sqliteOption:
+		logger.WithField("storagePath", storagePath).Info("Using SQLMessageStore (sqlite) in directory")
+		warnIfEncryptionUnsupported(backend)
+		ms := sqlstore.NewSqliteMessageStore(path.Join(storagePath, "message-store.db"))
+		if err := ms.Open(); err != nil {
+			logger.WithError(err).Panic("Could not open sqlite message store")
+		}
+		return ms
+	case "postgres":
+		logger.Info("Using SQLMessageStore (postgres)")
+		warnIfEncryptionUnsupported(backend)
+		ms := sqlstore.NewPostgresMessageStore(postgresConfig())
+		if err := ms.Open(); err != nil {
+			logger.WithError(err).Panic("Could not open postgres message store")
+		}
+		return ms
 	default:
-		panic(fmt.Errorf("Unknown message-store backend: %q", *Config.MS))
+		panic(fmt.Errorf("Unknown message-store backend: %q", backend))
+	}
+}
+
+func warnIfEncryptionUnsupported(backend string) {
+	if loadKeyring() != nil {
+		logger.WithField("ms", backend).Warn("The messages are not encrypted by this message store")
 	}
 }
 
@@ -122,11 +373,26 @@ var CreateModules = func(router router.Router) []interface{} {
 	if wsHandler, err := websocket.NewWSHandler(router, "/stream/"); err != nil {
 		logger.WithError(err).Error("Error loading WSHandler module")
 	} else {
+		wsHandler.SetLimits(websocket.Limits{
+			MaxConnectionsPerUser: *Config.WS.MaxConnectionsPerUser,
+			MaxConnectionsPerIP:   *Config.WS.MaxConnectionsPerIP,
+			MaxSubscriptions:      *Config.WS.MaxSubscriptions,
+			MaxMessageSize:        *Config.WS.MaxMessageSize,
+			CommandRate:           *Config.WS.CommandRate,
+			CommandBurst:          *Config.WS.CommandBurst,
+			MaxViolations:         *Config.WS.MaxViolations,
+		})
 		modules = append(modules, wsHandler)
 	}
 
 	modules = append(modules, rest.NewRestMessageAPI(router, "/api/"))
 
+	// the admin API is only served with API keys, which protect it by the admin scope
+	if loadAPIKeys() != nil {
+		logger.WithField("prefix", defaultAdminPrefix).Info("Admin API: enabled")
+		modules = append(modules, rest.NewRestAdminAPI(router, defaultAdminPrefix))
+	}
+
 	if *Config.FCM.Enabled {
 		logger.Info("Firebase Cloud Messaging: enabled")
 		if *Config.FCM.APIKey == "" {
@@ -237,6 +503,20 @@ func Main() {
 		logger.Fatal("Fatal error in gubled in validation of storage path")
 	}
 
+	if command == migrateCommand {
+		if err := Migrate(); err != nil {
+			logger.WithError(err).Fatal("Migration of the message store failed")
+		}
+		return
+	}
+
+	if command == verifyAuditCommand {
+		if err := VerifyAudit(); err != nil {
+			logger.WithError(err).Fatal("Verification of the audit log failed")
+		}
+		return
+	}
+
 	srv := StartService()
 	if srv == nil {
 		logger.Fatal("exiting because of unrecoverable error(s) when starting the service")
@@ -254,9 +534,10 @@ func Main() {
 func StartService() *service.Service {
 	//TODO StartService could return an error in case it fails to start
 
-	accessManager := CreateAccessManager()
 	messageStore := CreateMessageStore()
 	kvStore := CreateKVStore()
+	accessManager := CreateAccessManager(kvStore)
+	store.PublishStats(messageStore)
 
 	var cl *cluster.Cluster
 	var err error
@@ -276,15 +557,45 @@ func StartService() *service.Service {
 		logger.Info("Starting in standalone-mode")
 	}
 
+	auditRecorder := CreateAuditRecorder()
+	if auditRecorder != nil {
+		logger.WithField("file", *Config.Audit.File).Info("Audit log: enabled")
+		audit.SetRecorder(auditRecorder)
+	}
+
 	r := router.New(accessManager, messageStore, kvStore, cl)
+	if auditRecorder != nil && *Config.Audit.Topic != "" {
+		auditRecorder.PublishTo(protocol.Path(*Config.Audit.Topic), r)
+	}
 	websrv := webserver.New(*Config.HttpListen)
+	if *Config.TLS.CertFile != "" || *Config.TLS.KeyFile != "" {
+		err = websrv.SetTLS(webserver.TLSConfig{
+			CertFile:           *Config.TLS.CertFile,
+			KeyFile:            *Config.TLS.KeyFile,
+			ClientCAFile:       *Config.TLS.ClientCAFile,
+			ClientCertOptional: *Config.TLS.ClientCertOptional,
+			ClientCertUserID:   *Config.TLS.ClientCertUserID,
+		})
+		if err != nil {
+			logger.WithError(err).Fatal("Could not load the TLS certificates")
+		}
+	}
+	if keys := loadAPIKeys(); keys != nil {
+		logger.Info("API keys: enabled")
+		websrv.SetAPIKeys(keys)
+	}
 
 	srv := service.New(r, websrv).
 		HealthEndpoint(*Config.HealthEndpoint).
-		MetricsEndpoint(*Config.MetricsEndpoint)
+		MetricsEndpoint(*Config.MetricsEndpoint).
+		PublicHealth(*Config.PublicHealth)
 
-	srv.RegisterModules(0, 6, kvStore, messageStore)
+	srv.RegisterModules(0, 6, kvStore, messageStore, accessManager)
 	srv.RegisterModules(4, 3, CreateModules(r)...)
+	if auditRecorder != nil {
+		// the audit log is closed after all the modules recording events are stopped
+		srv.RegisterModules(0, 7, auditRecorder)
+	}
 
 	if err = srv.Start(); err != nil {
 		logger.WithField("error", err.Error()).Error("errors occurred while starting service")
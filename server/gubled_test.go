@@ -1,8 +1,11 @@
 package server
 
 import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
 	"github.com/smancke/guble/server/kvstore"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/smancke/guble/testutil"
 	"github.com/stretchr/testify/assert"
 
@@ -45,6 +48,134 @@ func TestCreateKVStoreBackend(t *testing.T) {
 	*Config.StoragePath = dir
 	sqlite := CreateKVStore()
 	a.Equal("*kvstore.SqliteKVStore", reflect.TypeOf(sqlite).String())
+
+	*Config.KVS = "bolt"
+	bolt := CreateKVStore()
+	a.Equal("*kvstore.BoltKVStore", reflect.TypeOf(bolt).String())
+	a.NoError(bolt.(*kvstore.BoltKVStore).Stop())
+
+	redisServer, err := miniredis.Run()
+	a.NoError(err)
+	defer redisServer.Close()
+	*Config.KVS = "redis"
+	*Config.Redis.Addr = redisServer.Addr()
+	redis := CreateKVStore()
+	a.Equal("*kvstore.RedisKVStore", reflect.TypeOf(redis).String())
+	a.NoError(redis.(*kvstore.RedisKVStore).Stop())
+}
+
+func TestCreateAccessManager(t *testing.T) {
+	a := assert.New(t)
+	*Config.JWT.KeyFile = ""
+	allowAll := CreateAccessManager(nil)
+	a.Equal("auth.AllowAllAccessManager", reflect.TypeOf(allowAll).String())
+
+	f, err := ioutil.TempFile("", "guble_test")
+	a.NoError(err)
+	defer os.Remove(f.Name())
+	f.WriteString("secret")
+	f.Close()
+
+	*Config.JWT.Algorithm = "HS256"
+	*Config.JWT.KeyFile = f.Name()
+	jwt := CreateAccessManager(nil)
+	a.Equal("*auth.JWTAccessManager", reflect.TypeOf(jwt).String())
+	*Config.JWT.KeyFile = ""
+
+	aclFile, err := ioutil.TempFile("", "guble_test")
+	a.NoError(err)
+	defer os.Remove(aclFile.Name())
+	aclFile.WriteString(`{"rules": [{"users": ["*"], "access": ["read"], "paths": ["*"]}]}`)
+	aclFile.Close()
+
+	*Config.ACLFile = aclFile.Name()
+	defer func() { *Config.ACLFile = "" }()
+	acl := CreateAccessManager(nil)
+	a.Equal("*auth.ACLAccessManager", reflect.TypeOf(acl).String())
+	*Config.ACLFile = ""
+
+	*Config.RestAuth.URL = "http://localhost:8081/auth"
+	defer func() { *Config.RestAuth.URL = "" }()
+	rest := CreateAccessManager(nil)
+	a.Equal("*auth.RestAccessManager", reflect.TypeOf(rest).String())
+	*Config.RestAuth.URL = ""
+
+	*Config.RBAC = true
+	defer func() { *Config.RBAC = false }()
+	rbac := CreateAccessManager(kvstore.NewMemoryKVStore())
+	a.Equal("*auth.RBACAccessManager", reflect.TypeOf(rbac).String())
+}
+
+func TestCreateAccessManager_Chain(t *testing.T) {
+	a := assert.New(t)
+	*Config.AccessChain = "any(rbac, first(deny))"
+	defer func() { *Config.AccessChain = "" }()
+
+	chain := CreateAccessManager(kvstore.NewMemoryKVStore())
+	a.Equal("*auth.Chain", reflect.TypeOf(chain).String())
+	a.False(chain.IsAllowed(auth.READ, "user01", "/foo"))
+
+	*Config.AccessChain = "all(acl, allow)"
+	a.Panics(func() { CreateAccessManager(nil) }, "the ACL file is not configured")
+	*Config.AccessChain = "all(unknown)"
+	a.Panics(func() { CreateAccessManager(nil) })
+}
+
+func TestCreateMessageStoreBackend(t *testing.T) {
+	a := assert.New(t)
+	*Config.MS = "memory"
+	memory := CreateMessageStore()
+	a.Equal("*memorystore.MemoryMessageStore", reflect.TypeOf(memory).String())
+
+	*Config.MS = "none"
+	dummy := CreateMessageStore()
+	a.Equal("*dummystore.DummyMessageStore", reflect.TypeOf(dummy).String())
+
+	dir, _ := ioutil.TempDir("", "guble_test")
+	defer os.RemoveAll(dir)
+
+	*Config.MS = "file"
+	*Config.StoragePath = dir
+	file := CreateMessageStore()
+	a.Equal("*filestore.FileMessageStore", reflect.TypeOf(file).String())
+
+	*Config.MS = "sqlite"
+	sqlite := CreateMessageStore()
+	a.Equal("*sqlstore.SQLMessageStore", reflect.TypeOf(sqlite).String())
+}
+
+func TestMigrate(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_test")
+	defer os.RemoveAll(dir)
+
+	*Config.MS = "file"
+	*Config.StoragePath = dir
+	*Config.Migrate.To = "sqlite"
+	*Config.Migrate.StoragePath = ""
+	*Config.Migrate.BatchSize = 2
+
+	source := CreateMessageStore()
+	for i := 0; i < 5; i++ {
+		_, err := source.StoreMessage(&protocol.Message{Path: "/topic", Body: []byte("body")}, 1)
+		a.NoError(err)
+	}
+	maxID, err := source.MaxMessageID("topic")
+	a.NoError(err)
+	stopMessageStore(source)
+
+	a.NoError(Migrate())
+
+	target := newMessageStore("sqlite", dir)
+	defer stopMessageStore(target)
+	p, err := target.Partition("topic")
+	a.NoError(err)
+	a.Equal(uint64(5), p.Count())
+	a.Equal(maxID, p.MaxMessageID())
+
+	// migrating to the same store is rejected
+	*Config.Migrate.To = "file"
+	a.Error(Migrate())
 }
 
 func TestFCMOnlyStartedIfEnabled(t *testing.T) {
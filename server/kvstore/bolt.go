@@ -0,0 +1,454 @@
+package kvstore
+
+import (
+	log "github.com/Sirupsen/logrus"
+
+	bolt "go.etcd.io/bbolt"
+
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"time"
+)
+
+const (
+	boltOpenTimeout = time.Second
+
+	// boltExpiryLength is the length of the expiry time, stored before each value.
+	boltExpiryLength = 8
+)
+
+var errInvalidBoltValue = errors.New("kv-bolt: invalid stored value")
+
+// BoltKVStore is a KVStore embedded in a single file, implemented in pure Go with bbolt.
+// Each schema is stored in a bucket, in which the keys are sorted, so that the prefix iterations are seeks.
+// The stored values are prefixed with their expiry time in unix nanoseconds (0 if they do not expire).
+type BoltKVStore struct {
+	db       *bolt.DB
+	filename string
+	logger   *log.Entry
+	sweeper  *sweeper
+	watchers watchers
+}
+
+// NewBoltKVStore returns a new configured BoltKVStore (not opened yet).
+func NewBoltKVStore(filename string) *BoltKVStore {
+	return &BoltKVStore{
+		filename: filename,
+		logger: log.WithFields(log.Fields{
+			"module":   "kv-bolt",
+			"filename": filename,
+		}),
+	}
+}
+
+// Open opens the database file. If the directory does not exist, it will be created.
+func (kvStore *BoltKVStore) Open() error {
+	if err := ensureWriteableDirectory(filepath.Dir(kvStore.filename)); err != nil {
+		kvStore.logger.WithError(err).Error("DB Directory is not writeable")
+		return err
+	}
+
+	kvStore.logger.Info("Opening database")
+	db, err := bolt.Open(kvStore.filename, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		kvStore.logger.WithError(err).Error("Error opening database")
+		return err
+	}
+	kvStore.db = db
+	return nil
+}
+
+// Start the periodic removal of the expired entries.
+func (kvStore *BoltKVStore) Start() error {
+	kvStore.sweeper = &sweeper{sweep: kvStore.sweep, logger: kvStore.logger}
+	kvStore.sweeper.start()
+	return nil
+}
+
+// Stop the periodic removal of the expired entries, and close the database.
+func (kvStore *BoltKVStore) Stop() error {
+	if kvStore.sweeper != nil {
+		kvStore.sweeper.stop()
+	}
+	if kvStore.db != nil {
+		err := kvStore.db.Close()
+		kvStore.db = nil
+		return err
+	}
+	return nil
+}
+
+// Check returns an error if the database is not opened.
+func (kvStore *BoltKVStore) Check() error {
+	if kvStore.db == nil {
+		errorMessage := "Error: Database is not initialized (nil)"
+		kvStore.logger.Error(errorMessage)
+		return errors.New(errorMessage)
+	}
+	return nil
+}
+
+// Put implements the `kvstore` Put func.
+func (kvStore *BoltKVStore) Put(schema, key string, value []byte) error {
+	return kvStore.PutWithTTL(schema, key, value, 0)
+}
+
+// PutWithTTL implements the `kvstore` PutWithTTL func.
+func (kvStore *BoltKVStore) PutWithTTL(schema, key string, value []byte, ttl time.Duration) error {
+	err := kvStore.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, schema, key, value, expiryTime(ttl))
+	})
+	if err != nil {
+		return err
+	}
+	kvStore.watchers.notify(Event{Type: EventPut, Schema: schema, Key: key, Value: value})
+	return nil
+}
+
+// Get implements the `kvstore` Get func.
+func (kvStore *BoltKVStore) Get(schema, key string) ([]byte, bool, error) {
+	var value []byte
+	var exists, expired bool
+	now := time.Now()
+	err := kvStore.db.View(func(tx *bolt.Tx) error {
+		v, err := boltGet(tx, schema, key, time.Time{})
+		if err != nil || v == nil {
+			return err
+		}
+		expired = v.expired(now)
+		if !expired {
+			value, exists = v.copyValue(), true
+		}
+		return nil
+	})
+	if err != nil || !expired {
+		return value, exists, err
+	}
+
+	// the expiry is checked again, so that an entry which was put again in the meantime is kept
+	err = kvStore.db.Update(func(tx *bolt.Tx) error {
+		v, err := boltGet(tx, schema, key, time.Time{})
+		if err != nil || v == nil || !v.expired(now) {
+			return err
+		}
+		return tx.Bucket([]byte(schema)).Delete([]byte(key))
+	})
+	return nil, false, err
+}
+
+// Delete implements the `kvstore` Delete func.
+func (kvStore *BoltKVStore) Delete(schema, key string) error {
+	var deleted bool
+	err := kvStore.db.Update(func(tx *bolt.Tx) (err error) {
+		deleted, err = boltDelete(tx, schema, key, time.Now())
+		return
+	})
+	if err != nil {
+		return err
+	}
+	if deleted {
+		kvStore.watchers.notify(Event{Type: EventDelete, Schema: schema, Key: key})
+	}
+	return nil
+}
+
+// Iterate implements the `kvstore` Iterate func.
+// The entries are read before sending them, so that the consumer can modify the store while receiving.
+func (kvStore *BoltKVStore) Iterate(schema string, keyPrefix string) chan [2]string {
+	responseC := make(chan [2]string, responseChannelSize)
+	go func() {
+		var entries [][2]string
+		err := kvStore.scan(schema, keyPrefix, func(key []byte, v boltValue) {
+			entries = append(entries, [2]string{string(key), string(v.value())})
+		})
+		if err != nil {
+			kvStore.logger.WithError(err).Error("Error fetching entries from database")
+		}
+		for _, entry := range entries {
+			responseC <- entry
+		}
+		close(responseC)
+	}()
+	return responseC
+}
+
+// IterateKeys implements the `kvstore` IterateKeys func.
+func (kvStore *BoltKVStore) IterateKeys(schema string, keyPrefix string) chan string {
+	responseC := make(chan string, responseChannelSize)
+	go func() {
+		var keys []string
+		err := kvStore.scan(schema, keyPrefix, func(key []byte, v boltValue) {
+			keys = append(keys, string(key))
+		})
+		if err != nil {
+			kvStore.logger.WithError(err).Error("Error fetching keys from database")
+		}
+		for _, key := range keys {
+			responseC <- key
+		}
+		close(responseC)
+	}()
+	return responseC
+}
+
+// IteratePage implements the `kvstore` IteratePage func.
+func (kvStore *BoltKVStore) IteratePage(ctx context.Context, schema, keyPrefix, cursor string, limit int) ([][2]string, string, error) {
+	if limit <= 0 {
+		return nil, "", ErrInvalidLimit
+	}
+	after, err := decodeKeyCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var entries [][2]string
+	now := time.Now()
+	err = kvStore.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(schema))
+		if bucket == nil {
+			return nil
+		}
+		prefix := []byte(keyPrefix)
+		c := bucket.Cursor()
+		key, data := c.Seek(prefix)
+		if after > keyPrefix {
+			key, data = c.Seek([]byte(after))
+			if key != nil && string(key) == after {
+				key, data = c.Next()
+			}
+		}
+
+		// one more entry is read, for knowing if there is a next page
+		for ; key != nil && bytes.HasPrefix(key, prefix) && len(entries) <= limit; key, data = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			v, err := parseBoltValue(data)
+			if err != nil {
+				return err
+			}
+			if !v.expired(now) {
+				entries = append(entries, [2]string{string(key), string(v.value())})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	entries, next := keyPage(entries, limit)
+	return entries, next, nil
+}
+
+// Batch implements the `kvstore` Batch func.
+func (kvStore *BoltKVStore) Batch(operations []Operation) error {
+	var events []Event
+	err := kvStore.db.Update(func(tx *bolt.Tx) error {
+		events = make([]Event, 0, len(operations))
+		now := time.Now()
+		for _, op := range operations {
+			if op.Compare {
+				current, err := boltGet(tx, op.Schema, op.Key, now)
+				if err != nil {
+					return err
+				}
+				if (current != nil) != (op.OldValue != nil) || (current != nil && !bytes.Equal(current.value(), op.OldValue)) {
+					return ErrBatchConflict
+				}
+			}
+			if !op.Delete {
+				if err := boltPut(tx, op.Schema, op.Key, op.Value, time.Time{}); err != nil {
+					return err
+				}
+				events = append(events, Event{Type: EventPut, Schema: op.Schema, Key: op.Key, Value: op.Value})
+				continue
+			}
+			deleted, err := boltDelete(tx, op.Schema, op.Key, now)
+			if err != nil {
+				return err
+			}
+			if deleted {
+				events = append(events, Event{Type: EventDelete, Schema: op.Schema, Key: op.Key})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	kvStore.watchers.notify(events...)
+	return nil
+}
+
+// CompareAndSwap implements the `kvstore` CompareAndSwap func.
+func (kvStore *BoltKVStore) CompareAndSwap(schema, key string, oldValue, newValue []byte) (bool, error) {
+	var swapped bool
+	err := kvStore.db.Update(func(tx *bolt.Tx) error {
+		current, err := boltGet(tx, schema, key, time.Now())
+		if err != nil {
+			return err
+		}
+		if (current != nil) != (oldValue != nil) || (current != nil && !bytes.Equal(current.value(), oldValue)) {
+			return nil
+		}
+		swapped = true
+		if newValue != nil {
+			return boltPut(tx, schema, key, newValue, time.Time{})
+		}
+		if current != nil {
+			return tx.Bucket([]byte(schema)).Delete([]byte(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	// nothing is changed, if only the absence of the entry was verified
+	if swapped && (oldValue != nil || newValue != nil) {
+		kvStore.watchers.notify(changeEvent(schema, key, newValue))
+	}
+	return swapped, nil
+}
+
+// Watch implements the `kvstore` Watch func.
+func (kvStore *BoltKVStore) Watch(schema, keyPrefix string) (chan Event, func()) {
+	return kvStore.watchers.add(schema, keyPrefix)
+}
+
+// scan calls the func for each entry of the schema which matches the keyPrefix and is not expired.
+// The key and the value are only valid during the call.
+func (kvStore *BoltKVStore) scan(schema, keyPrefix string, f func(key []byte, v boltValue)) error {
+	now := time.Now()
+	return kvStore.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(schema))
+		if bucket == nil {
+			return nil
+		}
+		prefix := []byte(keyPrefix)
+		c := bucket.Cursor()
+		for key, data := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, data = c.Next() {
+			v, err := parseBoltValue(data)
+			if err != nil {
+				return err
+			}
+			if !v.expired(now) {
+				f(key, v)
+			}
+		}
+		return nil
+	})
+}
+
+// sweep removes all the expired entries.
+func (kvStore *BoltKVStore) sweep() error {
+	now := time.Now()
+	return kvStore.db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(_ []byte, bucket *bolt.Bucket) error {
+			var expired [][]byte
+			err := bucket.ForEach(func(key, data []byte) error {
+				v, err := parseBoltValue(data)
+				if err != nil {
+					return err
+				}
+				if v.expired(now) {
+					expired = append(expired, key)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, key := range expired {
+				if err := bucket.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// boltValue is a stored value, prefixed with its expiry time.
+type boltValue []byte
+
+func newBoltValue(value []byte, expiry time.Time) boltValue {
+	v := make(boltValue, boltExpiryLength+len(value))
+	if !expiry.IsZero() {
+		binary.BigEndian.PutUint64(v, uint64(expiry.UnixNano()))
+	}
+	copy(v[boltExpiryLength:], value)
+	return v
+}
+
+func parseBoltValue(data []byte) (boltValue, error) {
+	if len(data) < boltExpiryLength {
+		return nil, errInvalidBoltValue
+	}
+	return boltValue(data), nil
+}
+
+func (v boltValue) expired(now time.Time) bool {
+	expiresAt := int64(binary.BigEndian.Uint64(v))
+	return expiresAt != 0 && expiresAt <= now.UnixNano()
+}
+
+func (v boltValue) value() []byte {
+	return v[boltExpiryLength:]
+}
+
+// copyValue returns a copy of the value, which is valid also after the transaction.
+func (v boltValue) copyValue() []byte {
+	value := make([]byte, len(v)-boltExpiryLength)
+	copy(value, v.value())
+	return value
+}
+
+func boltPut(tx *bolt.Tx, schema, key string, value []byte, expiry time.Time) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(schema))
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), newBoltValue(value, expiry))
+}
+
+// boltGet returns the stored value, or nil if it does not exist or is expired at the given time.
+// A zero time returns also the expired values.
+func boltGet(tx *bolt.Tx, schema, key string, now time.Time) (boltValue, error) {
+	bucket := tx.Bucket([]byte(schema))
+	if bucket == nil {
+		return nil, nil
+	}
+	data := bucket.Get([]byte(key))
+	if data == nil {
+		return nil, nil
+	}
+	v, err := parseBoltValue(data)
+	if err != nil || (!now.IsZero() && v.expired(now)) {
+		return nil, err
+	}
+	return v, nil
+}
+
+// boltDelete deletes the entry, and returns true if it existed and was not expired.
+func boltDelete(tx *bolt.Tx, schema, key string, now time.Time) (bool, error) {
+	bucket := tx.Bucket([]byte(schema))
+	if bucket == nil {
+		return false, nil
+	}
+	data := bucket.Get([]byte(key))
+	if data == nil {
+		return false, nil
+	}
+	v, err := parseBoltValue(data)
+	if err != nil {
+		return false, err
+	}
+	existed := !v.expired(now)
+	return existed, bucket.Delete([]byte(key))
+}
@@ -0,0 +1,119 @@
+package kvstore
+
+import (
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+
+	"os"
+	"testing"
+)
+
+func newTestBoltKVStore(t testing.TB) (*BoltKVStore, func()) {
+	f := tempFilename()
+	db := NewBoltKVStore(f)
+	assert.NoError(t, db.Open())
+	return db, func() {
+		db.Stop()
+		os.Remove(f)
+	}
+}
+
+func BenchmarkBoltPutGet(b *testing.B) {
+	db, cleanup := newTestBoltKVStore(b)
+	defer cleanup()
+	CommonBenchmarkPutGet(b, db)
+}
+
+func TestBoltPutGetDelete(t *testing.T) {
+	db, cleanup := newTestBoltKVStore(t)
+	defer cleanup()
+	CommonTestPutGetDelete(t, db, db)
+}
+
+func TestBoltIterate(t *testing.T) {
+	db, cleanup := newTestBoltKVStore(t)
+	defer cleanup()
+	CommonTestIterate(t, db, db)
+}
+
+func TestBoltIterateKeys(t *testing.T) {
+	db, cleanup := newTestBoltKVStore(t)
+	defer cleanup()
+	CommonTestIterateKeys(t, db, db)
+}
+
+func TestBoltIteratePage(t *testing.T) {
+	db, cleanup := newTestBoltKVStore(t)
+	defer cleanup()
+	CommonTestIteratePage(t, db, db)
+}
+
+func TestBoltIteratePageSorted(t *testing.T) {
+	db, cleanup := newTestBoltKVStore(t)
+	defer cleanup()
+	CommonTestIteratePageSorted(t, db)
+}
+
+func TestBoltPutWithTTL(t *testing.T) {
+	db, cleanup := newTestBoltKVStore(t)
+	defer cleanup()
+	CommonTestPutWithTTL(t, db, db)
+}
+
+func TestBoltBatch(t *testing.T) {
+	db, cleanup := newTestBoltKVStore(t)
+	defer cleanup()
+	CommonTestBatch(t, db, db)
+}
+
+func TestBoltCompareAndSwap(t *testing.T) {
+	db, cleanup := newTestBoltKVStore(t)
+	defer cleanup()
+	CommonTestCompareAndSwap(t, db, db)
+	CommonTestConcurrentCompareAndSwap(t, db)
+}
+
+func TestBoltWatch(t *testing.T) {
+	db, cleanup := newTestBoltKVStore(t)
+	defer cleanup()
+	CommonTestWatch(t, db, db)
+}
+
+func TestBoltSweep(t *testing.T) {
+	db, cleanup := newTestBoltKVStore(t)
+	defer cleanup()
+	CommonTestSweep(t, db, db.sweep, func(schema string) int {
+		count := 0
+		db.db.View(func(tx *bolt.Tx) error {
+			count = tx.Bucket([]byte(schema)).Stats().KeyN
+			return nil
+		})
+		return count
+	})
+}
+
+func TestBoltReopen(t *testing.T) {
+	a := assert.New(t)
+	f := tempFilename()
+	defer os.Remove(f)
+
+	db := NewBoltKVStore(f)
+	a.NoError(db.Open())
+	a.NoError(db.Put("s1", "bli", test1))
+	a.NoError(db.Stop())
+
+	db = NewBoltKVStore(f)
+	a.NoError(db.Open())
+	defer db.Stop()
+	assertGet(a, db, "s1", "bli", test1)
+}
+
+func TestCheck_BoltKVStore(t *testing.T) {
+	a := assert.New(t)
+	db, cleanup := newTestBoltKVStore(t)
+	defer cleanup()
+
+	a.NoError(db.Check())
+	a.NoError(db.Stop())
+	a.Error(db.Check())
+}
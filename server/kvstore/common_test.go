@@ -3,9 +3,12 @@ package kvstore
 import (
 	"github.com/stretchr/testify/assert"
 
+	"context"
 	"crypto/rand"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -65,6 +68,185 @@ func CommonTestIterate(t *testing.T, kvs1 KVStore, kvs2 KVStore) {
 		[2]string{"bli", string(test2)})
 }
 
+func CommonTestPutWithTTL(t *testing.T, kvs1 KVStore, kvs2 KVStore) {
+	a := assert.New(t)
+
+	a.NoError(kvs1.PutWithTTL("s1", "short", test1, 50*time.Millisecond))
+	a.NoError(kvs1.PutWithTTL("s1", "long", test2, time.Hour))
+	a.NoError(kvs1.PutWithTTL("s1", "never", test3, 0))
+	a.NoError(kvs1.PutWithTTL("s1", "renewed", test1, 50*time.Millisecond))
+	a.NoError(kvs1.Put("s1", "renewed", test1))
+
+	assertGet(a, kvs2, "s1", "short", test1)
+	assertChannelContains(a, kvs2.IterateKeys("s1", ""),
+		"short", "long", "never", "renewed")
+
+	time.Sleep(100 * time.Millisecond)
+
+	assertGetNoExist(a, kvs2, "s1", "short")
+	assertGet(a, kvs2, "s1", "long", test2)
+	assertGet(a, kvs2, "s1", "never", test3)
+	assertGet(a, kvs2, "s1", "renewed", test1)
+
+	a.NoError(kvs1.PutWithTTL("s1", "short", test2, 50*time.Millisecond))
+	time.Sleep(100 * time.Millisecond)
+
+	// expired entries are skipped also before they are removed
+	assertChannelContainsEntries(a, kvs2.Iterate("s1", ""),
+		[2]string{"long", string(test2)},
+		[2]string{"never", string(test3)},
+		[2]string{"renewed", string(test1)})
+	assertChannelContains(a, kvs2.IterateKeys("s1", ""),
+		"long", "never", "renewed")
+}
+
+// CommonTestSweep verifies that sweep removes the expired entries,
+// using the function counting all the stored entries of a schema, including the expired ones.
+func CommonTestSweep(t *testing.T, kvs KVStore, sweep func() error, count func(schema string) int) {
+	a := assert.New(t)
+
+	a.NoError(kvs.PutWithTTL("s1", "short", test1, 50*time.Millisecond))
+	a.NoError(kvs.PutWithTTL("s1", "long", test2, time.Hour))
+	a.NoError(kvs.Put("s1", "never", test3))
+	time.Sleep(100 * time.Millisecond)
+
+	a.Equal(3, count("s1"))
+	a.NoError(sweep())
+	a.Equal(2, count("s1"))
+	assertGet(a, kvs, "s1", "long", test2)
+	assertGet(a, kvs, "s1", "never", test3)
+}
+
+func CommonTestBatch(t *testing.T, kvs1 KVStore, kvs2 KVStore) {
+	a := assert.New(t)
+
+	a.NoError(kvs1.Put("s1", "deleted", test1))
+	a.NoError(kvs1.PutWithTTL("s1", "replaced", test1, 50*time.Millisecond))
+
+	a.NoError(kvs1.Batch([]Operation{
+		{Schema: "s1", Key: "new", Value: test1},
+		{Schema: "s2", Key: "new", Value: test2},
+		{Schema: "s1", Key: "deleted", Delete: true},
+		{Schema: "s1", Key: "replaced", Value: test3},
+		{Schema: "s1", Key: "not existing", Delete: true},
+	}))
+
+	assertGet(a, kvs2, "s1", "new", test1)
+	assertGet(a, kvs2, "s2", "new", test2)
+	assertGetNoExist(a, kvs2, "s1", "deleted")
+
+	// the ttl is removed by the batch
+	time.Sleep(100 * time.Millisecond)
+	assertGet(a, kvs2, "s1", "replaced", test3)
+
+	a.NoError(kvs1.Batch(nil))
+
+	// nothing is applied, if a compared entry differs
+	a.Equal(ErrBatchConflict, kvs1.Batch([]Operation{
+		{Schema: "s1", Key: "new", Value: test2, Compare: true, OldValue: test1},
+		{Schema: "s1", Key: "replaced", Value: test1, Compare: true, OldValue: test1},
+	}))
+	assertGet(a, kvs2, "s1", "new", test1)
+	assertGet(a, kvs2, "s1", "replaced", test3)
+	a.Equal(ErrBatchConflict, kvs1.Batch([]Operation{
+		{Schema: "s1", Key: "new", Value: test2, Compare: true, OldValue: test1},
+		{Schema: "s1", Key: "replaced", Compare: true},
+	}))
+	assertGet(a, kvs2, "s1", "new", test1)
+
+	// the compared entries are written, if they are all equal
+	a.NoError(kvs1.Batch([]Operation{
+		{Schema: "s1", Key: "new", Value: test2, Compare: true, OldValue: test1},
+		{Schema: "s1", Key: "replaced", Delete: true, Compare: true, OldValue: test3},
+		{Schema: "s1", Key: "inserted", Value: test3, Compare: true},
+	}))
+	assertGet(a, kvs2, "s1", "new", test2)
+	assertGetNoExist(a, kvs2, "s1", "replaced")
+	assertGet(a, kvs2, "s1", "inserted", test3)
+}
+
+func CommonTestCompareAndSwap(t *testing.T, kvs1 KVStore, kvs2 KVStore) {
+	a := assert.New(t)
+
+	// insert, only if not existing
+	swapped, err := kvs1.CompareAndSwap("s1", "a", nil, test1)
+	a.NoError(err)
+	a.True(swapped)
+	swapped, err = kvs2.CompareAndSwap("s1", "a", nil, test2)
+	a.NoError(err)
+	a.False(swapped)
+	assertGet(a, kvs2, "s1", "a", test1)
+
+	// replace, only if equal
+	swapped, err = kvs2.CompareAndSwap("s1", "a", test2, test3)
+	a.NoError(err)
+	a.False(swapped)
+	swapped, err = kvs2.CompareAndSwap("s1", "a", test1, test2)
+	a.NoError(err)
+	a.True(swapped)
+	assertGet(a, kvs1, "s1", "a", test2)
+
+	// a not existing entry does not equal any value
+	swapped, err = kvs1.CompareAndSwap("s1", "b", test1, test2)
+	a.NoError(err)
+	a.False(swapped)
+	assertGetNoExist(a, kvs1, "s1", "b")
+
+	// delete, only if equal
+	swapped, err = kvs1.CompareAndSwap("s1", "a", test1, nil)
+	a.NoError(err)
+	a.False(swapped)
+	swapped, err = kvs1.CompareAndSwap("s1", "a", test2, nil)
+	a.NoError(err)
+	a.True(swapped)
+	assertGetNoExist(a, kvs2, "s1", "a")
+
+	// an expired entry does not exist
+	a.NoError(kvs1.PutWithTTL("s1", "c", test1, 50*time.Millisecond))
+	time.Sleep(100 * time.Millisecond)
+	swapped, err = kvs1.CompareAndSwap("s1", "c", test1, test2)
+	a.NoError(err)
+	a.False(swapped)
+	swapped, err = kvs1.CompareAndSwap("s1", "c", nil, test3)
+	a.NoError(err)
+	a.True(swapped)
+	assertGet(a, kvs2, "s1", "c", test3)
+}
+
+// CommonTestConcurrentCompareAndSwap verifies that concurrent increments using CompareAndSwap are not lost.
+func CommonTestConcurrentCompareAndSwap(t *testing.T, kvs KVStore) {
+	a := assert.New(t)
+	const workers, increments = 4, 10
+
+	increment := func() error {
+		for {
+			old, _, err := kvs.Get("s1", "counter")
+			if err != nil {
+				return err
+			}
+			n, _ := strconv.Atoi(string(old))
+			swapped, err := kvs.CompareAndSwap("s1", "counter", old, []byte(strconv.Itoa(n+1)))
+			if err != nil || swapped {
+				return err
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				a.NoError(increment())
+			}
+		}()
+	}
+	wg.Wait()
+
+	assertGet(a, kvs, "s1", "counter", []byte(strconv.Itoa(workers*increments)))
+}
+
 func assertChannelContainsEntries(a *assert.Assertions, entryC chan [2]string, expectedEntries ...[2]string) {
 	var allEntries [][2]string
 
@@ -110,6 +292,124 @@ func CommonTestIterateKeys(t *testing.T, kvs1 KVStore, kvs2 KVStore) {
 		"bli")
 }
 
+func CommonTestIteratePage(t *testing.T, kvs1 KVStore, kvs2 KVStore) {
+	a := assert.New(t)
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		a.NoError(kvs1.Put("s1", "bl"+strconv.Itoa(i), []byte(strconv.Itoa(i))))
+	}
+	a.NoError(kvs1.Put("s1", "other", test1))
+	a.NoError(kvs1.Put("s2", "bl9", test1))
+
+	var allEntries [][2]string
+	var pageSizes []int
+	cursor := ""
+	for {
+		entries, next, err := kvs2.IteratePage(ctx, "s1", "bl", cursor, 2)
+		a.NoError(err)
+		allEntries = append(allEntries, entries...)
+		pageSizes = append(pageSizes, len(entries))
+		if next == "" || len(pageSizes) > 5 {
+			break
+		}
+		cursor = next
+	}
+	a.Equal([]int{2, 2, 1}, pageSizes)
+	a.Equal(5, len(allEntries))
+	for i := 0; i < 5; i++ {
+		a.Contains(allEntries, [2]string{"bl" + strconv.Itoa(i), strconv.Itoa(i)})
+	}
+
+	entries, next, err := kvs2.IteratePage(ctx, "s1", "", "", 10)
+	a.NoError(err)
+	a.Equal(6, len(entries))
+	a.Equal("", next)
+
+	entries, next, err = kvs2.IteratePage(ctx, "s1", "nothing", "", 10)
+	a.NoError(err)
+	a.Empty(entries)
+	a.Equal("", next)
+
+	_, _, err = kvs2.IteratePage(ctx, "s1", "", "%invalid%", 10)
+	a.Equal(ErrInvalidCursor, err)
+
+	_, _, err = kvs2.IteratePage(ctx, "s1", "", "", 0)
+	a.Equal(ErrInvalidLimit, err)
+
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = kvs2.IteratePage(cancelledCtx, "s1", "", "", 10)
+	a.Equal(context.Canceled, err)
+}
+
+// CommonTestIteratePageSorted verifies the order of the entries, for the stores sorting them by key.
+func CommonTestIteratePageSorted(t *testing.T, kvs KVStore) {
+	a := assert.New(t)
+
+	a.NoError(kvs.Put("s1", "c", test3))
+	a.NoError(kvs.Put("s1", "a", test1))
+	a.NoError(kvs.Put("s1", "b", test2))
+
+	entries, next, err := kvs.IteratePage(context.Background(), "s1", "", "", 2)
+	a.NoError(err)
+	a.Equal([][2]string{{"a", string(test1)}, {"b", string(test2)}}, entries)
+
+	// an entry inserted before the cursor is not returned
+	a.NoError(kvs.Put("s1", "aa", test1))
+	entries, next, err = kvs.IteratePage(context.Background(), "s1", "", next, 2)
+	a.NoError(err)
+	a.Equal([][2]string{{"c", string(test3)}}, entries)
+	a.Equal("", next)
+}
+
+func CommonTestWatch(t *testing.T, kvs1 KVStore, kvs2 KVStore) {
+	a := assert.New(t)
+
+	events, cancel := kvs2.Watch("s1", "b")
+
+	a.NoError(kvs1.Put("s1", "bli", test1))
+	a.NoError(kvs1.Put("s1", "other", test1))
+	a.NoError(kvs1.Put("s2", "bla", test1))
+	a.NoError(kvs1.Delete("s1", "bli"))
+	a.NoError(kvs1.Delete("s1", "bli"))
+	a.NoError(kvs1.Batch([]Operation{
+		{Schema: "s1", Key: "bla", Value: test2},
+		{Schema: "s1", Key: "blu", Delete: true},
+	}))
+	swapped, err := kvs1.CompareAndSwap("s1", "bla", test1, test3)
+	a.NoError(err)
+	a.False(swapped)
+	swapped, err = kvs1.CompareAndSwap("s1", "bla", test2, test3)
+	a.NoError(err)
+	a.True(swapped)
+	swapped, err = kvs1.CompareAndSwap("s1", "bla", test3, nil)
+	a.NoError(err)
+	a.True(swapped)
+
+	assertEvent(a, events, Event{Type: EventPut, Schema: "s1", Key: "bli", Value: test1})
+	assertEvent(a, events, Event{Type: EventDelete, Schema: "s1", Key: "bli"})
+	assertEvent(a, events, Event{Type: EventPut, Schema: "s1", Key: "bla", Value: test2})
+	assertEvent(a, events, Event{Type: EventPut, Schema: "s1", Key: "bla", Value: test3})
+	assertEvent(a, events, Event{Type: EventDelete, Schema: "s1", Key: "bla"})
+
+	// no other events were sent
+	cancel()
+	cancel()
+	_, ok := <-events
+	a.False(ok)
+}
+
+func assertEvent(a *assert.Assertions, events chan Event, expected Event) {
+	select {
+	case event, ok := <-events:
+		a.True(ok)
+		a.Equal(expected, event)
+	case <-time.After(time.Second):
+		a.Fail("timeout waiting for event", "%v", expected)
+	}
+}
+
 func assertChannelContains(a *assert.Assertions, entryC chan string, expectedEntries ...string) {
 	var allEntries []string
 
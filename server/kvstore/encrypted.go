@@ -0,0 +1,279 @@
+package kvstore
+
+import (
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/smancke/guble/server/encryption"
+
+	"bytes"
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	encryptionSchema    = "guble_encryption"
+	encryptionMarkerKey = "key_ids"
+)
+
+var encryptedLogger = log.WithField("module", "kv-encrypted")
+
+// EncryptedKVStore is a KVStore which encrypts the values before storing them in the wrapped KVStore.
+// The schemas and keys are not encrypted, since they are used for lookups and iterations.
+type EncryptedKVStore struct {
+	kvStore KVStore
+	keyring *encryption.Keyring
+}
+
+// NewEncryptedKVStore returns a new EncryptedKVStore wrapping the KVStore.
+// CheckEncryption should be called before, for verifying that all the keys used for the stored values are available.
+func NewEncryptedKVStore(kvStore KVStore, keyring *encryption.Keyring) *EncryptedKVStore {
+	return &EncryptedKVStore{
+		kvStore: kvStore,
+		keyring: keyring,
+	}
+}
+
+// CheckEncryption verifies that the keyring contains all the keys used for encrypting values in the KVStore,
+// and records the current key of the keyring in the KVStore.
+// The keyring is nil if the encryption is disabled, in which case an error is returned if any value was encrypted.
+func CheckEncryption(kvStore KVStore, keyring *encryption.Keyring) error {
+	data, _, err := kvStore.Get(encryptionSchema, encryptionMarkerKey)
+	if err != nil {
+		return err
+	}
+	used, err := encryption.ParseKeyIDs(data)
+	if err != nil {
+		return err
+	}
+
+	updated, err := encryption.CheckUsedKeys(keyring, used)
+	if err != nil {
+		return err
+	}
+	if len(updated) == len(used) {
+		return nil
+	}
+	return kvStore.Put(encryptionSchema, encryptionMarkerKey, encryption.FormatKeyIDs(updated))
+}
+
+// Put implements the `kvstore` Put func.
+func (kvStore *EncryptedKVStore) Put(schema, key string, value []byte) error {
+	data, err := kvStore.keyring.Encrypt(value)
+	if err != nil {
+		return err
+	}
+	return kvStore.kvStore.Put(schema, key, data)
+}
+
+// PutWithTTL implements the `kvstore` PutWithTTL func.
+func (kvStore *EncryptedKVStore) PutWithTTL(schema, key string, value []byte, ttl time.Duration) error {
+	data, err := kvStore.keyring.Encrypt(value)
+	if err != nil {
+		return err
+	}
+	return kvStore.kvStore.PutWithTTL(schema, key, data, ttl)
+}
+
+// Get implements the `kvstore` Get func.
+func (kvStore *EncryptedKVStore) Get(schema, key string) ([]byte, bool, error) {
+	data, exists, err := kvStore.kvStore.Get(schema, key)
+	if err != nil || !exists {
+		return data, exists, err
+	}
+	value, err := kvStore.keyring.Decrypt(data)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// Batch implements the `kvstore` Batch func.
+func (kvStore *EncryptedKVStore) Batch(operations []Operation) error {
+	encrypted := make([]Operation, len(operations))
+	for i, op := range operations {
+		encrypted[i] = op
+		if op.Compare && op.OldValue != nil {
+			// the encryption of the same value differs, so the current encrypted value is compared by the store
+			data, exists, err := kvStore.kvStore.Get(op.Schema, op.Key)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return ErrBatchConflict
+			}
+			current, err := kvStore.keyring.Decrypt(data)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(current, op.OldValue) {
+				return ErrBatchConflict
+			}
+			encrypted[i].OldValue = data
+		}
+		if op.Delete {
+			continue
+		}
+		data, err := kvStore.keyring.Encrypt(op.Value)
+		if err != nil {
+			return err
+		}
+		encrypted[i].Value = data
+	}
+	return kvStore.kvStore.Batch(encrypted)
+}
+
+// CompareAndSwap implements the `kvstore` CompareAndSwap func.
+// Since the encryption of the same value differs each time, the old value is compared after decrypting
+// the current value, and the swap is done with the current encrypted value.
+func (kvStore *EncryptedKVStore) CompareAndSwap(schema, key string, oldValue, newValue []byte) (bool, error) {
+	var oldData []byte
+	if oldValue != nil {
+		data, exists, err := kvStore.kvStore.Get(schema, key)
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			return false, nil
+		}
+		current, err := kvStore.keyring.Decrypt(data)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(current, oldValue) {
+			return false, nil
+		}
+		oldData = data
+	}
+
+	var newData []byte
+	if newValue != nil {
+		data, err := kvStore.keyring.Encrypt(newValue)
+		if err != nil {
+			return false, err
+		}
+		newData = data
+	}
+	return kvStore.kvStore.CompareAndSwap(schema, key, oldData, newData)
+}
+
+// Delete implements the `kvstore` Delete func.
+func (kvStore *EncryptedKVStore) Delete(schema, key string) error {
+	return kvStore.kvStore.Delete(schema, key)
+}
+
+// Iterate implements the `kvstore` Iterate func.
+// Entries which can not be decrypted are logged and skipped.
+func (kvStore *EncryptedKVStore) Iterate(schema, keyPrefix string) chan [2]string {
+	responseC := make(chan [2]string, 100)
+	entriesC := kvStore.kvStore.Iterate(schema, keyPrefix)
+	go func() {
+		for entry := range entriesC {
+			value, err := kvStore.keyring.Decrypt([]byte(entry[1]))
+			if err != nil {
+				encryptedLogger.WithError(err).WithFields(log.Fields{
+					"schema": schema,
+					"key":    entry[0],
+				}).Error("Error decrypting value")
+				continue
+			}
+			responseC <- [2]string{entry[0], string(value)}
+		}
+		close(responseC)
+	}()
+	return responseC
+}
+
+// IterateKeys implements the `kvstore` IterateKeys func.
+func (kvStore *EncryptedKVStore) IterateKeys(schema, keyPrefix string) chan string {
+	return kvStore.kvStore.IterateKeys(schema, keyPrefix)
+}
+
+// IteratePage implements the `kvstore` IteratePage func.
+// Entries which can not be decrypted are logged and skipped, so that the page can contain less entries.
+func (kvStore *EncryptedKVStore) IteratePage(ctx context.Context, schema, keyPrefix, cursor string, limit int) ([][2]string, string, error) {
+	entries, next, err := kvStore.kvStore.IteratePage(ctx, schema, keyPrefix, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	decrypted := make([][2]string, 0, len(entries))
+	for _, entry := range entries {
+		value, err := kvStore.keyring.Decrypt([]byte(entry[1]))
+		if err != nil {
+			encryptedLogger.WithError(err).WithFields(log.Fields{
+				"schema": schema,
+				"key":    entry[0],
+			}).Error("Error decrypting value")
+			continue
+		}
+		decrypted = append(decrypted, [2]string{entry[0], string(value)})
+	}
+	return decrypted, next, nil
+}
+
+// Watch implements the `kvstore` Watch func.
+// Events with values which can not be decrypted are logged and skipped.
+func (kvStore *EncryptedKVStore) Watch(schema, keyPrefix string) (chan Event, func()) {
+	responseC := make(chan Event, watchChannelSize)
+	eventsC, cancelWatch := kvStore.kvStore.Watch(schema, keyPrefix)
+	doneC := make(chan bool)
+	go func() {
+		defer close(responseC)
+		for event := range eventsC {
+			if event.Type == EventPut {
+				value, err := kvStore.keyring.Decrypt(event.Value)
+				if err != nil {
+					encryptedLogger.WithError(err).WithFields(log.Fields{
+						"schema": schema,
+						"key":    event.Key,
+					}).Error("Error decrypting value")
+					continue
+				}
+				event.Value = value
+			}
+			select {
+			case responseC <- event:
+			case <-doneC:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return responseC, func() {
+		once.Do(func() {
+			close(doneC)
+			cancelWatch()
+		})
+	}
+}
+
+// Check forwards the health check to the wrapped KVStore, if it supports it.
+func (kvStore *EncryptedKVStore) Check() error {
+	if checker, ok := kvStore.kvStore.(interface {
+		Check() error
+	}); ok {
+		return checker.Check()
+	}
+	return nil
+}
+
+// Start starts the wrapped KVStore, if it is startable.
+func (kvStore *EncryptedKVStore) Start() error {
+	if startable, ok := kvStore.kvStore.(interface {
+		Start() error
+	}); ok {
+		return startable.Start()
+	}
+	return nil
+}
+
+// Stop stops the wrapped KVStore, if it is stoppable.
+func (kvStore *EncryptedKVStore) Stop() error {
+	if stopable, ok := kvStore.kvStore.(interface {
+		Stop() error
+	}); ok {
+		return stopable.Stop()
+	}
+	return nil
+}
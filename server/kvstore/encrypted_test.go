@@ -0,0 +1,119 @@
+package kvstore
+
+import (
+	"os"
+	"testing"
+
+	"github.com/smancke/guble/server/encryption"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testKey1 = "1:000102030405060708090a0b0c0d0e0f"
+	testKey2 = "2:101112131415161718191a1b1c1d1e1f"
+)
+
+func newTestKeyring(t *testing.T, keys string) *encryption.Keyring {
+	keyring, err := encryption.ParseKeyring(keys)
+	assert.NoError(t, err)
+	return keyring
+}
+
+func TestEncryptedPutGetDelete(t *testing.T) {
+	kvs := NewEncryptedKVStore(NewMemoryKVStore(), newTestKeyring(t, testKey1))
+	CommonTestPutGetDelete(t, kvs, kvs)
+}
+
+func TestEncryptedIterate(t *testing.T) {
+	kvs := NewEncryptedKVStore(NewMemoryKVStore(), newTestKeyring(t, testKey1))
+	CommonTestIterate(t, kvs, kvs)
+}
+
+func TestEncryptedIterateKeys(t *testing.T) {
+	kvs := NewEncryptedKVStore(NewMemoryKVStore(), newTestKeyring(t, testKey1))
+	CommonTestIterateKeys(t, kvs, kvs)
+}
+
+func TestEncryptedIteratePage(t *testing.T) {
+	kvs := NewEncryptedKVStore(NewMemoryKVStore(), newTestKeyring(t, testKey1))
+	CommonTestIteratePage(t, kvs, kvs)
+}
+
+func TestEncryptedPutWithTTL(t *testing.T) {
+	kvs := NewEncryptedKVStore(NewMemoryKVStore(), newTestKeyring(t, testKey1))
+	CommonTestPutWithTTL(t, kvs, kvs)
+}
+
+func TestEncryptedBatch(t *testing.T) {
+	kvs := NewEncryptedKVStore(NewMemoryKVStore(), newTestKeyring(t, testKey1))
+	CommonTestBatch(t, kvs, kvs)
+}
+
+func TestEncryptedCompareAndSwap(t *testing.T) {
+	kvs := NewEncryptedKVStore(NewMemoryKVStore(), newTestKeyring(t, testKey1))
+	CommonTestCompareAndSwap(t, kvs, kvs)
+	CommonTestConcurrentCompareAndSwap(t, kvs)
+}
+
+func TestEncryptedWatch(t *testing.T) {
+	kvs := NewEncryptedKVStore(NewMemoryKVStore(), newTestKeyring(t, testKey1))
+	CommonTestWatch(t, kvs, kvs)
+}
+
+func TestEncryptedSqlite(t *testing.T) {
+	a := assert.New(t)
+	f := tempFilename()
+	defer os.Remove(f)
+
+	db := NewSqliteKVStore(f, false)
+	a.NoError(db.Open())
+	a.NoError(db.Put("s1", "plain", []byte("written before the encryption")))
+
+	keyring := newTestKeyring(t, testKey1)
+	a.NoError(CheckEncryption(db, keyring))
+	kvs := NewEncryptedKVStore(db, keyring)
+	a.NoError(kvs.Put("s1", "token", []byte("device token")))
+
+	// the value is encrypted in the database
+	data, exists, err := db.Get("s1", "token")
+	a.NoError(err)
+	a.True(exists)
+	a.True(encryption.IsEncrypted(data))
+	a.NotContains(string(data), "device token")
+
+	assertGet(a, kvs, "s1", "token", []byte("device token"))
+	assertGet(a, kvs, "s1", "plain", []byte("written before the encryption"))
+	assertChannelContainsEntries(a, kvs.Iterate("s1", ""),
+		[2]string{"token", "device token"},
+		[2]string{"plain", "written before the encryption"})
+
+	a.NoError(kvs.Check())
+	a.NoError(kvs.Stop())
+}
+
+func TestCheckEncryption(t *testing.T) {
+	a := assert.New(t)
+	kvs := NewMemoryKVStore()
+
+	// nothing was encrypted yet
+	a.NoError(CheckEncryption(kvs, nil))
+
+	a.NoError(CheckEncryption(kvs, newTestKeyring(t, testKey1)))
+
+	// the key is missing
+	a.Error(CheckEncryption(kvs, nil))
+	a.Error(CheckEncryption(kvs, newTestKeyring(t, testKey2)))
+
+	// key rotation
+	rotated := newTestKeyring(t, testKey1+","+testKey2)
+	a.NoError(CheckEncryption(kvs, rotated))
+	a.Error(CheckEncryption(kvs, newTestKeyring(t, testKey1)))
+
+	// values encrypted with the old key are readable after the rotation
+	a.NoError(NewEncryptedKVStore(kvs, newTestKeyring(t, testKey1)).Put("s1", "a", test1))
+	assertGet(a, NewEncryptedKVStore(kvs, rotated), "s1", "a", test1)
+
+	_, _, err := NewEncryptedKVStore(kvs, newTestKeyring(t, testKey2)).Get("s1", "a")
+	a.Error(err)
+}
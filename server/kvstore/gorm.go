@@ -4,6 +4,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/jinzhu/gorm"
 
+	"context"
 	"errors"
 	"time"
 )
@@ -17,14 +18,37 @@ type kvEntry struct {
 	Key       string    `gorm:"primary_key"sql:"type:varchar(200)"`
 	Value     []byte    `sql:"type:bytea"`
 	UpdatedAt time.Time ``
+
+	// ExpiresAt is the expiry time in unix nanoseconds, or nil if the entry does not expire.
+	ExpiresAt *int64
 }
 
+// notExpired is the condition selecting the entries which are not expired at a time given as parameter.
+const notExpired = "(expires_at is null or expires_at > ?)"
+
 type kvStore struct {
-	db     *gorm.DB
-	logger *log.Entry
+	db      *gorm.DB
+	logger  *log.Entry
+	sweeper *sweeper
+
+	watchers watchers
+
+	// publish reports the changes to the watchers of all the processes sharing the database.
+	// If it is nil, only the watchers of this process are notified.
+	publish func(events ...Event)
+}
+
+// Start the periodic removal of the expired entries.
+func (store *kvStore) Start() error {
+	store.sweeper = &sweeper{sweep: store.sweep, logger: store.logger}
+	store.sweeper.start()
+	return nil
 }
 
 func (store *kvStore) Stop() error {
+	if store.sweeper != nil {
+		store.sweeper.stop()
+	}
 	if store.db != nil {
 		err := store.db.Close()
 		store.db = nil
@@ -47,11 +71,23 @@ func (store *kvStore) Check() error {
 }
 
 func (store *kvStore) Put(schema, key string, value []byte) error {
-	if err := store.Delete(schema, key); err != nil {
+	return store.PutWithTTL(schema, key, value, 0)
+}
+
+func (store *kvStore) PutWithTTL(schema, key string, value []byte, ttl time.Duration) error {
+	if err := store.db.Delete(&kvEntry{Schema: schema, Key: key}).Error; err != nil {
 		return err
 	}
 	entry := &kvEntry{Schema: schema, Key: key, Value: value, UpdatedAt: time.Now()}
-	return store.db.Create(entry).Error
+	if ttl > 0 {
+		expiresAt := expiryTime(ttl).UnixNano()
+		entry.ExpiresAt = &expiresAt
+	}
+	if err := store.db.Create(entry).Error; err != nil {
+		return err
+	}
+	store.notify(Event{Type: EventPut, Schema: schema, Key: key, Value: value})
+	return nil
 }
 
 func (store *kvStore) Get(schema, key string) ([]byte, bool, error) {
@@ -63,13 +99,20 @@ func (store *kvStore) Get(schema, key string) ([]byte, bool, error) {
 		return nil, false, err
 	}
 
+	now := time.Now().UnixNano()
+	if entry.ExpiresAt != nil && *entry.ExpiresAt <= now {
+		// the condition keeps an entry which was put again in the meantime
+		err := store.db.Where("schema = ? and key = ? and expires_at <= ?", schema, key, now).Delete(&kvEntry{}).Error
+		return nil, false, err
+	}
 	return entry.Value, true, nil
 }
 
 func (store *kvStore) Iterate(schema string, keyPrefix string) chan [2]string {
 	responseC := make(chan [2]string, responseChannelSize)
 	go func() {
-		rows, err := store.db.Raw("select key, value from kv_entry where schema = ? and key LIKE ?", schema, keyPrefix+"%").
+		rows, err := store.db.Raw("select key, value from kv_entry where schema = ? and key LIKE ? and "+notExpired,
+			schema, keyPrefix+"%", time.Now().UnixNano()).
 			Rows()
 		if err != nil {
 			store.logger.WithField("error", err.Error()).Error("Error fetching keys from database")
@@ -89,7 +132,8 @@ func (store *kvStore) Iterate(schema string, keyPrefix string) chan [2]string {
 func (store *kvStore) IterateKeys(schema string, keyPrefix string) chan string {
 	responseC := make(chan string, responseChannelSize)
 	go func() {
-		rows, err := store.db.Raw("select key from kv_entry where schema = ? and key LIKE ?", schema, keyPrefix+"%").
+		rows, err := store.db.Raw("select key from kv_entry where schema = ? and key LIKE ? and "+notExpired,
+			schema, keyPrefix+"%", time.Now().UnixNano()).
 			Rows()
 		if err != nil {
 			store.logger.WithField("error", err.Error()).Error("Error fetching keys from database")
@@ -106,6 +150,189 @@ func (store *kvStore) IterateKeys(schema string, keyPrefix string) chan string {
 	return responseC
 }
 
+func (store *kvStore) IteratePage(ctx context.Context, schema, keyPrefix, cursor string, limit int) ([][2]string, string, error) {
+	if limit <= 0 {
+		return nil, "", ErrInvalidLimit
+	}
+	after, err := decodeKeyCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	// one more entry is fetched, for knowing if there is a next page
+	rows, err := store.db.Raw("select key, value from kv_entry where schema = ? and key LIKE ? and key > ? and "+notExpired+
+		" order by key limit ?", schema, keyPrefix+"%", after, time.Now().UnixNano(), limit+1).
+		Rows()
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var entries [][2]string
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, "", err
+		}
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, "", err
+		}
+		entries = append(entries, [2]string{key, value})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	entries, next := keyPage(entries, limit)
+	return entries, next, nil
+}
+
 func (store *kvStore) Delete(schema, key string) error {
-	return store.db.Delete(&kvEntry{Schema: schema, Key: key}).Error
+	db := store.db.Delete(&kvEntry{Schema: schema, Key: key})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected > 0 {
+		store.notify(Event{Type: EventDelete, Schema: schema, Key: key})
+	}
+	return nil
+}
+
+func (store *kvStore) Batch(operations []Operation) error {
+	tx := store.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	now := time.Now()
+	events := make([]Event, 0, len(operations))
+	for _, op := range operations {
+		// a compared entry is removed by the comparison, if it exists
+		compared := false
+		if op.Compare {
+			matches, err := compareInTx(tx, op, now)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			if !matches {
+				tx.Rollback()
+				return ErrBatchConflict
+			}
+			compared = op.OldValue != nil
+		}
+		deleted := tx.Delete(&kvEntry{Schema: op.Schema, Key: op.Key})
+		if deleted.Error != nil {
+			tx.Rollback()
+			return deleted.Error
+		}
+		if op.Delete {
+			if compared || deleted.RowsAffected > 0 {
+				events = append(events, Event{Type: EventDelete, Schema: op.Schema, Key: op.Key})
+			}
+			continue
+		}
+		entry := &kvEntry{Schema: op.Schema, Key: op.Key, Value: op.Value, UpdatedAt: now}
+		if err := tx.Create(entry).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		events = append(events, Event{Type: EventPut, Schema: op.Schema, Key: op.Key, Value: op.Value})
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	store.notify(events...)
+	return nil
+}
+
+// compareInTx returns true, if the entry of the operation has its OldValue in the transaction.
+// An existing entry is deleted by the comparison, so that it is locked until the end of the transaction.
+func compareInTx(tx *gorm.DB, op Operation, now time.Time) (bool, error) {
+	if op.OldValue != nil {
+		deleted := tx.Where("schema = ? and key = ? and value = ? and "+notExpired, op.Schema, op.Key, op.OldValue, now.UnixNano()).
+			Delete(&kvEntry{})
+		return deleted.RowsAffected == 1, deleted.Error
+	}
+	var count int
+	err := tx.Model(&kvEntry{}).Where("schema = ? and key = ? and "+notExpired, op.Schema, op.Key, now.UnixNano()).
+		Count(&count).Error
+	return count == 0, err
+}
+
+func (store *kvStore) CompareAndSwap(schema, key string, oldValue, newValue []byte) (bool, error) {
+	swapped, err := store.compareAndSwap(schema, key, oldValue, newValue)
+	// nothing is changed, if only the absence of the entry was verified
+	if swapped && (oldValue != nil || newValue != nil) {
+		store.notify(changeEvent(schema, key, newValue))
+	}
+	return swapped, err
+}
+
+// compareAndSwap executes the comparison and the change in a single conditional statement,
+// so that it is atomic also with concurrent writers using other connections.
+func (store *kvStore) compareAndSwap(schema, key string, oldValue, newValue []byte) (bool, error) {
+	now := time.Now()
+	if oldValue == nil {
+		return store.insertIfNotExists(schema, key, newValue, now)
+	}
+
+	var db *gorm.DB
+	condition := "schema = ? and key = ? and value = ? and " + notExpired
+	if newValue == nil {
+		db = store.db.Where(condition, schema, key, oldValue, now.UnixNano()).Delete(&kvEntry{})
+	} else {
+		db = store.db.Model(&kvEntry{}).Where(condition, schema, key, oldValue, now.UnixNano()).
+			Updates(map[string]interface{}{"value": newValue, "updated_at": now, "expires_at": nil})
+	}
+	if db.Error != nil {
+		return false, db.Error
+	}
+	return db.RowsAffected == 1, nil
+}
+
+// insertIfNotExists inserts the entry, if there is no entry with the key yet.
+// A nil value does not insert anything, but still verifies that there is no entry.
+func (store *kvStore) insertIfNotExists(schema, key string, value []byte, now time.Time) (bool, error) {
+	// an expired entry is removed, so that it does not prevent the insert
+	err := store.db.Where("schema = ? and key = ? and expires_at <= ?", schema, key, now.UnixNano()).Delete(&kvEntry{}).Error
+	if err != nil {
+		return false, err
+	}
+	if value == nil {
+		_, exists, err := store.Get(schema, key)
+		return !exists, err
+	}
+
+	err = store.db.Create(&kvEntry{Schema: schema, Key: key, Value: value, UpdatedAt: now}).Error
+	if err == nil {
+		return true, nil
+	}
+	// the insert fails with a constraint violation, if the entry exists
+	if _, exists, errGet := store.Get(schema, key); errGet == nil && exists {
+		return false, nil
+	}
+	return false, err
+}
+
+func (store *kvStore) Watch(schema, keyPrefix string) (chan Event, func()) {
+	return store.watchers.add(schema, keyPrefix)
+}
+
+// notify reports the committed changes to the watchers.
+func (store *kvStore) notify(events ...Event) {
+	if len(events) == 0 {
+		return
+	}
+	if store.publish != nil {
+		store.publish(events...)
+		return
+	}
+	store.watchers.notify(events...)
+}
+
+// sweep removes all the expired entries.
+func (store *kvStore) sweep() error {
+	return store.db.Where("expires_at <= ?", time.Now().UnixNano()).Delete(&kvEntry{}).Error
 }
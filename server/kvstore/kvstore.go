@@ -1,11 +1,25 @@
 package kvstore
 
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrBatchConflict is returned by Batch, if the current value of an entry differs from the OldValue of its operation.
+var ErrBatchConflict = errors.New("kvstore: an entry of the batch was modified")
+
 // KVStore is an interface for a persistence backend, storing key-value pairs.
 type KVStore interface {
 
 	// Put stores an entry in the key-value store
 	Put(schema, key string, value []byte) error
 
+	// PutWithTTL stores an entry in the key-value store, which expires after the ttl.
+	// Expired entries are not returned anymore, and are removed periodically.
+	// A ttl <= 0 means that the entry does not expire, like with Put.
+	PutWithTTL(schema, key string, value []byte, ttl time.Duration) error
+
 	// Get fetches one entry
 	Get(schema, key string) (value []byte, exist bool, err error)
 
@@ -21,4 +35,38 @@ type KVStore interface {
 	// IterateKeys iterates over all keys in the key value store.
 	// The keys will be sent to the channel, which is closed after the last entry.
 	IterateKeys(schema, keyPrefix string) (keys chan string)
+
+	// IteratePage returns at most limit entries in the schema with keys matching the keyPrefix, starting after the cursor.
+	// An empty cursor starts with the first entry. The next cursor is opaque, and empty after the last page.
+	// The entries are sorted by key, except for the stores which can not sort them efficiently (e.g. Redis).
+	// The iteration is stopped if the context is done.
+	IteratePage(ctx context.Context, schema, keyPrefix, cursor string, limit int) (entries [][2]string, next string, err error)
+
+	// Batch executes the operations in one transaction: either all of them are applied, or none.
+	// It returns ErrBatchConflict without applying any operation, if the entry of a comparing operation
+	// does not have its OldValue.
+	Batch(operations []Operation) error
+
+	// CompareAndSwap replaces the value of an entry with the new value, only if its current value equals the old value.
+	// A nil old value means that the entry must not exist, and a nil new value deletes the entry.
+	// It returns false, if the entry was not changed because its current value is different.
+	CompareAndSwap(schema, key string, oldValue, newValue []byte) (swapped bool, err error)
+
+	// Watch streams the changes of the entries in the schema, with keys matching the keyPrefix.
+	// The channel is closed by calling cancel, or by the KVStore if some events may have been lost
+	// (e.g. because they were not received fast enough), in which case the watcher should read the entries again.
+	// The removals of expired entries are not reported.
+	Watch(schema, keyPrefix string) (events chan Event, cancel func())
+}
+
+// Operation is a write of a Batch: a Put of the value, or a Delete of the entry.
+// If Compare is set, the write is done only if the current value of the entry equals the OldValue,
+// like with CompareAndSwap: a nil OldValue means that the entry must not exist.
+type Operation struct {
+	Schema   string
+	Key      string
+	Value    []byte
+	Delete   bool
+	Compare  bool
+	OldValue []byte
 }
@@ -1,29 +1,69 @@
 package kvstore
 
 import (
+	"bytes"
+	"context"
+	"sort"
 	"strings"
 	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 // MemoryKVStore is a struct representing an in-memory key-value store.
 type MemoryKVStore struct {
 	data  map[string]map[string][]byte
 	mutex sync.RWMutex
+
+	// expiries contains the expiry times of the entries stored with a ttl.
+	expiries map[string]map[string]time.Time
+	sweeper  *sweeper
+
+	watchers watchers
 }
 
 // NewMemoryKVStore returns a new configured MemoryKVStore.
 func NewMemoryKVStore() *MemoryKVStore {
-	return &MemoryKVStore{
-		data: make(map[string]map[string][]byte),
+	kvStore := &MemoryKVStore{
+		data:     make(map[string]map[string][]byte),
+		expiries: make(map[string]map[string]time.Time),
 	}
+	kvStore.sweeper = &sweeper{
+		sweep:  kvStore.sweep,
+		logger: log.WithField("module", "kv-memory"),
+	}
+	return kvStore
+}
+
+// Start the periodic removal of the expired entries.
+// Implements the service.startable interface.
+func (kvStore *MemoryKVStore) Start() error {
+	kvStore.sweeper.start()
+	return nil
+}
+
+// Stop the periodic removal of the expired entries.
+// Implements the service.stopable interface.
+func (kvStore *MemoryKVStore) Stop() error {
+	kvStore.sweeper.stop()
+	return nil
 }
 
 // Put implements the `kvstore` Put func.
 func (kvStore *MemoryKVStore) Put(schema, key string, value []byte) error {
+	return kvStore.PutWithTTL(schema, key, value, 0)
+}
+
+// PutWithTTL implements the `kvstore` PutWithTTL func.
+func (kvStore *MemoryKVStore) PutWithTTL(schema, key string, value []byte, ttl time.Duration) error {
 	kvStore.mutex.Lock()
 	defer kvStore.mutex.Unlock()
-	s := kvStore.getSchema(schema)
-	s[key] = value
+	kvStore.put(schema, key, value)
+	if ttl > 0 {
+		kvStore.getExpiries(schema)[key] = expiryTime(ttl)
+	}
+	kvStore.watchers.notify(Event{Type: EventPut, Schema: schema, Key: key, Value: value})
 	return nil
 }
 
@@ -31,19 +71,18 @@ func (kvStore *MemoryKVStore) Put(schema, key string, value []byte) error {
 func (kvStore *MemoryKVStore) Get(schema, key string) ([]byte, bool, error) {
 	kvStore.mutex.Lock()
 	defer kvStore.mutex.Unlock()
-	s := kvStore.getSchema(schema)
-	if v, ok := s[key]; ok {
-		return v, true, nil
-	}
-	return nil, false, nil
+	v, ok := kvStore.get(schema, key)
+	return v, ok, nil
 }
 
 // Delete implements the `kvstore` Delete func.
 func (kvStore *MemoryKVStore) Delete(schema, key string) error {
 	kvStore.mutex.Lock()
 	defer kvStore.mutex.Unlock()
-	s := kvStore.getSchema(schema)
-	delete(s, key)
+	if _, exists := kvStore.get(schema, key); exists {
+		kvStore.remove(schema, key)
+		kvStore.watchers.notify(Event{Type: EventDelete, Schema: schema, Key: key})
+	}
 	return nil
 }
 
@@ -56,8 +95,9 @@ func (kvStore *MemoryKVStore) Iterate(schema string, keyPrefix string) chan [2]s
 	kvStore.mutex.Unlock()
 	go func() {
 		kvStore.mutex.Lock()
+		now := time.Now()
 		for key, value := range s {
-			if strings.HasPrefix(key, keyPrefix) {
+			if strings.HasPrefix(key, keyPrefix) && !kvStore.expired(schema, key, now) {
 				responseChan <- [2]string{key, string(value)}
 			}
 		}
@@ -76,8 +116,9 @@ func (kvStore *MemoryKVStore) IterateKeys(schema string, keyPrefix string) chan
 	kvStore.mutex.Unlock()
 	go func() {
 		kvStore.mutex.Lock()
+		now := time.Now()
 		for key := range s {
-			if strings.HasPrefix(key, keyPrefix) {
+			if strings.HasPrefix(key, keyPrefix) && !kvStore.expired(schema, key, now) {
 				responseChan <- key
 			}
 		}
@@ -88,6 +129,135 @@ func (kvStore *MemoryKVStore) IterateKeys(schema string, keyPrefix string) chan
 	return responseChan
 }
 
+// IteratePage implements the `kvstore` IteratePage func.
+func (kvStore *MemoryKVStore) IteratePage(ctx context.Context, schema, keyPrefix, cursor string, limit int) ([][2]string, string, error) {
+	if limit <= 0 {
+		return nil, "", ErrInvalidLimit
+	}
+	after, err := decodeKeyCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	kvStore.mutex.RLock()
+	defer kvStore.mutex.RUnlock()
+	now := time.Now()
+	var keys []string
+	for key := range kvStore.data[schema] {
+		if strings.HasPrefix(key, keyPrefix) && key > after && !kvStore.expired(schema, key, now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > limit+1 {
+		keys = keys[:limit+1]
+	}
+	entries := make([][2]string, len(keys))
+	for i, key := range keys {
+		entries[i] = [2]string{key, string(kvStore.data[schema][key])}
+	}
+	entries, next := keyPage(entries, limit)
+	return entries, next, nil
+}
+
+// Batch implements the `kvstore` Batch func.
+func (kvStore *MemoryKVStore) Batch(operations []Operation) error {
+	kvStore.mutex.Lock()
+	defer kvStore.mutex.Unlock()
+	// all the entries are compared before the first write, since the writes can not be rolled back
+	for _, op := range operations {
+		if !op.Compare {
+			continue
+		}
+		current, exists := kvStore.get(op.Schema, op.Key)
+		if exists != (op.OldValue != nil) || !bytes.Equal(current, op.OldValue) {
+			return ErrBatchConflict
+		}
+	}
+	events := make([]Event, 0, len(operations))
+	for _, op := range operations {
+		if !op.Delete {
+			kvStore.put(op.Schema, op.Key, op.Value)
+			events = append(events, Event{Type: EventPut, Schema: op.Schema, Key: op.Key, Value: op.Value})
+		} else if _, exists := kvStore.get(op.Schema, op.Key); exists {
+			kvStore.remove(op.Schema, op.Key)
+			events = append(events, Event{Type: EventDelete, Schema: op.Schema, Key: op.Key})
+		}
+	}
+	kvStore.watchers.notify(events...)
+	return nil
+}
+
+// CompareAndSwap implements the `kvstore` CompareAndSwap func.
+func (kvStore *MemoryKVStore) CompareAndSwap(schema, key string, oldValue, newValue []byte) (bool, error) {
+	kvStore.mutex.Lock()
+	defer kvStore.mutex.Unlock()
+	current, exists := kvStore.get(schema, key)
+	if exists != (oldValue != nil) || !bytes.Equal(current, oldValue) {
+		return false, nil
+	}
+	if newValue == nil {
+		if exists {
+			kvStore.remove(schema, key)
+			kvStore.watchers.notify(Event{Type: EventDelete, Schema: schema, Key: key})
+		}
+	} else {
+		kvStore.put(schema, key, newValue)
+		kvStore.watchers.notify(Event{Type: EventPut, Schema: schema, Key: key, Value: newValue})
+	}
+	return true, nil
+}
+
+// Watch implements the `kvstore` Watch func.
+func (kvStore *MemoryKVStore) Watch(schema, keyPrefix string) (chan Event, func()) {
+	return kvStore.watchers.add(schema, keyPrefix)
+}
+
+// get returns the value of the entry, and removes it if it is expired.
+func (kvStore *MemoryKVStore) get(schema, key string) ([]byte, bool) {
+	if kvStore.expired(schema, key, time.Now()) {
+		kvStore.remove(schema, key)
+		return nil, false
+	}
+	v, ok := kvStore.getSchema(schema)[key]
+	return v, ok
+}
+
+// put stores the value without a ttl.
+func (kvStore *MemoryKVStore) put(schema, key string, value []byte) {
+	kvStore.getSchema(schema)[key] = value
+	delete(kvStore.getExpiries(schema), key)
+}
+
+// sweep removes all the expired entries.
+func (kvStore *MemoryKVStore) sweep() error {
+	kvStore.mutex.Lock()
+	defer kvStore.mutex.Unlock()
+	now := time.Now()
+	for schema, expiries := range kvStore.expiries {
+		for key := range expiries {
+			if kvStore.expired(schema, key, now) {
+				kvStore.remove(schema, key)
+			}
+		}
+	}
+	return nil
+}
+
+// expired returns true, if the entry has a ttl which is over at the time.
+func (kvStore *MemoryKVStore) expired(schema, key string, now time.Time) bool {
+	expiry, ok := kvStore.expiries[schema][key]
+	return ok && !now.Before(expiry)
+}
+
+func (kvStore *MemoryKVStore) remove(schema, key string) {
+	delete(kvStore.getSchema(schema), key)
+	delete(kvStore.getExpiries(schema), key)
+}
+
 func (kvStore *MemoryKVStore) getSchema(schema string) map[string][]byte {
 	if s, ok := kvStore.data[schema]; ok {
 		return s
@@ -96,3 +266,12 @@ func (kvStore *MemoryKVStore) getSchema(schema string) map[string][]byte {
 	kvStore.data[schema] = s
 	return s
 }
+
+func (kvStore *MemoryKVStore) getExpiries(schema string) map[string]time.Time {
+	if e, ok := kvStore.expiries[schema]; ok {
+		return e
+	}
+	e := make(map[string]time.Time)
+	kvStore.expiries[schema] = e
+	return e
+}
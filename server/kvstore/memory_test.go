@@ -1,7 +1,10 @@
 package kvstore
 
 import (
+	"github.com/stretchr/testify/assert"
+
 	"testing"
+	"time"
 )
 
 func TestMemoryPutGetDelete(t *testing.T) {
@@ -19,6 +22,78 @@ func TestMemoryIterate(t *testing.T) {
 	CommonTestIterate(t, mkvs, mkvs)
 }
 
+func TestMemoryIteratePage(t *testing.T) {
+	mkvs := NewMemoryKVStore()
+	CommonTestIteratePage(t, mkvs, mkvs)
+}
+
+func TestMemoryIteratePageSorted(t *testing.T) {
+	CommonTestIteratePageSorted(t, NewMemoryKVStore())
+}
+
 func BenchmarkMemoryPutGet(b *testing.B) {
 	CommonBenchmarkPutGet(b, NewMemoryKVStore())
 }
+
+func TestMemoryPutWithTTL(t *testing.T) {
+	mkvs := NewMemoryKVStore()
+	CommonTestPutWithTTL(t, mkvs, mkvs)
+}
+
+func TestMemoryBatch(t *testing.T) {
+	mkvs := NewMemoryKVStore()
+	CommonTestBatch(t, mkvs, mkvs)
+}
+
+func TestMemoryCompareAndSwap(t *testing.T) {
+	mkvs := NewMemoryKVStore()
+	CommonTestCompareAndSwap(t, mkvs, mkvs)
+	CommonTestConcurrentCompareAndSwap(t, mkvs)
+}
+
+func TestMemorySweep(t *testing.T) {
+	mkvs := NewMemoryKVStore()
+	CommonTestSweep(t, mkvs, mkvs.sweep, func(schema string) int {
+		mkvs.mutex.Lock()
+		defer mkvs.mutex.Unlock()
+		return len(mkvs.data[schema])
+	})
+}
+
+func TestMemorySweepPeriodically(t *testing.T) {
+	a := assert.New(t)
+	defer func(interval time.Duration) { sweepInterval = interval }(sweepInterval)
+	sweepInterval = 10 * time.Millisecond
+
+	mkvs := NewMemoryKVStore()
+	a.NoError(mkvs.Start())
+	a.NoError(mkvs.PutWithTTL("s1", "short", test1, time.Millisecond))
+	time.Sleep(50 * time.Millisecond)
+	a.NoError(mkvs.Stop())
+
+	a.Empty(mkvs.data["s1"])
+	a.Empty(mkvs.expiries["s1"])
+}
+
+func TestMemoryWatch(t *testing.T) {
+	mkvs := NewMemoryKVStore()
+	CommonTestWatch(t, mkvs, mkvs)
+}
+
+func TestMemoryWatchNotReceived(t *testing.T) {
+	a := assert.New(t)
+	mkvs := NewMemoryKVStore()
+
+	events, cancel := mkvs.Watch("s1", "")
+	defer cancel()
+	for i := 0; i <= watchChannelSize; i++ {
+		a.NoError(mkvs.Put("s1", "bli", test1))
+	}
+
+	// the watcher is closed after the buffered events, since it missed the last one
+	count := 0
+	for range events {
+		count++
+	}
+	a.Equal(watchChannelSize, count)
+}
@@ -0,0 +1,38 @@
+package kvstore
+
+import (
+	"encoding/base64"
+	"errors"
+)
+
+var (
+	// ErrInvalidCursor is returned by IteratePage for a cursor which was not returned by the KVStore.
+	ErrInvalidCursor = errors.New("kvstore: invalid cursor")
+
+	// ErrInvalidLimit is returned by IteratePage for a limit which is not positive.
+	ErrInvalidLimit = errors.New("kvstore: the limit must be positive")
+)
+
+// encodeKeyCursor returns the cursor of a page ending with the key, for the stores iterating in the order of the keys.
+func encodeKeyCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// decodeKeyCursor returns the key after which the page starts, or an empty key for the first page.
+func decodeKeyCursor(cursor string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", ErrInvalidCursor
+	}
+	return string(key), nil
+}
+
+// keyPage returns the page of at most limit entries, from the entries sorted by key
+// of which at most one more than the limit was fetched.
+func keyPage(entries [][2]string, limit int) ([][2]string, string) {
+	if len(entries) <= limit {
+		return entries, ""
+	}
+	entries = entries[:limit]
+	return entries, encodeKeyCursor(entries[limit-1][0])
+}
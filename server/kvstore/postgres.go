@@ -4,17 +4,39 @@ import (
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
 
 	// use gorm's postgres dialect
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+
+	"encoding/json"
+	"time"
 )
 
-const postgresGormLogMode = false
+const (
+	postgresGormLogMode = false
+
+	// postgresNotifyChannel is the channel of the notifications about the changes of the entries.
+	postgresNotifyChannel = "guble_kv"
+
+	postgresMinReconnectInterval = time.Second
+	postgresMaxReconnectInterval = time.Minute
+)
 
 // PostgresKVStore extends a gorm-based kvStore with a Postgresql-specific configuration.
+// The changes are notified through LISTEN/NOTIFY, so that the watchers receive also the changes by other processes.
 type PostgresKVStore struct {
 	*kvStore
-	config PostgresConfig
+	config   PostgresConfig
+	listener *pq.Listener
+}
+
+// postgresNotification is the payload of a notification.
+// It does not contain the value, since the size of the payload is limited.
+type postgresNotification struct {
+	Type   EventType `json:"type"`
+	Schema string    `json:"schema"`
+	Key    string    `json:"key"`
 }
 
 // NewPostgresKVStore returns a new configured PostgresKVStore (not opened yet).
@@ -30,7 +52,7 @@ func (kvStore *PostgresKVStore) Open() error {
 	logger := kvStore.logger.WithField("config", kvStore.config)
 	logger.Info("Opening database")
 
-	gormdb, err := gorm.Open("postgres", kvStore.config.connectionString())
+	gormdb, err := gorm.Open("postgres", kvStore.config.ConnectionString())
 	if err != nil {
 		logger.WithField("err", err).Error("Error opening database")
 		return err
@@ -57,5 +79,83 @@ func (kvStore *PostgresKVStore) Open() error {
 
 	logger.Info("Ensured database schema")
 	kvStore.db = gormdb
+
+	if err := kvStore.listen(); err != nil {
+		logger.WithField("err", err).Error("Error listening to the notifications")
+		return err
+	}
+	kvStore.publish = kvStore.publishNotifications
+	return nil
+}
+
+// Stop the listener of the notifications and close the database.
+func (kvStore *PostgresKVStore) Stop() error {
+	if kvStore.listener != nil {
+		kvStore.listener.Close()
+		kvStore.listener = nil
+	}
+	return kvStore.kvStore.Stop()
+}
+
+func (kvStore *PostgresKVStore) listen() error {
+	listener := pq.NewListener(kvStore.config.ConnectionString(), postgresMinReconnectInterval, postgresMaxReconnectInterval,
+		func(_ pq.ListenerEventType, err error) {
+			if err != nil {
+				kvStore.logger.WithError(err).Error("Error in the connection listening to the notifications")
+			}
+		})
+	if err := listener.Listen(postgresNotifyChannel); err != nil {
+		listener.Close()
+		return err
+	}
+	kvStore.listener = listener
+	go kvStore.receiveNotifications(listener.Notify)
 	return nil
 }
+
+// publishNotifications sends a notification for each of the events, received by all the listening processes.
+func (kvStore *PostgresKVStore) publishNotifications(events ...Event) {
+	for _, event := range events {
+		payload, err := json.Marshal(postgresNotification{Type: event.Type, Schema: event.Schema, Key: event.Key})
+		if err == nil {
+			err = kvStore.db.Exec("select pg_notify(?, ?)", postgresNotifyChannel, string(payload)).Error
+		}
+		if err != nil {
+			kvStore.logger.WithError(err).WithField("key", event.Key).Error("Error sending notification")
+		}
+	}
+}
+
+// receiveNotifications notifies the watchers of this process about the received notifications,
+// until the listener is closed.
+func (kvStore *PostgresKVStore) receiveNotifications(notifyC <-chan *pq.Notification) {
+	for n := range notifyC {
+		if n == nil {
+			// the connection was re-established, and the notifications in between are lost
+			kvStore.logger.Warn("Reconnected listening to the notifications, closing the watchers")
+			kvStore.watchers.closeAll()
+			continue
+		}
+
+		var notification postgresNotification
+		if err := json.Unmarshal([]byte(n.Extra), &notification); err != nil {
+			kvStore.logger.WithError(err).WithField("payload", n.Extra).Error("Error decoding notification")
+			continue
+		}
+		event := Event{Type: notification.Type, Schema: notification.Schema, Key: notification.Key}
+		if event.Type == EventPut {
+			value, exists, err := kvStore.Get(event.Schema, event.Key)
+			if err != nil {
+				kvStore.logger.WithError(err).WithField("key", event.Key).Error("Error fetching the changed entry")
+				kvStore.watchers.closeAll()
+				continue
+			}
+			if !exists {
+				// the entry was deleted in the meantime, which is notified next
+				continue
+			}
+			event.Value = value
+		}
+		kvStore.watchers.notify(event)
+	}
+}
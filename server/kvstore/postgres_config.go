@@ -10,7 +10,8 @@ type PostgresConfig struct {
 	MaxOpenConns int
 }
 
-func (pc PostgresConfig) connectionString() string {
+// ConnectionString returns the parameters of the Postgresql connection, in the format required by the driver.
+func (pc PostgresConfig) ConnectionString() string {
 	var params []string
 	for key, value := range pc.ConnParams {
 		params = append(params, key+"="+value)
@@ -29,6 +29,42 @@ func TestPostgresKVStore_IterateKeys(t *testing.T) {
 	CommonTestIterateKeys(t, kvs, kvs)
 }
 
+func TestPostgresKVStore_IteratePage(t *testing.T) {
+	kvs := NewPostgresKVStore(aPostgresConfig())
+	kvs.Open()
+	CommonTestIteratePage(t, kvs, kvs)
+}
+
+func TestPostgresKVStore_PutWithTTL(t *testing.T) {
+	kvs := NewPostgresKVStore(aPostgresConfig())
+	kvs.Open()
+	CommonTestPutWithTTL(t, kvs, kvs)
+}
+
+func TestPostgresKVStore_Batch(t *testing.T) {
+	kvs := NewPostgresKVStore(aPostgresConfig())
+	kvs.Open()
+	CommonTestBatch(t, kvs, kvs)
+}
+
+func TestPostgresKVStore_CompareAndSwap(t *testing.T) {
+	kvs := NewPostgresKVStore(aPostgresConfig())
+	kvs.Open()
+	CommonTestCompareAndSwap(t, kvs, kvs)
+	CommonTestConcurrentCompareAndSwap(t, kvs)
+}
+
+// TestPostgresKVStore_Watch verifies that the changes are notified to the watchers of other processes.
+func TestPostgresKVStore_Watch(t *testing.T) {
+	kvs1 := NewPostgresKVStore(aPostgresConfig())
+	kvs1.Open()
+	defer kvs1.Stop()
+	kvs2 := NewPostgresKVStore(aPostgresConfig())
+	kvs2.Open()
+	defer kvs2.Stop()
+	CommonTestWatch(t, kvs1, kvs2)
+}
+
 func TestPostgresKVStore_Check(t *testing.T) {
 	a := assert.New(t)
 
@@ -0,0 +1,602 @@
+package kvstore
+
+import (
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/gomodule/redigo/redis"
+
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redisScanCount         = 100
+	redisReconnectInterval = time.Second
+)
+
+var errRedisStopped = errors.New("kv-redis: the store is stopped")
+
+// RedisKVStore is a KVStore using a Redis server, which can be shared by several guble nodes.
+// The entries are stored as "<prefix>:<schema>:<key>", and the changes are notified to the watchers
+// of all the nodes with a Redis channel.
+type RedisKVStore struct {
+	config RedisConfig
+	pool   *redis.Pool
+	logger *log.Entry
+
+	watchers watchers
+
+	// psc is the connection receiving the notifications, closed on Stop.
+	psc     *redis.PubSubConn
+	pscLock sync.Mutex
+	stopC   chan bool
+	wg      sync.WaitGroup
+}
+
+// redisNotification is the payload of a notification about a change.
+type redisNotification struct {
+	Type   EventType `json:"type"`
+	Schema string    `json:"schema"`
+	Key    string    `json:"key"`
+	Value  []byte    `json:"value,omitempty"`
+}
+
+// NewRedisKVStore returns a new configured RedisKVStore (not opened yet).
+func NewRedisKVStore(config RedisConfig) *RedisKVStore {
+	kvStore := &RedisKVStore{
+		config: config,
+		logger: log.WithFields(log.Fields{
+			"module": "kv-redis",
+			"addr":   config.Addr,
+			"db":     config.DB,
+		}),
+	}
+	kvStore.pool = &redis.Pool{
+		Dial:        kvStore.dial,
+		MaxIdle:     config.MaxIdle,
+		MaxActive:   config.MaxActive,
+		IdleTimeout: defaultRedisIdleTimeout,
+		Wait:        true,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+	return kvStore
+}
+
+// Open verifies the connection to the server, and subscribes to the notifications about the changes.
+func (kvStore *RedisKVStore) Open() error {
+	kvStore.logger.Info("Connecting to redis")
+	if err := kvStore.Check(); err != nil {
+		return err
+	}
+
+	kvStore.stopC = make(chan bool)
+	if err := kvStore.subscribe(); err != nil {
+		kvStore.logger.WithError(err).Error("Error subscribing to the notifications")
+		return err
+	}
+	kvStore.wg.Add(1)
+	go kvStore.receiveNotifications()
+	return nil
+}
+
+// Stop receiving the notifications, and close the connections.
+func (kvStore *RedisKVStore) Stop() error {
+	if kvStore.stopC != nil {
+		close(kvStore.stopC)
+		kvStore.closePubSubConn()
+		kvStore.wg.Wait()
+		kvStore.stopC = nil
+	}
+	return kvStore.pool.Close()
+}
+
+// Check pings the server.
+func (kvStore *RedisKVStore) Check() error {
+	if _, err := kvStore.do("PING"); err != nil {
+		kvStore.logger.WithError(err).Error("Error pinging redis")
+		return err
+	}
+	return nil
+}
+
+// Put implements the `kvstore` Put func.
+func (kvStore *RedisKVStore) Put(schema, key string, value []byte) error {
+	return kvStore.PutWithTTL(schema, key, value, 0)
+}
+
+// PutWithTTL implements the `kvstore` PutWithTTL func.
+// The expiry is done by the server.
+func (kvStore *RedisKVStore) PutWithTTL(schema, key string, value []byte, ttl time.Duration) error {
+	ttlMillis := int64(0)
+	if ttl > 0 {
+		// at least one millisecond, since a ttl of 0 means no expiry
+		ttlMillis = int64((ttl + time.Millisecond - 1) / time.Millisecond)
+	}
+	return kvStore.write([]Operation{{Schema: schema, Key: key, Value: value}}, ttlMillis)
+}
+
+// Get implements the `kvstore` Get func.
+func (kvStore *RedisKVStore) Get(schema, key string) ([]byte, bool, error) {
+	value, err := redis.Bytes(kvStore.do("GET", kvStore.redisKey(schema, key)))
+	if err == redis.ErrNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// Delete implements the `kvstore` Delete func.
+func (kvStore *RedisKVStore) Delete(schema, key string) error {
+	return kvStore.write([]Operation{{Schema: schema, Key: key, Delete: true}}, 0)
+}
+
+// Iterate implements the `kvstore` Iterate func.
+func (kvStore *RedisKVStore) Iterate(schema string, keyPrefix string) chan [2]string {
+	responseC := make(chan [2]string, responseChannelSize)
+	go func() {
+		err := kvStore.scan(schema, keyPrefix, func(keys []string) error {
+			args := make([]interface{}, len(keys))
+			for i, key := range keys {
+				args[i] = kvStore.redisKey(schema, key)
+			}
+			values, err := redis.ByteSlices(kvStore.do("MGET", args...))
+			if err != nil {
+				return err
+			}
+			for i, value := range values {
+				// the entry was deleted or expired after the scan
+				if value != nil {
+					responseC <- [2]string{keys[i], string(value)}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			kvStore.logger.WithError(err).Error("Error fetching entries from redis")
+		}
+		close(responseC)
+	}()
+	return responseC
+}
+
+// IterateKeys implements the `kvstore` IterateKeys func.
+func (kvStore *RedisKVStore) IterateKeys(schema string, keyPrefix string) chan string {
+	responseC := make(chan string, responseChannelSize)
+	go func() {
+		err := kvStore.scan(schema, keyPrefix, func(keys []string) error {
+			for _, key := range keys {
+				responseC <- key
+			}
+			return nil
+		})
+		if err != nil {
+			kvStore.logger.WithError(err).Error("Error fetching keys from redis")
+		}
+		close(responseC)
+	}()
+	return responseC
+}
+
+// redisCursor is the position of a paginated iteration, which is sent base64-encoded as the opaque cursor.
+// Since a SCAN returns an undetermined number of keys, the keys which did not fit in the page are kept pending.
+type redisCursor struct {
+	Scan    int      `json:"s"`
+	Done    bool     `json:"d,omitempty"`
+	Pending []string `json:"p,omitempty"`
+}
+
+// IteratePage implements the `kvstore` IteratePage func.
+// The entries are in the order of the SCAN, and an entry may be returned more than once, if it was moved during the iteration.
+func (kvStore *RedisKVStore) IteratePage(ctx context.Context, schema, keyPrefix, cursor string, limit int) ([][2]string, string, error) {
+	if limit <= 0 {
+		return nil, "", ErrInvalidLimit
+	}
+	var position redisCursor
+	if cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		if err := json.Unmarshal(data, &position); err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+
+	schemaPrefix := kvStore.redisKey(schema, "")
+	pattern := escapeRedisPattern(schemaPrefix+keyPrefix) + "*"
+	keys := position.Pending
+	for len(keys) < limit && !position.Done {
+		if err := ctx.Err(); err != nil {
+			return nil, "", err
+		}
+		values, err := redis.Values(kvStore.do("SCAN", position.Scan, "MATCH", pattern, "COUNT", redisScanCount))
+		if err != nil {
+			return nil, "", err
+		}
+		var redisKeys []string
+		if _, err := redis.Scan(values, &position.Scan, &redisKeys); err != nil {
+			return nil, "", err
+		}
+		for _, redisKey := range redisKeys {
+			keys = append(keys, strings.TrimPrefix(redisKey, schemaPrefix))
+		}
+		position.Done = position.Scan == 0
+	}
+	position.Pending = nil
+	if len(keys) > limit {
+		position.Pending = keys[limit:]
+		keys = keys[:limit]
+	}
+
+	entries := make([][2]string, 0, len(keys))
+	if len(keys) > 0 {
+		args := make([]interface{}, len(keys))
+		for i, key := range keys {
+			args[i] = kvStore.redisKey(schema, key)
+		}
+		values, err := redis.ByteSlices(kvStore.do("MGET", args...))
+		if err != nil {
+			return nil, "", err
+		}
+		for i, value := range values {
+			// the entry was deleted or expired after the scan
+			if value != nil {
+				entries = append(entries, [2]string{keys[i], string(value)})
+			}
+		}
+	}
+
+	if position.Done && len(position.Pending) == 0 {
+		return entries, "", nil
+	}
+	data, err := json.Marshal(position)
+	if err != nil {
+		return nil, "", err
+	}
+	return entries, base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Batch implements the `kvstore` Batch func.
+func (kvStore *RedisKVStore) Batch(operations []Operation) error {
+	if len(operations) == 0 {
+		return nil
+	}
+	return kvStore.write(operations, 0)
+}
+
+// CompareAndSwap implements the `kvstore` CompareAndSwap func.
+// The entry is watched while comparing it, so that the change is aborted and retried if it is changed concurrently.
+func (kvStore *RedisKVStore) CompareAndSwap(schema, key string, oldValue, newValue []byte) (bool, error) {
+	payload, err := json.Marshal(redisNotification(changeEvent(schema, key, newValue)))
+	if err != nil {
+		return false, err
+	}
+	redisKey := kvStore.redisKey(schema, key)
+
+	conn := kvStore.pool.Get()
+	defer conn.Close()
+	for {
+		if _, err := conn.Do("WATCH", redisKey); err != nil {
+			return false, err
+		}
+		current, err := redis.Bytes(conn.Do("GET", redisKey))
+		exists := err != redis.ErrNil
+		if err != nil && exists {
+			conn.Do("UNWATCH")
+			return false, err
+		}
+		if exists != (oldValue != nil) || !bytes.Equal(current, oldValue) {
+			_, err := conn.Do("UNWATCH")
+			return false, err
+		}
+		if newValue == nil && !exists {
+			_, err := conn.Do("UNWATCH")
+			return true, err
+		}
+
+		conn.Send("MULTI")
+		if newValue != nil {
+			conn.Send("SET", redisKey, newValue)
+		} else {
+			conn.Send("DEL", redisKey)
+		}
+		conn.Send("PUBLISH", kvStore.channel(), payload)
+		committed, err := exec(conn)
+		if err != nil || committed {
+			return committed, err
+		}
+	}
+}
+
+// Watch implements the `kvstore` Watch func.
+// The events are received through the Redis channel, also for the changes done by this process.
+func (kvStore *RedisKVStore) Watch(schema, keyPrefix string) (chan Event, func()) {
+	return kvStore.watchers.add(schema, keyPrefix)
+}
+
+// write executes the operations and publishes their notifications in a transaction.
+func (kvStore *RedisKVStore) write(operations []Operation, ttlMillis int64) error {
+	conn := kvStore.pool.Get()
+	defer conn.Close()
+	for {
+		committed, err := kvStore.tryWrite(conn, operations, ttlMillis)
+		if err != nil || committed {
+			return err
+		}
+	}
+}
+
+// tryWrite executes the operations, and returns false if the transaction was aborted
+// because a deleted entry was changed concurrently.
+func (kvStore *RedisKVStore) tryWrite(conn redis.Conn, operations []Operation, ttlMillis int64) (bool, error) {
+	// the compared entries are watched, so that the transaction is aborted if they are changed meanwhile
+	for _, op := range operations {
+		if !op.Compare {
+			continue
+		}
+		redisKey := kvStore.redisKey(op.Schema, op.Key)
+		if _, err := conn.Do("WATCH", redisKey); err != nil {
+			return false, err
+		}
+		current, err := redis.Bytes(conn.Do("GET", redisKey))
+		exists := err != redis.ErrNil
+		if err != nil && exists {
+			conn.Do("UNWATCH")
+			return false, err
+		}
+		if exists != (op.OldValue != nil) || !bytes.Equal(current, op.OldValue) {
+			conn.Do("UNWATCH")
+			return false, ErrBatchConflict
+		}
+	}
+
+	// the deleted entries are watched, so that only the deletions of existing entries are notified
+	exists := make(map[string]bool)
+	for _, op := range operations {
+		if !op.Delete {
+			continue
+		}
+		redisKey := kvStore.redisKey(op.Schema, op.Key)
+		if _, err := conn.Do("WATCH", redisKey); err != nil {
+			return false, err
+		}
+		n, err := redis.Int(conn.Do("EXISTS", redisKey))
+		if err != nil {
+			conn.Do("UNWATCH")
+			return false, err
+		}
+		exists[redisKey] = n > 0
+	}
+
+	conn.Send("MULTI")
+	for _, op := range operations {
+		redisKey := kvStore.redisKey(op.Schema, op.Key)
+		event := Event{Type: EventPut, Schema: op.Schema, Key: op.Key, Value: op.Value}
+		if op.Delete {
+			conn.Send("DEL", redisKey)
+			if !exists[redisKey] {
+				continue
+			}
+			event = Event{Type: EventDelete, Schema: op.Schema, Key: op.Key}
+			exists[redisKey] = false
+		} else {
+			if ttlMillis > 0 {
+				conn.Send("SET", redisKey, op.Value, "PX", ttlMillis)
+			} else {
+				conn.Send("SET", redisKey, op.Value)
+			}
+			exists[redisKey] = true
+		}
+		payload, err := json.Marshal(redisNotification(event))
+		if err != nil {
+			conn.Do("DISCARD")
+			return false, err
+		}
+		conn.Send("PUBLISH", kvStore.channel(), payload)
+	}
+	return exec(conn)
+}
+
+// exec executes the queued transaction, and returns false if it was aborted because a watched key was changed.
+func exec(conn redis.Conn) (bool, error) {
+	replies, err := redis.Values(conn.Do("EXEC"))
+	// an aborted transaction is replied with nil, or with an empty array by some implementations,
+	// while the transactions executed here always contain commands
+	if err == redis.ErrNil || (err == nil && len(replies) == 0) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// scan calls the func with the batches of keys in the schema, matching the keyPrefix.
+func (kvStore *RedisKVStore) scan(schema, keyPrefix string, f func(keys []string) error) error {
+	schemaPrefix := kvStore.redisKey(schema, "")
+	pattern := escapeRedisPattern(schemaPrefix+keyPrefix) + "*"
+
+	// the same key can be returned more than once by a scan
+	seen := make(map[string]bool)
+	cursor := 0
+	for {
+		values, err := redis.Values(kvStore.do("SCAN", cursor, "MATCH", pattern, "COUNT", redisScanCount))
+		if err != nil {
+			return err
+		}
+		var redisKeys []string
+		if _, err := redis.Scan(values, &cursor, &redisKeys); err != nil {
+			return err
+		}
+
+		keys := make([]string, 0, len(redisKeys))
+		for _, redisKey := range redisKeys {
+			if !seen[redisKey] {
+				seen[redisKey] = true
+				keys = append(keys, strings.TrimPrefix(redisKey, schemaPrefix))
+			}
+		}
+		if len(keys) > 0 {
+			if err := f(keys); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// receiveNotifications notifies the watchers about the received notifications until the store is stopped,
+// subscribing again after a connection error.
+func (kvStore *RedisKVStore) receiveNotifications() {
+	defer kvStore.wg.Done()
+	for {
+		kvStore.receive()
+		for {
+			select {
+			case <-kvStore.stopC:
+				return
+			case <-time.After(redisReconnectInterval):
+			}
+			err := kvStore.subscribe()
+			if err == nil {
+				break
+			}
+			if err != errRedisStopped {
+				kvStore.logger.WithError(err).Error("Error subscribing again to the notifications")
+			}
+		}
+		// the notifications while reconnecting are lost
+		kvStore.logger.Warn("Subscribed again to the notifications, closing the watchers")
+		kvStore.watchers.closeAll()
+	}
+}
+
+// receive the notifications, until the connection is closed.
+func (kvStore *RedisKVStore) receive() {
+	kvStore.pscLock.Lock()
+	psc := kvStore.psc
+	kvStore.pscLock.Unlock()
+	if psc == nil {
+		return
+	}
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			var notification redisNotification
+			if err := json.Unmarshal(v.Data, &notification); err != nil {
+				kvStore.logger.WithError(err).Error("Error decoding notification")
+				continue
+			}
+			kvStore.watchers.notify(Event(notification))
+		case error:
+			select {
+			case <-kvStore.stopC:
+			default:
+				kvStore.logger.WithError(v).Error("Error receiving the notifications")
+			}
+			psc.Close()
+			return
+		}
+	}
+}
+
+// subscribe to the channel of the notifications with a new connection, which is not part of the pool.
+func (kvStore *RedisKVStore) subscribe() error {
+	conn, err := kvStore.dial()
+	if err != nil {
+		return err
+	}
+	psc := &redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(kvStore.channel()); err != nil {
+		psc.Close()
+		return err
+	}
+	// wait for the confirmation, so that no later change is missed
+	switch v := psc.Receive().(type) {
+	case redis.Subscription:
+	case error:
+		psc.Close()
+		return v
+	default:
+		psc.Close()
+		return fmt.Errorf("kv-redis: unexpected reply when subscribing: %v", v)
+	}
+
+	kvStore.pscLock.Lock()
+	defer kvStore.pscLock.Unlock()
+	select {
+	case <-kvStore.stopC:
+		psc.Close()
+		return errRedisStopped
+	default:
+	}
+	kvStore.psc = psc
+	return nil
+}
+
+func (kvStore *RedisKVStore) closePubSubConn() {
+	kvStore.pscLock.Lock()
+	defer kvStore.pscLock.Unlock()
+	if kvStore.psc != nil {
+		kvStore.psc.Close()
+		kvStore.psc = nil
+	}
+}
+
+func (kvStore *RedisKVStore) dial() (redis.Conn, error) {
+	return redis.Dial("tcp", kvStore.config.Addr,
+		redis.DialPassword(kvStore.config.Password),
+		redis.DialDatabase(kvStore.config.DB))
+}
+
+// do executes a command with a connection of the pool.
+func (kvStore *RedisKVStore) do(command string, args ...interface{}) (interface{}, error) {
+	conn := kvStore.pool.Get()
+	defer conn.Close()
+	return conn.Do(command, args...)
+}
+
+func (kvStore *RedisKVStore) redisKey(schema, key string) string {
+	return kvStore.config.keyPrefix() + ":" + schema + ":" + key
+}
+
+// channel returns the name of the channel of the notifications.
+func (kvStore *RedisKVStore) channel() string {
+	return kvStore.config.keyPrefix() + ":changes"
+}
+
+// escapeRedisPattern escapes the special characters of the glob-style patterns of Redis.
+func escapeRedisPattern(s string) string {
+	var b bytes.Buffer
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,31 @@
+package kvstore
+
+import "time"
+
+const (
+	defaultRedisKeyPrefix   = "guble"
+	defaultRedisIdleTimeout = 4 * time.Minute
+)
+
+// RedisConfig is the configuration of the connections to a Redis server.
+type RedisConfig struct {
+	// Addr is the address of the server, in the format "host:port".
+	Addr     string
+	Password string
+	DB       int
+
+	// MaxIdle and MaxActive are the maximum numbers of idle and of all connections in the pool.
+	// A MaxActive of 0 means that the number of connections is not limited.
+	MaxIdle   int
+	MaxActive int
+
+	// KeyPrefix is the namespace of all the keys stored by guble, so that a server can be shared.
+	KeyPrefix string
+}
+
+func (rc RedisConfig) keyPrefix() string {
+	if rc.KeyPrefix == "" {
+		return defaultRedisKeyPrefix
+	}
+	return rc.KeyPrefix
+}
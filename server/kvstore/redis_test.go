@@ -0,0 +1,152 @@
+package kvstore
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+
+	"testing"
+	"time"
+)
+
+func newTestRedisKVStore(t testing.TB) (*RedisKVStore, *miniredis.Miniredis, func()) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs := NewRedisKVStore(RedisConfig{Addr: server.Addr(), MaxIdle: 2})
+	assert.NoError(t, kvs.Open())
+	return kvs, server, func() {
+		kvs.Stop()
+		server.Close()
+	}
+}
+
+// advanceTime advances the time of the server with the real time, since miniredis expires the keys only
+// when its time is advanced. It returns the func for stopping it.
+func advanceTime(server *miniredis.Miniredis) func() {
+	stopC := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-stopC:
+				return
+			case <-time.After(10 * time.Millisecond):
+				server.FastForward(10 * time.Millisecond)
+			}
+		}
+	}()
+	return func() { close(stopC) }
+}
+
+func BenchmarkRedisPutGet(b *testing.B) {
+	kvs, _, cleanup := newTestRedisKVStore(b)
+	defer cleanup()
+	CommonBenchmarkPutGet(b, kvs)
+}
+
+func TestRedisPutGetDelete(t *testing.T) {
+	kvs, _, cleanup := newTestRedisKVStore(t)
+	defer cleanup()
+	CommonTestPutGetDelete(t, kvs, kvs)
+}
+
+func TestRedisIterate(t *testing.T) {
+	kvs, _, cleanup := newTestRedisKVStore(t)
+	defer cleanup()
+	CommonTestIterate(t, kvs, kvs)
+}
+
+func TestRedisIterateKeys(t *testing.T) {
+	kvs, _, cleanup := newTestRedisKVStore(t)
+	defer cleanup()
+	CommonTestIterateKeys(t, kvs, kvs)
+}
+
+func TestRedisIteratePage(t *testing.T) {
+	kvs, _, cleanup := newTestRedisKVStore(t)
+	defer cleanup()
+	CommonTestIteratePage(t, kvs, kvs)
+}
+
+func TestRedisIterateSpecialCharacters(t *testing.T) {
+	a := assert.New(t)
+	kvs, _, cleanup := newTestRedisKVStore(t)
+	defer cleanup()
+
+	a.NoError(kvs.Put("s1", "a*b", test1))
+	a.NoError(kvs.Put("s1", "aXb", test2))
+	a.NoError(kvs.Put("s1*", "a", test3))
+
+	assertChannelContains(a, kvs.IterateKeys("s1", "a*"), "a*b")
+	assertChannelContains(a, kvs.IterateKeys("s1", "a"), "a*b", "aXb")
+}
+
+func TestRedisPutWithTTL(t *testing.T) {
+	kvs, server, cleanup := newTestRedisKVStore(t)
+	defer cleanup()
+	defer advanceTime(server)()
+	CommonTestPutWithTTL(t, kvs, kvs)
+}
+
+func TestRedisBatch(t *testing.T) {
+	kvs, _, cleanup := newTestRedisKVStore(t)
+	defer cleanup()
+	CommonTestBatch(t, kvs, kvs)
+}
+
+func TestRedisCompareAndSwap(t *testing.T) {
+	kvs, server, cleanup := newTestRedisKVStore(t)
+	defer cleanup()
+	defer advanceTime(server)()
+	CommonTestCompareAndSwap(t, kvs, kvs)
+	CommonTestConcurrentCompareAndSwap(t, kvs)
+}
+
+// TestRedisWatch verifies that the changes are notified to the watchers of other processes.
+func TestRedisWatch(t *testing.T) {
+	kvs1, server, cleanup := newTestRedisKVStore(t)
+	defer cleanup()
+	kvs2 := NewRedisKVStore(RedisConfig{Addr: server.Addr()})
+	assert.NoError(t, kvs2.Open())
+	defer kvs2.Stop()
+
+	CommonTestWatch(t, kvs1, kvs2)
+}
+
+func TestRedisWatchReconnect(t *testing.T) {
+	a := assert.New(t)
+	kvs, server, cleanup := newTestRedisKVStore(t)
+	defer cleanup()
+
+	events, cancel := kvs.Watch("s1", "")
+	defer cancel()
+
+	// the watchers are closed after subscribing again, since notifications may have been lost
+	server.Close()
+	a.NoError(server.Restart())
+	select {
+	case _, ok := <-events:
+		a.False(ok)
+	case <-time.After(5 * time.Second):
+		a.Fail("watcher was not closed")
+	}
+
+	// the idle connections of the pool were closed by the restart
+	for i := 0; i < 2 && kvs.Check() != nil; i++ {
+	}
+
+	events, cancel = kvs.Watch("s1", "")
+	defer cancel()
+	a.NoError(kvs.Put("s1", "bli", test1))
+	assertEvent(a, events, Event{Type: EventPut, Schema: "s1", Key: "bli", Value: test1})
+}
+
+func TestCheck_RedisKVStore(t *testing.T) {
+	a := assert.New(t)
+	kvs, server, cleanup := newTestRedisKVStore(t)
+	defer cleanup()
+
+	a.NoError(kvs.Check())
+	server.Close()
+	a.Error(kvs.Check())
+}
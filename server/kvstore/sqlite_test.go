@@ -44,6 +44,81 @@ func TestSqliteIterateKeys(t *testing.T) {
 	CommonTestIterateKeys(t, db, db)
 }
 
+func TestSqliteIteratePage(t *testing.T) {
+	f := tempFilename()
+	defer os.Remove(f)
+
+	db := NewSqliteKVStore(f, false)
+	db.Open()
+
+	CommonTestIteratePage(t, db, db)
+}
+
+func TestSqliteIteratePageSorted(t *testing.T) {
+	f := tempFilename()
+	defer os.Remove(f)
+
+	db := NewSqliteKVStore(f, false)
+	db.Open()
+
+	CommonTestIteratePageSorted(t, db)
+}
+
+func TestSqlitePutWithTTL(t *testing.T) {
+	f := tempFilename()
+	defer os.Remove(f)
+
+	db := NewSqliteKVStore(f, false)
+	db.Open()
+
+	CommonTestPutWithTTL(t, db, db)
+}
+
+func TestSqliteBatch(t *testing.T) {
+	f := tempFilename()
+	defer os.Remove(f)
+
+	db := NewSqliteKVStore(f, false)
+	db.Open()
+
+	CommonTestBatch(t, db, db)
+}
+
+func TestSqliteCompareAndSwap(t *testing.T) {
+	f := tempFilename()
+	defer os.Remove(f)
+
+	db := NewSqliteKVStore(f, false)
+	db.Open()
+
+	CommonTestCompareAndSwap(t, db, db)
+	CommonTestConcurrentCompareAndSwap(t, db)
+}
+
+func TestSqliteWatch(t *testing.T) {
+	f := tempFilename()
+	defer os.Remove(f)
+
+	db := NewSqliteKVStore(f, false)
+	db.Open()
+
+	CommonTestWatch(t, db, db)
+}
+
+func TestSqliteSweep(t *testing.T) {
+	f := tempFilename()
+	defer os.Remove(f)
+
+	db := NewSqliteKVStore(f, false)
+	db.Open()
+
+	CommonTestSweep(t, db, db.sweep, func(schema string) int {
+		count := 0
+		db.db.Model(&kvEntry{}).Where("schema = ?", schema).Count(&count)
+		return count
+	})
+}
+
 func TestCheck_SqlKVStore(t *testing.T) {
 	a := assert.New(t)
 	f := tempFilename()
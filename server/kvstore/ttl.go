@@ -0,0 +1,59 @@
+package kvstore
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// sweepInterval is the interval between the periodic removals of the expired entries.
+var sweepInterval = time.Minute
+
+// expiryTime returns the time at which an entry stored now with the ttl expires,
+// or the zero time if it does not expire.
+func expiryTime(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// sweeper periodically removes the expired entries of a KVStore.
+type sweeper struct {
+	sweep  func() error
+	logger *log.Entry
+	stopC  chan bool
+	wg     sync.WaitGroup
+}
+
+func (s *sweeper) start() {
+	s.stopC = make(chan bool)
+	s.wg.Add(1)
+	go s.loop(s.stopC)
+}
+
+func (s *sweeper) loop(stopC chan bool) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.sweep(); err != nil {
+				s.logger.WithError(err).Error("Error removing expired entries")
+			}
+		case <-stopC:
+			return
+		}
+	}
+}
+
+func (s *sweeper) stop() {
+	if s.stopC != nil {
+		close(s.stopC)
+		s.stopC = nil
+		s.wg.Wait()
+	}
+}
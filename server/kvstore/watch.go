@@ -0,0 +1,124 @@
+package kvstore
+
+import (
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// EventType is the type of a change of an entry.
+type EventType int
+
+const (
+	// EventPut is sent when an entry was stored.
+	EventPut EventType = iota
+
+	// EventDelete is sent when an entry was deleted.
+	EventDelete
+)
+
+func (t EventType) String() string {
+	if t == EventDelete {
+		return "delete"
+	}
+	return "put"
+}
+
+// Event is a change of an entry, sent to the watchers of its schema.
+// The Value is the stored value for an EventPut, and nil for an EventDelete.
+type Event struct {
+	Type   EventType
+	Schema string
+	Key    string
+	Value  []byte
+}
+
+// changeEvent returns the event for storing the value, or for deleting the entry if the value is nil.
+func changeEvent(schema, key string, value []byte) Event {
+	if value == nil {
+		return Event{Type: EventDelete, Schema: schema, Key: key}
+	}
+	return Event{Type: EventPut, Schema: schema, Key: key, Value: value}
+}
+
+// watchChannelSize is the number of events buffered for each watcher.
+const watchChannelSize = 100
+
+type watcher struct {
+	schema    string
+	keyPrefix string
+	events    chan Event
+}
+
+func (w *watcher) matches(event Event) bool {
+	return w.schema == event.Schema && strings.HasPrefix(event.Key, w.keyPrefix)
+}
+
+// watchers is the registry of the watchers of a KVStore, notified in-process about the changes.
+// The zero value is ready to use.
+type watchers struct {
+	mutex sync.Mutex
+	all   map[*watcher]bool
+}
+
+// add registers a new watcher, and returns its channel and the func for cancelling it.
+func (ws *watchers) add(schema, keyPrefix string) (chan Event, func()) {
+	w := &watcher{
+		schema:    schema,
+		keyPrefix: keyPrefix,
+		events:    make(chan Event, watchChannelSize),
+	}
+
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	if ws.all == nil {
+		ws.all = make(map[*watcher]bool)
+	}
+	ws.all[w] = true
+
+	return w.events, func() {
+		ws.mutex.Lock()
+		defer ws.mutex.Unlock()
+		ws.remove(w)
+	}
+}
+
+// notify sends the events to the matching watchers, without blocking.
+// A watcher which does not keep up with the events is closed, since it would miss some of them.
+func (ws *watchers) notify(events ...Event) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	for _, event := range events {
+		for w := range ws.all {
+			if !w.matches(event) {
+				continue
+			}
+			select {
+			case w.events <- event:
+			default:
+				log.WithFields(log.Fields{
+					"schema":    w.schema,
+					"keyPrefix": w.keyPrefix,
+				}).Warn("Closing kvstore watcher, which does not receive the events fast enough")
+				ws.remove(w)
+			}
+		}
+	}
+}
+
+// closeAll closes all the watchers, e.g. when some events may have been lost.
+func (ws *watchers) closeAll() {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	for w := range ws.all {
+		ws.remove(w)
+	}
+}
+
+func (ws *watchers) remove(w *watcher) {
+	if ws.all[w] {
+		delete(ws.all, w)
+		close(w.events)
+	}
+}
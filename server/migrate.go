@@ -0,0 +1,53 @@
+package server
+
+import (
+	"errors"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/smancke/guble/server/service"
+	"github.com/smancke/guble/server/store"
+	"github.com/smancke/guble/server/store/migration"
+)
+
+// Migrate copies all the messages from the message store selected by --ms
+// to the message store selected by the options of the migrate command.
+// An interrupted migration is resumed by running it again.
+func Migrate() error {
+	storagePath := *Config.Migrate.StoragePath
+	if storagePath == "" {
+		storagePath = *Config.StoragePath
+	}
+	if *Config.Migrate.To == *Config.MS && (*Config.MS == "postgres" || storagePath == *Config.StoragePath) {
+		return errors.New("The source and the target message store are the same")
+	}
+
+	source := CreateMessageStore()
+	defer stopMessageStore(source)
+	target := newMessageStore(*Config.Migrate.To, storagePath)
+	defer stopMessageStore(target)
+
+	logger.WithFields(log.Fields{
+		"from": *Config.MS,
+		"to":   *Config.Migrate.To,
+	}).Info("Migrating the message store")
+
+	results, err := migration.Migrate(source, target, *Config.Migrate.BatchSize)
+	copied := 0
+	for _, result := range results {
+		copied += result.Copied
+	}
+	logger.WithFields(log.Fields{
+		"partitions": len(results),
+		"copied":     copied,
+	}).Info("Migrated the message store")
+	return err
+}
+
+func stopMessageStore(ms store.MessageStore) {
+	if stopable, ok := ms.(service.Stopable); ok {
+		if err := stopable.Stop(); err != nil {
+			logger.WithError(err).Error("Error stopping message store")
+		}
+	}
+}
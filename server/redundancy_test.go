@@ -41,7 +41,7 @@ func Test_Subscribe_on_random_node(t *testing.T) {
 	client1, err := node1.client("user1", 1000, true)
 	a.NoError(err)
 
-	err = client1.Send(testTopic, "body", "{jsonHeader:1}")
+	_, err = client1.Send(testTopic, "body", "{jsonHeader:1}")
 	a.NoError(err)
 
 	// only one message should be received but only on the first node.
@@ -83,7 +83,7 @@ func Test_Subscribe_working_After_Node_Restart(t *testing.T) {
 	// connect a clinet and send a message
 	client1, err := node1.client("user1", 1000, true)
 	a.NoError(err)
-	err = client1.Send(testTopic, "body", "{jsonHeader:1}")
+	_, err = client1.Send(testTopic, "body", "{jsonHeader:1}")
 	a.NoError(err)
 
 	// one message should be received but only on the first node.
@@ -107,7 +107,7 @@ func Test_Subscribe_working_After_Node_Restart(t *testing.T) {
 	a.NoError(err)
 	time.Sleep(time.Second)
 
-	err = client1.Send(testTopic, "body", "{jsonHeader:1}")
+	_, err = client1.Send(testTopic, "body", "{jsonHeader:1}")
 	a.NoError(err, "Subscription should work even after node restart")
 
 	// only one message should be received but only on the first node.
@@ -147,7 +147,7 @@ func Test_Independent_Receiving(t *testing.T) {
 
 	// connect a client and send a message
 	client1, err := node1.client("user1", 1000, true)
-	err = client1.Send(testTopic, "body", "{jsonHeader:1}")
+	_, err = client1.Send(testTopic, "body", "{jsonHeader:1}")
 	a.NoError(err)
 
 	// only one message should be received but only on the first node.
@@ -161,7 +161,7 @@ func Test_Independent_Receiving(t *testing.T) {
 	// NOW connect to second node
 	client2, err := node2.client("user2", 1000, true)
 	a.NoError(err)
-	err = client2.Send(testTopic, "body", "{jsonHeader:1}")
+	_, err = client2.Send(testTopic, "body", "{jsonHeader:1}")
 	a.NoError(err)
 
 	// only one message should be received but only on the second node.
@@ -202,7 +202,7 @@ func Test_NoReceiving_After_Unsubscribe(t *testing.T) {
 
 	// connect a client and send a message
 	client1, err := node1.client("user1", 1000, true)
-	err = client1.Send(testTopic, "body", "{jsonHeader:1}")
+	_, err = client1.Send(testTopic, "body", "{jsonHeader:1}")
 	a.NoError(err)
 
 	// only one message should be received but only on the first node.
@@ -218,7 +218,7 @@ func Test_NoReceiving_After_Unsubscribe(t *testing.T) {
 	node1.FCM.reset()
 
 	// and send a message again. No one should receive it
-	err = client1.Send(testTopic, "body", "{jsonHeader:1}")
+	_, err = client1.Send(testTopic, "body", "{jsonHeader:1}")
 	a.NoError(err)
 
 	// only one message should be received but only on the second node.
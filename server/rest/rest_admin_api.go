@@ -0,0 +1,467 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/audit"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/server/scope"
+	"github.com/smancke/guble/server/store"
+)
+
+const (
+	messagesPrefix = "/messages/"
+	partitionsPath = "/partitions"
+	explainPath    = "/access/explain"
+	rolesPath      = "/roles"
+	groupsPath     = "/groups"
+)
+
+var errPartitionNotFound = errors.New("Partition not found")
+
+// auditLogger logs the administrative actions independently of the configured log level, if the audit is disabled.
+var auditLogger = func() *log.Logger {
+	l := log.New()
+	l.Formatter = &log.JSONFormatter{}
+	return l
+}()
+
+// RestAdminAPI is a REST API for administrative actions, like deleting stored messages.
+// All requests require an API key with the admin scope, so it has to be served only if the webserver has API keys.
+type RestAdminAPI struct {
+	router router.Router
+	prefix string
+}
+
+// NewRestAdminAPI returns a new RestAdminAPI.
+func NewRestAdminAPI(router router.Router, prefix string) *RestAdminAPI {
+	return &RestAdminAPI{router, prefix}
+}
+
+// RequiredScope returns the scope of the API key required by all the requests.
+// It is a part of the service.ScopedEndpoint implementation.
+func (api *RestAdminAPI) RequiredScope(req *http.Request) scope.Scope {
+	return scope.Admin
+}
+
+// GetPrefix returns the prefix.
+// It is a part of the service.endpoint implementation.
+func (api *RestAdminAPI) GetPrefix() string {
+	return api.prefix
+}
+
+// ServeHTTP is an http.Handler.
+// It is a part of the service.endpoint implementation.
+//
+// Listing the statistics of all partitions, or of a single partition:
+//
+//	GET <prefix>/partitions
+//	GET <prefix>/partitions/<partition>
+//
+// Reading a single message by its id:
+//
+//	GET <prefix>/messages/<partition>/<id>
+//
+// Deleting messages of a partition:
+//
+//	DELETE <prefix>/messages/<partition>?id=<id>&id=<id>&from=<id>&to=<id>&userId=<userId>&filterCamelCase=<value>
+//
+// All the given criteria have to match for a message to be deleted.
+//
+// Explaining the decision of the access manager on an access, without accessing (if it can explain it):
+//
+//	GET <prefix>/access/explain?userId=<userId>&path=<path>&access=<read|write>
+//
+// Managing the roles and groups of the access manager (if it manages roles):
+//
+//	GET    <prefix>/roles
+//	GET    <prefix>/roles/<name>
+//	PUT    <prefix>/roles/<name>     {"read": ["/chat/*"], "write": ["/chat/{user_id}/*"]}
+//	DELETE <prefix>/roles/<name>
+//	GET    <prefix>/groups
+//	GET    <prefix>/groups/<name>
+//	PUT    <prefix>/groups/<name>    {"members": ["user01"], "roles": ["chatter"]}
+//	DELETE <prefix>/groups/<name>
+func (api *RestAdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, removeTrailingSlash(api.prefix))
+	switch {
+	case strings.HasPrefix(path, messagesPrefix):
+		api.serveMessages(w, r, strings.Split(strings.TrimPrefix(path, messagesPrefix), "/"))
+	case path == partitionsPath:
+		api.servePartitions(w, r)
+	case strings.HasPrefix(path, partitionsPath+"/"):
+		api.servePartition(w, r, strings.TrimPrefix(path, partitionsPath+"/"))
+	case path == explainPath:
+		api.serveExplain(w, r)
+	case path == rolesPath || strings.HasPrefix(path, rolesPath+"/"):
+		api.serveRoles(w, r, strings.TrimPrefix(strings.TrimPrefix(path, rolesPath), "/"))
+	case path == groupsPath || strings.HasPrefix(path, groupsPath+"/"):
+		api.serveGroups(w, r, strings.TrimPrefix(strings.TrimPrefix(path, groupsPath), "/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (api *RestAdminAPI) serveMessages(w http.ResponseWriter, r *http.Request, parts []string) {
+	if parts[0] == "" || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 2 {
+		api.serveMessage(w, r, parts[0], parts[1])
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	partition := parts[0]
+
+	req, err := deleteRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var deleted int
+	p, err := api.partition(partition)
+	if err == nil {
+		deleted, err = p.Delete(req)
+	}
+
+	auditAdmin(r, "delete-messages", map[string]interface{}{
+		"partition": partition,
+		"ids":       req.IDs,
+		"fromId":    req.FromID,
+		"toId":      req.ToID,
+		"userId":    req.UserID,
+		"filters":   req.Filters,
+		"deleted":   deleted,
+	}, err)
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"partition": partition,
+		"deleted":   deleted,
+	})
+}
+
+func (api *RestAdminAPI) serveMessage(w http.ResponseWriter, r *http.Request, partition, idParam string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(idParam, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid id: "+idParam, http.StatusBadRequest)
+		return
+	}
+
+	var data []byte
+	p, err := api.partition(partition)
+	if err == nil {
+		data, err = store.FetchMessage(p, id)
+	}
+
+	auditAdmin(r, "read-message", map[string]interface{}{
+		"partition": partition,
+		"id":        id,
+	}, err)
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(data)
+}
+
+func (api *RestAdminAPI) servePartitions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ms, err := api.router.MessageStore()
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	stats, err := store.AllStats(ms)
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+func (api *RestAdminAPI) servePartition(w http.ResponseWriter, r *http.Request, partition string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var stats *store.PartitionStats
+	p, err := api.partition(partition)
+	if err == nil {
+		stats, err = store.Stats(p)
+	}
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+func (api *RestAdminAPI) serveExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	var accessType auth.AccessType
+	switch query.Get("access") {
+	case auth.READ.String():
+		accessType = auth.READ
+	case auth.WRITE.String():
+		accessType = auth.WRITE
+	default:
+		http.Error(w, "The access has to be read or write", http.StatusBadRequest)
+		return
+	}
+	path := query.Get("path")
+	if path == "" {
+		http.Error(w, "Missing path", http.StatusBadRequest)
+		return
+	}
+
+	accessManager, err := api.router.AccessManager()
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	explainer, ok := accessManager.(auth.Explainer)
+	if !ok {
+		http.Error(w, "The access manager can not explain its decisions", http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, explainer.Explain(accessType, query.Get("userId"), protocol.Path(path)))
+}
+
+func (api *RestAdminAPI) serveRoles(w http.ResponseWriter, r *http.Request, name string) {
+	roleManager, ok := api.roleManager(w)
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet:
+		roles, err := roleManager.Roles()
+		if err != nil {
+			writeAdminError(w, r, err)
+			return
+		}
+		if name == "" {
+			writeJSON(w, roles)
+		} else if role, exists := roles[name]; exists {
+			writeJSON(w, role)
+		} else {
+			http.Error(w, auth.ErrRoleNotFound.Error(), http.StatusNotFound)
+		}
+	case r.Method == http.MethodPut && name != "":
+		var role auth.Role
+		if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
+			http.Error(w, "Invalid role: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		api.auditRoleChange(w, r, "put-role", name, role, roleManager.PutRole(name, role))
+	case r.Method == http.MethodDelete && name != "":
+		api.auditRoleChange(w, r, "delete-role", name, nil, roleManager.DeleteRole(name))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (api *RestAdminAPI) serveGroups(w http.ResponseWriter, r *http.Request, name string) {
+	roleManager, ok := api.roleManager(w)
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet:
+		groups, err := roleManager.Groups()
+		if err != nil {
+			writeAdminError(w, r, err)
+			return
+		}
+		if name == "" {
+			writeJSON(w, groups)
+		} else if group, exists := groups[name]; exists {
+			writeJSON(w, group)
+		} else {
+			http.Error(w, auth.ErrGroupNotFound.Error(), http.StatusNotFound)
+		}
+	case r.Method == http.MethodPut && name != "":
+		var group auth.Group
+		if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+			http.Error(w, "Invalid group: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		api.auditRoleChange(w, r, "put-group", name, group, roleManager.PutGroup(name, group))
+	case r.Method == http.MethodDelete && name != "":
+		api.auditRoleChange(w, r, "delete-group", name, nil, roleManager.DeleteGroup(name))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// roleManager returns the access manager if it manages roles, or writes an error.
+func (api *RestAdminAPI) roleManager(w http.ResponseWriter) (auth.RoleManager, bool) {
+	accessManager, err := api.router.AccessManager()
+	if err != nil {
+		http.Error(w, "Server error.", http.StatusInternalServerError)
+		return nil, false
+	}
+	roleManager, ok := auth.FindRoleManager(accessManager)
+	if !ok {
+		http.Error(w, "The access manager does not manage roles", http.StatusNotImplemented)
+		return nil, false
+	}
+	return roleManager, true
+}
+
+// auditRoleChange audits the change of a role or group, and writes its result.
+func (api *RestAdminAPI) auditRoleChange(w http.ResponseWriter, r *http.Request, action, name string, value interface{}, err error) {
+	auditAdmin(r, action, map[string]interface{}{
+		"name":  name,
+		"value": value,
+	}, err)
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case auth.ErrRoleNotFound, auth.ErrGroupNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case auth.ErrInvalidName, auth.ErrEmptyPathPattern:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.WithError(err).WithField("action", action).Error("Changing the access roles failed")
+		http.Error(w, "Server error.", http.StatusInternalServerError)
+	}
+}
+
+// auditAdmin records the administrative action with its error, if the audit is enabled.
+// Otherwise it is logged by the auditLogger.
+func auditAdmin(r *http.Request, action string, details map[string]interface{}, err error) {
+	userID := auth.UserIDFromContext(r.Context())
+	if audit.Enabled() {
+		audit.Record(&audit.Event{
+			Action:     action,
+			UserID:     userID,
+			RemoteAddr: r.RemoteAddr,
+			Details:    details,
+			Result:     audit.Result(err),
+		})
+		return
+	}
+
+	le := auditLogger.WithFields(log.Fields(details)).WithFields(log.Fields{
+		"remoteAddr": r.RemoteAddr,
+		"action":     action,
+	})
+	if userID != "" {
+		le = le.WithField("userId", userID)
+	}
+	if err != nil {
+		le.WithError(err).Warn("Administrative action failed")
+		return
+	}
+	le.Info("Administrative action")
+}
+
+// partition returns the existing partition with the name.
+func (api *RestAdminAPI) partition(name string) (store.MessagePartition, error) {
+	ms, err := api.router.MessageStore()
+	if err != nil {
+		return nil, err
+	}
+
+	// only look for existing partitions, since store.Partition() may create a new one
+	partitions, err := ms.Partitions()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range partitions {
+		if p.Name() == name {
+			return p, nil
+		}
+	}
+	return nil, errPartitionNotFound
+}
+
+func writeAdminError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errPartitionNotFound, store.ErrMessageNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case store.ErrEmptyDeleteRequest:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.WithError(err).WithField("url", r.URL.String()).Error("Admin request failed")
+		http.Error(w, "Server error.", http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// deleteRequest creates a store.DeleteRequest from the query parameters of the request.
+func deleteRequest(r *http.Request) (*store.DeleteRequest, error) {
+	query := r.URL.Query()
+	req := &store.DeleteRequest{
+		UserID: q(r, "userId"),
+	}
+
+	for _, value := range query["id"] {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, errors.New("Invalid id: " + value)
+		}
+		req.IDs = append(req.IDs, id)
+	}
+
+	var err error
+	if value := q(r, "from"); value != "" {
+		if req.FromID, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return nil, errors.New("Invalid from: " + value)
+		}
+	}
+	if value := q(r, "to"); value != "" {
+		if req.ToID, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return nil, errors.New("Invalid to: " + value)
+		}
+	}
+
+	for name, values := range query {
+		if strings.HasPrefix(name, filterPrefix) && len(values) > 0 {
+			if req.Filters == nil {
+				req.Filters = make(map[string]string)
+			}
+			req.Filters[filterName(name)] = values[0]
+		}
+	}
+
+	return req, req.Validate()
+}
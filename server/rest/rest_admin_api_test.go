@@ -0,0 +1,309 @@
+package rest
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/audit"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/scope"
+	"github.com/smancke/guble/server/service"
+	"github.com/smancke/guble/server/store"
+	"github.com/smancke/guble/server/store/memorystore"
+	"github.com/smancke/guble/testutil"
+
+	"github.com/stretchr/testify/assert"
+
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRestAdminAPI_RequiredScope(t *testing.T) {
+	a := assert.New(t)
+	var api service.ScopedEndpoint = NewRestAdminAPI(nil, "/admin")
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete, http.MethodPut} {
+		req, _ := http.NewRequest(method, "http://localhost/admin/messages/p1?id=1", nil)
+		a.Equal(scope.Admin, api.RequiredScope(req), method)
+	}
+}
+
+func TestRestAdminAPI_DeleteMessages(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	ms := memorystore.New(0, 0)
+	for i, userID := range []string{"marvin", "arthur", "marvin", "marvin"} {
+		msg := &protocol.Message{
+			ID:      uint64(i + 1),
+			Path:    protocol.Path("/p1/topic"),
+			UserID:  userID,
+			Filters: map[string]string{"device_id": "phone"},
+		}
+		a.NoError(ms.Store("p1", msg.ID, msg.Bytes()))
+	}
+
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().MessageStore().Return(ms, nil).AnyTimes()
+	api := NewRestAdminAPI(routerMock, "/admin")
+
+	testCases := []struct {
+		method       string
+		url          string
+		expectedCode int
+		expectedBody string
+	}{
+		{http.MethodGet, "/admin/messages/p1?id=1", http.StatusMethodNotAllowed, ""},
+		{http.MethodDelete, "/admin/messages/", http.StatusNotFound, ""},
+		{http.MethodDelete, "/admin/messages/unknown?id=1", http.StatusNotFound, ""},
+		{http.MethodDelete, "/admin/messages/p1", http.StatusBadRequest, ""},
+		{http.MethodDelete, "/admin/messages/p1?id=abc", http.StatusBadRequest, ""},
+		{http.MethodDelete, "/admin/messages/p1?id=1&id=2", http.StatusOK, `{"deleted":2,"partition":"p1"}`},
+		{http.MethodDelete, "/admin/messages/p1?from=3&userId=marvin&filterDeviceId=phone", http.StatusOK, `{"deleted":2,"partition":"p1"}`},
+		{http.MethodDelete, "/admin/messages/p1?userId=marvin", http.StatusOK, `{"deleted":0,"partition":"p1"}`},
+	}
+
+	for _, tc := range testCases {
+		req, _ := http.NewRequest(tc.method, "http://localhost"+tc.url, nil)
+		w := httptest.NewRecorder()
+
+		api.ServeHTTP(w, req)
+
+		a.Equal(tc.expectedCode, w.Code, tc.url)
+		if tc.expectedBody != "" {
+			a.JSONEq(tc.expectedBody, w.Body.String(), tc.url)
+		}
+	}
+
+	p, err := ms.Partition("p1")
+	a.NoError(err)
+	a.Equal(uint64(0), p.Count())
+}
+
+type testAuditRecorder struct {
+	events []*audit.Event
+}
+
+func (r *testAuditRecorder) Record(e *audit.Event) {
+	r.events = append(r.events, e)
+}
+
+func TestRestAdminAPI_Audit(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+	recorder := &testAuditRecorder{}
+	audit.SetRecorder(recorder)
+	defer audit.SetRecorder(nil)
+
+	ms := memorystore.New(0, 0)
+	msg := &protocol.Message{ID: 1, Path: protocol.Path("/p1/topic"), UserID: "marvin"}
+	a.NoError(ms.Store("p1", msg.ID, msg.Bytes()))
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().MessageStore().Return(ms, nil).AnyTimes()
+	api := NewRestAdminAPI(routerMock, "/admin")
+
+	req, _ := http.NewRequest(http.MethodDelete, "http://localhost/admin/messages/p1?id=1", nil)
+	api.ServeHTTP(httptest.NewRecorder(), req)
+
+	if a.Equal(1, len(recorder.events)) {
+		a.Equal("delete-messages", recorder.events[0].Action)
+		a.Equal(audit.ResultOK, recorder.events[0].Result)
+		a.Equal("p1", recorder.events[0].Details["partition"])
+		a.Equal(1, recorder.events[0].Details["deleted"])
+	}
+}
+
+func TestRestAdminAPI_AuditLoggerOnlyWithoutAudit(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+	out := &bytes.Buffer{}
+	auditLogger.Out = out
+	defer func() { auditLogger.Out = os.Stderr }()
+
+	ms := memorystore.New(0, 0)
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().MessageStore().Return(ms, nil).AnyTimes()
+	api := NewRestAdminAPI(routerMock, "/admin")
+	deleteMessage := func() {
+		a.NoError(ms.Store("p1", 1, (&protocol.Message{ID: 1, Path: "/p1/topic"}).Bytes()))
+		req, _ := http.NewRequest(http.MethodDelete, "http://localhost/admin/messages/p1?id=1", nil)
+		api.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// the action is logged, if the audit is disabled
+	deleteMessage()
+	a.Contains(out.String(), `"action":"delete-messages"`)
+
+	// and only recorded, if the audit is enabled
+	out.Reset()
+	recorder := &testAuditRecorder{}
+	audit.SetRecorder(recorder)
+	defer audit.SetRecorder(nil)
+	deleteMessage()
+	a.Empty(out.String())
+	a.Equal(1, len(recorder.events))
+}
+
+func TestRestAdminAPI_PartitionsAndMessages(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	ms := memorystore.New(0, 0)
+	var messages []*protocol.Message
+	for i := 1; i <= 3; i++ {
+		msg := &protocol.Message{
+			ID:   uint64(i),
+			Time: int64(1000 + i),
+			Path: protocol.Path("/p1/topic"),
+			Body: []byte("body"),
+		}
+		a.NoError(ms.Store("p1", msg.ID, msg.Bytes()))
+		messages = append(messages, msg)
+	}
+
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().MessageStore().Return(ms, nil).AnyTimes()
+	api := NewRestAdminAPI(routerMock, "/admin")
+
+	get := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost"+url, nil)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/admin/partitions")
+	a.Equal(http.StatusOK, w.Code)
+	var all []store.PartitionStats
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &all))
+	a.Equal(1, len(all))
+	a.Equal("p1", all[0].Name)
+	a.Equal(uint64(3), all[0].Count)
+	a.Equal(uint64(1), all[0].OldestID)
+	a.Equal(int64(1001), all[0].OldestTime)
+	a.Equal(uint64(3), all[0].NewestID)
+	a.Equal(int64(1003), all[0].NewestTime)
+	a.True(all[0].Bytes > 0)
+
+	w = get("/admin/partitions/p1")
+	a.Equal(http.StatusOK, w.Code)
+	var stats store.PartitionStats
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &stats))
+	a.Equal(all[0], stats)
+
+	a.Equal(http.StatusNotFound, get("/admin/partitions/unknown").Code)
+
+	w = get("/admin/messages/p1/2")
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal(string(messages[1].Bytes()), w.Body.String())
+
+	a.Equal(http.StatusNotFound, get("/admin/messages/p1/4").Code)
+	a.Equal(http.StatusNotFound, get("/admin/messages/unknown/1").Code)
+	a.Equal(http.StatusBadRequest, get("/admin/messages/p1/abc").Code)
+	a.Equal(http.StatusNotFound, get("/admin/unknown").Code)
+}
+
+// testExplainer allows only the user "marvin" to read.
+type testExplainer struct{}
+
+func (testExplainer) IsAllowed(accessType auth.AccessType, userID string, path protocol.Path) bool {
+	return testExplainer{}.Explain(accessType, userID, path).Allowed
+}
+
+func (testExplainer) Explain(accessType auth.AccessType, userID string, path protocol.Path) auth.Explanation {
+	if accessType == auth.READ && userID == "marvin" {
+		return auth.Explanation{Allowed: true, Reason: "allowed by rule 0"}
+	}
+	return auth.Explanation{Allowed: false, Reason: "no rule matches", RuleIndex: -1}
+}
+
+func TestRestAdminAPI_ExplainAccess(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestAdminAPI(routerMock, "/admin")
+
+	get := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost"+url, nil)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	routerMock.EXPECT().AccessManager().Return(testExplainer{}, nil).Times(2)
+	w := get("/admin/access/explain?userId=marvin&path=/foo&access=read")
+	a.Equal(http.StatusOK, w.Code)
+	a.JSONEq(`{"allowed":true,"reason":"allowed by rule 0","ruleIndex":0}`, w.Body.String())
+
+	w = get("/admin/access/explain?userId=marvin&path=/foo&access=write")
+	a.Equal(http.StatusOK, w.Code)
+	a.JSONEq(`{"allowed":false,"reason":"no rule matches","ruleIndex":-1}`, w.Body.String())
+
+	a.Equal(http.StatusBadRequest, get("/admin/access/explain?userId=marvin&path=/foo&access=delete").Code)
+	a.Equal(http.StatusBadRequest, get("/admin/access/explain?userId=marvin&access=read").Code)
+
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil)
+	a.Equal(http.StatusNotImplemented, get("/admin/access/explain?userId=marvin&path=/foo&access=read").Code)
+}
+
+func TestRestAdminAPI_Roles(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestAdminAPI(routerMock, "/admin")
+	roleManager := auth.NewRBACAccessManager(kvstore.NewMemoryKVStore())
+	routerMock.EXPECT().AccessManager().Return(roleManager, nil).AnyTimes()
+
+	request := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://localhost"+url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	a.Equal(http.StatusNoContent, request(http.MethodPut, "/admin/roles/chatter", `{"read": ["/chat/*"], "write": ["/chat/{user_id}/*"]}`).Code)
+	a.Equal(http.StatusNoContent, request(http.MethodPut, "/admin/groups/users", `{"members": ["marvin"], "roles": ["chatter"]}`).Code)
+	a.True(roleManager.IsAllowed(auth.WRITE, "marvin", "/chat/marvin/room1"))
+
+	w := request(http.MethodGet, "/admin/roles", "")
+	a.Equal(http.StatusOK, w.Code)
+	a.JSONEq(`{"chatter": {"read": ["/chat/*"], "write": ["/chat/{user_id}/*"]}}`, w.Body.String())
+	w = request(http.MethodGet, "/admin/groups/users", "")
+	a.Equal(http.StatusOK, w.Code)
+	a.JSONEq(`{"members": ["marvin"], "roles": ["chatter"]}`, w.Body.String())
+	a.Equal(http.StatusNotFound, request(http.MethodGet, "/admin/groups/unknown", "").Code)
+
+	a.Equal(http.StatusBadRequest, request(http.MethodPut, "/admin/roles/invalid", `{"read": [`).Code)
+	a.Equal(http.StatusBadRequest, request(http.MethodPut, "/admin/roles/invalid", `{"read": [""]}`).Code)
+	a.Equal(http.StatusMethodNotAllowed, request(http.MethodPut, "/admin/roles", `{}`).Code)
+
+	a.Equal(http.StatusNoContent, request(http.MethodDelete, "/admin/roles/chatter", "").Code)
+	a.Equal(http.StatusNotFound, request(http.MethodDelete, "/admin/roles/chatter", "").Code)
+	a.False(roleManager.IsAllowed(auth.WRITE, "marvin", "/chat/marvin/room1"))
+}
+
+func TestRestAdminAPI_RolesNotManaged(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestAdminAPI(routerMock, "/admin")
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/admin/groups", nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
@@ -7,7 +7,10 @@ import (
 	"github.com/azer/snakecase"
 
 	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/audit"
+	"github.com/smancke/guble/server/auth"
 	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/server/store"
 
 	"github.com/rs/xid"
 
@@ -64,6 +67,9 @@ func (api *RestMessageAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Server error.", http.StatusInternalServerError)
 			return
 		}
+		if _, ok := api.authorize(w, r, auth.READ, protocol.Path(topic)); !ok {
+			return
+		}
 
 		resp, err := api.router.GetSubscribers(topic)
 		w.Header().Set("Content-Type", "application/json")
@@ -97,11 +103,20 @@ func (api *RestMessageAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Server error.", http.StatusInternalServerError)
 		return
 	}
+	userID, ok := api.authorize(w, r, auth.WRITE, protocol.Path(topic))
+	if !ok {
+		return
+	}
+
+	if err := audit.CheckPublish(protocol.Path(topic)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 
 	msg := &protocol.Message{
 		Path:          protocol.Path(topic),
 		Body:          body,
-		UserID:        q(r, "userId"),
+		UserID:        userID,
 		ApplicationID: xid.New().String(),
 		HeaderJSON:    headersToJSON(r.Header),
 	}
@@ -109,10 +124,57 @@ func (api *RestMessageAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// add filters
 	api.setFilters(r, msg)
 
-	api.router.HandleMessage(msg)
+	if err := api.router.HandleMessage(msg); err != nil {
+		log.WithError(err).WithField("path", msg.Path).Error("Error handling message")
+		switch err.(type) {
+		case *router.PermissionDeniedError:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case *router.ModuleStoppingError:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		case *store.QuotaExceededError:
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		default:
+			http.Error(w, "Server error.", http.StatusInternalServerError)
+		}
+		return
+	}
 	fmt.Fprintf(w, "OK")
 }
 
+// authorize returns the user of the request, which is identified by the token of the request
+// if the AccessManager of the router is an auth.Authenticator, else by the transport (e.g. a client certificate)
+// if it authenticated the user, else given by the userId parameter.
+// The permissions granted by the token are checked here, the AccessManager is checked by the router.
+// If the request is not authorized, the error response is written and false is returned.
+func (api *RestMessageAPI) authorize(w http.ResponseWriter, r *http.Request, accessType auth.AccessType, path protocol.Path) (string, bool) {
+	accessManager, err := api.router.AccessManager()
+	if err != nil {
+		log.WithError(err).Error("Getting the access manager failed")
+		http.Error(w, "Server error.", http.StatusInternalServerError)
+		return "", false
+	}
+	authenticator, ok := accessManager.(auth.Authenticator)
+	if !ok {
+		if userID, identified := auth.UserIDFromTransport(r.Context()); identified {
+			return userID, true
+		}
+		return q(r, "userId"), true
+	}
+
+	userID, permissions, err := authenticator.Authenticate(auth.TokenFromRequest(r))
+	if err != nil {
+		log.WithError(err).WithField("url", r.URL.Path).Warn("Unauthenticated request")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="guble"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	if !permissions.IsAllowed(accessType, userID, path) {
+		http.Error(w, (&router.PermissionDeniedError{UserID: userID, AccessType: accessType, Path: path}).Error(), http.StatusForbidden)
+		return "", false
+	}
+	return userID, true
+}
+
 func (api *RestMessageAPI) extractTopic(path string, requestTypeTopicPrefix string) (string, error) {
 	p := removeTrailingSlash(api.prefix) + requestTypeTopicPrefix
 	if !strings.HasPrefix(path, p) {
@@ -2,6 +2,10 @@ package rest
 
 import (
 	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/audit"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/server/store"
 	"github.com/smancke/guble/testutil"
 
 	"github.com/golang/mock/gomock"
@@ -9,10 +13,12 @@ import (
 
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 )
@@ -27,6 +33,7 @@ func TestServerHTTP(t *testing.T) {
 
 	// given:  a rest api with a message sink
 	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil).AnyTimes()
 	api := NewRestMessageAPI(routerMock, "/api")
 
 	u, _ := url.Parse("http://localhost/api/message/my/topic?userId=marvin&messageId=42")
@@ -54,6 +61,157 @@ func TestServerHTTP(t *testing.T) {
 	api.ServeHTTP(w, req)
 }
 
+// testAuthenticator accepts the token "valid" of the user "tokenuser", who may only write to /my/topic.
+type testAuthenticator struct {
+	auth.AllowAllAccessManager
+}
+
+func (testAuthenticator) Authenticate(token string) (string, auth.AccessManager, error) {
+	if token != "valid" {
+		return "", nil, errors.New("invalid token")
+	}
+	return "tokenuser", testPermissions{}, nil
+}
+
+type testPermissions struct{}
+
+func (testPermissions) IsAllowed(accessType auth.AccessType, userID string, path protocol.Path) bool {
+	return accessType == auth.WRITE && userID == "tokenuser" && path == "/my/topic"
+}
+
+func TestServeHTTP_Token(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().AccessManager().Return(testAuthenticator{auth.NewAllowAllAccessManager(true)}, nil).AnyTimes()
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	testCases := []struct {
+		url   string
+		token string
+		code  int
+	}{
+		{"http://localhost/api/message/my/topic?userId=marvin", "", http.StatusUnauthorized},
+		{"http://localhost/api/message/my/topic?userId=marvin", "invalid", http.StatusUnauthorized},
+		{"http://localhost/api/message/other/topic", "valid", http.StatusForbidden},
+		{"http://localhost/api/subscribers/my/topic", "valid", http.StatusForbidden},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(http.MethodPost, tc.url, bytes.NewReader(testBytes))
+		if strings.Contains(tc.url, "subscribers") {
+			req.Method = http.MethodGet
+		}
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		a.Equal(tc.code, w.Code, tc.url)
+	}
+
+	// the user is identified by the token, instead of the userId parameter
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(msg *protocol.Message) {
+		a.Equal("tokenuser", msg.UserID)
+	})
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?userId=marvin&access_token=valid", bytes.NewReader(testBytes))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusOK, w.Code)
+}
+
+func TestServeHTTP_TransportUserID(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil).AnyTimes()
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	// the user authenticated by the transport (e.g. a client certificate) replaces the userId parameter
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(msg *protocol.Message) {
+		a.Equal("certuser", msg.UserID)
+	})
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?userId=marvin", bytes.NewReader(testBytes))
+	req = req.WithContext(auth.WithUserID(req.Context(), "certuser"))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusOK, w.Code)
+
+	// a request without a certificate is anonymous, instead of the userId parameter
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(msg *protocol.Message) {
+		a.Equal("", msg.UserID)
+	})
+	req = httptest.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?userId=marvin", bytes.NewReader(testBytes))
+	req = req.WithContext(auth.WithUserID(req.Context(), ""))
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusOK, w.Code)
+}
+
+// auditTopicRecorder is an audit.Recorder publishing the events to the topic /audit.
+type auditTopicRecorder struct{}
+
+func (auditTopicRecorder) Record(e *audit.Event) {}
+
+func (auditTopicRecorder) Topic() protocol.Path {
+	return "/audit"
+}
+
+func TestServeHTTP_AuditTopic(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+	audit.SetRecorder(auditTopicRecorder{})
+	defer audit.SetRecorder(nil)
+
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil).AnyTimes()
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	// the message is not handled by the router
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/message/audit?userId="+audit.TopicUserID, bytes.NewReader(testBytes))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusForbidden, w.Code)
+}
+
+// Server should only acknowledge the message if it was handled by the router
+func TestServeHTTP_HandleMessageError(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil).AnyTimes()
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	testCases := []struct {
+		err  error
+		code int
+	}{
+		{&router.PermissionDeniedError{UserID: "marvin"}, http.StatusForbidden},
+		{&router.ModuleStoppingError{Name: "router"}, http.StatusServiceUnavailable},
+		{&store.QuotaExceededError{Partition: "my", Resource: "bytes", Limit: 100}, http.StatusInsufficientStorage},
+		{errors.New("sync failed"), http.StatusInternalServerError},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?userId=marvin", bytes.NewReader(testBytes))
+		w := httptest.NewRecorder()
+
+		routerMock.EXPECT().HandleMessage(gomock.Any()).Return(tc.err)
+		api.ServeHTTP(w, req)
+
+		a.Equal(tc.code, w.Code)
+		a.NotContains(w.Body.String(), "OK")
+	}
+}
+
 // Server should return an 405 Method Not Allowed in case method request is not POST
 func TestServeHTTP_GetError(t *testing.T) {
 	a := assert.New(t)
@@ -86,6 +244,7 @@ func TestServeHTTP_GetSubscribers(t *testing.T) {
 	a := assert.New(t)
 
 	routerMock := NewMockRouter(testutil.MockCtrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil).AnyTimes()
 	api := NewRestMessageAPI(routerMock, "/api")
 	routerMock.EXPECT().GetSubscribers(gomock.Any()).Return([]byte("{}"), nil)
 	u, _ := url.Parse("http://localhost/api/subscribers/mytopic")
@@ -201,6 +360,7 @@ func TestRestMessageAPI_SetFiltersWhenServing(t *testing.T) {
 	a.NoError(err)
 
 	routerMock := NewMockRouter(testutil.MockCtrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil).AnyTimes()
 	api := NewRestMessageAPI(routerMock, "/test/")
 	recorder := httptest.NewRecorder()
 
@@ -14,9 +14,11 @@ import (
 	"net/http"
 
 	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/audit"
 	"github.com/smancke/guble/server/auth"
 	"github.com/smancke/guble/server/cluster"
 	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/scope"
 	"github.com/smancke/guble/server/store"
 )
 
@@ -167,7 +169,9 @@ func (router *router) HandleMessage(message *protocol.Message) error {
 		return err
 	}
 
-	if !router.accessManager.IsAllowed(auth.WRITE, message.UserID, message.Path) {
+	// the audit events are published by the audit recorder, and not by a client
+	if !audit.IsOwnPublish(message) && !router.accessManager.IsAllowed(auth.WRITE, message.UserID, message.Path) {
+		auditPublish(message, audit.ResultDenied)
 		return &PermissionDeniedError{UserID: message.UserID, AccessType: auth.WRITE, Path: message.Path}
 	}
 
@@ -181,9 +185,11 @@ func (router *router) HandleMessage(message *protocol.Message) error {
 	if err != nil {
 		logger.WithField("error", err.Error()).Error("Error storing message")
 		mTotalMessageStoreErrors.Add(1)
+		auditPublish(message, audit.Result(err))
 		return err
 	}
 	mTotalMessagesStoredBytes.Add(int64(size))
+	auditPublish(message, audit.ResultOK)
 
 	router.handleOverloadedChannel()
 
@@ -211,6 +217,7 @@ func (router *router) Subscribe(r *Route) (*Route, error) {
 
 	accessAllowed := router.accessManager.IsAllowed(auth.READ, userID, routePath)
 	if !accessAllowed {
+		auditRoute(audit.ActionSubscribe, r, audit.ResultDenied)
 		return r, &PermissionDeniedError{UserID: userID, AccessType: auth.READ, Path: routePath}
 	}
 	req := subRequest{
@@ -220,6 +227,7 @@ func (router *router) Subscribe(r *Route) (*Route, error) {
 
 	router.subscribeC <- req
 	<-req.doneC
+	auditRoute(audit.ActionSubscribe, r, audit.ResultOK)
 	return r, nil
 }
 
@@ -236,6 +244,7 @@ func (router *router) Unsubscribe(r *Route) {
 	}
 	router.unsubscribeC <- req
 	<-req.doneC
+	auditRoute(audit.ActionUnsubscribe, r, audit.ResultOK)
 }
 
 func (router *router) GetSubscribers(topicPath string) ([]byte, error) {
@@ -302,6 +311,44 @@ func (router *router) unsubscribe(r *Route) {
 	}
 }
 
+// auditPublish records the publish of the message, if the audit is enabled.
+func auditPublish(message *protocol.Message, result string) {
+	if !audit.Enabled() {
+		return
+	}
+	audit.Record(&audit.Event{
+		Action:        audit.ActionPublish,
+		UserID:        message.UserID,
+		Path:          message.Path,
+		MessageID:     message.ID,
+		Result:        result,
+		Body:          message.Body,
+		ApplicationID: message.ApplicationID,
+	})
+}
+
+// auditRoute records the subscription or unsubscription of the route, if the audit is enabled.
+// Only the application and connector of the route are recorded, since its other parameters can be credentials,
+// like device tokens.
+func auditRoute(action string, r *Route, result string) {
+	if !audit.Enabled() {
+		return
+	}
+	details := make(map[string]interface{})
+	for _, key := range []string{"application_id", "connector"} {
+		if value := r.Get(key); value != "" {
+			details[key] = value
+		}
+	}
+	audit.Record(&audit.Event{
+		Action:  action,
+		UserID:  r.Get("user_id"),
+		Path:    r.Path,
+		Details: details,
+		Result:  result,
+	})
+}
+
 func (router *router) panicIfInternalDependenciesAreNil() {
 	if router.accessManager == nil || router.kvStore == nil || router.messageStore == nil {
 		panic(fmt.Sprintf("router: the internal dependencies marked with `true` are not set: AccessManager=%v, KVStore=%v, MessageStore=%v",
@@ -467,3 +514,9 @@ func (router *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 func (router *router) GetPrefix() string {
 	return prefix
 }
+
+// RequiredScope returns the scope of the API key required for listing the routes.
+// It is a part of the service.ScopedEndpoint implementation.
+func (router *router) RequiredScope(req *http.Request) scope.Scope {
+	return scope.ReadOnly
+}
@@ -2,10 +2,14 @@ package router
 
 import (
 	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/audit"
 	"github.com/smancke/guble/server/auth"
 	"github.com/smancke/guble/server/kvstore"
 	"github.com/smancke/guble/server/store"
@@ -185,6 +189,74 @@ func TestRouter_HandleMessageNotAllowed(t *testing.T) {
 	a.NoError(err)
 }
 
+type testAuditRecorder struct {
+	events []*audit.Event
+}
+
+func (r *testAuditRecorder) Record(e *audit.Event) {
+	r.events = append(r.events, e)
+}
+
+func TestRouter_Audit(t *testing.T) {
+	a := assert.New(t)
+	recorder := &testAuditRecorder{}
+	audit.SetRecorder(recorder)
+	defer audit.SetRecorder(nil)
+
+	router, r := aRouterRoute(chanSize)
+	a.NoError(router.HandleMessage(&protocol.Message{Path: r.Path, Body: aTestByteMessage, UserID: "user02"}))
+	router.Unsubscribe(r)
+	router.accessManager = auth.NewAllowAllAccessManager(false)
+	a.Error(router.HandleMessage(&protocol.Message{Path: r.Path, Body: aTestByteMessage, UserID: "user03"}))
+
+	a.Equal(4, len(recorder.events))
+	a.Equal(audit.ActionSubscribe, recorder.events[0].Action)
+	a.Equal("user01", recorder.events[0].UserID)
+	a.Equal(map[string]interface{}{"application_id": "appid01"}, recorder.events[0].Details)
+
+	a.Equal(audit.ActionPublish, recorder.events[1].Action)
+	a.Equal("user02", recorder.events[1].UserID)
+	a.Equal(r.Path, recorder.events[1].Path)
+	a.NotZero(recorder.events[1].MessageID)
+	a.Equal(aTestByteMessage, recorder.events[1].Body)
+	a.Equal(audit.ResultOK, recorder.events[1].Result)
+
+	a.Equal(audit.ActionUnsubscribe, recorder.events[2].Action)
+
+	a.Equal(audit.ActionPublish, recorder.events[3].Action)
+	a.Equal("user03", recorder.events[3].UserID)
+	a.Equal(audit.ResultDenied, recorder.events[3].Result)
+}
+
+func TestRouter_AuditTopic(t *testing.T) {
+	a := assert.New(t)
+	dir, err := ioutil.TempDir("", "guble_router_test")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+	recorder, err := audit.NewFileRecorder(audit.Config{Filename: filepath.Join(dir, "audit.log")})
+	a.NoError(err)
+	audit.SetRecorder(recorder)
+	defer audit.SetRecorder(nil)
+
+	router, r := aRouterRoute(chanSize)
+	router.accessManager = auth.NewAllowAllAccessManager(false)
+	recorder.PublishTo(r.Path, router)
+
+	// the audit events are published by the recorder, although it has no write permission on the topic
+	audit.Record(&audit.Event{Action: audit.ActionSubscribe, UserID: "user01"})
+	select {
+	case m := <-r.MessagesChannel():
+		a.Equal(audit.TopicUserID, m.UserID)
+		a.Contains(string(m.Body), "user01")
+	case <-time.After(time.Second):
+		a.Fail("No audit event received")
+	}
+
+	// the messages pretending to be published by the recorder are checked
+	a.Error(router.HandleMessage(&protocol.Message{Path: r.Path, Body: aTestByteMessage, UserID: audit.TopicUserID}))
+	a.NoError(recorder.Stop())
+}
+
 func TestRouter_ReplacingOfRoutesMatchingAppID(t *testing.T) {
 	a := assert.New(t)
 
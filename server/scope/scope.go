@@ -0,0 +1,42 @@
+// Package scope defines the scopes of the API keys, which are required by the protected endpoints.
+package scope
+
+import "net/http"
+
+// Scope is a permission granted to an API key.
+type Scope string
+
+const (
+	// Admin grants all the requests on the protected endpoints.
+	Admin Scope = "admin"
+
+	// ConnectorWrite grants the changes of the connector registrations (and the reading requests).
+	ConnectorWrite Scope = "connector-write"
+
+	// ReadOnly grants the reading requests, like the health, the metrics and the connector listings.
+	ReadOnly Scope = "read-only"
+)
+
+// Valid returns true for the known scopes.
+func (s Scope) Valid() bool {
+	return s == Admin || s == ConnectorWrite || s == ReadOnly
+}
+
+// Func returns the scope required by a request.
+type Func func(r *http.Request) Scope
+
+// ReadOnlyOr returns a Func requiring ReadOnly for GET and HEAD requests, and the scope for other requests.
+func ReadOnlyOr(s Scope) Func {
+	return func(r *http.Request) Scope {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			return ReadOnly
+		}
+		return s
+	}
+}
+
+// Granted returns true if the scopes include the required scope.
+// Admin grants all the scopes, and all the scopes grant ReadOnly.
+func Granted(scopes map[Scope]bool, required Scope) bool {
+	return len(scopes) > 0 && (scopes[Admin] || scopes[required] || required == ReadOnly)
+}
@@ -0,0 +1,36 @@
+package scope
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnlyOr(t *testing.T) {
+	a := assert.New(t)
+	f := ReadOnlyOr(ConnectorWrite)
+	a.Equal(ReadOnly, f(httptest.NewRequest(http.MethodGet, "/", nil)))
+	a.Equal(ReadOnly, f(httptest.NewRequest(http.MethodHead, "/", nil)))
+	a.Equal(ConnectorWrite, f(httptest.NewRequest(http.MethodPost, "/", nil)))
+	a.Equal(ConnectorWrite, f(httptest.NewRequest(http.MethodDelete, "/", nil)))
+}
+
+func TestGranted(t *testing.T) {
+	a := assert.New(t)
+	a.False(Granted(nil, ReadOnly))
+	a.True(Granted(map[Scope]bool{ConnectorWrite: true}, ReadOnly))
+	a.True(Granted(map[Scope]bool{ConnectorWrite: true}, ConnectorWrite))
+	a.False(Granted(map[Scope]bool{ReadOnly: true}, ConnectorWrite))
+	a.False(Granted(map[Scope]bool{ConnectorWrite: true}, Admin))
+	a.True(Granted(map[Scope]bool{Admin: true}, ConnectorWrite))
+}
+
+func TestValid(t *testing.T) {
+	a := assert.New(t)
+	a.True(Admin.Valid())
+	a.True(ConnectorWrite.Valid())
+	a.True(ReadOnly.Valid())
+	a.False(Scope("write").Valid())
+}
@@ -1,6 +1,8 @@
 package service
 
 import (
+	"github.com/smancke/guble/server/scope"
+
 	"net/http"
 	"sort"
 )
@@ -21,6 +23,12 @@ type Endpoint interface {
 	GetPrefix() string
 }
 
+// ScopedEndpoint is an Endpoint requiring an API key with the returned scope, if the webserver has API keys
+type ScopedEndpoint interface {
+	Endpoint
+	RequiredScope(r *http.Request) scope.Scope
+}
+
 type module struct {
 	iface      interface{}
 	startLevel int
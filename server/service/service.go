@@ -6,6 +6,7 @@ import (
 
 	"github.com/smancke/guble/server/metrics"
 	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/server/scope"
 	"github.com/smancke/guble/server/webserver"
 
 	"github.com/hashicorp/go-multierror"
@@ -28,6 +29,7 @@ type Service struct {
 	healthFrequency time.Duration
 	healthThreshold int
 	metricsEndpoint string
+	publicHealth    bool
 }
 
 // New creates a new Service, using the given Router and WebServer.
@@ -80,6 +82,13 @@ func (s *Service) MetricsEndpoint(endpointPrefix string) *Service {
 	return s
 }
 
+// PublicHealth sets if the health endpoint is served without an API key, when the webserver has API keys
+// (e.g. for the probes of load balancers). Returns the updated service.
+func (s *Service) PublicHealth(public bool) *Service {
+	s.publicHealth = public
+	return s
+}
+
 // Start checks the modules for the following interfaces and registers and/or starts:
 //   Startable:
 //   health.Checker:
@@ -88,13 +97,17 @@ func (s *Service) Start() error {
 	var multierr *multierror.Error
 	if s.healthEndpoint != "" {
 		logger.WithField("healthEndpoint", s.healthEndpoint).Info("Health endpoint")
-		s.webserver.Handle(s.healthEndpoint, http.HandlerFunc(health.StatusHandler))
+		if s.publicHealth {
+			s.webserver.Handle(s.healthEndpoint, http.HandlerFunc(health.StatusHandler))
+		} else {
+			s.webserver.HandleScoped(s.healthEndpoint, http.HandlerFunc(health.StatusHandler), readOnly)
+		}
 	} else {
 		logger.Info("Health endpoint disabled")
 	}
 	if s.metricsEndpoint != "" {
 		logger.WithField("metricsEndpoint", s.metricsEndpoint).Info("Metrics endpoint")
-		s.webserver.Handle(s.metricsEndpoint, http.HandlerFunc(metrics.HttpHandler))
+		s.webserver.HandleScoped(s.metricsEndpoint, http.HandlerFunc(metrics.HttpHandler), readOnly)
 	} else {
 		logger.Info("Metrics endpoint disabled")
 	}
@@ -113,7 +126,11 @@ func (s *Service) Start() error {
 			logger.WithField("name", name).Info("Registering module as Health-Checker")
 			health.RegisterPeriodicThresholdFunc(name, s.healthFrequency, s.healthThreshold, health.CheckFunc(c.Check))
 		}
-		if e, ok := iface.(Endpoint); ok {
+		if e, ok := iface.(ScopedEndpoint); ok {
+			prefix := e.GetPrefix()
+			logger.WithFields(log.Fields{"name": name, "prefix": prefix}).Info("Registering module as scoped Endpoint")
+			s.webserver.HandleScoped(prefix, e, e.RequiredScope)
+		} else if e, ok := iface.(Endpoint); ok {
 			prefix := e.GetPrefix()
 			logger.WithFields(log.Fields{"name": name, "prefix": prefix}).Info("Registering module as Endpoint")
 			s.webserver.Handle(prefix, e)
@@ -122,6 +139,10 @@ func (s *Service) Start() error {
 	return multierr.ErrorOrNil()
 }
 
+func readOnly(r *http.Request) scope.Scope {
+	return scope.ReadOnly
+}
+
 // Stop stops the registered modules in their given order
 func (s *Service) Stop() error {
 	var multierr *multierror.Error
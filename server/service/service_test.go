@@ -2,6 +2,7 @@ package service
 
 import (
 	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/scope"
 	"github.com/smancke/guble/server/store"
 	"github.com/smancke/guble/server/store/dummystore"
 	"github.com/smancke/guble/server/webserver"
@@ -76,6 +77,44 @@ func TestEndpointRegisterAndServing(t *testing.T) {
 	a.Equal("bar", string(body))
 }
 
+func TestScopedEndpointsWithAPIKeys(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	defer testutil.ResetDefaultRegistryHealthCheck()
+	a := assert.New(t)
+
+	// given: a service with API keys, a scoped endpoint at /scoped and an unscoped endpoint at /foo
+	service, _, _, _ := aMockedServiceWithMockedRouterStandalone()
+	keys, err := webserver.ParseAPIKeys("read-only:reader,connector-write:writer")
+	a.NoError(err)
+	service.WebServer().SetAPIKeys(keys)
+	service = service.MetricsEndpoint("/metrics_url")
+	service.RegisterModules(0, 0, &testEndpoint{}, &testScopedEndpoint{})
+	service.Start()
+	defer service.Stop()
+	time.Sleep(time.Millisecond * 10)
+
+	request := func(method, path, key string) int {
+		req, _ := http.NewRequest(method, fmt.Sprintf("http://%s%s", service.WebServer().GetAddr(), path), nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		a.NoError(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	a.Equal(http.StatusOK, request(http.MethodGet, "/foo", ""))
+	a.Equal(http.StatusUnauthorized, request(http.MethodGet, "/scoped", ""))
+	a.Equal(http.StatusUnauthorized, request(http.MethodGet, "/scoped", "unknown"))
+	a.Equal(http.StatusOK, request(http.MethodGet, "/scoped", "reader"))
+	a.Equal(http.StatusForbidden, request(http.MethodPost, "/scoped", "reader"))
+	a.Equal(http.StatusOK, request(http.MethodPost, "/scoped", "writer"))
+	a.Equal(http.StatusUnauthorized, request(http.MethodGet, "/metrics_url", ""))
+	a.Equal(http.StatusOK, request(http.MethodGet, "/metrics_url", "reader"))
+}
+
 func TestHealthUp(t *testing.T) {
 	_, finish := testutil.NewMockCtrl(t)
 	defer finish()
@@ -183,6 +222,21 @@ func (*testEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+type testScopedEndpoint struct {
+}
+
+func (*testScopedEndpoint) GetPrefix() string {
+	return "/scoped"
+}
+
+func (*testScopedEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "scoped")
+}
+
+func (*testScopedEndpoint) RequiredScope(r *http.Request) scope.Scope {
+	return scope.ReadOnlyOr(scope.ConnectorWrite)(r)
+}
+
 type testStartable struct {
 }
 
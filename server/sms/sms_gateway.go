@@ -263,6 +263,9 @@ func (g *gateway) Stop() error {
 	return nil
 }
 
+// SetLastSentID stores the ID as the last sent ID, unless a higher ID was already stored
+// (e.g. by another worker or cluster node). The stored value is replaced with a compare-and-swap,
+// so that concurrent updates do not move the last sent ID backwards.
 func (g *gateway) SetLastSentID(ID uint64) error {
 	g.logger.WithField("LastIDSent", ID).WithField("path", *g.config.SMSTopic).Debug("Seting LastIDSent")
 
@@ -277,13 +280,31 @@ func (g *gateway) SetLastSentID(ID uint64) error {
 		g.logger.WithField("error", err.Error()).Error("Error encoding last ID")
 		return err
 	}
-	err = kvStore.Put(g.config.Schema, *g.config.SMSTopic, data)
-	if err != nil {
-		g.logger.WithField("error", err.Error()).WithField("path", *g.config.SMSTopic).Error("KVStore could not set value for LastIDSent for topic")
-		return err
+
+	for {
+		old, exist, err := kvStore.Get(g.config.Schema, *g.config.SMSTopic)
+		if err != nil {
+			g.logger.WithField("error", err.Error()).WithField("path", *g.config.SMSTopic).Error("KvStore could not get value for LastIDSent for topic")
+			return err
+		}
+		if exist {
+			v := &struct{ ID uint64 }{}
+			if err := json.Unmarshal(old, v); err == nil && v.ID >= ID {
+				g.LastIDSent = v.ID
+				return nil
+			}
+		}
+
+		swapped, err := kvStore.CompareAndSwap(g.config.Schema, *g.config.SMSTopic, old, data)
+		if err != nil {
+			g.logger.WithField("error", err.Error()).WithField("path", *g.config.SMSTopic).Error("KVStore could not set value for LastIDSent for topic")
+			return err
+		}
+		if swapped {
+			g.LastIDSent = ID
+			return nil
+		}
 	}
-	g.LastIDSent = ID
-	return nil
 }
 
 func (g *gateway) ReadLastID() error {
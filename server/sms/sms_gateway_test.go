@@ -230,4 +230,13 @@ func TestReadLastID(t *testing.T) {
 	gw.ReadLastID()
 
 	a.Equal(uint64(10), gw.LastIDSent)
+
+	// the last sent ID does not move backwards
+	a.NoError(gw.SetLastSentID(uint64(5)))
+	gw.ReadLastID()
+	a.Equal(uint64(10), gw.LastIDSent)
+
+	a.NoError(gw.SetLastSentID(uint64(11)))
+	gw.ReadLastID()
+	a.Equal(uint64(11), gw.LastIDSent)
 }
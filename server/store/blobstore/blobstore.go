@@ -0,0 +1,25 @@
+// Package blobstore provides a minimal storage for named blobs, used as secondary storage tier.
+package blobstore
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned when a blob does not exist.
+var ErrNotFound = errors.New("Blob not found")
+
+// BlobStore stores blobs by name. Names may contain slashes for grouping the blobs.
+type BlobStore interface {
+
+	// Put stores the data read from the reader as blob with the name, replacing an existing blob.
+	// The blob is complete and durable when Put returns without error.
+	Put(name string, r io.Reader) error
+
+	// Get returns a reader for the blob with the name, or ErrNotFound.
+	// The reader has to be closed by the caller.
+	Get(name string) (io.ReadCloser, error)
+
+	// Delete removes the blob with the name. Deleting a missing blob is not an error.
+	Delete(name string) error
+}
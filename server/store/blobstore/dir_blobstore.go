@@ -0,0 +1,86 @@
+package blobstore
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DirBlobStore is a BlobStore keeping each blob as file in a local directory,
+// for example on a cheaper or larger disk.
+type DirBlobStore struct {
+	dir string
+}
+
+// NewDirBlobStore returns a new DirBlobStore storing the blobs in the directory, which is created if needed.
+func NewDirBlobStore(dir string) (*DirBlobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DirBlobStore{dir: dir}, nil
+}
+
+// Put writes the blob to a temporary file, which replaces the blob file after it was synced.
+func (s *DirBlobStore) Put(name string, r io.Reader) error {
+	filename, err := s.filename(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// Get opens the blob file.
+func (s *DirBlobStore) Get(name string) (io.ReadCloser, error) {
+	filename, err := s.filename(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+// Delete removes the blob file.
+func (s *DirBlobStore) Delete(name string) error {
+	filename, err := s.filename(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// filename returns the path of the blob file, and rejects names leaving the directory.
+func (s *DirBlobStore) filename(name string) (string, error) {
+	filename := filepath.Join(s.dir, filepath.FromSlash(name))
+	if name == "" || !strings.HasPrefix(filename, filepath.Clean(s.dir)+string(filepath.Separator)) {
+		return "", &os.PathError{Op: "blob", Path: name, Err: os.ErrInvalid}
+	}
+	return filename, nil
+}
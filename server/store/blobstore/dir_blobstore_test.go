@@ -0,0 +1,45 @@
+package blobstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirBlobStore(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_blobstore_test")
+	defer os.RemoveAll(dir)
+
+	s, err := NewDirBlobStore(dir)
+	a.NoError(err)
+
+	_, err = s.Get("p1/a.msg")
+	a.Equal(ErrNotFound, err)
+
+	a.NoError(s.Put("p1/a.msg", bytes.NewReader([]byte("first"))))
+	a.NoError(s.Put("p1/a.msg", bytes.NewReader([]byte("second"))))
+
+	r, err := s.Get("p1/a.msg")
+	a.NoError(err)
+	data, err := ioutil.ReadAll(r)
+	a.NoError(err)
+	a.NoError(r.Close())
+	a.Equal("second", string(data))
+
+	a.NoError(s.Delete("p1/a.msg"))
+	a.NoError(s.Delete("p1/a.msg"))
+	_, err = s.Get("p1/a.msg")
+	a.Equal(ErrNotFound, err)
+
+	// no temporary files are left
+	files, _ := ioutil.ReadDir(dir + "/p1")
+	a.Equal(0, len(files))
+
+	// names can not leave the directory
+	a.Error(s.Put("../outside", bytes.NewReader(nil)))
+	a.Error(s.Put("", bytes.NewReader(nil)))
+}
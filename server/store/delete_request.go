@@ -0,0 +1,86 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/smancke/guble/protocol"
+)
+
+// ErrEmptyDeleteRequest is returned when a DeleteRequest does not contain any criteria,
+// so that a whole partition can not be deleted by mistake.
+var ErrEmptyDeleteRequest = errors.New("Delete request has no criteria")
+
+// DeleteRequest selects the messages which should be deleted from a partition.
+// All the supplied criteria have to match for a message to be deleted.
+type DeleteRequest struct {
+
+	// IDs restricts the deletion to the messages with these IDs
+	IDs []uint64
+
+	// FromID and ToID restrict the deletion to an inclusive range of IDs.
+	// A value of 0 means the range is open on that side.
+	FromID uint64
+	ToID   uint64
+
+	// UserID restricts the deletion to messages sent by this user
+	UserID string
+
+	// Filters restricts the deletion to messages having all these filters
+	Filters map[string]string
+}
+
+// Validate returns an error if the request does not contain any criteria.
+func (r *DeleteRequest) Validate() error {
+	if len(r.IDs) == 0 && r.FromID == 0 && r.ToID == 0 && r.UserID == "" && len(r.Filters) == 0 {
+		return ErrEmptyDeleteRequest
+	}
+	return nil
+}
+
+// MatchesID returns true if the ID matches the ID criteria of the request.
+func (r *DeleteRequest) MatchesID(id uint64) bool {
+	if r.FromID > 0 && id < r.FromID {
+		return false
+	}
+	if r.ToID > 0 && id > r.ToID {
+		return false
+	}
+	if len(r.IDs) == 0 {
+		return true
+	}
+	for _, candidate := range r.IDs {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsContent returns true if the stored message has to be parsed to decide about its deletion.
+func (r *DeleteRequest) NeedsContent() bool {
+	return r.UserID != "" || len(r.Filters) > 0
+}
+
+// Matches returns true if the stored message with the given ID and data should be deleted.
+// Messages which can not be parsed never match a content criteria.
+func (r *DeleteRequest) Matches(id uint64, data []byte) bool {
+	if !r.MatchesID(id) {
+		return false
+	}
+	if !r.NeedsContent() {
+		return true
+	}
+	msg, err := protocol.ParseMessage(data)
+	if err != nil {
+		return false
+	}
+	if r.UserID != "" && msg.UserID != r.UserID {
+		return false
+	}
+	for key, value := range r.Filters {
+		if msg.Filters[key] != value {
+			return false
+		}
+	}
+	return true
+}
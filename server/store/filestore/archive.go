@@ -0,0 +1,182 @@
+package filestore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/smancke/guble/server/metrics"
+	"github.com/smancke/guble/server/store/blobstore"
+)
+
+// restoreSuffix is appended to the name of a message file while it is restored from the archive.
+const restoreSuffix = ".restore"
+
+var (
+	mTotalArchivedFiles = metrics.NewInt("filestore.total_archived_files")
+	mTotalRestoredFiles = metrics.NewInt("filestore.total_restored_files")
+)
+
+// validateArchive returns an error if the archive settings of the options are invalid.
+func (o Options) validateArchive() error {
+	if o.Archive != nil && o.ArchiveAfter <= 0 {
+		return fmt.Errorf("The archive age has to be positive, but is %v", o.ArchiveAfter)
+	}
+	return nil
+}
+
+// archive moves the closed message files, which were not written for the archiveAfter duration, to the archive.
+// The index files stay on disk, so that the fetch lists are calculated without accessing the archive.
+// Files containing deleted messages are archived after their compaction.
+func (p *messagePartition) archive(now time.Time) error {
+	if p.archiveStore == nil {
+		return nil
+	}
+
+	p.compactionMutex.Lock()
+	defer p.compactionMutex.Unlock()
+
+	for fileID := 0; fileID < p.fileCache.length(); fileID++ {
+		entry := p.fileCache.get(fileID)
+		if len(p.tombstones.inRange(entry.min, entry.max)) > 0 {
+			continue
+		}
+
+		filename := p.composeMsgFilenameForPosition(uint64(fileID))
+		info, err := os.Stat(filename)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if now.Sub(info.ModTime()) < p.archiveAfter {
+			continue
+		}
+
+		if err := p.archiveFile(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveFile copies the message file to the archive, and removes it from disk afterwards.
+func (p *messagePartition) archiveFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := p.archiveStore.Put(p.blobName(filename), file); err != nil {
+		return err
+	}
+	if err := os.Remove(filename); err != nil {
+		return err
+	}
+	p.addUsedBytes(-info.Size())
+	mTotalArchivedFiles.Add(1)
+
+	logger.WithFields(log.Fields{
+		"partition": p.name,
+		"filename":  filename,
+	}).Info("Archived message file")
+	return nil
+}
+
+// openMsgFile opens the message file, after restoring it from the archive if it was archived.
+// The restored file stays on disk until it is archived again.
+func (p *messagePartition) openMsgFile(fileID uint64) (*os.File, error) {
+	filename := p.composeMsgFilenameForPosition(fileID)
+	file, err := os.Open(filename)
+	if err == nil || !os.IsNotExist(err) || p.archiveStore == nil {
+		return file, err
+	}
+
+	if err := p.restore(filename); err != nil {
+		return nil, err
+	}
+	return os.Open(filename)
+}
+
+// restore copies the archived message file back to disk.
+func (p *messagePartition) restore(filename string) error {
+	p.restoreMutex.Lock()
+	defer p.restoreMutex.Unlock()
+
+	// the file may have been restored by a concurrent fetch
+	if _, err := os.Stat(filename); err == nil {
+		return nil
+	}
+
+	r, err := p.archiveStore.Get(p.blobName(filename))
+	if err == blobstore.ErrNotFound {
+		return fmt.Errorf("Message file %s is neither on disk nor archived", filename)
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp, err := os.Create(filename + restoreSuffix)
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	p.addUsedBytes(size)
+	mTotalRestoredFiles.Add(1)
+
+	logger.WithFields(log.Fields{
+		"partition": p.name,
+		"filename":  filename,
+	}).Info("Restored message file from archive")
+	return nil
+}
+
+// removeArchived removes the archived copy of the message file, after it was rewritten.
+func (p *messagePartition) removeArchived(filename string) error {
+	if p.archiveStore == nil {
+		return nil
+	}
+	return p.archiveStore.Delete(p.blobName(filename))
+}
+
+// recoverRestore removes the files of restores interrupted by a crash.
+func (p *messagePartition) recoverRestore() error {
+	filenames, err := filepath.Glob(filepath.Join(p.basedir, p.name+"-*.msg"+restoreSuffix))
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		logger.WithField("filename", filename).Warn("Removing file of interrupted restore")
+		if err := os.Remove(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobName returns the name of the archived copy of the file.
+func (p *messagePartition) blobName(filename string) string {
+	return p.name + "/" + filepath.Base(filename)
+}
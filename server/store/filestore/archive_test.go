@@ -0,0 +1,130 @@
+package filestore
+
+import (
+	"expvar"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/server/store"
+	"github.com/smancke/guble/server/store/blobstore"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func totalRestoredFiles() int64 {
+	return expvar.Get("filestore.total_restored_files").(*expvar.Int).Value()
+}
+
+func newArchivingPartition(a *assert.Assertions, dir string) (*messagePartition, *blobstore.DirBlobStore) {
+	archive, err := blobstore.NewDirBlobStore(dir + "/archive")
+	a.NoError(err)
+	p, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	p.archiveStore = archive
+	p.archiveAfter = time.Hour
+	return p, archive
+}
+
+func Test_Options_validateArchive(t *testing.T) {
+	a := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "guble_message_store_test")
+	defer os.RemoveAll(dir)
+	archive, err := blobstore.NewDirBlobStore(dir)
+	a.NoError(err)
+
+	a.NoError(Options{}.validateArchive())
+	a.NoError(Options{Archive: archive, ArchiveAfter: time.Hour}.validateArchive())
+	a.Error(Options{Archive: archive}.validateArchive())
+}
+
+func Test_MessagePartition_ArchiveAndRestore(t *testing.T) {
+	a := assert.New(t)
+	messagesPerFile = uint64(5)
+
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+	p, archive := newArchivingPartition(a, dir)
+	defer p.Close()
+
+	// files: [1..5] [6..10] [11, 12]
+	storeTestMessages(a, p, 12)
+
+	// the files are not old enough
+	a.NoError(p.archive(time.Now()))
+	_, err := archive.Get("myMessages/myMessages-00000000000000000000.msg")
+	a.Equal(blobstore.ErrNotFound, err)
+
+	// only the closed files are archived
+	a.NoError(p.archive(time.Now().Add(2 * time.Hour)))
+	for fileID := uint64(0); fileID < 2; fileID++ {
+		_, err := os.Stat(p.composeMsgFilenameForPosition(fileID))
+		a.True(os.IsNotExist(err))
+		_, err = os.Stat(p.composeIdxFilenameForPosition(fileID))
+		a.NoError(err)
+	}
+	_, err = os.Stat(p.composeMsgFilenameForPosition(2))
+	a.NoError(err)
+
+	restoredBefore := totalRestoredFiles()
+	a.Equal([]uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}, fetchAllIDs(a, p))
+	a.Equal(int64(2), totalRestoredFiles()-restoredBefore)
+	_, err = os.Stat(p.composeMsgFilenameForPosition(0))
+	a.NoError(err)
+
+	// the restored files are archived again, without being restored by a fetch of newer messages
+	a.NoError(p.archive(time.Now().Add(2 * time.Hour)))
+	req := store.NewFetchRequest(p.name, 11, 0, store.DirectionForward, -1)
+	req.Init()
+	p.Fetch(req)
+	req.Ready()
+	for range req.Messages() {
+	}
+	_, err = os.Stat(p.composeMsgFilenameForPosition(0))
+	a.True(os.IsNotExist(err))
+}
+
+func Test_MessagePartition_CompactArchived(t *testing.T) {
+	a := assert.New(t)
+	messagesPerFile = uint64(5)
+
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+	p, archive := newArchivingPartition(a, dir)
+	defer p.Close()
+
+	storeTestMessages(a, p, 12)
+	a.NoError(p.archive(time.Now().Add(2 * time.Hour)))
+
+	deleted, err := p.Delete(&store.DeleteRequest{IDs: []uint64{2, 3}})
+	a.NoError(err)
+	a.Equal(2, deleted)
+	a.NoError(p.compact())
+
+	// the compacted file is on disk, and the archived copy with the deleted messages is removed
+	_, err = os.Stat(p.composeMsgFilenameForPosition(0))
+	a.NoError(err)
+	_, err = archive.Get("myMessages/myMessages-00000000000000000000.msg")
+	a.Equal(blobstore.ErrNotFound, err)
+
+	a.Equal([]uint64{1, 4, 5, 6, 7, 8, 9, 10, 11, 12}, fetchAllIDs(a, p))
+}
+
+func Test_MessagePartition_recoverRestore(t *testing.T) {
+	a := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+
+	leftover := dir + "/myMessages-00000000000000000000.msg" + restoreSuffix
+	a.NoError(ioutil.WriteFile(leftover, []byte("partial"), 0666))
+
+	p, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	defer p.Close()
+
+	_, err = os.Stat(leftover)
+	a.True(os.IsNotExist(err))
+}
@@ -32,6 +32,20 @@ func (c *cache) add(entry *cacheEntry) {
 	c.entries = append(c.entries, entry)
 }
 
+func (c *cache) get(i int) *cacheEntry {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.entries[i]
+}
+
+func (c *cache) set(i int, entry *cacheEntry) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.entries[i] = entry
+}
+
 type cacheEntry struct {
 	min, max uint64
 }
@@ -0,0 +1,348 @@
+package filestore
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/smancke/guble/server/store"
+)
+
+// compactionSuffix is appended to the names of the files written during a compaction,
+// before they replace the original files.
+const compactionSuffix = ".compact"
+
+// Delete marks the messages matching the request as deleted.
+// The deleted messages are skipped by Fetch, and their data is removed
+// from the message files by the next compaction of the partition.
+func (p *messagePartition) Delete(req *store.DeleteRequest) (int, error) {
+	if err := req.Validate(); err != nil {
+		return 0, err
+	}
+
+	p.compactionMutex.RLock()
+	defer p.compactionMutex.RUnlock()
+	p.Lock()
+	defer p.Unlock()
+
+	var ids []uint64
+	for fileID := 0; fileID < p.fileCache.length(); fileID++ {
+		entry := p.fileCache.get(fileID)
+		if (req.ToID > 0 && entry.min > req.ToID) || (req.FromID > 0 && entry.max < req.FromID) {
+			continue
+		}
+		l, err := p.loadIndexList(fileID)
+		if err != nil {
+			return 0, err
+		}
+		matched, err := p.matchingIDs(l, req)
+		if err != nil {
+			return 0, err
+		}
+		ids = append(ids, matched...)
+	}
+
+	matched, err := p.matchingIDs(p.list, req)
+	if err != nil {
+		return 0, err
+	}
+	ids = append(ids, matched...)
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	if err := p.tombstones.add(ids); err != nil {
+		return 0, err
+	}
+	p.totalNumberOfMessages -= uint64(len(ids))
+
+	logger.WithFields(log.Fields{
+		"partition": p.name,
+		"deleted":   len(ids),
+	}).Info("Deleted messages")
+
+	return len(ids), nil
+}
+
+// matchingIDs returns the IDs of the not yet deleted messages from the list, which match the request.
+// All the entries of the list have to belong to the same message file.
+func (p *messagePartition) matchingIDs(l *indexList, req *store.DeleteRequest) ([]uint64, error) {
+	var ids []uint64
+	var file *os.File
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	err := l.mapWithPredicate(func(index *index, _ int) error {
+		if p.tombstones.contains(index.id) || !req.MatchesID(index.id) {
+			return nil
+		}
+
+		var data []byte
+		if req.NeedsContent() {
+			if file == nil {
+				var err error
+				if file, err = p.openMsgFile(uint64(index.fileID)); err != nil {
+					return err
+				}
+			}
+			data = make([]byte, index.size)
+			if _, err := file.ReadAt(data, int64(index.offset)); err != nil {
+				return err
+			}
+			decrypted, err := p.keyring.Decrypt(data)
+			if err != nil {
+				return err
+			}
+			data = decrypted
+		}
+
+		if req.Matches(index.id, data) {
+			ids = append(ids, index.id)
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// withoutDeleted returns the list without the entries of the deleted messages.
+func (p *messagePartition) withoutDeleted(l *indexList) *indexList {
+	if p.tombstones.len() == 0 {
+		return l
+	}
+
+	filtered := newIndexList(l.len())
+	l.mapWithPredicate(func(index *index, _ int) error {
+		if !p.tombstones.contains(index.id) {
+			filtered.items = append(filtered.items, index)
+		}
+		return nil
+	})
+	return filtered
+}
+
+// compact rewrites the message files which contain deleted messages,
+// so that the data of the deleted messages is removed from disk.
+// The file currently used for appending is closed first, if it contains deleted messages.
+func (p *messagePartition) compact() error {
+	if p.tombstones.len() == 0 {
+		return nil
+	}
+
+	p.compactionMutex.Lock()
+	defer p.compactionMutex.Unlock()
+
+	if err := p.rotateIfDeleted(); err != nil {
+		return err
+	}
+
+	for fileID := 0; fileID < p.fileCache.length(); fileID++ {
+		entry := p.fileCache.get(fileID)
+		ids := p.tombstones.inRange(entry.min, entry.max)
+		if len(ids) == 0 {
+			continue
+		}
+
+		if err := p.compactFile(fileID); err != nil {
+			return err
+		}
+		if err := p.tombstones.remove(ids); err != nil {
+			return err
+		}
+
+		logger.WithFields(log.Fields{
+			"partition": p.name,
+			"fileID":    fileID,
+			"removed":   len(ids),
+		}).Info("Compacted message file")
+	}
+	return nil
+}
+
+// rotateIfDeleted closes the file currently used for appending if it contains deleted messages,
+// so that it is compacted like the closed files.
+func (p *messagePartition) rotateIfDeleted() error {
+	p.Lock()
+	defer p.Unlock()
+
+	front, back := p.list.front(), p.list.back()
+	if front == nil || len(p.tombstones.inRange(front.id, back.id)) == 0 {
+		return nil
+	}
+	return p.rotate()
+}
+
+// compactFile writes a copy of the message and index files without the deleted messages,
+// and replaces the original files with it.
+// The .msg file is replaced before the .idx file (see recoverCompaction).
+func (p *messagePartition) compactFile(fileID int) error {
+	l, err := p.loadIndexList(fileID)
+	if err != nil {
+		return err
+	}
+
+	msgFilename := p.composeMsgFilenameForPosition(uint64(fileID))
+	idxFilename := p.composeIdxFilenameForPosition(uint64(fileID))
+
+	src, err := p.openMsgFile(uint64(fileID))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	sizeBefore, err := filesSize(msgFilename, idxFilename)
+	if err != nil {
+		return err
+	}
+
+	msgFile, err := os.Create(msgFilename + compactionSuffix)
+	if err != nil {
+		return err
+	}
+	defer msgFile.Close()
+
+	idxFile, err := os.Create(idxFilename + compactionSuffix)
+	if err != nil {
+		return err
+	}
+	defer idxFile.Close()
+
+	if _, err := msgFile.Write(magicNumber); err != nil {
+		return err
+	}
+	if _, err := msgFile.Write(fileFormatVersion); err != nil {
+		return err
+	}
+
+	position := uint64(len(magicNumber) + len(fileFormatVersion))
+	entry := &cacheEntry{}
+	entriesCount := uint64(0)
+	err = l.mapWithPredicate(func(index *index, _ int) error {
+		if p.tombstones.contains(index.id) {
+			return nil
+		}
+
+		data := make([]byte, index.size)
+		if _, err := src.ReadAt(data, int64(index.offset)); err != nil {
+			return err
+		}
+		sizeAndID := encodeSizeAndID(index.id, index.size)
+		if _, err := msgFile.Write(sizeAndID); err != nil {
+			return err
+		}
+		if _, err := msgFile.Write(data); err != nil {
+			return err
+		}
+
+		messageOffset := position + uint64(len(sizeAndID))
+		if err := writeIndexEntry(idxFile, index.id, messageOffset, index.size, entriesCount); err != nil {
+			return err
+		}
+
+		if entriesCount == 0 {
+			entry.min = index.id
+		}
+		entry.max = index.id
+		entriesCount++
+		position = messageOffset + uint64(index.size)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := msgFile.Sync(); err != nil {
+		return err
+	}
+	if err := idxFile.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(msgFile.Name(), msgFilename); err != nil {
+		return err
+	}
+	if err := os.Rename(idxFile.Name(), idxFilename); err != nil {
+		return err
+	}
+	// the archived copy still contains the deleted messages
+	if err := p.removeArchived(msgFilename); err != nil {
+		return err
+	}
+
+	sizeAfter, err := filesSize(msgFilename, idxFilename)
+	if err != nil {
+		return err
+	}
+	p.addUsedBytes(sizeAfter - sizeBefore)
+
+	p.fileCache.set(fileID, entry)
+	return nil
+}
+
+// filesSize returns the sum of the sizes of the files.
+func filesSize(filenames ...string) (int64, error) {
+	size := int64(0)
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+// recoverCompaction completes or discards the compactions interrupted by a crash.
+// A remaining temporary .idx file without its temporary .msg file means that
+// the .msg file was already replaced, so the .idx file has to be replaced as well.
+// In all other cases the original files are still complete, and the temporary files are removed.
+func (p *messagePartition) recoverCompaction() error {
+	tmpIdxFilenames, err := filepath.Glob(filepath.Join(p.basedir, p.name+"-*.idx"+compactionSuffix))
+	if err != nil {
+		return err
+	}
+
+	for _, tmpIdxFilename := range tmpIdxFilenames {
+		idxFilename := strings.TrimSuffix(tmpIdxFilename, compactionSuffix)
+		tmpMsgFilename := strings.TrimSuffix(idxFilename, ".idx") + ".msg" + compactionSuffix
+
+		if _, err := os.Stat(tmpMsgFilename); os.IsNotExist(err) {
+			logger.WithField("filename", idxFilename).Warn("Completing interrupted compaction")
+			if err := os.Rename(tmpIdxFilename, idxFilename); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.Remove(tmpIdxFilename); err != nil {
+			return err
+		}
+	}
+
+	tmpMsgFilenames, err := filepath.Glob(filepath.Join(p.basedir, p.name+"-*.msg"+compactionSuffix))
+	if err != nil {
+		return err
+	}
+	for _, tmpMsgFilename := range tmpMsgFilenames {
+		logger.WithField("filename", tmpMsgFilename).Warn("Removing file of interrupted compaction")
+		if err := os.Remove(tmpMsgFilename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// messageHeaderSize is the size of the header written before each message by encodeSizeAndID.
+const messageHeaderSize = 12
+
+// encodeSizeAndID returns the header written before each message:
+// the message size and the message id, 32 bit and 64 bit, so 12 bytes.
+func encodeSizeAndID(messageID uint64, size uint32) []byte {
+	sizeAndID := make([]byte, messageHeaderSize)
+	binary.LittleEndian.PutUint32(sizeAndID, size)
+	binary.LittleEndian.PutUint64(sizeAndID[4:], messageID)
+	return sizeAndID
+}
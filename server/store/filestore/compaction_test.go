@@ -0,0 +1,206 @@
+package filestore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fetchAllIDs(a *assert.Assertions, p *messagePartition) []uint64 {
+	req := store.NewFetchRequest(p.name, 0, 0, store.DirectionForward, -1)
+	req.Init()
+	p.Fetch(req)
+
+	ids := []uint64{}
+	count := req.Ready()
+	for msg := range req.Messages() {
+		ids = append(ids, msg.ID)
+	}
+	a.Equal(count, len(ids))
+	return ids
+}
+
+func storeTestMessages(a *assert.Assertions, p *messagePartition, n int) {
+	for i := 1; i <= n; i++ {
+		msg := &protocol.Message{
+			ID:     uint64(i),
+			Path:   protocol.Path("/myMessages/topic"),
+			UserID: fmt.Sprintf("user%d", i%2),
+			Body:   []byte("body"),
+		}
+		a.NoError(p.Store(msg.ID, msg.Bytes()))
+	}
+}
+
+func Test_MessagePartition_DeleteAndCompact(t *testing.T) {
+	a := assert.New(t)
+	messagesPerFile = uint64(5)
+
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+	p, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+
+	// files: [1..5] [6..10] [11, 12]
+	storeTestMessages(a, p, 12)
+
+	_, err = p.Delete(&store.DeleteRequest{})
+	a.Equal(store.ErrEmptyDeleteRequest, err)
+
+	deleted, err := p.Delete(&store.DeleteRequest{IDs: []uint64{2, 11}})
+	a.NoError(err)
+	a.Equal(2, deleted)
+
+	deleted, err = p.Delete(&store.DeleteRequest{FromID: 6, ToID: 10})
+	a.NoError(err)
+	a.Equal(5, deleted)
+
+	deleted, err = p.Delete(&store.DeleteRequest{ToID: 5, UserID: "user1"})
+	a.NoError(err)
+	a.Equal(3, deleted)
+
+	// already deleted messages are not counted again
+	deleted, err = p.Delete(&store.DeleteRequest{IDs: []uint64{2}})
+	a.NoError(err)
+	a.Equal(0, deleted)
+
+	expectedIDs := []uint64{4, 12}
+	a.Equal(expectedIDs, fetchAllIDs(a, p))
+	a.Equal(uint64(2), p.Count())
+	a.Equal(10, p.tombstones.len())
+
+	firstFile := p.composeMsgFilenameForPosition(0)
+	statBefore, err := os.Stat(firstFile)
+	a.NoError(err)
+
+	a.NoError(p.compact())
+
+	statAfter, err := os.Stat(firstFile)
+	a.NoError(err)
+	a.True(statAfter.Size() < statBefore.Size())
+	a.Equal(expectedIDs, fetchAllIDs(a, p))
+	a.Equal(uint64(2), p.Count())
+
+	// the file used for appending was closed and compacted as well
+	a.Equal(0, p.tombstones.len())
+
+	// the deletions are persistent after a restart, also for the now empty second file
+	a.NoError(p.Close())
+	p, err = newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	defer p.Close()
+
+	a.Equal(expectedIDs, fetchAllIDs(a, p))
+	a.Equal(uint64(2), p.Count())
+	a.Equal(uint64(12), p.MaxMessageID())
+
+	a.NoError(p.Store(13, []byte("new message")))
+	a.Equal([]uint64{4, 12, 13}, fetchAllIDs(a, p))
+}
+
+func Test_MessagePartition_CompactCurrentFile(t *testing.T) {
+	a := assert.New(t)
+	messagesPerFile = uint64(5)
+
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+	p, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+
+	// all messages are in the file used for appending
+	for i := 1; i <= 3; i++ {
+		a.NoError(p.Store(uint64(i), []byte(fmt.Sprintf("secret-body-%d", i))))
+	}
+
+	deleted, err := p.Delete(&store.DeleteRequest{IDs: []uint64{2}})
+	a.NoError(err)
+	a.Equal(1, deleted)
+	a.NoError(p.compact())
+
+	data, err := ioutil.ReadFile(p.composeMsgFilenameForPosition(0))
+	a.NoError(err)
+	a.False(bytes.Contains(data, []byte("secret-body-2")))
+	a.True(bytes.Contains(data, []byte("secret-body-1")))
+	a.True(bytes.Contains(data, []byte("secret-body-3")))
+	a.Equal(0, p.tombstones.len())
+
+	// the next messages are appended to the next file
+	a.NoError(p.Store(4, []byte("secret-body-4")))
+	a.Equal([]uint64{1, 3, 4}, fetchAllIDs(a, p))
+	a.Equal(uint64(3), p.Count())
+
+	a.NoError(p.Close())
+	p, err = newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	defer p.Close()
+	a.Equal([]uint64{1, 3, 4}, fetchAllIDs(a, p))
+}
+
+func Test_MessagePartition_recoverCompaction(t *testing.T) {
+	a := assert.New(t)
+	messagesPerFile = uint64(5)
+
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+	p, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	storeTestMessages(a, p, 7)
+	a.NoError(p.Close())
+
+	// the .msg file was replaced, but not the .idx file: the replacement is completed
+	idxFilename := p.composeIdxFilenameForPosition(0)
+	idxData, err := ioutil.ReadFile(idxFilename)
+	a.NoError(err)
+	a.NoError(ioutil.WriteFile(idxFilename+compactionSuffix, idxData, 0666))
+	a.NoError(ioutil.WriteFile(idxFilename, []byte{}, 0666))
+
+	// both files are still temporary: the compaction is discarded
+	a.NoError(ioutil.WriteFile(p.composeIdxFilenameForPosition(1)+compactionSuffix, []byte{}, 0666))
+	a.NoError(ioutil.WriteFile(p.composeMsgFilenameForPosition(1)+compactionSuffix, []byte{}, 0666))
+
+	p, err = newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	defer p.Close()
+
+	a.Equal([]uint64{1, 2, 3, 4, 5, 6, 7}, fetchAllIDs(a, p))
+	files, err := ioutil.ReadDir(dir)
+	a.NoError(err)
+	for _, f := range files {
+		a.NotEqual(compactionSuffix, path.Ext(f.Name()))
+	}
+}
+
+func Test_MessagePartition_Size(t *testing.T) {
+	a := assert.New(t)
+	messagesPerFile = uint64(5)
+
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+	p, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+
+	// files: [1..5] [6..7], each with a .msg and an .idx file
+	storeTestMessages(a, p, 7)
+
+	files, bytes, err := p.Size()
+	a.NoError(err)
+	a.Equal(4, files)
+	a.True(bytes > 7*12)
+
+	data, err := store.FetchMessage(p, 6)
+	a.NoError(err)
+	msg, err := protocol.ParseMessage(data)
+	a.NoError(err)
+	a.Equal(uint64(6), msg.ID)
+
+	_, err = store.FetchMessage(p, 8)
+	a.Equal(store.ErrMessageNotFound, err)
+}
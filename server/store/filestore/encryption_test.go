@@ -0,0 +1,75 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/encryption"
+	"github.com/smancke/guble/server/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testKey1 = "1:000102030405060708090a0b0c0d0e0f"
+	testKey2 = "2:101112131415161718191a1b1c1d1e1f"
+)
+
+func Test_MessageStore_Encryption(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_message_store_test")
+	defer os.RemoveAll(dir)
+
+	keyring, err := encryption.ParseKeyring(testKey1)
+	a.NoError(err)
+	mStore, err := NewWithOptions(dir, Options{Keyring: keyring})
+	a.NoError(err)
+
+	msg := &protocol.Message{Path: protocol.Path("/p1/topic"), UserID: "marvin", Body: []byte("secret body")}
+	_, err = mStore.StoreMessage(msg, 0)
+	a.NoError(err)
+	a.NoError(mStore.Stop())
+
+	// the message file does not contain the plaintext
+	data, err := ioutil.ReadFile(path.Join(dir, "p1", "p1-00000000000000000000.msg"))
+	a.NoError(err)
+	a.NotContains(string(data), "secret body")
+	a.NotContains(string(data), "marvin")
+
+	// the store can not be used without the key
+	_, err = NewWithOptions(dir, Options{})
+	a.Error(err)
+	otherKeyring, _ := encryption.ParseKeyring(testKey2)
+	_, err = NewWithOptions(dir, Options{Keyring: otherKeyring})
+	a.Error(err)
+
+	// after a key rotation the old messages are still readable
+	rotated, err := encryption.ParseKeyring(testKey1 + "," + testKey2)
+	a.NoError(err)
+	mStore, err = NewWithOptions(dir, Options{Keyring: rotated})
+	a.NoError(err)
+	defer mStore.Stop()
+
+	msg2 := &protocol.Message{Path: protocol.Path("/p1/topic"), UserID: "arthur", Body: []byte("second body")}
+	_, err = mStore.StoreMessage(msg2, 0)
+	a.NoError(err)
+
+	p, err := mStore.Partition("p1")
+	a.NoError(err)
+	a.Equal([]uint64{msg.ID, msg2.ID}, fetchAllIDs(a, p.(*messagePartition)))
+
+	req := store.NewFetchRequest("p1", msg.ID, 0, store.DirectionOneMessage, 1)
+	req.Init()
+	mStore.Fetch(req)
+	a.Equal(1, req.Ready())
+	fetched := <-req.Messages()
+	a.Equal(msg.Bytes(), fetched.Message)
+
+	// deletion by user id works on the decrypted messages
+	deleted, err := p.Delete(&store.DeleteRequest{UserID: "marvin"})
+	a.NoError(err)
+	a.Equal(1, deleted)
+}
@@ -8,9 +8,12 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/smancke/guble/server/encryption"
 	"github.com/smancke/guble/server/store"
+	"github.com/smancke/guble/server/store/blobstore"
 
 	"io"
 
@@ -24,14 +27,6 @@ var (
 	indexEntrySize    = 20
 )
 
-const (
-	gubleNodeIdBits    = 3
-	sequenceBits       = 12
-	gubleNodeIdShift   = sequenceBits
-	timestampLeftShift = sequenceBits + gubleNodeIdBits
-	gubleEpoch         = 1467714505012
-)
-
 type index struct {
 	id     uint64
 	offset uint64
@@ -40,17 +35,35 @@ type index struct {
 }
 
 type messagePartition struct {
+	// usedBytes is the size of the files of the partition on disk, without the archived files.
+	// It is accessed atomically, and kept as the first field for the 64 bit alignment.
+	usedBytes int64
+
 	basedir               string
 	name                  string
 	appendFile            *os.File
 	indexFile             *os.File
 	appendFilePosition    uint64
 	maxMessageID          uint64
-	sequenceNumber        uint64
+	idGenerator           store.IDGenerator
 	totalNumberOfMessages uint64
 	entriesCount          uint64
 	list                  *indexList
 	fileCache             *cache
+	tombstones            *tombstones
+	keyring               *encryption.Keyring
+	syncMode              SyncMode
+	syncInterval          time.Duration
+	pendingSync           *syncGroup
+	archiveStore          blobstore.BlobStore
+	archiveAfter          time.Duration
+	restoreMutex          sync.Mutex
+	quota                 *Quota
+	quotaPolicy           QuotaPolicy
+
+	// compactionMutex protects the content of the message files:
+	// it is held exclusively while compacting them, and shared while opening them for reading.
+	compactionMutex sync.RWMutex
 
 	sync.RWMutex
 }
@@ -87,14 +100,35 @@ func (p *messagePartition) initialize() error {
 	p.Lock()
 	defer p.Unlock()
 
+	if err := p.recoverCompaction(); err != nil {
+		logger.WithError(err).Error("MessagePartition error on recovering compaction")
+		return err
+	}
+	if err := p.recoverRestore(); err != nil {
+		logger.WithError(err).Error("MessagePartition error on recovering restore")
+		return err
+	}
+
+	tombstones, err := loadTombstones(p.composeTombstonesFilename())
+	if err != nil {
+		logger.WithError(err).Error("MessagePartition error on loading tombstones")
+		return err
+	}
+	p.tombstones = tombstones
+
 	// reset the cache entries
 	p.fileCache = newCache()
-	err := p.readIdxFiles()
+	err = p.readIdxFiles()
 	if err != nil {
 		logger.WithField("err", err).Error("MessagePartition error on scanFiles")
 		return err
 	}
 
+	if _, p.usedBytes, err = p.Size(); err != nil {
+		logger.WithError(err).Error("MessagePartition error on calculating the used bytes")
+		return err
+	}
+
 	return nil
 }
 
@@ -136,8 +170,12 @@ func (p *messagePartition) readIdxFiles() error {
 			}).Error("Error loading existing .idxFile")
 			return err
 		}
-		//add to total number of messages per partition
-		p.totalNumberOfMessages += messagesPerFile
+		//add to total number of messages per partition (which can be less than messagesPerFile after a compaction)
+		entriesInIndex, err := calculateNoEntries(indexFilenames[i])
+		if err != nil {
+			return err
+		}
+		p.totalNumberOfMessages += entriesInIndex
 
 		// put entry in file cache
 		p.fileCache.add(cEntry)
@@ -160,8 +198,9 @@ func (p *messagePartition) readIdxFiles() error {
 		}).Error("Error loading last .idx file")
 		return err
 	}
-	//add the last part
+	//add the last part, and skip the deleted messages
 	p.totalNumberOfMessages += uint64(p.list.len())
+	p.totalNumberOfMessages -= uint64(p.tombstones.len())
 	back := p.list.back()
 
 	if back != nil && back.id >= p.maxMessageID {
@@ -190,12 +229,61 @@ func (p *messagePartition) closeAppendFiles() error {
 	return nil
 }
 
+// closeAndSyncAppendFiles closes the files used for appending.
+func (p *messagePartition) closeAndSyncAppendFiles() error {
+	// the messages waiting for a sync are kept durable when switching to the next files
+	if p.syncMode == SyncInterval {
+		if err := p.sync(); err != nil {
+			return err
+		}
+	}
+	return p.closeAppendFiles()
+}
+
+// rotate closes the files used for appending, and adds them to the closed files,
+// so that the next message is stored in the next files.
+// It has to be called with the lock held.
+func (p *messagePartition) rotate() error {
+	if err := p.closeAndSyncAppendFiles(); err != nil {
+		return err
+	}
+	if p.entriesCount == 0 {
+		return nil
+	}
+
+	logger.WithFields(log.Fields{
+		"partition":    p.name,
+		"entriesCount": p.entriesCount,
+	}).Info("Dumping current file")
+
+	//sort the indexFile
+	err := p.rewriteSortedIdxFile(p.composeIdxFilenameForPosition(uint64(p.fileCache.length())))
+	if err != nil {
+		logger.WithError(err).Error("Error dumping file")
+		return err
+	}
+	//Add items in the filecache
+	p.fileCache.add(&cacheEntry{
+		min: p.list.front().id,
+		max: p.list.back().id,
+	})
+
+	//clear the current sorted cache
+	p.list.clear()
+	p.entriesCount = 0
+	return nil
+}
+
 // readCacheEntryFromIdxFile  reads the first and last entry from a idx file which should be sorted
 func readCacheEntryFromIdxFile(filename string) (entry *cacheEntry, err error) {
 	entriesInIndex, err := calculateNoEntries(filename)
 	if err != nil {
 		return
 	}
+	// all the messages of a file may have been removed by a compaction
+	if entriesInIndex == 0 {
+		return &cacheEntry{}, nil
+	}
 
 	file, err := os.Open(filename)
 	if err != nil {
@@ -238,6 +326,7 @@ func (p *messagePartition) createNextAppendFiles() error {
 		if err != nil {
 			return err
 		}
+		atomic.AddInt64(&p.usedBytes, int64(len(magicNumber)+len(fileFormatVersion)))
 	}
 
 	indexfile, errIndex := os.OpenFile(p.composeIdxFilenameForPosition(uint64(p.fileCache.length())), os.O_RDWR|os.O_CREATE, 0666)
@@ -262,28 +351,15 @@ func (p *messagePartition) generateNextMsgID(nodeID uint8) (uint64, int64, error
 	p.Lock()
 	defer p.Unlock()
 
-	//Get the local Timestamp
-	currTime := time.Now()
-	// timestamp in Seconds will be return to client
-	timestamp := currTime.Unix()
-
-	//Use the unixNanoTimestamp for generating id
-	nanoTimestamp := currTime.UnixNano()
-
-	if nanoTimestamp < gubleEpoch {
-		err := fmt.Errorf("Clock is moving backwards. Rejecting requests until %d.", timestamp)
+	id, timestamp, err := p.idGenerator.Next(nodeID)
+	if err != nil {
 		return 0, 0, err
 	}
 
-	id := (uint64(nanoTimestamp-gubleEpoch) << timestampLeftShift) |
-		(uint64(nodeID) << gubleNodeIdShift) | p.sequenceNumber
-
-	p.sequenceNumber++
-
 	logger.WithFields(log.Fields{
 		"id":                  id,
 		"messagePartition":    p.basedir,
-		"localSequenceNumber": p.sequenceNumber,
+		"localSequenceNumber": p.idGenerator.SequenceNumber(),
 		"currentNode":         nodeID,
 	}).Debug("Generated id")
 
@@ -294,6 +370,7 @@ func (p *messagePartition) Close() error {
 	p.Lock()
 	defer p.Unlock()
 
+	p.completePendingSync()
 	return p.closeAppendFiles()
 }
 
@@ -304,10 +381,57 @@ func (p *messagePartition) DoInTx(fnToExecute func(maxMessageId uint64) error) e
 }
 
 func (p *messagePartition) Store(msgID uint64, msg []byte) error {
+	data, err := p.keyring.Encrypt(msg)
+	if err != nil {
+		return err
+	}
+
+	group, err := p.storeAndSync(msgID, data)
+	for p.quotaPolicy == QuotaEvict && isQuotaExceeded(err) {
+		evicted, errEvict := p.evict()
+		if errEvict != nil {
+			return errEvict
+		}
+		if !evicted {
+			break
+		}
+		group, err = p.storeAndSync(msgID, data)
+	}
+	if isQuotaExceeded(err) {
+		mTotalQuotaRejections.Add(1)
+	}
+	if err != nil || group == nil {
+		return err
+	}
+	return group.wait()
+}
+
+func isQuotaExceeded(err error) bool {
+	_, ok := err.(*store.QuotaExceededError)
+	return ok
+}
+
+// storeAndSync stores the message and syncs it according to the sync mode.
+// It returns the sync group to wait for, if the message will be synced later.
+func (p *messagePartition) storeAndSync(msgID uint64, data []byte) (*syncGroup, error) {
 	p.Lock()
 	defer p.Unlock()
 
-	return p.store(msgID, msg)
+	if err := p.checkQuota(len(data)); err != nil {
+		return nil, err
+	}
+	if err := p.store(msgID, data); err != nil {
+		return nil, err
+	}
+	store.CountWrite(p.name)
+
+	switch p.syncMode {
+	case SyncAlways:
+		return nil, p.sync()
+	case SyncInterval:
+		return p.pendingSyncGroup(), nil
+	}
+	return nil, nil
 }
 
 func (p *messagePartition) store(messageID uint64, data []byte) error {
@@ -321,32 +445,12 @@ func (p *messagePartition) store(messageID uint64, data []byte) error {
 			"fileCache":    p.fileCache,
 		}).Debug("store")
 
-		if err := p.closeAppendFiles(); err != nil {
-			return err
-		}
-
 		if p.entriesCount == messagesPerFile {
-
-			logger.WithFields(log.Fields{
-				"msgId":        messageID,
-				"entriesCount": p.entriesCount,
-			}).Info("Dumping current file")
-
-			//sort the indexFile
-			err := p.rewriteSortedIdxFile(p.composeIdxFilenameForPosition(uint64(p.fileCache.length())))
-			if err != nil {
-				logger.WithError(err).Error("Error dumping file")
+			if err := p.rotate(); err != nil {
 				return err
 			}
-			//Add items in the filecache
-			p.fileCache.add(&cacheEntry{
-				min: p.list.front().id,
-				max: p.list.back().id,
-			})
-
-			//clear the current sorted cache
-			p.list.clear()
-			p.entriesCount = 0
+		} else if err := p.closeAndSyncAppendFiles(); err != nil {
+			return err
 		}
 
 		if err := p.createNextAppendFiles(); err != nil {
@@ -354,10 +458,8 @@ func (p *messagePartition) store(messageID uint64, data []byte) error {
 		}
 	}
 
-	// write the message size and the message id: 32 bit and 64 bit, so 12 bytes
-	sizeAndID := make([]byte, 12)
-	binary.LittleEndian.PutUint32(sizeAndID, uint32(len(data)))
-	binary.LittleEndian.PutUint64(sizeAndID[4:], messageID)
+	// write the message size and the message id
+	sizeAndID := encodeSizeAndID(messageID, uint32(len(data)))
 
 	if _, err := p.appendFile.Write(sizeAndID); err != nil {
 		return err
@@ -376,6 +478,7 @@ func (p *messagePartition) store(messageID uint64, data []byte) error {
 	}
 	p.entriesCount++
 	p.totalNumberOfMessages++
+	atomic.AddInt64(&p.usedBytes, int64(len(sizeAndID)+len(data)+indexEntrySize))
 
 	logger.WithFields(log.Fields{
 		"p.noOfEntriesInIndexFile": p.entriesCount,
@@ -414,16 +517,17 @@ func (p *messagePartition) Fetch(req *store.FetchRequest) {
 	le.Debug("Fetching")
 
 	go func() {
-		fetchList, err := p.calculateFetchList(req)
+		fetchList, files, err := p.snapshotFetchList(req)
 
 		if err != nil {
 			log.WithField("err", err).Error("Error calculating list")
 			req.ErrorC <- err
 			return
 		}
+		defer closeFiles(files)
 		req.StartC <- fetchList.len()
 
-		err = p.fetchByFetchlist(fetchList, req)
+		err = p.fetchByFetchlist(fetchList, files, req)
 
 		if err != nil {
 			le.WithField("err", err).Error("Error calculating list")
@@ -434,22 +538,56 @@ func (p *messagePartition) Fetch(req *store.FetchRequest) {
 	}()
 }
 
-// fetchByFetchlist fetches the messages in the supplied fetchlist and sends them to the message-channel
-func (p *messagePartition) fetchByFetchlist(fetchList *indexList, req *store.FetchRequest) error {
+// snapshotFetchList returns the fetch list, and the opened message files containing its messages, by file ID.
+// The files are opened while no compaction is running, so that the messages stay readable at their listed offsets
+// through the open files, even if a compaction replaces the files while the messages are sent.
+func (p *messagePartition) snapshotFetchList(req *store.FetchRequest) (*indexList, map[int]*os.File, error) {
+	p.compactionMutex.RLock()
+	defer p.compactionMutex.RUnlock()
+
+	fetchList, err := p.calculateFetchList(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files := make(map[int]*os.File)
+	err = fetchList.mapWithPredicate(func(index *index, _ int) error {
+		if _, exists := files[index.fileID]; exists {
+			return nil
+		}
+		file, err := p.openMsgFile(uint64(index.fileID))
+		if err != nil {
+			return err
+		}
+		files[index.fileID] = file
+		return nil
+	})
+	if err != nil {
+		closeFiles(files)
+		return nil, nil, err
+	}
+	return fetchList, files, nil
+}
+
+func closeFiles(files map[int]*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// fetchByFetchlist fetches the messages in the supplied fetchlist from the opened files and sends them to the message-channel.
+// The messages deleted in the meantime are skipped.
+func (p *messagePartition) fetchByFetchlist(fetchList *indexList, files map[int]*os.File, req *store.FetchRequest) error {
 	return fetchList.mapWithPredicate(func(index *index, _ int) error {
 		if req.IsDone() {
 			return store.ErrRequestDone
 		}
-
-		filename := p.composeMsgFilenameForPosition(uint64(index.fileID))
-		file, err := os.Open(filename)
-		if err != nil {
-			return err
+		if p.tombstones.contains(index.id) {
+			return nil
 		}
-		defer file.Close()
 
 		msg := make([]byte, index.size, index.size)
-		_, err = file.ReadAt(msg, int64(index.offset))
+		_, err := files[index.fileID].ReadAt(msg, int64(index.offset))
 		if err != nil {
 			logger.WithFields(log.Fields{
 				"err":    err,
@@ -458,6 +596,12 @@ func (p *messagePartition) fetchByFetchlist(fetchList *indexList, req *store.Fet
 			return err
 		}
 
+		msg, err = p.keyring.Decrypt(msg)
+		if err != nil {
+			logger.WithError(err).WithField("id", index.id).Error("Error decrypting message")
+			return err
+		}
+
 		req.Push(index.id, msg)
 		return nil
 	})
@@ -489,7 +633,7 @@ func (p *messagePartition) calculateFetchList(req *store.FetchRequest) (*indexLi
 				return nil, err
 			}
 
-			potentialEntries.insert(l.extract(req).toSliceArray()...)
+			potentialEntries.insert(p.withoutDeleted(l).extract(req).toSliceArray()...)
 		} else {
 			prev = false
 		}
@@ -497,7 +641,7 @@ func (p *messagePartition) calculateFetchList(req *store.FetchRequest) (*indexLi
 
 	// Read from current cached value (the idx file which size is smaller than MESSAGE_PER_FILE
 	if p.list.contains(req.StartID) || (prev && potentialEntries.len() < req.Count) {
-		potentialEntries.insert(p.list.extract(req).toSliceArray()...)
+		potentialEntries.insert(p.withoutDeleted(p.list).extract(req).toSliceArray()...)
 	}
 
 	// Currently potentialEntries contains a potentials IDs from any files and
@@ -666,3 +810,24 @@ func (p *messagePartition) composeMsgFilenameForPosition(value uint64) string {
 func (p *messagePartition) composeIdxFilenameForPosition(value uint64) string {
 	return filepath.Join(p.basedir, fmt.Sprintf("%s-%020d.idx", p.name, value))
 }
+
+// Size returns the number of files and of bytes in the directory of the partition.
+func (p *messagePartition) Size() (int, int64, error) {
+	infos, err := ioutil.ReadDir(p.basedir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	files, bytes := 0, int64(0)
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			files++
+			bytes += info.Size()
+		}
+	}
+	return files, bytes, nil
+}
+
+func (p *messagePartition) composeTombstonesFilename() string {
+	return filepath.Join(p.basedir, p.name+".tombstones")
+}
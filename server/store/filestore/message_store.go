@@ -9,18 +9,56 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/encryption"
 	"github.com/smancke/guble/server/store"
+	"github.com/smancke/guble/server/store/blobstore"
 )
 
+// encryptionMarkerFilename is the name of the file recording the ids of the keys used for encrypting messages.
+const encryptionMarkerFilename = "message-store.encryption"
+
+// compactionInterval is the interval for removing the data of deleted messages from the message files.
+var compactionInterval = time.Minute
+
 // FileMessageStore is a struct used by the filesystem-based implementation of the MessageStore interface.
 // It holds the base directory, a map of messagePartitions etc.
 type FileMessageStore struct {
 	partitions map[string]*messagePartition
 	basedir    string
 	mutex      sync.RWMutex
+	options    Options
+
+	stopC        chan bool
+	compactionWG sync.WaitGroup
+}
+
+// Options are the optional settings of a FileMessageStore.
+type Options struct {
+
+	// Keyring is used for encrypting the stored messages. The messages are not encrypted if it is nil.
+	Keyring *encryption.Keyring
+
+	// SyncMode defines when the written messages are synced to disk (default: SyncNone).
+	SyncMode SyncMode
+
+	// SyncInterval is the interval between the syncs, for SyncInterval.
+	SyncInterval time.Duration
+
+	// Archive is the secondary storage for old message files. The files are not archived if it is nil.
+	Archive blobstore.BlobStore
+
+	// ArchiveAfter is the duration after the last write to a closed message file, before it is archived.
+	ArchiveAfter time.Duration
+
+	// Quotas limit the storage used by the partitions. A partition without a matching quota is not limited.
+	Quotas []Quota
+
+	// QuotaPolicy defines what happens when a quota is reached. The default is QuotaReject.
+	QuotaPolicy QuotaPolicy
 }
 
 // New returns a new FileMessageStore.
@@ -31,6 +69,28 @@ func New(basedir string) *FileMessageStore {
 	}
 }
 
+// NewWithOptions returns a new FileMessageStore using the options.
+// It returns an error if the options are invalid,
+// or if the stored messages are encrypted with a key which is not in the keyring.
+func NewWithOptions(basedir string, options Options) (*FileMessageStore, error) {
+	if err := options.validateSync(); err != nil {
+		return nil, err
+	}
+	if err := options.validateArchive(); err != nil {
+		return nil, err
+	}
+	if err := options.validateQuotas(); err != nil {
+		return nil, err
+	}
+	if err := encryption.CheckMarkerFile(path.Join(basedir, encryptionMarkerFilename), options.Keyring); err != nil {
+		return nil, err
+	}
+
+	fms := New(basedir)
+	fms.options = options
+	return fms, nil
+}
+
 // MaxMessageID is a part of the `store.MessageStore` implementation.
 func (fms *FileMessageStore) MaxMessageID(partition string) (uint64, error) {
 	p, err := fms.Partition(partition)
@@ -40,9 +100,76 @@ func (fms *FileMessageStore) MaxMessageID(partition string) (uint64, error) {
 	return p.MaxMessageID(), nil
 }
 
+// Start the periodic compaction of the message files.
+// Implements the service.startable interface.
+func (fms *FileMessageStore) Start() error {
+	fms.stopC = make(chan bool)
+	fms.compactionWG.Add(1)
+	go fms.compactPeriodically(fms.stopC)
+	return nil
+}
+
+func (fms *FileMessageStore) compactPeriodically(stopC chan bool) {
+	defer fms.compactionWG.Done()
+
+	ticker := time.NewTicker(compactionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fms.compact()
+			fms.archive()
+		case <-stopC:
+			return
+		}
+	}
+}
+
+// compact removes the data of the deleted messages from the message files of all the partitions.
+func (fms *FileMessageStore) compact() {
+	fms.mutex.RLock()
+	partitions := make([]*messagePartition, 0, len(fms.partitions))
+	for _, p := range fms.partitions {
+		partitions = append(partitions, p)
+	}
+	fms.mutex.RUnlock()
+
+	for _, p := range partitions {
+		if err := p.compact(); err != nil {
+			logger.WithError(err).WithField("partition", p.name).Error("Error compacting message partition")
+		}
+	}
+}
+
+// archive moves the old message files of all the partitions to the archive, if it is configured.
+func (fms *FileMessageStore) archive() {
+	if fms.options.Archive == nil {
+		return
+	}
+
+	// not loaded partitions are archived as well, since their files are not written anymore
+	partitions, err := fms.Partitions()
+	if err != nil {
+		logger.WithError(err).Error("Error listing message partitions for archiving")
+		return
+	}
+	now := time.Now()
+	for _, p := range partitions {
+		if err := p.(*messagePartition).archive(now); err != nil {
+			logger.WithError(err).WithField("partition", p.Name()).Error("Error archiving message files")
+		}
+	}
+}
+
 // Stop the FileMessageStore.
 // Implements the service.stopable interface.
 func (fms *FileMessageStore) Stop() error {
+	if fms.stopC != nil {
+		close(fms.stopC)
+		fms.stopC = nil
+		fms.compactionWG.Wait()
+	}
+
 	fms.mutex.Lock()
 	defer fms.mutex.Unlock()
 
@@ -133,6 +260,7 @@ func (fms *FileMessageStore) Fetch(req *store.FetchRequest) {
 		req.ErrorC <- err
 		return
 	}
+	store.CountFetch(req.Partition)
 	p.Fetch(req)
 }
 
@@ -192,6 +320,12 @@ func (fms *FileMessageStore) Partition(partition string) (store.MessagePartition
 			logger.WithField("err", err).Error("partitionStore")
 			return nil, err
 		}
+		partitionStore.keyring = fms.options.Keyring
+		partitionStore.syncMode = fms.options.SyncMode
+		partitionStore.syncInterval = fms.options.SyncInterval
+		partitionStore.archiveStore = fms.options.Archive
+		partitionStore.archiveAfter = fms.options.ArchiveAfter
+		partitionStore.setQuota(fms.options.quotaFor(partition), fms.options.QuotaPolicy)
 		fms.partitions[partition] = partitionStore
 	}
 	return partitionStore, nil
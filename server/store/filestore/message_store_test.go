@@ -3,14 +3,24 @@ package filestore
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/smancke/guble/server/store"
+	"github.com/smancke/guble/server/store/storetest"
 
 	"github.com/stretchr/testify/assert"
 )
 
+func Test_MessageStore(t *testing.T) {
+	storetest.TestMessageStore(t, func(t *testing.T) (store.MessageStore, func()) {
+		dir, err := ioutil.TempDir("", "guble_message_store_test")
+		assert.NoError(t, err)
+		return New(dir), func() { os.RemoveAll(dir) }
+	})
+}
+
 func Test_Fetch(t *testing.T) {
 	a := assert.New(t)
 	dir, _ := ioutil.TempDir("", "guble_message_store_test")
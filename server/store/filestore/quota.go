@@ -0,0 +1,209 @@
+package filestore
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/smancke/guble/server/metrics"
+	"github.com/smancke/guble/server/store"
+)
+
+// QuotaPolicy defines what happens when storing a message would exceed the quota of its partition.
+type QuotaPolicy string
+
+const (
+	// QuotaReject rejects the message with a store.QuotaExceededError.
+	QuotaReject QuotaPolicy = "reject"
+
+	// QuotaEvict deletes the messages of the oldest message files, until the message fits into the quota.
+	// The message is rejected if it does not fit after evicting all the messages of the partition.
+	QuotaEvict QuotaPolicy = "evict"
+)
+
+var (
+	mTotalQuotaRejections = metrics.NewInt("filestore.total_quota_rejections")
+	mTotalEvictedFiles    = metrics.NewInt("filestore.total_evicted_files")
+	mTotalEvictedMessages = metrics.NewInt("filestore.total_evicted_messages")
+	mPartitionQuotaUsage  = metrics.NewMap("filestore.partition_quota_usage")
+)
+
+// Quota limits the storage used by a partition. A limit of 0 means unlimited.
+type Quota struct {
+	// Partition is the name of the partition, or a prefix of partition names ending with "*".
+	// A prefix quota applies to each matching partition separately.
+	Partition string
+
+	MaxBytes    int64
+	MaxMessages uint64
+}
+
+// quotaUsage is the usage of a partition against its quota, as published in the metrics.
+type quotaUsage struct {
+	Bytes       int64  `json:"bytes"`
+	MaxBytes    int64  `json:"maxBytes"`
+	Messages    uint64 `json:"messages"`
+	MaxMessages uint64 `json:"maxMessages"`
+}
+
+// ParseQuota parses a quota in the format "<partition>[*]:<max bytes>:<max messages>".
+func ParseQuota(s string) (Quota, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return Quota{}, fmt.Errorf("Invalid quota %q, expected <partition>[*]:<max bytes>:<max messages>", s)
+	}
+	maxBytes, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return Quota{}, fmt.Errorf("Invalid max bytes in quota %q: %v", s, err)
+	}
+	maxMessages, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return Quota{}, fmt.Errorf("Invalid max messages in quota %q: %v", s, err)
+	}
+	return Quota{Partition: parts[0], MaxBytes: maxBytes, MaxMessages: maxMessages}, nil
+}
+
+func (q Quota) matches(partition string) bool {
+	if strings.HasSuffix(q.Partition, "*") {
+		return strings.HasPrefix(partition, strings.TrimSuffix(q.Partition, "*"))
+	}
+	return q.Partition == partition
+}
+
+// validateQuotas returns an error if the quota settings of the options are invalid.
+func (o Options) validateQuotas() error {
+	switch o.QuotaPolicy {
+	case "", QuotaReject, QuotaEvict:
+	default:
+		return fmt.Errorf("Unknown quota policy %q", o.QuotaPolicy)
+	}
+	for _, q := range o.Quotas {
+		if q.Partition == "" {
+			return fmt.Errorf("The quota has no partition")
+		}
+		if q.MaxBytes < 0 {
+			return fmt.Errorf("The max bytes of the quota for %s are negative", q.Partition)
+		}
+	}
+	return nil
+}
+
+// quotaFor returns the quota for the partition, or nil if it is not limited.
+// A quota for the exact partition name takes precedence, then the quota with the longest matching prefix.
+func (o Options) quotaFor(partition string) *Quota {
+	var found *Quota
+	for i := range o.Quotas {
+		q := &o.Quotas[i]
+		if !q.matches(partition) {
+			continue
+		}
+		if q.Partition == partition {
+			return q
+		}
+		if found == nil || len(q.Partition) > len(found.Partition) {
+			found = q
+		}
+	}
+	return found
+}
+
+// setQuota limits the storage of the partition, and publishes its usage in the metrics.
+func (p *messagePartition) setQuota(quota *Quota, policy QuotaPolicy) {
+	p.quota = quota
+	p.quotaPolicy = policy
+	if quota == nil {
+		return
+	}
+	mPartitionQuotaUsage.Set(p.name, expvar.Func(func() interface{} {
+		return p.quotaUsage()
+	}))
+}
+
+func (p *messagePartition) quotaUsage() quotaUsage {
+	p.RLock()
+	defer p.RUnlock()
+
+	return quotaUsage{
+		Bytes:       atomic.LoadInt64(&p.usedBytes),
+		MaxBytes:    p.quota.MaxBytes,
+		Messages:    p.totalNumberOfMessages,
+		MaxMessages: p.quota.MaxMessages,
+	}
+}
+
+// checkQuota returns a store.QuotaExceededError, if storing a message with the size would exceed the quota.
+// It has to be called with the lock held.
+func (p *messagePartition) checkQuota(size int) error {
+	if p.quota == nil {
+		return nil
+	}
+	if p.quota.MaxMessages > 0 && p.totalNumberOfMessages >= p.quota.MaxMessages {
+		return &store.QuotaExceededError{Partition: p.name, Resource: "messages", Limit: int64(p.quota.MaxMessages)}
+	}
+	// the message header and the index entry are stored in addition to the message
+	needed := int64(messageHeaderSize + size + indexEntrySize)
+	if p.quota.MaxBytes > 0 && atomic.LoadInt64(&p.usedBytes)+needed > p.quota.MaxBytes {
+		return &store.QuotaExceededError{Partition: p.name, Resource: "bytes", Limit: p.quota.MaxBytes}
+	}
+	return nil
+}
+
+// addUsedBytes adjusts the bytes used on disk, after files were changed outside of store.
+func (p *messagePartition) addUsedBytes(delta int64) {
+	atomic.AddInt64(&p.usedBytes, delta)
+}
+
+// evict deletes all the messages of the oldest closed message file which still contains messages,
+// and compacts the partition to free their space. If all the messages are in the file used for appending,
+// this file is closed and evicted. It returns false if there are no messages to evict.
+func (p *messagePartition) evict() (bool, error) {
+	for fileID := 0; fileID < p.fileCache.length(); fileID++ {
+		entry := p.fileCache.get(fileID)
+		if entry.max == 0 {
+			// the file is empty after a compaction
+			continue
+		}
+
+		deleted, err := p.Delete(&store.DeleteRequest{FromID: entry.min, ToID: entry.max})
+		if err != nil {
+			return false, err
+		}
+		if deleted == 0 {
+			continue
+		}
+		if err := p.compact(); err != nil {
+			return false, err
+		}
+		mTotalEvictedFiles.Add(1)
+		mTotalEvictedMessages.Add(int64(deleted))
+
+		logger.WithFields(log.Fields{
+			"partition": p.name,
+			"fileID":    fileID,
+			"deleted":   deleted,
+		}).Warn("Evicted oldest messages to stay within quota")
+		return true, nil
+	}
+
+	rotated, err := p.rotateIfNotEmpty()
+	if err != nil || !rotated {
+		return false, err
+	}
+	return p.evict()
+}
+
+// rotateIfNotEmpty closes the file currently used for appending if it contains messages,
+// so that it can be evicted like the closed files. It returns false if the file is empty.
+func (p *messagePartition) rotateIfNotEmpty() (bool, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.entriesCount == 0 {
+		return false, nil
+	}
+	return true, p.rotate()
+}
@@ -0,0 +1,182 @@
+package filestore
+
+import (
+	"expvar"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/smancke/guble/server/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newLimitedPartition(a *assert.Assertions, dir string, quota Quota, policy QuotaPolicy) *messagePartition {
+	p, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	p.setQuota(&quota, policy)
+	return p
+}
+
+func Test_ParseQuota(t *testing.T) {
+	a := assert.New(t)
+
+	q, err := ParseQuota("tenant*:1024:10")
+	a.NoError(err)
+	a.Equal(Quota{Partition: "tenant*", MaxBytes: 1024, MaxMessages: 10}, q)
+
+	_, err = ParseQuota("tenant:1024")
+	a.Error(err)
+	_, err = ParseQuota("tenant:many:10")
+	a.Error(err)
+	_, err = ParseQuota("tenant:1024:-1")
+	a.Error(err)
+}
+
+func Test_Options_quotaFor(t *testing.T) {
+	a := assert.New(t)
+
+	o := Options{Quotas: []Quota{
+		{Partition: "*", MaxMessages: 1},
+		{Partition: "tenant*", MaxMessages: 2},
+		{Partition: "tenant-big", MaxMessages: 3},
+		{Partition: "tenant-b*", MaxMessages: 4},
+	}}
+	a.Equal(uint64(1), o.quotaFor("other").MaxMessages)
+	a.Equal(uint64(2), o.quotaFor("tenant-a").MaxMessages)
+	a.Equal(uint64(3), o.quotaFor("tenant-big").MaxMessages)
+	a.Equal(uint64(4), o.quotaFor("tenant-bigger").MaxMessages)
+	a.Nil(Options{}.quotaFor("other"))
+
+	a.NoError(o.validateQuotas())
+	a.Error(Options{QuotaPolicy: "ignore"}.validateQuotas())
+	a.Error(Options{Quotas: []Quota{{MaxMessages: 1}}}.validateQuotas())
+}
+
+func Test_MessagePartition_QuotaReject(t *testing.T) {
+	a := assert.New(t)
+	messagesPerFile = uint64(5)
+
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+	p := newLimitedPartition(a, dir, Quota{Partition: "myMessages", MaxMessages: 3}, QuotaReject)
+	defer p.Close()
+
+	storeTestMessages(a, p, 3)
+	err := p.Store(4, []byte("too many"))
+	a.Equal(&store.QuotaExceededError{Partition: "myMessages", Resource: "messages", Limit: 3}, err)
+	a.Equal([]uint64{1, 2, 3}, fetchAllIDs(a, p))
+
+	// deleting messages frees the quota
+	_, err = p.Delete(&store.DeleteRequest{IDs: []uint64{1}})
+	a.NoError(err)
+	a.NoError(p.Store(4, []byte("fits again")))
+}
+
+func Test_MessagePartition_QuotaBytes(t *testing.T) {
+	a := assert.New(t)
+	messagesPerFile = uint64(5)
+
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+	p := newLimitedPartition(a, dir, Quota{Partition: "myMessages", MaxBytes: 200}, QuotaReject)
+	defer p.Close()
+
+	// each message uses 12 + 10 + 20 bytes, and the message file header 9 bytes
+	data := []byte("0123456789")
+	for id := uint64(1); id <= 4; id++ {
+		a.NoError(p.Store(id, data))
+	}
+	a.Equal(int64(9+4*42), p.quotaUsage().Bytes)
+	_, used, err := p.Size()
+	a.NoError(err)
+	a.Equal(used, p.quotaUsage().Bytes)
+
+	err = p.Store(5, data)
+	a.IsType(&store.QuotaExceededError{}, err)
+	a.Equal("bytes", err.(*store.QuotaExceededError).Resource)
+}
+
+func Test_MessagePartition_QuotaEvict(t *testing.T) {
+	a := assert.New(t)
+	messagesPerFile = uint64(5)
+
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+	p := newLimitedPartition(a, dir, Quota{Partition: "myMessages", MaxMessages: 12}, QuotaEvict)
+	defer p.Close()
+
+	evictedBefore := expvar.Get("filestore.total_evicted_files").(*expvar.Int).Value()
+
+	// files: [1..5] [6..10] [11, 12]
+	storeTestMessages(a, p, 12)
+	a.NoError(p.Store(13, []byte("evicts the oldest file")))
+	a.Equal([]uint64{6, 7, 8, 9, 10, 11, 12, 13}, fetchAllIDs(a, p))
+
+	for id := uint64(14); id <= 17; id++ {
+		a.NoError(p.Store(id, []byte("fits")))
+	}
+	a.NoError(p.Store(18, []byte("evicts the next file")))
+	a.Equal([]uint64{11, 12, 13, 14, 15, 16, 17, 18}, fetchAllIDs(a, p))
+	a.Equal(int64(2), expvar.Get("filestore.total_evicted_files").(*expvar.Int).Value()-evictedBefore)
+
+	// the usage is kept after the compactions
+	_, used, err := p.Size()
+	a.NoError(err)
+	a.Equal(used, p.quotaUsage().Bytes)
+}
+
+func Test_MessagePartition_QuotaEvictCurrentFile(t *testing.T) {
+	a := assert.New(t)
+	messagesPerFile = uint64(5)
+
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+	p := newLimitedPartition(a, dir, Quota{Partition: "myMessages", MaxMessages: 2}, QuotaEvict)
+	defer p.Close()
+
+	// all the messages are in the file used for appending, which is closed and evicted
+	storeTestMessages(a, p, 2)
+	a.NoError(p.Store(3, []byte("evicts the current file")))
+	a.Equal([]uint64{3}, fetchAllIDs(a, p))
+
+	a.NoError(p.Store(4, []byte("fits")))
+	a.NoError(p.Store(5, []byte("evicts the current file again")))
+	a.Equal([]uint64{5}, fetchAllIDs(a, p))
+	a.Equal(uint64(1), p.Count())
+}
+
+func Test_MessagePartition_QuotaEvictBytesSmallerThanFile(t *testing.T) {
+	a := assert.New(t)
+	messagesPerFile = uint64(5)
+
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+	data := make([]byte, 100)
+	// less than two messages fit, but a file holds five of them
+	maxBytes := int64(2*(messageHeaderSize+len(data)+indexEntrySize) + len(magicNumber) + len(fileFormatVersion))
+	p := newLimitedPartition(a, dir, Quota{Partition: "myMessages", MaxBytes: maxBytes}, QuotaEvict)
+	defer p.Close()
+
+	for id := uint64(1); id <= 8; id++ {
+		a.NoError(p.Store(id, data))
+	}
+	ids := fetchAllIDs(a, p)
+	a.True(len(ids) > 0)
+	a.Equal(uint64(8), ids[len(ids)-1])
+	a.True(p.quotaUsage().Bytes <= maxBytes)
+}
+
+func Test_MessagePartition_QuotaEvictRejectsIfNothingToEvict(t *testing.T) {
+	a := assert.New(t)
+	messagesPerFile = uint64(5)
+
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+	p := newLimitedPartition(a, dir, Quota{Partition: "myMessages", MaxBytes: 50}, QuotaEvict)
+	defer p.Close()
+
+	// the message does not fit, even into the empty partition
+	a.IsType(&store.QuotaExceededError{}, p.Store(1, make([]byte, 100)))
+	a.Equal([]uint64{}, fetchAllIDs(a, p))
+}
@@ -0,0 +1,121 @@
+package filestore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/smancke/guble/server/metrics"
+)
+
+// SyncMode defines when the written messages are synced to disk (fsync).
+type SyncMode string
+
+const (
+	// SyncNone leaves the syncing to the operating system,
+	// so that stored messages can be lost by a crash of the operating system.
+	SyncNone SyncMode = "none"
+
+	// SyncInterval syncs the written messages periodically (group commit):
+	// storing a message returns after the next sync, which is shared by all the messages written in the interval.
+	SyncInterval SyncMode = "interval"
+
+	// SyncAlways syncs each message before storing it returns.
+	SyncAlways SyncMode = "always"
+)
+
+var (
+	mTotalSyncs                = metrics.NewInt("filestore.total_syncs")
+	mTotalSyncErrors           = metrics.NewInt("filestore.total_sync_errors")
+	mTotalSyncLatencyNanos     = metrics.NewInt("filestore.total_sync_latency_nanos")
+	mTotalSyncWaits            = metrics.NewInt("filestore.total_sync_waits")
+	mTotalSyncWaitLatencyNanos = metrics.NewInt("filestore.total_sync_wait_latency_nanos")
+)
+
+// validateSync returns an error if the sync settings of the options are invalid.
+func (o Options) validateSync() error {
+	switch o.SyncMode {
+	case "", SyncNone, SyncAlways:
+		return nil
+	case SyncInterval:
+		if o.SyncInterval <= 0 {
+			return fmt.Errorf("The sync interval has to be positive, but is %v", o.SyncInterval)
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unknown sync mode: %q", o.SyncMode)
+	}
+}
+
+// syncGroup is a group of writes waiting for the same sync.
+type syncGroup struct {
+	doneC chan struct{}
+	err   error
+}
+
+func newSyncGroup() *syncGroup {
+	return &syncGroup{doneC: make(chan struct{})}
+}
+
+func (g *syncGroup) done(err error) {
+	g.err = err
+	close(g.doneC)
+}
+
+// wait blocks until the sync of the group is done, and returns its result.
+func (g *syncGroup) wait() error {
+	start := time.Now()
+	<-g.doneC
+	mTotalSyncWaits.Add(1)
+	mTotalSyncWaitLatencyNanos.Add(time.Since(start).Nanoseconds())
+	return g.err
+}
+
+// pendingSyncGroup returns the group of writes waiting for the next periodic sync,
+// and schedules this sync if it is the first write of the group.
+// The lock of the partition has to be held.
+func (p *messagePartition) pendingSyncGroup() *syncGroup {
+	if p.pendingSync == nil {
+		p.pendingSync = newSyncGroup()
+		time.AfterFunc(p.syncInterval, p.syncPending)
+	}
+	return p.pendingSync
+}
+
+func (p *messagePartition) syncPending() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.completePendingSync()
+}
+
+// completePendingSync syncs the written data, and releases the writes waiting for it.
+// The lock of the partition has to be held.
+func (p *messagePartition) completePendingSync() {
+	if p.pendingSync == nil {
+		return
+	}
+	p.pendingSync.done(p.sync())
+	p.pendingSync = nil
+}
+
+// sync flushes the written data of the current message and index files to disk.
+// The lock of the partition has to be held.
+func (p *messagePartition) sync() error {
+	if p.appendFile == nil || p.indexFile == nil {
+		return nil
+	}
+
+	start := time.Now()
+	err := p.appendFile.Sync()
+	if err == nil {
+		err = p.indexFile.Sync()
+	}
+	mTotalSyncs.Add(1)
+	mTotalSyncLatencyNanos.Add(time.Since(start).Nanoseconds())
+
+	if err != nil {
+		mTotalSyncErrors.Add(1)
+		logger.WithError(err).WithField("partition", p.name).Error("Error syncing message files")
+	}
+	return err
+}
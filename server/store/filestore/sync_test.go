@@ -0,0 +1,110 @@
+package filestore
+
+import (
+	"expvar"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func totalSyncs() int64 {
+	return expvar.Get("filestore.total_syncs").(*expvar.Int).Value()
+}
+
+func newSyncingPartition(a *assert.Assertions, dir string, mode SyncMode, interval time.Duration) *messagePartition {
+	p, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	p.syncMode = mode
+	p.syncInterval = interval
+	return p
+}
+
+func Test_Options_validateSync(t *testing.T) {
+	a := assert.New(t)
+
+	a.NoError(Options{}.validateSync())
+	a.NoError(Options{SyncMode: SyncNone}.validateSync())
+	a.NoError(Options{SyncMode: SyncAlways}.validateSync())
+	a.NoError(Options{SyncMode: SyncInterval, SyncInterval: time.Millisecond}.validateSync())
+	a.Error(Options{SyncMode: SyncInterval}.validateSync())
+	a.Error(Options{SyncMode: "sometimes"}.validateSync())
+
+	dir, _ := ioutil.TempDir("", "guble_message_store_test")
+	defer os.RemoveAll(dir)
+	_, err := NewWithOptions(dir, Options{SyncMode: SyncInterval})
+	a.Error(err)
+}
+
+func Test_MessagePartition_SyncNone(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+	p := newSyncingPartition(a, dir, SyncNone, 0)
+
+	before := totalSyncs()
+	storeTestMessages(a, p, 3)
+	a.Equal(before, totalSyncs())
+}
+
+func Test_MessagePartition_SyncAlways(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+	p := newSyncingPartition(a, dir, SyncAlways, 0)
+
+	before := totalSyncs()
+	storeTestMessages(a, p, 3)
+	a.Equal(before+3, totalSyncs())
+}
+
+func Test_MessagePartition_SyncInterval(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+	interval := 50 * time.Millisecond
+	p := newSyncingPartition(a, dir, SyncInterval, interval)
+
+	// concurrent stores wait for the same sync
+	before := totalSyncs()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			a.NoError(p.Store(id, []byte("body")))
+		}(uint64(i))
+	}
+	wg.Wait()
+
+	a.True(time.Since(start) >= interval)
+	syncs := totalSyncs() - before
+	a.True(syncs >= 1 && syncs < 10, "syncs: %d", syncs)
+	a.Nil(p.pendingSync)
+}
+
+func Test_MessagePartition_CloseCompletesPendingSync(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+	p := newSyncingPartition(a, dir, SyncInterval, time.Hour)
+
+	errC := make(chan error)
+	go func() {
+		errC <- p.Store(1, []byte("body"))
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	a.NoError(p.Close())
+
+	select {
+	case err := <-errC:
+		a.NoError(err)
+	case <-time.After(time.Second):
+		a.Fail("store did not return after closing the partition")
+	}
+}
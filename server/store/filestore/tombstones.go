@@ -0,0 +1,121 @@
+package filestore
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+const tombstoneSize = 8
+
+// tombstones is the set of IDs of deleted messages, which are still present in the message files.
+// The set is persisted in an append-only file, and rewritten when the message files are compacted.
+type tombstones struct {
+	filename string
+	ids      map[uint64]struct{}
+
+	sync.RWMutex
+}
+
+// loadTombstones reads the tombstones from the file, if it exists.
+func loadTombstones(filename string) (*tombstones, error) {
+	t := &tombstones{
+		filename: filename,
+		ids:      make(map[uint64]struct{}),
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return nil, err
+	}
+	// a partially written last entry (e.g. after a crash) is ignored
+	for i := 0; i+tombstoneSize <= len(data); i += tombstoneSize {
+		t.ids[binary.LittleEndian.Uint64(data[i:])] = struct{}{}
+	}
+	return t, nil
+}
+
+func (t *tombstones) len() int {
+	t.RLock()
+	defer t.RUnlock()
+
+	return len(t.ids)
+}
+
+func (t *tombstones) contains(id uint64) bool {
+	t.RLock()
+	defer t.RUnlock()
+
+	_, exists := t.ids[id]
+	return exists
+}
+
+// inRange returns the tombstones with an ID between min and max (inclusive).
+func (t *tombstones) inRange(min, max uint64) []uint64 {
+	t.RLock()
+	defer t.RUnlock()
+
+	var ids []uint64
+	for id := range t.ids {
+		if id >= min && id <= max {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// add persists the new tombstones, before making them visible.
+func (t *tombstones) add(ids []uint64) error {
+	t.Lock()
+	defer t.Unlock()
+
+	file, err := os.OpenFile(t.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(encodeTombstones(ids)); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		t.ids[id] = struct{}{}
+	}
+	return nil
+}
+
+// remove drops the tombstones of messages which are not present in the message files anymore.
+func (t *tombstones) remove(ids []uint64) error {
+	t.Lock()
+	defer t.Unlock()
+
+	for _, id := range ids {
+		delete(t.ids, id)
+	}
+
+	remaining := make([]uint64, 0, len(t.ids))
+	for id := range t.ids {
+		remaining = append(remaining, id)
+	}
+	tmpFilename := t.filename + compactionSuffix
+	if err := ioutil.WriteFile(tmpFilename, encodeTombstones(remaining), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, t.filename)
+}
+
+func encodeTombstones(ids []uint64) []byte {
+	data := make([]byte, len(ids)*tombstoneSize)
+	for i, id := range ids {
+		binary.LittleEndian.PutUint64(data[i*tombstoneSize:], id)
+	}
+	return data
+}
@@ -0,0 +1,7 @@
+package memorystore
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+var logger = log.WithField("module", "memorystore")
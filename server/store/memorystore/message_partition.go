@@ -0,0 +1,177 @@
+package memorystore
+
+import (
+	"math"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/smancke/guble/server/store"
+)
+
+type messagePartition struct {
+	name         string
+	messages     *ring
+	maxMessageID uint64
+	idGenerator  store.IDGenerator
+
+	sync.RWMutex
+}
+
+func newMessagePartition(name string, maxMessages int, maxBytes int64) *messagePartition {
+	return &messagePartition{
+		name:     name,
+		messages: newRing(maxMessages, maxBytes),
+	}
+}
+
+func (p *messagePartition) Name() string {
+	return p.name
+}
+
+// MaxMessageID returns the highest ID ever stored in this partition, even if the message was already evicted.
+func (p *messagePartition) MaxMessageID() uint64 {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.maxMessageID
+}
+
+// Count returns the number of messages currently kept in the partition.
+func (p *messagePartition) Count() uint64 {
+	p.RLock()
+	defer p.RUnlock()
+
+	return uint64(p.messages.length)
+}
+
+func (p *messagePartition) generateNextMsgID(nodeID uint8) (uint64, int64, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	id, timestamp, err := p.idGenerator.Next(nodeID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	logger.WithFields(log.Fields{
+		"id":                  id,
+		"messagePartition":    p.name,
+		"localSequenceNumber": p.idGenerator.SequenceNumber(),
+		"currentNode":         nodeID,
+	}).Debug("Generated id")
+
+	return id, timestamp, nil
+}
+
+func (p *messagePartition) DoInTx(fnToExecute func(maxMessageId uint64) error) error {
+	p.Lock()
+	defer p.Unlock()
+	return fnToExecute(p.maxMessageID)
+}
+
+func (p *messagePartition) Store(msgID uint64, msg []byte) error {
+	p.Lock()
+	defer p.Unlock()
+
+	p.messages.insert(entry{id: msgID, data: msg})
+	if msgID > p.maxMessageID {
+		p.maxMessageID = msgID
+	}
+	store.CountWrite(p.name)
+	return nil
+}
+
+// Size returns the number of bytes of the messages kept in memory.
+func (p *messagePartition) Size() (int, int64, error) {
+	p.RLock()
+	defer p.RUnlock()
+
+	return 0, p.messages.size, nil
+}
+
+// Delete removes the messages matching the request.
+// The MaxMessageID of the partition is not changed.
+func (p *messagePartition) Delete(req *store.DeleteRequest) (int, error) {
+	if err := req.Validate(); err != nil {
+		return 0, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	return p.messages.removeIf(func(e *entry) bool {
+		return req.Matches(e.id, e.data)
+	}), nil
+}
+
+// Fetch fetches a set of messages.
+// The messages are always returned in ascending order of their IDs.
+func (p *messagePartition) Fetch(req *store.FetchRequest) {
+	logger.WithFields(log.Fields{
+		"partition": req.Partition,
+		"startID":   req.StartID,
+		"endID":     req.EndID,
+		"Count":     req.Count,
+	}).Debug("Fetching")
+
+	fetchList := p.fetchList(req)
+
+	go func() {
+		req.StartC <- len(fetchList)
+		for _, e := range fetchList {
+			if req.IsDone() {
+				return
+			}
+			req.Push(e.id, e.data)
+		}
+		req.Done()
+	}()
+}
+
+// fetchList returns a copy of the entries matching the fetch request.
+func (p *messagePartition) fetchList(req *store.FetchRequest) []entry {
+	p.RLock()
+	defer p.RUnlock()
+
+	if req.Direction == 0 {
+		req.Direction = store.DirectionForward
+	}
+	count := req.Count
+	if count < 0 {
+		count = math.MaxInt32
+	}
+
+	var from, to int
+	if req.Direction == store.DirectionForward {
+		from = p.messages.search(req.StartID)
+		to = p.messages.length
+		if req.EndID > 0 {
+			to = p.messages.search(req.EndID + 1)
+		}
+		if to-from > count {
+			to = from + count
+		}
+	} else {
+		to = p.messages.length
+		if req.StartID > 0 && req.StartID < math.MaxUint64 {
+			to = p.messages.search(req.StartID + 1)
+		}
+		from = 0
+		if req.EndID > 0 {
+			from = p.messages.search(req.EndID)
+		}
+		if to-from > count {
+			from = to - count
+		}
+	}
+
+	if from >= to {
+		return nil
+	}
+	entries := make([]entry, 0, to-from)
+	for i := from; i < to; i++ {
+		entries = append(entries, *p.messages.at(i))
+	}
+	return entries
+}
@@ -0,0 +1,156 @@
+// Package memorystore is an in-memory implementation of the MessageStore interface.
+// Every partition keeps only a bounded history of its most recent messages.
+package memorystore
+
+import (
+	"sort"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/store"
+)
+
+const (
+	// DefaultMaxMessages is the default maximum number of messages kept per partition.
+	DefaultMaxMessages = 10000
+
+	// DefaultMaxBytes is the default maximum size of the messages kept per partition.
+	DefaultMaxBytes = 10 * 1024 * 1024
+)
+
+// MemoryMessageStore is a struct used by the in-memory implementation of the MessageStore interface.
+// It holds a map of messagePartitions, each of them bounded by a number of messages and of bytes.
+type MemoryMessageStore struct {
+	partitions  map[string]*messagePartition
+	maxMessages int
+	maxBytes    int64
+	mutex       sync.RWMutex
+}
+
+// New returns a new MemoryMessageStore.
+// Each partition keeps at most maxMessages messages and maxBytes bytes of message data;
+// non-positive values are replaced by the defaults.
+func New(maxMessages int, maxBytes int64) *MemoryMessageStore {
+	if maxMessages <= 0 {
+		maxMessages = DefaultMaxMessages
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	return &MemoryMessageStore{
+		partitions:  make(map[string]*messagePartition),
+		maxMessages: maxMessages,
+		maxBytes:    maxBytes,
+	}
+}
+
+// MaxMessageID is a part of the `store.MessageStore` implementation.
+func (ms *MemoryMessageStore) MaxMessageID(partition string) (uint64, error) {
+	return ms.partition(partition).MaxMessageID(), nil
+}
+
+// GenerateNextMsgID is a part of the `store.MessageStore` implementation.
+func (ms *MemoryMessageStore) GenerateNextMsgID(partitionName string, nodeID uint8) (uint64, int64, error) {
+	return ms.partition(partitionName).generateNextMsgID(nodeID)
+}
+
+// StoreMessage is a part of the `store.MessageStore` implementation.
+func (ms *MemoryMessageStore) StoreMessage(message *protocol.Message, nodeID uint8) (int, error) {
+	partitionName := message.Path.Partition()
+
+	// If nodeID is zero means we are running in standalone more, otherwise
+	// if the message has no nodeID it means it was received by this node
+	if nodeID == 0 || message.NodeID == 0 {
+		id, ts, err := ms.GenerateNextMsgID(partitionName, nodeID)
+		if err != nil {
+			logger.WithError(err).Error("Generation of id failed")
+			return 0, err
+		}
+
+		message.ID = id
+		message.Time = ts
+		message.NodeID = nodeID
+	}
+
+	data := message.Bytes()
+	if err := ms.Store(partitionName, message.ID, data); err != nil {
+		return 0, err
+	}
+
+	logger.WithFields(log.Fields{
+		"id":        message.ID,
+		"ts":        message.Time,
+		"partition": partitionName,
+		"nodeID":    nodeID,
+	}).Debug("Stored message")
+
+	return len(data), nil
+}
+
+// Store stores a message within a partition.
+// It is a part of the `store.MessageStore` implementation.
+func (ms *MemoryMessageStore) Store(partition string, msgID uint64, msg []byte) error {
+	return ms.partition(partition).Store(msgID, msg)
+}
+
+// Fetch asynchronously fetches a set of messages defined by the fetch request.
+// It is a part of the `store.MessageStore` implementation.
+func (ms *MemoryMessageStore) Fetch(req *store.FetchRequest) {
+	store.CountFetch(req.Partition)
+	ms.partition(req.Partition).Fetch(req)
+}
+
+// DoInTx is a part of the `store.MessageStore` implementation.
+func (ms *MemoryMessageStore) DoInTx(partition string, fnToExecute func(maxMessageId uint64) error) error {
+	return ms.partition(partition).DoInTx(fnToExecute)
+}
+
+// Partition returns the MessagePartition with the given name, creating it if required.
+// It is a part of the `store.MessageStore` implementation.
+func (ms *MemoryMessageStore) Partition(name string) (store.MessagePartition, error) {
+	return ms.partition(name), nil
+}
+
+// Partitions returns all the partitions, sorted by name.
+// It is a part of the `store.MessageStore` implementation.
+func (ms *MemoryMessageStore) Partitions() ([]store.MessagePartition, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	names := make([]string, 0, len(ms.partitions))
+	for name := range ms.partitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	partitions := make([]store.MessagePartition, 0, len(names))
+	for _, name := range names {
+		partitions = append(partitions, ms.partitions[name])
+	}
+	return partitions, nil
+}
+
+// Check is always successful for the MemoryMessageStore.
+func (ms *MemoryMessageStore) Check() error {
+	return nil
+}
+
+func (ms *MemoryMessageStore) partition(name string) *messagePartition {
+	ms.mutex.RLock()
+	p, exist := ms.partitions[name]
+	ms.mutex.RUnlock()
+	if exist {
+		return p
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if p, exist := ms.partitions[name]; exist {
+		return p
+	}
+	p = newMessagePartition(name, ms.maxMessages, ms.maxBytes)
+	ms.partitions[name] = p
+	return p
+}
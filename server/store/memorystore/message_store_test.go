@@ -0,0 +1,190 @@
+package memorystore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/store"
+	"github.com/smancke/guble/server/store/storetest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MessageStore(t *testing.T) {
+	storetest.TestMessageStore(t, func(t *testing.T) (store.MessageStore, func()) {
+		return New(0, 0), func() {}
+	})
+}
+
+func Test_Fetch(t *testing.T) {
+	a := assert.New(t)
+	mStore := New(0, 0)
+
+	for i := 1; i <= 5; i++ {
+		a.NoError(mStore.Store("p1", uint64(i), []byte(fmt.Sprintf("p1-%d", i))))
+	}
+	a.NoError(mStore.Store("p2", uint64(1), []byte("p2-1")))
+
+	testCases := []struct {
+		description     string
+		req             *store.FetchRequest
+		expectedResults []string
+	}{
+		{`only one message`,
+			&store.FetchRequest{Partition: "p1", StartID: 2, Direction: store.DirectionOneMessage, Count: 1},
+			[]string{"p1-2"},
+		},
+		{`match in partition 2`,
+			&store.FetchRequest{Partition: "p2", StartID: 1, Count: 1},
+			[]string{"p2-1"},
+		},
+		{`forward from the beginning`,
+			&store.FetchRequest{Partition: "p1", StartID: 0, Direction: store.DirectionForward, Count: 2},
+			[]string{"p1-1", "p1-2"},
+		},
+		{`forward, unlimited`,
+			&store.FetchRequest{Partition: "p1", StartID: 3, Direction: store.DirectionForward, Count: -1},
+			[]string{"p1-3", "p1-4", "p1-5"},
+		},
+		{`forward until end id`,
+			&store.FetchRequest{Partition: "p1", StartID: 2, EndID: 3, Direction: store.DirectionForward, Count: 10},
+			[]string{"p1-2", "p1-3"},
+		},
+		{`backwards, returned in ascending order`,
+			&store.FetchRequest{Partition: "p1", StartID: 4, Direction: store.DirectionBackwards, Count: 2},
+			[]string{"p1-3", "p1-4"},
+		},
+		{`backwards from the newest message`,
+			&store.FetchRequest{Partition: "p1", StartID: 0, Direction: store.DirectionBackwards, Count: 2},
+			[]string{"p1-4", "p1-5"},
+		},
+		{`backwards until end id`,
+			&store.FetchRequest{Partition: "p1", StartID: 5, EndID: 4, Direction: store.DirectionBackwards, Count: 10},
+			[]string{"p1-4", "p1-5"},
+		},
+		{`no match`,
+			&store.FetchRequest{Partition: "p2", StartID: 5, Count: 1},
+			[]string{},
+		},
+		{`unknown partition`,
+			&store.FetchRequest{Partition: "p3", StartID: 0, Count: 1},
+			[]string{},
+		},
+	}
+
+	for _, testcase := range testCases {
+		testcase.req.Init()
+		messages := []string{}
+
+		mStore.Fetch(testcase.req)
+
+		select {
+		case numberOfResults := <-testcase.req.StartC:
+			a.Equal(len(testcase.expectedResults), numberOfResults, "Testcase: "+testcase.description)
+		case <-time.After(time.Second):
+			a.Fail("timeout")
+			return
+		}
+
+	loop:
+		for {
+			select {
+			case msg, open := <-testcase.req.MessageC:
+				if !open {
+					break loop
+				}
+				messages = append(messages, string(msg.Message))
+			case err := <-testcase.req.ErrorC:
+				a.Fail(err.Error())
+				break loop
+			case <-time.After(time.Second):
+				a.Fail("timeout")
+				return
+			}
+		}
+		a.Equal(testcase.expectedResults, messages, "Testcase: "+testcase.description)
+	}
+}
+
+func Test_BoundedHistory(t *testing.T) {
+	a := assert.New(t)
+	mStore := New(3, 1000)
+
+	for i := 1; i <= 10; i++ {
+		a.NoError(mStore.Store("p1", uint64(i), []byte("data")))
+	}
+
+	p, err := mStore.Partition("p1")
+	a.NoError(err)
+	a.Equal(uint64(3), p.Count())
+	a.Equal(uint64(10), p.MaxMessageID())
+
+	maxID, err := mStore.MaxMessageID("p1")
+	a.NoError(err)
+	a.Equal(uint64(10), maxID)
+}
+
+func Test_StoreMessage(t *testing.T) {
+	a := assert.New(t)
+	mStore := New(0, 0)
+
+	var lastID uint64
+	for i := 0; i < 10; i++ {
+		msg := &protocol.Message{Path: protocol.Path("/p1/topic"), Body: []byte("body")}
+		size, err := mStore.StoreMessage(msg, 1)
+		a.NoError(err)
+		a.Equal(len(msg.Bytes()), size)
+		a.True(msg.ID > lastID, "Ids should be monotonic")
+		a.Equal(uint8(1), msg.NodeID)
+		lastID = msg.ID
+	}
+
+	maxID, err := mStore.MaxMessageID("p1")
+	a.NoError(err)
+	a.Equal(lastID, maxID)
+}
+
+func Test_Delete(t *testing.T) {
+	a := assert.New(t)
+	mStore := New(0, 0)
+
+	for i := 1; i <= 6; i++ {
+		msg := &protocol.Message{
+			ID:     uint64(i),
+			NodeID: 1,
+			Path:   protocol.Path("/p1/topic"),
+			UserID: fmt.Sprintf("user%d", i%2),
+			Body:   []byte("body"),
+		}
+		_, err := mStore.StoreMessage(msg, 1)
+		a.NoError(err)
+	}
+	p, err := mStore.Partition("p1")
+	a.NoError(err)
+
+	_, err = p.Delete(&store.DeleteRequest{})
+	a.Equal(store.ErrEmptyDeleteRequest, err)
+
+	deleted, err := p.Delete(&store.DeleteRequest{IDs: []uint64{2}})
+	a.NoError(err)
+	a.Equal(1, deleted)
+
+	deleted, err = p.Delete(&store.DeleteRequest{FromID: 4, UserID: "user1"})
+	a.NoError(err)
+	a.Equal(1, deleted)
+
+	a.Equal(uint64(4), p.Count())
+	a.Equal(uint64(6), p.MaxMessageID())
+
+	req := store.NewFetchRequest("p1", 0, 0, store.DirectionForward, -1)
+	req.Init()
+	p.Fetch(req)
+	a.Equal(4, req.Ready())
+	ids := []uint64{}
+	for msg := range req.Messages() {
+		ids = append(ids, msg.ID)
+	}
+	a.Equal([]uint64{1, 3, 4, 6}, ids)
+}
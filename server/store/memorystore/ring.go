@@ -0,0 +1,132 @@
+package memorystore
+
+// entry is a message stored in the ring, together with its ID.
+type entry struct {
+	id   uint64
+	data []byte
+}
+
+// ring is a buffer of entries sorted by ID, bounded by a maximum number of entries and of bytes.
+// When a bound is exceeded, the oldest entries are evicted.
+// The capacity grows on demand, up to the maximum number of entries.
+type ring struct {
+	entries    []entry
+	start      int
+	length     int
+	size       int64
+	maxEntries int
+	maxBytes   int64
+}
+
+func newRing(maxEntries int, maxBytes int64) *ring {
+	return &ring{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+	}
+}
+
+// at returns the entry at the given logical position (0 is the oldest entry).
+func (r *ring) at(i int) *entry {
+	return &r.entries[(r.start+i)%len(r.entries)]
+}
+
+// front returns the oldest entry, or nil if the ring is empty.
+func (r *ring) front() *entry {
+	if r.length == 0 {
+		return nil
+	}
+	return r.at(0)
+}
+
+// back returns the newest entry, or nil if the ring is empty.
+func (r *ring) back() *entry {
+	if r.length == 0 {
+		return nil
+	}
+	return r.at(r.length - 1)
+}
+
+// insert adds the entry keeping the order by ID, and evicts the oldest entries if required.
+// The newest entry is always kept, even if it exceeds the maximum number of bytes.
+func (r *ring) insert(e entry) {
+	if r.length == len(r.entries) {
+		r.grow()
+	}
+
+	// messages are usually stored in ascending order, so start searching from the back
+	pos := r.length
+	for pos > 0 && r.at(pos-1).id > e.id {
+		*r.at(pos) = *r.at(pos - 1)
+		pos--
+	}
+	*r.at(pos) = e
+	r.length++
+	r.size += int64(len(e.data))
+
+	for r.length > 1 && (r.length > r.maxEntries || (r.maxBytes > 0 && r.size > r.maxBytes)) {
+		r.evict()
+	}
+}
+
+func (r *ring) evict() {
+	oldest := r.at(0)
+	r.size -= int64(len(oldest.data))
+	*oldest = entry{}
+	r.start = (r.start + 1) % len(r.entries)
+	r.length--
+}
+
+// grow doubles the capacity (keeping one spare slot for the insertion before eviction).
+func (r *ring) grow() {
+	capacity := 2 * len(r.entries)
+	if capacity == 0 {
+		capacity = 16
+	}
+	if capacity > r.maxEntries+1 {
+		capacity = r.maxEntries + 1
+	}
+	entries := make([]entry, capacity)
+	for i := 0; i < r.length; i++ {
+		entries[i] = *r.at(i)
+	}
+	r.entries = entries
+	r.start = 0
+}
+
+// search returns the position of the first entry with an ID greater or equal to the given id
+// (which is r.length if there is no such entry).
+func (r *ring) search(id uint64) int {
+	low, high := 0, r.length
+	for low < high {
+		mid := (low + high) / 2
+		if r.at(mid).id < id {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+	return low
+}
+
+// removeIf removes all entries for which the predicate returns true, keeping the order of the others.
+// It returns the number of removed entries.
+func (r *ring) removeIf(predicate func(e *entry) bool) int {
+	kept := 0
+	for i := 0; i < r.length; i++ {
+		e := r.at(i)
+		if predicate(e) {
+			r.size -= int64(len(e.data))
+			continue
+		}
+		if kept != i {
+			*r.at(kept) = *e
+		}
+		kept++
+	}
+	for i := kept; i < r.length; i++ {
+		*r.at(i) = entry{}
+	}
+	removed := r.length - kept
+	r.length = kept
+	return removed
+}
@@ -0,0 +1,88 @@
+package memorystore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func ringIDs(r *ring) []uint64 {
+	ids := []uint64{}
+	for i := 0; i < r.length; i++ {
+		ids = append(ids, r.at(i).id)
+	}
+	return ids
+}
+
+func Test_Ring_InsertSortedAndEvictByCount(t *testing.T) {
+	a := assert.New(t)
+	r := newRing(3, 0)
+
+	r.insert(entry{id: 2, data: []byte("b")})
+	r.insert(entry{id: 1, data: []byte("a")})
+	r.insert(entry{id: 4, data: []byte("d")})
+	a.Equal([]uint64{1, 2, 4}, ringIDs(r))
+
+	r.insert(entry{id: 3, data: []byte("c")})
+	a.Equal([]uint64{2, 3, 4}, ringIDs(r))
+
+	for i := uint64(5); i < 100; i++ {
+		r.insert(entry{id: i, data: []byte("x")})
+	}
+	a.Equal([]uint64{97, 98, 99}, ringIDs(r))
+	a.Equal(int64(3), r.size)
+	a.Equal(uint64(97), r.front().id)
+	a.Equal(uint64(99), r.back().id)
+}
+
+func Test_Ring_EvictByBytes(t *testing.T) {
+	a := assert.New(t)
+	r := newRing(100, 10)
+
+	r.insert(entry{id: 1, data: []byte("aaaa")})
+	r.insert(entry{id: 2, data: []byte("bbbb")})
+	a.Equal([]uint64{1, 2}, ringIDs(r))
+
+	r.insert(entry{id: 3, data: []byte("cccc")})
+	a.Equal([]uint64{2, 3}, ringIDs(r))
+	a.Equal(int64(8), r.size)
+
+	// the newest message is kept, even if it is bigger than the limit
+	r.insert(entry{id: 4, data: []byte("dddddddddddddddd")})
+	a.Equal([]uint64{4}, ringIDs(r))
+}
+
+func Test_Ring_Search(t *testing.T) {
+	a := assert.New(t)
+	r := newRing(10, 0)
+	a.Equal(0, r.search(5))
+	a.Nil(r.front())
+	a.Nil(r.back())
+
+	for _, id := range []uint64{2, 4, 6} {
+		r.insert(entry{id: id})
+	}
+	a.Equal(0, r.search(1))
+	a.Equal(0, r.search(2))
+	a.Equal(1, r.search(3))
+	a.Equal(2, r.search(6))
+	a.Equal(3, r.search(7))
+}
+
+func Test_Ring_RemoveIf(t *testing.T) {
+	a := assert.New(t)
+	r := newRing(4, 0)
+	for i := uint64(1); i <= 6; i++ {
+		r.insert(entry{id: i, data: []byte("x")})
+	}
+	a.Equal([]uint64{3, 4, 5, 6}, ringIDs(r))
+
+	removed := r.removeIf(func(e *entry) bool { return e.id%2 == 1 })
+	a.Equal(2, removed)
+	a.Equal([]uint64{4, 6}, ringIDs(r))
+	a.Equal(int64(2), r.size)
+
+	r.insert(entry{id: 7, data: []byte("x")})
+	r.insert(entry{id: 5, data: []byte("x")})
+	a.Equal([]uint64{4, 5, 6, 7}, ringIDs(r))
+}
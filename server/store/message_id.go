@@ -0,0 +1,50 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	gubleNodeIdBits    = 3
+	sequenceBits       = 12
+	gubleNodeIdShift   = sequenceBits
+	timestampLeftShift = sequenceBits + gubleNodeIdBits
+	gubleEpoch         = 1467714505012
+)
+
+// IDGenerator generates message IDs based on the local timestamp, the ID of the cluster node and a local sequence number.
+// The IDs are only increasing as long as the local clock is: they are not guaranteed to be increasing
+// across restarts, or if the clock is set back.
+// It is not safe for concurrent use: the caller has to hold the lock of the partition.
+type IDGenerator struct {
+	sequenceNumber uint64
+}
+
+// Next returns a new message ID for the given node, and the timestamp (in seconds) used for it.
+func (g *IDGenerator) Next(nodeID uint8) (uint64, int64, error) {
+	//Get the local Timestamp
+	currTime := time.Now()
+	// timestamp in Seconds will be return to client
+	timestamp := currTime.Unix()
+
+	//Use the unixNanoTimestamp for generating id
+	nanoTimestamp := currTime.UnixNano()
+
+	if nanoTimestamp < gubleEpoch {
+		err := fmt.Errorf("Clock is moving backwards. Rejecting requests until %d.", timestamp)
+		return 0, 0, err
+	}
+
+	id := (uint64(nanoTimestamp-gubleEpoch) << timestampLeftShift) |
+		(uint64(nodeID) << gubleNodeIdShift) | g.sequenceNumber
+
+	g.sequenceNumber++
+
+	return id, timestamp, nil
+}
+
+// SequenceNumber returns the local sequence number which will be used for the next ID.
+func (g *IDGenerator) SequenceNumber() uint64 {
+	return g.sequenceNumber
+}
@@ -0,0 +1,7 @@
+package migration
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+var logger = log.WithField("module", "migration")
@@ -0,0 +1,179 @@
+// Package migration copies the messages of all the partitions from one MessageStore to another,
+// for example when moving from the file message store to a SQL message store.
+package migration
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/smancke/guble/server/store"
+)
+
+// DefaultBatchSize is the default number of messages fetched from the source store at once.
+const DefaultBatchSize = 1000
+
+// MismatchError is returned when a partition of the target store differs from the source partition
+// after the migration.
+type MismatchError struct {
+	Partition          string
+	SourceCount        uint64
+	TargetCount        uint64
+	SourceMaxMessageID uint64
+	TargetMaxMessageID uint64
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("Partition %s differs after the migration: count %d (target: %d), max message id %d (target: %d)",
+		e.Partition, e.SourceCount, e.TargetCount, e.SourceMaxMessageID, e.TargetMaxMessageID)
+}
+
+// Result describes the migration of a partition.
+type Result struct {
+	Partition    string
+	Copied       int
+	Count        uint64
+	MaxMessageID uint64
+}
+
+// Migrate copies the messages of all the partitions of the source store to the target store,
+// and verifies the count and the max message id of each partition afterwards.
+// The messages are stored with their original ids and data, so the node ids and timestamps are kept.
+//
+// An interrupted migration can be resumed by running it again:
+// the messages are copied in ascending order, so only the messages with an id
+// above the max message id of a target partition are copied.
+//
+// Each batch is fetched starting with the last copied message, which is not copied again:
+// the message ids are not consecutive, and a store may not find the messages following an id
+// which it does not contain (like the file store at the end of a file).
+func Migrate(source, target store.MessageStore, batchSize int) ([]Result, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	partitions, err := source.Partitions()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]Result, 0, len(partitions))
+	for _, sourcePartition := range partitions {
+		targetPartition, err := target.Partition(sourcePartition.Name())
+		if err != nil {
+			return results, err
+		}
+		result, err := MigratePartition(sourcePartition, targetPartition, batchSize)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// MigratePartition copies the messages of the source partition, which are not yet in the target partition,
+// and verifies the partitions afterwards.
+func MigratePartition(source, target store.MessagePartition, batchSize int) (Result, error) {
+	result := Result{Partition: source.Name()}
+	le := logger.WithField("partition", source.Name())
+
+	lastID := target.MaxMessageID()
+	if lastID > 0 {
+		le.WithField("lastID", lastID).Info("Resuming migration of partition")
+	}
+
+	for {
+		copied, batchLastID, err := copyBatch(source, target, lastID, batchSize)
+		result.Copied += copied
+		if err != nil {
+			return result, err
+		}
+		if copied == 0 {
+			break
+		}
+		lastID = batchLastID
+	}
+
+	if err := Verify(source, target); err != nil {
+		return result, err
+	}
+	result.Count = target.Count()
+	result.MaxMessageID = target.MaxMessageID()
+
+	le.WithFields(log.Fields{
+		"copied":       result.Copied,
+		"count":        result.Count,
+		"maxMessageID": result.MaxMessageID,
+	}).Info("Migrated partition")
+	return result, nil
+}
+
+// Verify returns a *MismatchError if the count or the max message id of the partitions differ.
+func Verify(source, target store.MessagePartition) error {
+	e := &MismatchError{
+		Partition:          source.Name(),
+		SourceCount:        source.Count(),
+		TargetCount:        target.Count(),
+		SourceMaxMessageID: source.MaxMessageID(),
+		TargetMaxMessageID: target.MaxMessageID(),
+	}
+	if e.SourceCount != e.TargetCount || e.SourceMaxMessageID != e.TargetMaxMessageID {
+		return e
+	}
+	return nil
+}
+
+// copyBatch fetches up to batchSize messages following the afterID from the source, and stores them in the target.
+// The fetch starts with the afterID itself, so that it is found by all the stores if it exists,
+// and one more message is fetched in place of it.
+// Some stores start fetching at the closest id, if there is no message with the afterID,
+// so all the fetched messages with an id up to the afterID are skipped.
+// It returns the number of copied messages, and the id of the last copied message.
+func copyBatch(source, target store.MessagePartition, afterID uint64, batchSize int) (int, uint64, error) {
+	req := store.NewFetchRequest(source.Name(), afterID, 0, store.DirectionForward, batchSize+1)
+	req.Init()
+	source.Fetch(req)
+
+	select {
+	case <-req.StartC:
+	case err := <-req.Errors():
+		return 0, 0, err
+	}
+
+	copied := 0
+	lastID := afterID
+	for {
+		select {
+		case fm, open := <-req.Messages():
+			if !open {
+				return copied, lastID, nil
+			}
+			if fm.ID <= afterID || copied == batchSize {
+				continue
+			}
+			if err := target.Store(fm.ID, fm.Message); err != nil {
+				go drain(req)
+				return copied, lastID, err
+			}
+			copied++
+			lastID = fm.ID
+		case err := <-req.Errors():
+			return copied, lastID, err
+		}
+	}
+}
+
+// drain consumes the remaining messages of the fetch request, so that the fetching goroutine can finish.
+func drain(req *store.FetchRequest) {
+	for {
+		select {
+		case _, open := <-req.Messages():
+			if !open {
+				return
+			}
+		case <-req.Errors():
+			return
+		}
+	}
+}
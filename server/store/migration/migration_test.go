@@ -0,0 +1,168 @@
+package migration
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/store"
+	"github.com/smancke/guble/server/store/filestore"
+	"github.com/smancke/guble/server/store/memorystore"
+	"github.com/smancke/guble/server/store/sqlstore"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newSourceStore(a *assert.Assertions, dir string, partitions map[string]int) *filestore.FileMessageStore {
+	source := filestore.New(dir)
+	for name, n := range partitions {
+		for i := 0; i < n; i++ {
+			msg := &protocol.Message{
+				Path:   protocol.Path(fmt.Sprintf("/%s/topic", name)),
+				UserID: "marvin",
+				Body:   []byte(fmt.Sprintf("body %d", i)),
+			}
+			_, err := source.StoreMessage(msg, 2)
+			a.NoError(err)
+		}
+	}
+	return source
+}
+
+func fetchAll(a *assert.Assertions, p store.MessagePartition) []*protocol.Message {
+	req := store.NewFetchRequest(p.Name(), 0, 0, store.DirectionForward, -1)
+	req.Init()
+	p.Fetch(req)
+	req.Ready()
+
+	var messages []*protocol.Message
+	for fetched := range req.Messages() {
+		msg, err := protocol.ParseMessage(fetched.Message)
+		a.NoError(err)
+		a.Equal(fetched.ID, msg.ID)
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+func Test_Migrate(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_migration_test")
+	defer os.RemoveAll(dir)
+
+	source := newSourceStore(a, dir, map[string]int{"p1": 7, "p2": 2})
+	defer source.Stop()
+
+	target := sqlstore.NewSqliteMessageStore(path.Join(dir, "message-store.db"))
+	a.NoError(target.Open())
+	defer target.Stop()
+
+	results, err := Migrate(source, target, 3)
+	a.NoError(err)
+	a.Equal(2, len(results))
+
+	copied := map[string]int{}
+	for _, result := range results {
+		copied[result.Partition] = result.Copied
+	}
+	a.Equal(map[string]int{"p1": 7, "p2": 2}, copied)
+
+	for _, name := range []string{"p1", "p2"} {
+		sourcePartition, _ := source.Partition(name)
+		targetPartition, _ := target.Partition(name)
+
+		// ids, node ids and timestamps are kept
+		sourceMessages := fetchAll(a, sourcePartition)
+		targetMessages := fetchAll(a, targetPartition)
+		a.Equal(len(sourceMessages), len(targetMessages))
+		for i, msg := range sourceMessages {
+			a.Equal(msg.ID, targetMessages[i].ID)
+			a.Equal(uint8(2), targetMessages[i].NodeID)
+			a.Equal(msg.Time, targetMessages[i].Time)
+			a.Equal(msg.Body, targetMessages[i].Body)
+		}
+	}
+
+	// running it again does not copy anything
+	results, err = Migrate(source, target, 3)
+	a.NoError(err)
+	for _, result := range results {
+		a.Equal(0, result.Copied)
+	}
+}
+
+func Test_Migrate_Resume(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_migration_test")
+	defer os.RemoveAll(dir)
+
+	source := newSourceStore(a, dir, map[string]int{"p1": 5})
+	defer source.Stop()
+	sourcePartition, _ := source.Partition("p1")
+	messages := fetchAll(a, sourcePartition)
+
+	// an interrupted migration copied the first two messages
+	target := memorystore.New(0, 0)
+	for _, msg := range messages[:2] {
+		a.NoError(target.Store("p1", msg.ID, msg.Bytes()))
+	}
+
+	results, err := Migrate(source, target, 0)
+	a.NoError(err)
+	a.Equal(1, len(results))
+	a.Equal(3, results[0].Copied)
+	a.Equal(uint64(5), results[0].Count)
+	a.Equal(messages[4].ID, results[0].MaxMessageID)
+}
+
+func Test_Migrate_SeveralFiles(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_migration_test")
+	defer os.RemoveAll(dir)
+
+	// the file store holds 10000 messages per file, so the batches end at the end of the files
+	source := newSourceStore(a, dir, map[string]int{"p1": 25000})
+	defer source.Stop()
+	sourcePartition, _ := source.Partition("p1")
+	messages := fetchAll(a, sourcePartition)
+
+	target := memorystore.New(100000, 0)
+	results, err := Migrate(source, target, 1000)
+	a.NoError(err)
+	a.Equal(25000, results[0].Copied)
+
+	// an interrupted migration, which copied the first file, is resumed at the end of the file
+	target = memorystore.New(100000, 0)
+	for _, msg := range messages[:10000] {
+		a.NoError(target.Store("p1", msg.ID, msg.Bytes()))
+	}
+	results, err = Migrate(source, target, 1000)
+	a.NoError(err)
+	a.Equal(15000, results[0].Copied)
+	a.Equal(uint64(25000), results[0].Count)
+	a.Equal(messages[24999].ID, results[0].MaxMessageID)
+}
+
+func Test_Verify(t *testing.T) {
+	a := assert.New(t)
+	source := memorystore.New(0, 0)
+	target := memorystore.New(0, 0)
+
+	a.NoError(source.Store("p1", 1, []byte("a")))
+	a.NoError(source.Store("p1", 2, []byte("b")))
+	a.NoError(target.Store("p1", 2, []byte("b")))
+
+	sourcePartition, _ := source.Partition("p1")
+	targetPartition, _ := target.Partition("p1")
+
+	err := Verify(sourcePartition, targetPartition)
+	a.IsType(&MismatchError{}, err)
+	a.Equal(uint64(2), err.(*MismatchError).SourceCount)
+	a.Equal(uint64(1), err.(*MismatchError).TargetCount)
+
+	a.NoError(target.Store("p1", 1, []byte("a")))
+	a.NoError(Verify(sourcePartition, targetPartition))
+}
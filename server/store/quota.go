@@ -0,0 +1,18 @@
+package store
+
+import "fmt"
+
+// QuotaExceededError is returned when storing a message would exceed the storage quota of its partition.
+type QuotaExceededError struct {
+	Partition string
+
+	// Resource is the limited resource: "bytes" or "messages".
+	Resource string
+
+	// Limit is the maximum amount of the resource the partition may use.
+	Limit int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("Quota of %d %s exceeded for partition %s", e.Limit, e.Resource, e.Partition)
+}
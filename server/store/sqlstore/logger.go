@@ -0,0 +1,7 @@
+package sqlstore
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+var logger = log.WithField("module", "sqlstore")
@@ -0,0 +1,330 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+
+	"github.com/smancke/guble/server/store"
+)
+
+// signBit is flipped when storing message IDs as (signed) BIGINT,
+// so that the order of the stored values is the same as the order of the unsigned IDs.
+const signBit = uint64(1) << 63
+
+func toDBID(id uint64) int64 {
+	return int64(id ^ signBit)
+}
+
+func fromDBID(id int64) uint64 {
+	return uint64(id) ^ signBit
+}
+
+type messagePartition struct {
+	db          *gorm.DB
+	dialect     string
+	name        string
+	table       string
+	idGenerator store.IDGenerator
+
+	sync.RWMutex
+}
+
+func newMessagePartition(db *gorm.DB, dialect, name, table string) *messagePartition {
+	return &messagePartition{
+		db:      db,
+		dialect: dialect,
+		name:    name,
+		table:   table,
+	}
+}
+
+func (p *messagePartition) Name() string {
+	return p.name
+}
+
+func (p *messagePartition) MaxMessageID() uint64 {
+	p.RLock()
+	defer p.RUnlock()
+
+	maxID, err := p.maxMessageID(p.db)
+	if err != nil {
+		logger.WithError(err).WithField("partition", p.name).Error("Error reading max message id")
+	}
+	return maxID
+}
+
+func (p *messagePartition) Count() uint64 {
+	p.RLock()
+	defer p.RUnlock()
+
+	var count uint64
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s", p.table)
+	if err := p.db.Raw(query).Row().Scan(&count); err != nil {
+		logger.WithError(err).WithField("partition", p.name).Error("Error counting messages")
+		return 0
+	}
+	return count
+}
+
+func (p *messagePartition) generateNextMsgID(nodeID uint8) (uint64, int64, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	id, timestamp, err := p.idGenerator.Next(nodeID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	logger.WithFields(log.Fields{
+		"id":                  id,
+		"messagePartition":    p.name,
+		"localSequenceNumber": p.idGenerator.SequenceNumber(),
+		"currentNode":         nodeID,
+	}).Debug("Generated id")
+
+	return id, timestamp, nil
+}
+
+// DoInTx executes the fnToExecute holding the lock of the partition,
+// in this process and (for postgres) as a row lock in the database.
+func (p *messagePartition) DoInTx(fnToExecute func(maxMessageId uint64) error) error {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.inLockedTx(func(tx *gorm.DB) error {
+		maxID, err := p.maxMessageID(tx)
+		if err != nil {
+			return err
+		}
+		return fnToExecute(maxID)
+	})
+}
+
+func (p *messagePartition) Store(msgID uint64, msg []byte) error {
+	p.Lock()
+	defer p.Unlock()
+
+	err := p.inLockedTx(func(tx *gorm.DB) error {
+		query := fmt.Sprintf("INSERT INTO %s (id, data) VALUES (?, ?)", p.table)
+		return tx.Exec(query, toDBID(msgID), msg).Error
+	})
+	if err != nil {
+		return err
+	}
+	store.CountWrite(p.name)
+	return nil
+}
+
+// Size returns the number of bytes of the stored messages.
+// The messages are stored in a table of the database, so no files are reported.
+func (p *messagePartition) Size() (int, int64, error) {
+	p.RLock()
+	defer p.RUnlock()
+
+	var bytes int64
+	query := fmt.Sprintf("SELECT COALESCE(SUM(LENGTH(data)), 0) FROM %s", p.table)
+	if err := p.db.Raw(query).Row().Scan(&bytes); err != nil {
+		return 0, 0, err
+	}
+	return 0, bytes, nil
+}
+
+// Delete removes the messages matching the request from the partition table.
+func (p *messagePartition) Delete(req *store.DeleteRequest) (int, error) {
+	if err := req.Validate(); err != nil {
+		return 0, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	var ids []int64
+	err := p.inLockedTx(func(tx *gorm.DB) error {
+		var err error
+		if ids, err = p.matchingIDs(tx, req); err != nil {
+			return err
+		}
+		query := fmt.Sprintf("DELETE FROM %s WHERE id = ?", p.table)
+		for _, id := range ids {
+			if err := tx.Exec(query, id).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+// matchingIDs returns the (database) IDs of the messages matching the delete request.
+func (p *messagePartition) matchingIDs(tx *gorm.DB, req *store.DeleteRequest) ([]int64, error) {
+	var conditions []string
+	var args []interface{}
+	if req.FromID > 0 {
+		conditions = append(conditions, "id >= ?")
+		args = append(args, toDBID(req.FromID))
+	}
+	if req.ToID > 0 {
+		conditions = append(conditions, "id <= ?")
+		args = append(args, toDBID(req.ToID))
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	rows, err := tx.Raw(fmt.Sprintf("SELECT id, data FROM %s %s", p.table, where), args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		if req.Matches(fromDBID(id), data) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, rows.Err()
+}
+
+// inLockedTx runs fn in a transaction, after locking the row of the partition in the partitions table.
+// The row lock is not available in sqlite, where the database is only used by this process.
+func (p *messagePartition) inLockedTx(fn func(tx *gorm.DB) error) error {
+	tx := p.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if p.dialect == postgresDialect {
+		if err := tx.Exec("SELECT name FROM message_partition_entry WHERE name = ? FOR UPDATE", p.name).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (p *messagePartition) maxMessageID(db *gorm.DB) (uint64, error) {
+	var maxID sql.NullInt64
+	query := fmt.Sprintf("SELECT MAX(id) FROM %s", p.table)
+	if err := db.Raw(query).Row().Scan(&maxID); err != nil {
+		return 0, err
+	}
+	if !maxID.Valid {
+		return 0, nil
+	}
+	return fromDBID(maxID.Int64), nil
+}
+
+// Fetch fetches a set of messages.
+// The messages are always returned in ascending order of their IDs.
+func (p *messagePartition) Fetch(req *store.FetchRequest) {
+	le := logger.WithFields(log.Fields{
+		"partition": req.Partition,
+		"startID":   req.StartID,
+		"endID":     req.EndID,
+		"Count":     req.Count,
+	})
+	le.Debug("Fetching")
+
+	go func() {
+		query, args := p.fetchQuery(req)
+
+		var count int
+		countQuery := fmt.Sprintf("SELECT COUNT(*) FROM (%s) AS f", query)
+		if err := p.db.Raw(countQuery, args...).Row().Scan(&count); err != nil {
+			le.WithError(err).Error("Error counting messages to fetch")
+			req.ErrorC <- err
+			return
+		}
+		req.StartC <- count
+
+		if err := p.fetchRows(query, args, req); err != nil {
+			le.WithError(err).Error("Error fetching messages")
+			req.Error(err)
+			return
+		}
+		req.Done()
+	}()
+}
+
+func (p *messagePartition) fetchRows(query string, args []interface{}, req *store.FetchRequest) error {
+	rows, err := p.db.Raw(fmt.Sprintf("SELECT id, data FROM (%s) AS f ORDER BY id ASC", query), args...).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if req.IsDone() {
+			return store.ErrRequestDone
+		}
+		var id int64
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return err
+		}
+		req.Push(fromDBID(id), data)
+	}
+	return rows.Err()
+}
+
+// fetchQuery returns the query (and its arguments) selecting the messages of the fetch request.
+func (p *messagePartition) fetchQuery(req *store.FetchRequest) (string, []interface{}) {
+	if req.Direction == 0 {
+		req.Direction = store.DirectionForward
+	}
+
+	var conditions []string
+	var args []interface{}
+	order := "ASC"
+
+	if req.Direction == store.DirectionForward {
+		conditions = append(conditions, "id >= ?")
+		args = append(args, toDBID(req.StartID))
+		if req.EndID > 0 {
+			conditions = append(conditions, "id <= ?")
+			args = append(args, toDBID(req.EndID))
+		}
+	} else {
+		order = "DESC"
+		if req.StartID > 0 {
+			conditions = append(conditions, "id <= ?")
+			args = append(args, toDBID(req.StartID))
+		}
+		if req.EndID > 0 {
+			conditions = append(conditions, "id >= ?")
+			args = append(args, toDBID(req.EndID))
+		}
+	}
+
+	limit := req.Count
+	if limit < 0 {
+		limit = math.MaxInt32
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	return fmt.Sprintf("SELECT id, data FROM %s %s ORDER BY id %s LIMIT %d", p.table, where, order, limit), args
+}
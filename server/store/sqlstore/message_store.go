@@ -0,0 +1,324 @@
+// Package sqlstore is a gorm-based (sqlite / postgres) implementation of the MessageStore interface.
+// Every partition is stored in its own table, registered in a common partition table.
+package sqlstore
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+
+	// use gorm's postgres dialect
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	// use this as gorm's sqlite dialect / implementation
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/store"
+)
+
+const (
+	postgresDialect = "postgres"
+	sqliteDialect   = "sqlite3"
+
+	sqliteMaxIdleConns = 2
+	sqliteMaxOpenConns = 5
+	gormLogMode        = false
+
+	partitionTablePrefix = "msg_"
+
+	// maxTableNameLength is the length of the partition name in the table name, so that the table name
+	// with the prefix and the hash fits into the 63 bytes of the postgres identifiers
+	maxTableNameLength = 63 - len(partitionTablePrefix) - 9
+)
+
+var invalidTableChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// messagePartitionEntry registers a partition and the table holding its messages.
+type messagePartitionEntry struct {
+	Name         string `gorm:"primary_key" sql:"type:varchar(200)"`
+	StorageTable string `sql:"type:varchar(250)"`
+}
+
+// SQLMessageStore is a struct used by the SQL-based implementation of the MessageStore interface.
+// It holds the gorm database and a map of the already used message partitions.
+type SQLMessageStore struct {
+	db         *gorm.DB
+	dialect    string
+	source     string
+	partitions map[string]*messagePartition
+	mutex      sync.RWMutex
+	logger     *log.Entry
+}
+
+// NewSqliteMessageStore returns a new SQLMessageStore using a sqlite database file (not opened yet).
+func NewSqliteMessageStore(filename string) *SQLMessageStore {
+	return newSQLMessageStore(sqliteDialect, filename)
+}
+
+// NewPostgresMessageStore returns a new SQLMessageStore using a Postgresql database (not opened yet).
+func NewPostgresMessageStore(config kvstore.PostgresConfig) *SQLMessageStore {
+	return newSQLMessageStore(postgresDialect, config.ConnectionString())
+}
+
+func newSQLMessageStore(dialect, source string) *SQLMessageStore {
+	return &SQLMessageStore{
+		dialect:    dialect,
+		source:     source,
+		partitions: make(map[string]*messagePartition),
+		logger:     logger.WithField("dialect", dialect),
+	}
+}
+
+// Open opens the database and ensures the schema of the partition table.
+func (ms *SQLMessageStore) Open() error {
+	ms.logger.Info("Opening database")
+
+	if ms.dialect == sqliteDialect {
+		if err := os.MkdirAll(filepath.Dir(ms.source), 0755); err != nil {
+			ms.logger.WithError(err).Error("Error creating directory of database")
+			return err
+		}
+	}
+
+	gormdb, err := gorm.Open(ms.dialect, ms.source)
+	if err != nil {
+		ms.logger.WithError(err).Error("Error opening database")
+		return err
+	}
+
+	if err := gormdb.DB().Ping(); err != nil {
+		ms.logger.WithError(err).Error("Error pinging database")
+		return err
+	}
+	ms.logger.Info("Ping reply from database")
+
+	gormdb.LogMode(gormLogMode)
+	gormdb.SingularTable(true)
+
+	if ms.dialect == sqliteDialect {
+		gormdb.DB().SetMaxIdleConns(sqliteMaxIdleConns)
+		gormdb.DB().SetMaxOpenConns(sqliteMaxOpenConns)
+
+		// WAL allows the reads of a running DoInTx, while other connections are writing
+		if err := gormdb.Exec("PRAGMA journal_mode = WAL").Error; err != nil {
+			ms.logger.WithError(err).Error("Error setting PRAGMA journal_mode = WAL")
+			return err
+		}
+	}
+
+	if err := gormdb.AutoMigrate(&messagePartitionEntry{}).Error; err != nil {
+		ms.logger.WithError(err).Error("Error in schema migration")
+		return err
+	}
+	ms.logger.Info("Ensured database schema")
+
+	ms.db = gormdb
+	return nil
+}
+
+// Stop the SQLMessageStore, closing the database.
+// Implements the service.stopable interface.
+func (ms *SQLMessageStore) Stop() error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.logger.Info("Stopping")
+	ms.partitions = make(map[string]*messagePartition)
+	if ms.db != nil {
+		err := ms.db.Close()
+		ms.db = nil
+		return err
+	}
+	return nil
+}
+
+// Check returns an error if the database is not available.
+func (ms *SQLMessageStore) Check() error {
+	if ms.db == nil {
+		errorMessage := "Error: Database is not initialized (nil)"
+		ms.logger.Error(errorMessage)
+		return errors.New(errorMessage)
+	}
+	if err := ms.db.DB().Ping(); err != nil {
+		ms.logger.WithError(err).Error("Error pinging database")
+		return err
+	}
+	return nil
+}
+
+// MaxMessageID is a part of the `store.MessageStore` implementation.
+func (ms *SQLMessageStore) MaxMessageID(partition string) (uint64, error) {
+	p, err := ms.partition(partition)
+	if err != nil {
+		return 0, err
+	}
+	return p.maxMessageID(ms.db)
+}
+
+// GenerateNextMsgID is a part of the `store.MessageStore` implementation.
+func (ms *SQLMessageStore) GenerateNextMsgID(partitionName string, nodeID uint8) (uint64, int64, error) {
+	p, err := ms.partition(partitionName)
+	if err != nil {
+		return 0, 0, err
+	}
+	return p.generateNextMsgID(nodeID)
+}
+
+// StoreMessage is a part of the `store.MessageStore` implementation.
+func (ms *SQLMessageStore) StoreMessage(message *protocol.Message, nodeID uint8) (int, error) {
+	partitionName := message.Path.Partition()
+
+	// If nodeID is zero means we are running in standalone more, otherwise
+	// if the message has no nodeID it means it was received by this node
+	if nodeID == 0 || message.NodeID == 0 {
+		id, ts, err := ms.GenerateNextMsgID(partitionName, nodeID)
+		if err != nil {
+			ms.logger.WithError(err).Error("Generation of id failed")
+			return 0, err
+		}
+
+		message.ID = id
+		message.Time = ts
+		message.NodeID = nodeID
+	}
+
+	data := message.Bytes()
+	if err := ms.Store(partitionName, message.ID, data); err != nil {
+		ms.logger.WithError(err).WithField("partition", partitionName).Error("Error storing message in partition")
+		return 0, err
+	}
+
+	ms.logger.WithFields(log.Fields{
+		"id":        message.ID,
+		"ts":        message.Time,
+		"partition": partitionName,
+		"nodeID":    nodeID,
+	}).Debug("Stored message")
+
+	return len(data), nil
+}
+
+// Store stores a message within a partition.
+// It is a part of the `store.MessageStore` implementation.
+func (ms *SQLMessageStore) Store(partition string, msgID uint64, msg []byte) error {
+	p, err := ms.partition(partition)
+	if err != nil {
+		return err
+	}
+	return p.Store(msgID, msg)
+}
+
+// Fetch asynchronously fetches a set of messages defined by the fetch request.
+// It is a part of the `store.MessageStore` implementation.
+func (ms *SQLMessageStore) Fetch(req *store.FetchRequest) {
+	p, err := ms.partition(req.Partition)
+	if err != nil {
+		req.ErrorC <- err
+		return
+	}
+	store.CountFetch(req.Partition)
+	p.Fetch(req)
+}
+
+// DoInTx is a part of the `store.MessageStore` implementation.
+// The partition row is locked in the database for the duration of the fnToExecute,
+// so that no other node can store messages in the partition.
+func (ms *SQLMessageStore) DoInTx(partition string, fnToExecute func(maxMessageId uint64) error) error {
+	p, err := ms.partition(partition)
+	if err != nil {
+		return err
+	}
+	return p.DoInTx(fnToExecute)
+}
+
+// Partition returns the MessagePartition with the given name, creating its table if required.
+// It is a part of the `store.MessageStore` implementation.
+func (ms *SQLMessageStore) Partition(name string) (store.MessagePartition, error) {
+	return ms.partition(name)
+}
+
+// Partitions returns all the partitions registered in the database.
+// It is a part of the `store.MessageStore` implementation.
+func (ms *SQLMessageStore) Partitions() (partitions []store.MessagePartition, err error) {
+	if ms.db == nil {
+		return nil, errors.New("sqlstore: database is not opened")
+	}
+	var entries []messagePartitionEntry
+	if err := ms.db.Order("name").Find(&entries).Error; err != nil {
+		ms.logger.WithError(err).Error("Error reading partitions")
+		return nil, err
+	}
+	for _, entry := range entries {
+		p, err := ms.partition(entry.Name)
+		if err != nil {
+			continue
+		}
+		partitions = append(partitions, p)
+	}
+	return
+}
+
+func (ms *SQLMessageStore) partition(name string) (*messagePartition, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if p, exist := ms.partitions[name]; exist {
+		return p, nil
+	}
+	if ms.db == nil {
+		return nil, errors.New("sqlstore: database is not opened")
+	}
+
+	entry := messagePartitionEntry{Name: name, StorageTable: tableName(name)}
+	if err := ms.ensurePartition(&entry); err != nil {
+		ms.logger.WithError(err).WithField("partition", name).Error("Error creating partition")
+		return nil, err
+	}
+
+	p := newMessagePartition(ms.db, ms.dialect, entry.Name, entry.StorageTable)
+	ms.partitions[name] = p
+	return p, nil
+}
+
+// ensurePartition registers the partition (if not already done by this or another node)
+// and creates its table.
+func (ms *SQLMessageStore) ensurePartition(entry *messagePartitionEntry) error {
+	blobType := "bytea"
+	if ms.dialect == sqliteDialect {
+		blobType = "blob"
+	}
+	// a registered partition keeps its table, also if it was named differently
+	if err := ms.db.FirstOrCreate(entry, messagePartitionEntry{Name: entry.Name}).Error; err != nil {
+		// another node may have registered the partition concurrently
+		if err := ms.db.First(entry, "name = ?", entry.Name).Error; err != nil {
+			return err
+		}
+	}
+
+	createTable := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id BIGINT PRIMARY KEY, data %s NOT NULL)",
+		entry.StorageTable, blobType)
+	return ms.db.Exec(createTable).Error
+}
+
+// tableName returns a valid table name for a partition: the lowercased name without the characters which
+// are not allowed, shortened to fit into the 63 bytes of postgres, and a hash of the name.
+// The hash is always appended, since the table names are case-insensitive, so that different partitions
+// (like "Foo" and "foo") are not mapped to the same table.
+func tableName(partition string) string {
+	sanitized := strings.ToLower(invalidTableChars.ReplaceAllString(partition, "_"))
+	if len(sanitized) > maxTableNameLength {
+		sanitized = sanitized[:maxTableNameLength]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(partition))
+	return fmt.Sprintf("%s%s_%08x", partitionTablePrefix, sanitized, h.Sum32())
+}
@@ -0,0 +1,144 @@
+package sqlstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/smancke/guble/server/store"
+	"github.com/smancke/guble/server/store/storetest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MessageStore(t *testing.T) {
+	storetest.TestMessageStore(t, func(t *testing.T) (store.MessageStore, func()) {
+		return newTestStore(assert.New(t))
+	})
+}
+
+func newTestStore(a *assert.Assertions) (*SQLMessageStore, func()) {
+	dir, _ := ioutil.TempDir("", "guble_sql_message_store_test")
+	mStore := NewSqliteMessageStore(path.Join(dir, "message-store.db"))
+	a.NoError(mStore.Open())
+	return mStore, func() {
+		mStore.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_StoreDuplicateID(t *testing.T) {
+	a := assert.New(t)
+	mStore, cleanup := newTestStore(a)
+	defer cleanup()
+
+	a.NoError(mStore.Store("p1", uint64(1), []byte("aaaaaaaaaa")))
+	a.Error(mStore.Store("p1", uint64(1), []byte("bbbbbbbbbb")))
+}
+
+func Test_ErrorsWhenNotOpened(t *testing.T) {
+	a := assert.New(t)
+	mStore := NewSqliteMessageStore("/tmp/not-opened.db")
+
+	a.Error(mStore.Store("p1", uint64(1), []byte("124151qfas")))
+	a.Error(mStore.DoInTx("p1", nil))
+	_, err := mStore.MaxMessageID("p1")
+	a.Error(err)
+	a.Error(mStore.Check())
+
+	chanCallBack := make(chan error, 1)
+	aFetchRequest := store.FetchRequest{Partition: "p1", StartID: 2, Count: 1, ErrorC: chanCallBack}
+	mStore.Fetch(&aFetchRequest)
+	a.NotNil(<-aFetchRequest.ErrorC)
+}
+
+func Test_Partitions(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_sql_message_store_test")
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "message-store.db")
+
+	mStore := NewSqliteMessageStore(filename)
+	a.NoError(mStore.Open())
+	a.NoError(mStore.Store("p1", uint64(2), []byte("test message data")))
+	a.NoError(mStore.Store("p2", uint64(2), []byte("test message data")))
+	a.NoError(mStore.Store("p3/with.special-chars", uint64(2), []byte("test message data")))
+	a.NoError(mStore.Check())
+	a.NoError(mStore.Stop())
+
+	// the partitions are found after reopening the store
+	mStore2 := NewSqliteMessageStore(filename)
+	a.NoError(mStore2.Open())
+	defer mStore2.Stop()
+
+	partitions, err := mStore2.Partitions()
+	a.NoError(err)
+	a.Equal(3, len(partitions))
+	a.Equal("p1", partitions[0].Name())
+	a.Equal("p2", partitions[1].Name())
+	a.Equal("p3/with.special-chars", partitions[2].Name())
+	a.Equal(uint64(2), partitions[2].MaxMessageID())
+	a.Equal(uint64(1), partitions[2].Count())
+}
+
+func Test_tableName(t *testing.T) {
+	a := assert.New(t)
+	a.True(strings.HasPrefix(tableName("p1"), "msg_p1_"))
+	a.NotEqual(tableName("a-b"), tableName("a.b"))
+
+	// the table names are case-insensitive
+	a.Equal(strings.ToLower(tableName("Foo")), tableName("Foo"))
+	a.NotEqual(tableName("Foo"), tableName("foo"))
+
+	// postgres truncates the names after 63 bytes
+	long := strings.Repeat("x", 100)
+	a.Equal(63, len(tableName(long+"1")))
+	a.NotEqual(tableName(long+"1"), tableName(long+"2"))
+}
+
+func Test_RegisteredPartitionKeepsTable(t *testing.T) {
+	a := assert.New(t)
+	mStore, cleanup := newTestStore(a)
+	defer cleanup()
+
+	// a partition registered with the table name of an older version
+	a.NoError(mStore.db.Create(&messagePartitionEntry{Name: "p1", StorageTable: "msg_p1"}).Error)
+	a.NoError(mStore.Store("p1", uint64(1), []byte("aaaaaaaaaa")))
+
+	var count int
+	a.NoError(mStore.db.Table("msg_p1").Count(&count).Error)
+	a.Equal(1, count)
+	a.False(mStore.db.HasTable(tableName("p1")))
+}
+
+func Test_DBIDOrdering(t *testing.T) {
+	a := assert.New(t)
+	ids := []uint64{0, 1, 1 << 62, 1<<63 - 1, 1 << 63, 1<<64 - 1}
+	for i := 0; i < len(ids)-1; i++ {
+		a.True(toDBID(ids[i]) < toDBID(ids[i+1]))
+		a.Equal(ids[i], fromDBID(toDBID(ids[i])))
+	}
+}
+
+func Test_Size(t *testing.T) {
+	a := assert.New(t)
+	mStore, cleanup := newTestStore(a)
+	defer cleanup()
+
+	a.NoError(mStore.Store("p1", uint64(1), []byte("aaaaaaaaaa")))
+	a.NoError(mStore.Store("p1", uint64(2), []byte("bbbbb")))
+	p, err := mStore.Partition("p1")
+	a.NoError(err)
+
+	files, bytes, err := p.Size()
+	a.NoError(err)
+	a.Equal(0, files)
+	a.Equal(int64(15), bytes)
+
+	stats, err := store.Stats(p)
+	a.NoError(err)
+	a.Equal(uint64(2), stats.Count)
+	a.Equal(int64(15), stats.Bytes)
+}
@@ -0,0 +1,235 @@
+package store
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/metrics"
+)
+
+// ErrMessageNotFound is returned when a message with the requested ID is not stored in a partition.
+var ErrMessageNotFound = errors.New("Message not found")
+
+// rateInterval is the minimal interval over which the write and fetch rates are calculated.
+var rateInterval = time.Minute
+
+var (
+	mPartitionWrites  = metrics.NewMap("store.partition_writes")
+	mPartitionFetches = metrics.NewMap("store.partition_fetches")
+	mPartitionStats   = metrics.NewMap("store.partition_stats")
+
+	writes  = newActivity()
+	fetches = newActivity()
+)
+
+// PartitionStats describes the messages stored in a partition.
+type PartitionStats struct {
+	Name string `json:"name"`
+
+	// Files and Bytes is the storage used by the partition.
+	// Stores which do not use files per partition report 0 files.
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+
+	Count uint64 `json:"count"`
+
+	// The IDs and the publishing times (unix timestamp) of the oldest and the newest stored message.
+	OldestID   uint64 `json:"oldestId"`
+	OldestTime int64  `json:"oldestTime"`
+	NewestID   uint64 `json:"newestId"`
+	NewestTime int64  `json:"newestTime"`
+
+	// WriteRate and FetchRate are the stored messages and the fetch requests per second,
+	// over the last minute.
+	WriteRate float64 `json:"writeRate"`
+	FetchRate float64 `json:"fetchRate"`
+}
+
+// CountWrite records a message stored in the partition, for the metrics and the write rate.
+func CountWrite(partition string) {
+	mPartitionWrites.Add(partition, 1)
+	writes.add(partition, time.Now())
+}
+
+// CountFetch records a fetch request for the partition, for the metrics and the fetch rate.
+func CountFetch(partition string) {
+	mPartitionFetches.Add(partition, 1)
+	fetches.add(partition, time.Now())
+}
+
+// PublishStats publishes the statistics of all the partitions of the message store in the metrics.
+// The statistics are calculated when the metrics are read.
+func PublishStats(ms MessageStore) {
+	mPartitionStats.Set("partitions", expvar.Func(func() interface{} {
+		stats, err := AllStats(ms)
+		if err != nil {
+			log.WithField("module", "store").WithError(err).Error("Error calculating the partition statistics")
+		}
+		return stats
+	}))
+}
+
+// AllStats returns the statistics of all the partitions of the message store.
+func AllStats(ms MessageStore) ([]*PartitionStats, error) {
+	partitions, err := ms.Partitions()
+	if err != nil {
+		return nil, err
+	}
+
+	all := make([]*PartitionStats, 0, len(partitions))
+	for _, p := range partitions {
+		stats, err := Stats(p)
+		if err != nil {
+			return all, err
+		}
+		all = append(all, stats)
+	}
+	return all, nil
+}
+
+// Stats returns the statistics of the partition.
+func Stats(p MessagePartition) (*PartitionStats, error) {
+	files, bytes, err := p.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	stats := &PartitionStats{
+		Name:      p.Name(),
+		Files:     files,
+		Bytes:     bytes,
+		Count:     p.Count(),
+		WriteRate: writes.rate(p.Name(), now),
+		FetchRate: fetches.rate(p.Name(), now),
+	}
+	if stats.Count == 0 {
+		return stats, nil
+	}
+
+	oldest, err := fetch(p, 0, DirectionForward)
+	if err != nil {
+		return nil, err
+	}
+	newest, err := fetch(p, p.MaxMessageID(), DirectionBackwards)
+	if err != nil {
+		return nil, err
+	}
+	stats.OldestID, stats.OldestTime = idAndTime(oldest)
+	stats.NewestID, stats.NewestTime = idAndTime(newest)
+	return stats, nil
+}
+
+// FetchMessage returns the data of the message with the ID,
+// or ErrMessageNotFound if the partition does not contain it.
+func FetchMessage(p MessagePartition, id uint64) ([]byte, error) {
+	fetched, err := fetch(p, id, DirectionForward)
+	if err != nil {
+		return nil, err
+	}
+	if fetched == nil || fetched.ID != id {
+		return nil, ErrMessageNotFound
+	}
+	return fetched.Message, nil
+}
+
+// idAndTime returns the id and the publishing time of the fetched message.
+// The time is 0 if the data is not a guble message.
+func idAndTime(fetched *FetchedMessage) (uint64, int64) {
+	if fetched == nil {
+		return 0, 0
+	}
+	msg, err := protocol.ParseMessage(fetched.Message)
+	if err != nil {
+		return fetched.ID, 0
+	}
+	return fetched.ID, msg.Time
+}
+
+// fetch returns the first message fetched in the direction, starting with the startID,
+// or nil if there is none.
+func fetch(p MessagePartition, startID uint64, direction FetchDirection) (*FetchedMessage, error) {
+	req := NewFetchRequest(p.Name(), startID, 0, direction, 1)
+	req.Init()
+	p.Fetch(req)
+
+	select {
+	case <-req.StartC:
+	case err := <-req.Errors():
+		return nil, err
+	}
+
+	var fetched *FetchedMessage
+	for {
+		select {
+		case fm, open := <-req.Messages():
+			if !open {
+				return fetched, nil
+			}
+			if fetched == nil {
+				fetched = fm
+			}
+		case err := <-req.Errors():
+			return nil, err
+		}
+	}
+}
+
+// activity counts events per partition, and calculates their rate per second.
+type activity struct {
+	sync.Mutex
+	counters map[string]*rateCounter
+}
+
+// rateCounter calculates the rate over the last interval which lasted at least the rateInterval.
+type rateCounter struct {
+	total         uint64
+	intervalStart time.Time
+	intervalTotal uint64
+	lastRate      float64
+}
+
+func newActivity() *activity {
+	return &activity{counters: make(map[string]*rateCounter)}
+}
+
+func (a *activity) add(partition string, now time.Time) {
+	a.Lock()
+	defer a.Unlock()
+
+	c, exists := a.counters[partition]
+	if !exists {
+		c = &rateCounter{intervalStart: now}
+		a.counters[partition] = c
+	}
+	c.roll(now)
+	c.total++
+}
+
+func (a *activity) rate(partition string, now time.Time) float64 {
+	a.Lock()
+	defer a.Unlock()
+
+	c, exists := a.counters[partition]
+	if !exists {
+		return 0
+	}
+	c.roll(now)
+	return c.lastRate
+}
+
+// roll completes the current interval, if it lasted at least the rateInterval.
+func (c *rateCounter) roll(now time.Time) {
+	elapsed := now.Sub(c.intervalStart)
+	if elapsed < rateInterval {
+		return
+	}
+	c.lastRate = float64(c.total-c.intervalTotal) / elapsed.Seconds()
+	c.intervalStart = now
+	c.intervalTotal = c.total
+}
@@ -0,0 +1,29 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_activity_rate(t *testing.T) {
+	a := assert.New(t)
+	start := time.Now()
+	activity := newActivity()
+
+	a.Equal(float64(0), activity.rate("p1", start))
+
+	for i := 0; i < 120; i++ {
+		activity.add("p1", start.Add(time.Duration(i)*100*time.Millisecond))
+	}
+	// the first interval is not completed yet
+	a.Equal(float64(0), activity.rate("p1", start.Add(30*time.Second)))
+
+	// 120 events in 60 seconds
+	a.Equal(float64(2), activity.rate("p1", start.Add(rateInterval)))
+	a.Equal(float64(0), activity.rate("p2", start.Add(rateInterval)))
+
+	// no events in the next interval
+	a.Equal(float64(0), activity.rate("p1", start.Add(2*rateInterval)))
+}
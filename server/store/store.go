@@ -29,7 +29,7 @@ type MessageStore interface {
 	// The error result if the fnToExecute or an error while locking will be returned by DoInTx.
 	DoInTx(partition string, fnToExecute func(uint64) error) error
 
-	// GenerateNextMsgId generates a new message ID based on a timestamp in a strictly monotonically order
+	// GenerateNextMsgId generates a new message ID based on the local timestamp, see IDGenerator
 	GenerateNextMsgID(partition string, nodeID uint8) (uint64, int64, error)
 
 	Partition(string) (MessagePartition, error)
@@ -53,4 +53,14 @@ type MessagePartition interface {
 	Fetch(req *FetchRequest)
 
 	DoInTx(func(uint64) error) error
+
+	// Delete removes the messages matching the request from the partition,
+	// and returns the number of deleted messages.
+	// Deleted messages are not returned by Fetch anymore,
+	// even if a store removes their data from disk only later.
+	Delete(req *DeleteRequest) (int, error)
+
+	// Size returns the number of files and of bytes used for storing the partition.
+	// Stores which do not use files per partition return 0 files.
+	Size() (int, int64, error)
 }
@@ -0,0 +1,234 @@
+// Package storetest is a conformance suite for the implementations of store.MessageStore,
+// so that the backends behave the same.
+package storetest
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/store"
+
+	"github.com/stretchr/testify/assert"
+
+	"fmt"
+	"testing"
+	"time"
+)
+
+// NewStore returns a new empty MessageStore, and a func cleaning it up after the test.
+type NewStore func(t *testing.T) (store.MessageStore, func())
+
+// TestMessageStore runs the conformance tests against the MessageStores created by newStore.
+func TestMessageStore(t *testing.T, newStore NewStore) {
+	tests := []struct {
+		name string
+		test func(*testing.T, store.MessageStore)
+	}{
+		{"Fetch", testFetch},
+		{"MaxMessageID", testMaxMessageID},
+		{"StoreMessage", testStoreMessage},
+		{"DoInTx", testDoInTx},
+		{"Partitions", testPartitions},
+		{"Delete", testDelete},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, cleanup := newStore(t)
+			defer cleanup()
+			tc.test(t, s)
+		})
+	}
+}
+
+func testFetch(t *testing.T, s store.MessageStore) {
+	a := assert.New(t)
+	a.NoError(s.Store("p1", uint64(1), []byte("aaaaaaaaaa")))
+	a.NoError(s.Store("p1", uint64(2), []byte("bbbbbbbbbb")))
+	a.NoError(s.Store("p1", uint64(3), []byte("cccccccccc")))
+	a.NoError(s.Store("p2", uint64(1), []byte("1111111111")))
+	a.NoError(s.Store("p2", uint64(2), []byte("2222222222")))
+
+	testCases := []struct {
+		description     string
+		req             *store.FetchRequest
+		expectedResults []string
+	}{
+		{`match in partition 1`,
+			&store.FetchRequest{Partition: "p1", StartID: 2, Count: 1},
+			[]string{"bbbbbbbbbb"},
+		},
+		{`match in partition 2`,
+			&store.FetchRequest{Partition: "p2", StartID: 2, Count: 1},
+			[]string{"2222222222"},
+		},
+		{`forward from the beginning`,
+			&store.FetchRequest{Partition: "p1", StartID: 0, Direction: store.DirectionForward, Count: 2},
+			[]string{"aaaaaaaaaa", "bbbbbbbbbb"},
+		},
+		{`forward until end id`,
+			&store.FetchRequest{Partition: "p1", StartID: 2, EndID: 2, Direction: store.DirectionForward, Count: 10},
+			[]string{"bbbbbbbbbb"},
+		},
+		{`backwards, returned in ascending order`,
+			&store.FetchRequest{Partition: "p1", StartID: 3, Direction: store.DirectionBackwards, Count: 2},
+			[]string{"bbbbbbbbbb", "cccccccccc"},
+		},
+		{`no match`,
+			&store.FetchRequest{Partition: "p2", StartID: 5, Count: 1},
+			[]string{},
+		},
+	}
+
+	for _, testcase := range testCases {
+		a.Equal(testcase.expectedResults, fetch(a, s, testcase.req), "Testcase: "+testcase.description)
+	}
+}
+
+// fetch returns the bodies of the messages fetched by the request,
+// and asserts that their number was announced on the StartC.
+func fetch(a *assert.Assertions, s store.MessageStore, req *store.FetchRequest) []string {
+	req.MessageC = make(chan *store.FetchedMessage)
+	req.ErrorC = make(chan error)
+	req.StartC = make(chan int)
+
+	messages := []string{}
+	s.Fetch(req)
+
+	var announced int
+	defer func() {
+		a.Equal(len(messages), announced, "the number of messages announced on the StartC")
+	}()
+
+	select {
+	case announced = <-req.StartC:
+	case err := <-req.ErrorC:
+		a.Fail(err.Error())
+		return messages
+	case <-time.After(time.Second):
+		a.Fail("timeout")
+		return messages
+	}
+
+	for {
+		select {
+		case msg, open := <-req.MessageC:
+			if !open {
+				return messages
+			}
+			messages = append(messages, string(msg.Message))
+		case err := <-req.ErrorC:
+			a.Fail(err.Error())
+			return messages
+		case <-time.After(time.Second):
+			a.Fail("timeout")
+			return messages
+		}
+	}
+}
+
+func testMaxMessageID(t *testing.T, s store.MessageStore) {
+	a := assert.New(t)
+
+	maxID, err := s.MaxMessageID("p1")
+	a.NoError(err)
+	a.Equal(uint64(0), maxID)
+
+	a.NoError(s.Store("p1", uint64(1), []byte("aaaaaaaaaa")))
+	a.NoError(s.Store("p1", uint64(2), []byte("bbbbbbbbbb")))
+
+	maxID, err = s.MaxMessageID("p1")
+	a.NoError(err)
+	a.Equal(uint64(2), maxID)
+}
+
+func testStoreMessage(t *testing.T, s store.MessageStore) {
+	a := assert.New(t)
+
+	var lastID uint64
+	for i := 0; i < 10; i++ {
+		msg := &protocol.Message{Path: protocol.Path("/p1/topic"), Body: []byte("body")}
+		size, err := s.StoreMessage(msg, 1)
+		a.NoError(err)
+		a.True(size > 0)
+		a.True(msg.ID > lastID, "the ids of a running store are increasing")
+		a.Equal(uint8(1), msg.NodeID)
+		lastID = msg.ID
+	}
+
+	maxID, err := s.MaxMessageID("p1")
+	a.NoError(err)
+	a.Equal(lastID, maxID)
+
+	p, err := s.Partition("p1")
+	a.NoError(err)
+	a.Equal(uint64(10), p.Count())
+}
+
+func testDoInTx(t *testing.T, s store.MessageStore) {
+	a := assert.New(t)
+	a.NoError(s.Store("p1", uint64(1), []byte("aaaaaaaaaa")))
+
+	err := s.DoInTx("p1", func(maxID uint64) error {
+		a.Equal(uint64(1), maxID)
+		return nil
+	})
+	a.NoError(err)
+
+	expectedErr := fmt.Errorf("expected")
+	a.Equal(expectedErr, s.DoInTx("p1", func(maxID uint64) error {
+		return expectedErr
+	}))
+}
+
+func testPartitions(t *testing.T, s store.MessageStore) {
+	a := assert.New(t)
+	a.NoError(s.Store("p2", uint64(1), []byte("data")))
+	a.NoError(s.Store("p1", uint64(1), []byte("data")))
+	a.NoError(s.Store("p1", uint64(2), []byte("data")))
+
+	partitions, err := s.Partitions()
+	a.NoError(err)
+	if a.Equal(2, len(partitions)) {
+		a.Equal("p1", partitions[0].Name())
+		a.Equal(uint64(2), partitions[0].Count())
+		a.Equal(uint64(2), partitions[0].MaxMessageID())
+		a.Equal("p2", partitions[1].Name())
+		a.Equal(uint64(1), partitions[1].Count())
+	}
+}
+
+func testDelete(t *testing.T, s store.MessageStore) {
+	a := assert.New(t)
+	for i := 1; i <= 6; i++ {
+		msg := &protocol.Message{
+			ID:      uint64(i),
+			Path:    protocol.Path("/p1/topic"),
+			UserID:  fmt.Sprintf("user%d", i%2),
+			Filters: map[string]string{"device_id": fmt.Sprintf("device%d", i%3)},
+			Body:    []byte(fmt.Sprintf("body%d", i)),
+		}
+		a.NoError(s.Store("p1", msg.ID, msg.Bytes()))
+	}
+	p, err := s.Partition("p1")
+	a.NoError(err)
+
+	_, err = p.Delete(&store.DeleteRequest{})
+	a.Equal(store.ErrEmptyDeleteRequest, err)
+
+	deleted, err := p.Delete(&store.DeleteRequest{IDs: []uint64{1, 2}})
+	a.NoError(err)
+	a.Equal(2, deleted)
+
+	deleted, err = p.Delete(&store.DeleteRequest{FromID: 3, UserID: "user1", Filters: map[string]string{"device_id": "device0"}})
+	a.NoError(err)
+	a.Equal(1, deleted)
+
+	a.Equal(uint64(3), p.Count())
+	a.Equal(uint64(6), p.MaxMessageID())
+
+	var ids []uint64
+	for _, data := range fetch(a, s, &store.FetchRequest{Partition: "p1", Direction: store.DirectionForward, Count: 10}) {
+		msg, err := protocol.ParseMessage([]byte(data))
+		a.NoError(err)
+		ids = append(ids, msg.ID)
+	}
+	a.Equal([]uint64{4, 5, 6}, ids)
+}
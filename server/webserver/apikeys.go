@@ -0,0 +1,151 @@
+package webserver
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/smancke/guble/server/scope"
+)
+
+// APIKeys are the API keys authenticating the requests on the protected endpoints, with their scopes.
+type APIKeys struct {
+	keys []apiKey
+}
+
+type apiKey struct {
+	key    []byte
+	scopes map[scope.Scope]bool
+}
+
+// ParseAPIKeys parses API keys in the format `<scope>:<key>`, separated by commas or newlines.
+// A key with several scopes is given once per scope. Empty lines and lines starting with # are ignored.
+func ParseAPIKeys(s string) (*APIKeys, error) {
+	byKey := make(map[string]map[scope.Scope]bool)
+	var order []string
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, errors.New("Invalid API key, expected format <scope>:<key>")
+		}
+		keyScope := scope.Scope(strings.TrimSpace(parts[0]))
+		if !keyScope.Valid() {
+			return nil, fmt.Errorf("Invalid API key scope %q", keyScope)
+		}
+		key := strings.TrimSpace(parts[1])
+		if _, exists := byKey[key]; !exists {
+			byKey[key] = make(map[scope.Scope]bool)
+			order = append(order, key)
+		}
+		byKey[key][keyScope] = true
+	}
+	if len(order) == 0 {
+		return nil, errors.New("No API key given")
+	}
+
+	keys := &APIKeys{}
+	for _, key := range order {
+		keys.keys = append(keys.keys, apiKey{key: []byte(key), scopes: byKey[key]})
+	}
+	return keys, nil
+}
+
+// LoadAPIKeys returns the API keys from the file, or from the keys given as string if there is no file.
+// It returns nil if neither is given, so that the endpoints are not protected.
+func LoadAPIKeys(filename, keys string) (*APIKeys, error) {
+	if filename != "" {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		keys = string(data)
+	}
+	if strings.TrimSpace(keys) == "" {
+		return nil, nil
+	}
+	return ParseAPIKeys(keys)
+}
+
+// With returns the API keys, and the key with the scope in addition.
+// It can be called on nil, for adding a key to no keys.
+func (k *APIKeys) With(keyScope scope.Scope, key string) *APIKeys {
+	keys := &APIKeys{}
+	added := false
+	if k != nil {
+		for _, existing := range k.keys {
+			scopes := make(map[scope.Scope]bool, len(existing.scopes)+1)
+			for s := range existing.scopes {
+				scopes[s] = true
+			}
+			if string(existing.key) == key {
+				scopes[keyScope] = true
+				added = true
+			}
+			keys.keys = append(keys.keys, apiKey{key: existing.key, scopes: scopes})
+		}
+	}
+	if !added {
+		keys.keys = append(keys.keys, apiKey{key: []byte(key), scopes: map[scope.Scope]bool{keyScope: true}})
+	}
+	return keys
+}
+
+// scopes returns the scopes of the API key given as `Authorization: Bearer <key>` header or `X-API-Key` header,
+// or nil if the request has no valid key.
+func (k *APIKeys) scopes(r *http.Request) map[scope.Scope]bool {
+	token := r.Header.Get("X-API-Key")
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	if token == "" {
+		return nil
+	}
+	var scopes map[scope.Scope]bool
+	// compare with all the keys, so that the duration does not tell which key matched
+	for _, key := range k.keys {
+		if subtle.ConstantTimeCompare([]byte(token), key.key) == 1 {
+			scopes = key.scopes
+		}
+	}
+	return scopes
+}
+
+// Protect returns a handler serving only the requests authenticated by an API key with the scope required by the scope.Func.
+// The other requests are rejected with 401 Unauthorized (no valid key) or 403 Forbidden (missing scope).
+func (k *APIKeys) Protect(handler http.Handler, scopeFunc scope.Func) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required := scopeFunc(r)
+		scopes := k.scopes(r)
+		if scopes == nil {
+			logger.WithFields(log.Fields{
+				"remoteAddr": r.RemoteAddr,
+				"method":     r.Method,
+				"path":       r.URL.Path,
+			}).Warn("Request without a valid API key")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="guble"`)
+			http.Error(w, "A valid API key is required", http.StatusUnauthorized)
+			return
+		}
+		if !scope.Granted(scopes, required) {
+			logger.WithFields(log.Fields{
+				"remoteAddr": r.RemoteAddr,
+				"method":     r.Method,
+				"path":       r.URL.Path,
+				"scope":      required,
+			}).Warn("Request with an API key missing the required scope")
+			http.Error(w, fmt.Sprintf("The API key has not the scope %s", required), http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,97 @@
+package webserver
+
+import (
+	"github.com/smancke/guble/server/scope"
+	"github.com/stretchr/testify/assert"
+
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	a := assert.New(t)
+
+	keys, err := ParseAPIKeys("admin:key1, read-only:key2\n# comment\n\nconnector-write:key2")
+	a.NoError(err)
+	a.Equal(2, len(keys.keys))
+	a.Equal(map[scope.Scope]bool{scope.Admin: true}, keys.keys[0].scopes)
+	a.Equal(map[scope.Scope]bool{scope.ReadOnly: true, scope.ConnectorWrite: true}, keys.keys[1].scopes)
+
+	for _, invalid := range []string{"key1", "admin:", "delete:key1", "", "# only a comment"} {
+		_, err := ParseAPIKeys(invalid)
+		a.Error(err, invalid)
+	}
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	a := assert.New(t)
+
+	keys, err := LoadAPIKeys("", "")
+	a.NoError(err)
+	a.Nil(keys)
+
+	f, err := ioutil.TempFile("", "guble_apikeys_test")
+	a.NoError(err)
+	defer os.Remove(f.Name())
+	f.WriteString("read-only:fromFile\n")
+	f.Close()
+
+	keys, err = LoadAPIKeys(f.Name(), "admin:ignored")
+	a.NoError(err)
+	a.Equal(1, len(keys.keys))
+	a.Equal("fromFile", string(keys.keys[0].key))
+
+	_, err = LoadAPIKeys("/does/not/exist", "")
+	a.Error(err)
+}
+
+func TestAPIKeysWith(t *testing.T) {
+	a := assert.New(t)
+
+	keys := (*APIKeys)(nil).With(scope.Admin, "key1")
+	a.Equal(1, len(keys.keys))
+	a.Equal(map[scope.Scope]bool{scope.Admin: true}, keys.keys[0].scopes)
+
+	parsed, err := ParseAPIKeys("read-only:key1,read-only:key2")
+	a.NoError(err)
+	keys = parsed.With(scope.Admin, "key1")
+	a.Equal(2, len(keys.keys))
+	a.Equal(map[scope.Scope]bool{scope.ReadOnly: true, scope.Admin: true}, keys.keys[0].scopes)
+	a.Equal(map[scope.Scope]bool{scope.ReadOnly: true}, keys.keys[1].scopes)
+
+	// the keys are not changed
+	a.Equal(map[scope.Scope]bool{scope.ReadOnly: true}, parsed.keys[0].scopes)
+}
+
+func TestAPIKeysProtect(t *testing.T) {
+	a := assert.New(t)
+	keys, err := ParseAPIKeys("admin:admin,connector-write:writer,read-only:reader")
+	a.NoError(err)
+	handler := keys.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}), scope.ReadOnlyOr(scope.Admin))
+
+	status := func(method, header, key string) int {
+		req := httptest.NewRequest(method, "/admin/something", nil)
+		if header == "Authorization" {
+			key = "Bearer " + key
+		}
+		if header != "" {
+			req.Header.Set(header, key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	a.Equal(http.StatusUnauthorized, status(http.MethodGet, "", ""))
+	a.Equal(http.StatusUnauthorized, status(http.MethodGet, "Authorization", "wrong"))
+	a.Equal(http.StatusOK, status(http.MethodGet, "Authorization", "reader"))
+	a.Equal(http.StatusOK, status(http.MethodGet, "X-API-Key", "writer"))
+	a.Equal(http.StatusForbidden, status(http.MethodPost, "Authorization", "reader"))
+	a.Equal(http.StatusForbidden, status(http.MethodPost, "Authorization", "writer"))
+	a.Equal(http.StatusOK, status(http.MethodPost, "Authorization", "admin"))
+}
@@ -0,0 +1,165 @@
+package webserver
+
+import (
+	"github.com/smancke/guble/server/auth"
+
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TLSReloadInterval is the interval between the checks for changes of the certificate files.
+var TLSReloadInterval = 10 * time.Second
+
+// TLSConfig is the configuration of the TLS listener of a WebServer.
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM-encoded certificate (chain) and private key of the server.
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile contains the PEM-encoded certificates of the CAs verifying the client certificates (mutual TLS).
+	// The client certificates are not requested if it is empty.
+	ClientCAFile string
+
+	// ClientCertOptional accepts the connections without a client certificate. A given certificate is still verified.
+	ClientCertOptional bool
+
+	// ClientCertUserID identifies the users by the common name of their verified client certificates.
+	ClientCertUserID bool
+}
+
+// tlsFiles are the loaded certificate files, reloaded when their content changes.
+type tlsFiles struct {
+	config TLSConfig
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	data        [][]byte
+
+	stopC chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newTLSFiles(config TLSConfig) (*tlsFiles, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("A TLS certificate file and key file are required")
+	}
+	if config.ClientCAFile == "" && (config.ClientCertOptional || config.ClientCertUserID) {
+		return nil, errors.New("A client CA file is required for the client certificates")
+	}
+	files := &tlsFiles{config: config}
+	if _, err := files.reload(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// tlsConfig returns the tls.Config, which uses the current certificate and client CAs for each connection.
+func (files *tlsFiles) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			files.mutex.RLock()
+			defer files.mutex.RUnlock()
+			config := &tls.Config{Certificates: []tls.Certificate{*files.certificate}}
+			if files.clientCAs != nil {
+				config.ClientCAs = files.clientCAs
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				if files.config.ClientCertOptional {
+					config.ClientAuth = tls.VerifyClientCertIfGiven
+				}
+			}
+			return config, nil
+		},
+	}
+}
+
+func (files *tlsFiles) start() {
+	files.stopC = make(chan struct{})
+	files.wg.Add(1)
+	go files.watch()
+}
+
+func (files *tlsFiles) stop() {
+	if files.stopC != nil {
+		close(files.stopC)
+		files.wg.Wait()
+		files.stopC = nil
+	}
+}
+
+func (files *tlsFiles) watch() {
+	defer files.wg.Done()
+	ticker := time.NewTicker(TLSReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if reloaded, err := files.reload(); err != nil {
+				logger.WithError(err).Error("Error reloading the TLS certificates, keeping the previous ones")
+			} else if reloaded {
+				logger.Info("Reloaded the TLS certificates")
+			}
+		case <-files.stopC:
+			return
+		}
+	}
+}
+
+// reload loads the files, if their content was changed since they were loaded.
+func (files *tlsFiles) reload() (bool, error) {
+	names := []string{files.config.CertFile, files.config.KeyFile}
+	if files.config.ClientCAFile != "" {
+		names = append(names, files.config.ClientCAFile)
+	}
+	data := make([][]byte, len(names))
+	changed := false
+	files.mutex.RLock()
+	for i, name := range names {
+		var err error
+		if data[i], err = ioutil.ReadFile(name); err != nil {
+			files.mutex.RUnlock()
+			return false, err
+		}
+		changed = changed || files.data == nil || !bytes.Equal(data[i], files.data[i])
+	}
+	files.mutex.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	certificate, err := tls.X509KeyPair(data[0], data[1])
+	if err != nil {
+		return false, fmt.Errorf("Invalid TLS certificate or key: %v", err)
+	}
+	var clientCAs *x509.CertPool
+	if files.config.ClientCAFile != "" {
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data[2]) {
+			return false, fmt.Errorf("No certificate in the client CA file %s", files.config.ClientCAFile)
+		}
+	}
+
+	files.mutex.Lock()
+	files.certificate, files.clientCAs, files.data = &certificate, clientCAs, data
+	files.mutex.Unlock()
+	return true, nil
+}
+
+// withClientCertUserID passes the common name of the verified client certificate as user ID in the request context.
+// The user of a request without a client certificate is anonymous.
+func withClientCertUserID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var userID string
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+			userID = r.TLS.VerifiedChains[0][0].Subject.CommonName
+		}
+		handler.ServeHTTP(w, r.WithContext(auth.WithUserID(r.Context(), userID)))
+	})
+}
@@ -0,0 +1,194 @@
+package webserver
+
+import (
+	"github.com/smancke/guble/server/auth"
+
+	"github.com/stretchr/testify/assert"
+
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *rsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a certificate with the common name, signed by the parent (or self-signed if the parent is nil).
+func newTestCert(t *testing.T, commonName string, parent *testCert) *testCert {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	signerCert, signerKey := template, key
+	if parent != nil {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	}
+}
+
+func (c *testCert) write(t *testing.T, dir string) (string, string) {
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.NoError(t, ioutil.WriteFile(certFile, c.certPEM, 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, c.keyPEM, 0600))
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	assert.NoError(t, err)
+	return cert
+}
+
+func startTLSServer(t *testing.T, config TLSConfig) *WebServer {
+	server := New("127.0.0.1:0")
+	assert.NoError(t, server.SetTLS(config))
+	server.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, identified := auth.UserIDFromTransport(r.Context())
+		fmt.Fprintf(w, "%s:%v", userID, identified)
+	}))
+	assert.NoError(t, server.Start())
+	return server
+}
+
+func tlsGet(server *WebServer, ca *testCert, clientCerts ...tls.Certificate) (string, *http.Response, error) {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool, Certificates: clientCerts},
+		DisableKeepAlives: true,
+	}}
+	resp, err := client.Get("https://" + server.GetAddr() + "/")
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), resp, err
+}
+
+func TestWebServer_MutualTLS(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_tls_test")
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "test ca", nil)
+	certFile, keyFile := newTestCert(t, "server", ca).write(t, dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	a.NoError(ioutil.WriteFile(caFile, ca.certPEM, 0600))
+	clientCert := newTestCert(t, "user01", ca).tlsCertificate(t)
+	otherCert := newTestCert(t, "user02", newTestCert(t, "other ca", nil)).tlsCertificate(t)
+
+	server := startTLSServer(t, TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientCertUserID: true})
+	defer server.Stop()
+
+	body, _, err := tlsGet(server, ca, clientCert)
+	a.NoError(err)
+	a.Equal("user01:true", body)
+
+	_, _, err = tlsGet(server, ca)
+	a.Error(err, "a client certificate is required")
+	_, _, err = tlsGet(server, ca, otherCert)
+	a.Error(err, "the client certificate is not signed by the CA")
+	server.Stop()
+
+	server = startTLSServer(t, TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientCertOptional: true})
+	defer server.Stop()
+	body, _, err = tlsGet(server, ca)
+	a.NoError(err)
+	a.Equal(":false", body)
+	body, _, err = tlsGet(server, ca, clientCert)
+	a.NoError(err)
+	a.Equal(":false", body, "the user ID is not taken from the certificate")
+	server.Stop()
+
+	server = startTLSServer(t, TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientCertOptional: true, ClientCertUserID: true})
+	defer server.Stop()
+	body, _, err = tlsGet(server, ca)
+	a.NoError(err)
+	a.Equal(":true", body, "the user without a certificate is anonymous")
+	body, _, err = tlsGet(server, ca, clientCert)
+	a.NoError(err)
+	a.Equal("user01:true", body)
+}
+
+func TestWebServer_TLSReload(t *testing.T) {
+	a := assert.New(t)
+	defer func(interval time.Duration) { TLSReloadInterval = interval }(TLSReloadInterval)
+	TLSReloadInterval = 10 * time.Millisecond
+	dir, _ := ioutil.TempDir("", "guble_tls_test")
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "test ca", nil)
+	certFile, keyFile := newTestCert(t, "server1", ca).write(t, dir)
+	server := startTLSServer(t, TLSConfig{CertFile: certFile, KeyFile: keyFile})
+	defer server.Stop()
+
+	serverName := func() string {
+		_, resp, err := tlsGet(server, ca)
+		if err != nil {
+			return ""
+		}
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	a.Equal("server1", serverName())
+
+	newTestCert(t, "server2", ca).write(t, dir)
+	for i := 0; i < 100 && serverName() != "server2"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.Equal("server2", serverName())
+
+	// an invalid certificate does not replace the current one
+	a.NoError(ioutil.WriteFile(certFile, []byte("invalid"), 0600))
+	time.Sleep(50 * time.Millisecond)
+	a.Equal("server2", serverName())
+}
+
+func TestWebServer_InvalidTLSConfig(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_tls_test")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := newTestCert(t, "server", nil).write(t, dir)
+
+	server := New("127.0.0.1:0")
+	a.Error(server.SetTLS(TLSConfig{CertFile: certFile}))
+	a.Error(server.SetTLS(TLSConfig{CertFile: certFile, KeyFile: filepath.Join(dir, "missing.pem")}))
+	a.Error(server.SetTLS(TLSConfig{CertFile: keyFile, KeyFile: certFile}))
+	a.Error(server.SetTLS(TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCertUserID: true}))
+	a.Error(server.SetTLS(TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile}))
+	a.NoError(server.SetTLS(TLSConfig{CertFile: certFile, KeyFile: keyFile}))
+}
@@ -1,10 +1,13 @@
 package webserver
 
 import (
+	"crypto/tls"
 	"net"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/smancke/guble/server/scope"
 )
 
 // WebServer is a struct representing a HTTP Server (using a net.Listener and a ServeMux multiplexer).
@@ -13,6 +16,8 @@ type WebServer struct {
 	ln     net.Listener
 	mux    *http.ServeMux
 	addr   string
+	keys   *APIKeys
+	tls    *tlsFiles
 }
 
 // New returns a new WebServer.
@@ -27,14 +32,25 @@ func New(addr string) *WebServer {
 func (ws *WebServer) Start() (err error) {
 	logger.WithField("address", ws.addr).Info("Http server is starting up on address")
 
-	ws.server = &http.Server{Addr: ws.addr, Handler: ws.mux}
+	var handler http.Handler = ws.mux
+	if ws.tls != nil && ws.tls.config.ClientCertUserID {
+		handler = withClientCertUserID(handler)
+	}
+	ws.server = &http.Server{Addr: ws.addr, Handler: handler}
 	ws.ln, err = net.Listen("tcp", ws.addr)
 	if err != nil {
 		return
 	}
 
+	var ln net.Listener = tcpKeepAliveListener{TCPListener: ws.ln.(*net.TCPListener)}
+	if ws.tls != nil {
+		logger.WithField("address", ws.addr).Info("Http server is using TLS")
+		ln = tls.NewListener(ln, ws.tls.tlsConfig())
+		ws.tls.start()
+	}
+
 	go func() {
-		err = ws.server.Serve(tcpKeepAliveListener{TCPListener: ws.ln.(*net.TCPListener)})
+		err = ws.server.Serve(ln)
 		if err != nil && !strings.HasSuffix(err.Error(), "use of closed network connection") {
 			logger.WithError(err).Error("ListenAndServe")
 		}
@@ -48,6 +64,9 @@ func (ws *WebServer) Stop() (err error) {
 	if ws.ln != nil {
 		err = ws.ln.Close()
 	}
+	if ws.tls != nil {
+		ws.tls.stop()
+	}
 
 	// reset the mux
 	ws.mux = http.NewServeMux()
@@ -60,6 +79,32 @@ func (ws *WebServer) Handle(prefix string, handler http.Handler) {
 	ws.mux.Handle(prefix, handler)
 }
 
+// SetTLS makes the WebServer listen with TLS, after loading the certificates of the config.
+// The certificate files are reloaded when they change, while the WebServer is started.
+func (ws *WebServer) SetTLS(config TLSConfig) error {
+	files, err := newTLSFiles(config)
+	if err != nil {
+		return err
+	}
+	ws.tls = files
+	return nil
+}
+
+// SetAPIKeys sets the API keys protecting the endpoints handled with HandleScoped.
+// The endpoints are not protected if no keys are set.
+func (ws *WebServer) SetAPIKeys(keys *APIKeys) {
+	ws.keys = keys
+}
+
+// HandleScoped handles the given prefix using the given handler, which requires the scopes given by the scope.Func
+// if API keys are set.
+func (ws *WebServer) HandleScoped(prefix string, handler http.Handler, scopeFunc scope.Func) {
+	if ws.keys != nil {
+		handler = ws.keys.Protect(handler, scopeFunc)
+	}
+	ws.mux.Handle(prefix, handler)
+}
+
 // GetAddr returns the address on which the WebServer is listening.
 // It is a part of the service.endpoint interface.
 func (ws *WebServer) GetAddr() string {
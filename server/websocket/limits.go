@@ -0,0 +1,117 @@
+package websocket
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// The names of the limits, used in the limit notifications and metrics.
+const (
+	limitConnectionsPerUser = "connections-per-user"
+	limitConnectionsPerIP   = "connections-per-ip"
+	limitSubscriptions      = "subscriptions"
+	limitMessageSize        = "message-size"
+	limitCommandRate        = "command-rate"
+	limitViolations         = "violations"
+)
+
+var errMessageTooLarge = errors.New("message too large")
+
+// Limits protect the server from clients using too many resources. A limit of 0 is unlimited.
+type Limits struct {
+	// MaxConnectionsPerUser and MaxConnectionsPerIP limit the open connections of a user,
+	// and from a remote address. The connections of anonymous users are only limited by their address.
+	MaxConnectionsPerUser int
+	MaxConnectionsPerIP   int
+
+	// MaxSubscriptions limits the receivers of a connection.
+	MaxSubscriptions int
+
+	// MaxMessageSize is the maximum size in bytes of a command sent by the client.
+	MaxMessageSize int64
+
+	// CommandRate is the number of commands per second a connection can send on average,
+	// with bursts of up to CommandBurst commands.
+	CommandRate  float64
+	CommandBurst int
+
+	// MaxViolations is the number of violated limits after which a connection is closed.
+	MaxViolations int
+}
+
+// connectionCounter counts the open connections by user and remote address.
+type connectionCounter struct {
+	mutex  sync.Mutex
+	byUser map[string]int
+	byIP   map[string]int
+}
+
+func newConnectionCounter() *connectionCounter {
+	return &connectionCounter{
+		byUser: make(map[string]int),
+		byIP:   make(map[string]int),
+	}
+}
+
+// acquire counts a new connection, or returns the exceeded limit.
+func (c *connectionCounter) acquire(limits Limits, userID, ip string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if limits.MaxConnectionsPerUser > 0 && userID != "" && c.byUser[userID] >= limits.MaxConnectionsPerUser {
+		return limitConnectionsPerUser, false
+	}
+	if limits.MaxConnectionsPerIP > 0 && c.byIP[ip] >= limits.MaxConnectionsPerIP {
+		return limitConnectionsPerIP, false
+	}
+	if userID != "" {
+		c.byUser[userID]++
+	}
+	c.byIP[ip]++
+	return "", true
+}
+
+// release counts a closed connection.
+func (c *connectionCounter) release(userID, ip string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if userID != "" {
+		if c.byUser[userID]--; c.byUser[userID] <= 0 {
+			delete(c.byUser, userID)
+		}
+	}
+	if c.byIP[ip]--; c.byIP[ip] <= 0 {
+		delete(c.byIP, ip)
+	}
+}
+
+// rateLimiter is a token bucket, allowing rate events per second on average, with bursts of up to burst events.
+// It is used by a single connection, so it is not synchronized.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow takes a token, if there is one.
+func (l *rateLimiter) allow() bool {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
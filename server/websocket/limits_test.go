@@ -0,0 +1,147 @@
+package websocket
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/testutil"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectionCounter(t *testing.T) {
+	a := assert.New(t)
+	limits := Limits{MaxConnectionsPerUser: 1, MaxConnectionsPerIP: 2}
+	c := newConnectionCounter()
+
+	_, ok := c.acquire(limits, "marvin", "10.0.0.1")
+	a.True(ok)
+	limit, ok := c.acquire(limits, "marvin", "10.0.0.2")
+	a.False(ok)
+	a.Equal(limitConnectionsPerUser, limit)
+
+	// anonymous connections are only limited by their address
+	_, ok = c.acquire(limits, "", "10.0.0.1")
+	a.True(ok)
+	limit, ok = c.acquire(limits, "", "10.0.0.1")
+	a.False(ok)
+	a.Equal(limitConnectionsPerIP, limit)
+
+	c.release("marvin", "10.0.0.1")
+	_, ok = c.acquire(limits, "marvin", "10.0.0.1")
+	a.True(ok)
+	c.release("marvin", "10.0.0.1")
+	c.release("", "10.0.0.1")
+	a.Empty(c.byUser)
+	a.Empty(c.byIP)
+}
+
+func TestRateLimiter(t *testing.T) {
+	a := assert.New(t)
+	l := newRateLimiter(100, 2)
+	a.True(l.allow())
+	a.True(l.allow())
+	a.False(l.allow(), "the burst is used up")
+	time.Sleep(20 * time.Millisecond)
+	a.True(l.allow(), "the tokens are refilled with the rate")
+}
+
+func TestWSHandler_TransportUserID(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	handler := testWSHandler(NewMockRouter(testutil.MockCtrl), auth.NewAllowAllAccessManager(true))
+	transportUserID := "certuser"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the transport identifies the users, like by client certificates
+		handler.ServeHTTP(w, r.WithContext(auth.WithUserID(r.Context(), transportUserID)))
+	}))
+	defer server.Close()
+
+	conn, _, err := dialTestServer(server, "marvin")
+	a.NoError(err)
+	a.Contains(readNotification(a, conn), `"UserId": "certuser"`)
+	conn.Close()
+
+	// a connection without a certificate is anonymous, instead of the user in the URI
+	transportUserID = ""
+	conn, _, err = dialTestServer(server, "marvin")
+	a.NoError(err)
+	a.Contains(readNotification(a, conn), `"UserId": ""`)
+	conn.Close()
+}
+
+func dialTestServer(server *httptest.Server, user string) (*websocket.Conn, *http.Response, error) {
+	return websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/prefix/user/"+user, nil)
+}
+
+func readNotification(a *assert.Assertions, conn *websocket.Conn) string {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := conn.ReadMessage()
+	a.NoError(err)
+	return string(data)
+}
+
+func TestWSHandler_ConnectionLimits(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	handler := testWSHandler(NewMockRouter(testutil.MockCtrl), auth.NewAllowAllAccessManager(true))
+	handler.SetLimits(Limits{MaxConnectionsPerUser: 1})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, _, err := dialTestServer(server, "marvin")
+	a.NoError(err)
+	a.Contains(readNotification(a, conn), "#"+protocol.SUCCESS_CONNECTED)
+
+	_, resp, err := dialTestServer(server, "marvin")
+	a.Error(err)
+	a.Equal(http.StatusTooManyRequests, resp.StatusCode)
+
+	other, _, err := dialTestServer(server, "arthur")
+	a.NoError(err)
+	other.Close()
+
+	// the connection is counted until it is closed
+	conn.Close()
+	for i := 0; i < 100; i++ {
+		if conn, _, err = dialTestServer(server, "marvin"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.NoError(err)
+	conn.Close()
+}
+
+func TestWSHandler_MaxMessageSize(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	handler := testWSHandler(NewMockRouter(testutil.MockCtrl), auth.NewAllowAllAccessManager(true))
+	handler.SetLimits(Limits{MaxMessageSize: 20})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, _, err := dialTestServer(server, "marvin")
+	a.NoError(err)
+	defer conn.Close()
+	readNotification(a, conn)
+
+	a.NoError(conn.WriteMessage(websocket.BinaryMessage, []byte("> /foo\n{}\n"+strings.Repeat("x", 100))))
+	a.Equal("!"+protocol.ERROR_LIMIT_EXCEEDED+" message-size the maximum message size is 20 bytes", readNotification(a, conn))
+
+	// the connection can still be used
+	a.NoError(conn.WriteMessage(websocket.BinaryMessage, []byte("XXXX")))
+	a.Contains(readNotification(a, conn), "!"+protocol.ERROR_BAD_REQUEST)
+}
@@ -2,14 +2,20 @@ package websocket
 
 import (
 	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/audit"
 	"github.com/smancke/guble/server/auth"
 	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/server/store"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/websocket"
 	"github.com/rs/xid"
 
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -24,6 +30,10 @@ type WSHandler struct {
 	router        router.Router
 	prefix        string
 	accessManager auth.AccessManager
+
+	limits Limits
+	// connections are counted if limits are set
+	connections *connectionCounter
 }
 
 // NewWSHandler returns a new WSHandler.
@@ -39,6 +49,12 @@ func NewWSHandler(router router.Router, prefix string) (*WSHandler, error) {
 	}, nil
 }
 
+// SetLimits sets the limits of the connections.
+func (handler *WSHandler) SetLimits(limits Limits) {
+	handler.limits = limits
+	handler.connections = newConnectionCounter()
+}
+
 // GetPrefix returns the prefix.
 // It is a part of the service.endpoint implementation.
 func (handler *WSHandler) GetPrefix() string {
@@ -47,7 +63,43 @@ func (handler *WSHandler) GetPrefix() string {
 
 // ServeHTTP is an http.Handler.
 // It is a part of the service.endpoint implementation.
+// If the AccessManager is an auth.Authenticator, the user is identified by the token of the request,
+// else by the transport (e.g. a client certificate) if it identifies the users, else by the user ID in the URI.
+// A connection without a client certificate is anonymous, if the users are identified by their client certificates.
+// A connection exceeding the limits of connections per user or remote address is rejected with 429 Too Many Requests.
 func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	userID, identified := auth.UserIDFromTransport(r.Context())
+	if !identified {
+		userID = extractUserID(r.RequestURI)
+	}
+	var permissions auth.AccessManager
+	if authenticator, ok := handler.accessManager.(auth.Authenticator); ok {
+		var err error
+		userID, permissions, err = authenticator.Authenticate(auth.TokenFromRequest(r))
+		if err != nil {
+			logger.WithError(err).Warn("Unauthenticated websocket connection")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="guble"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if handler.connections != nil {
+		ip := remoteIP(r)
+		limit, ok := handler.connections.acquire(handler.limits, userID, ip)
+		if !ok {
+			mTotalLimitViolations[limit].Add(1)
+			logger.WithFields(log.Fields{
+				"userId":     userID,
+				"remoteAddr": r.RemoteAddr,
+				"limit":      limit,
+			}).Warn("Websocket connection limit exceeded")
+			http.Error(w, "Too many connections", http.StatusTooManyRequests)
+			return
+		}
+		defer handler.connections.release(userID, ip)
+	}
+
 	c, err := webSocketUpgrader.Upgrade(w, r, nil)
 	if err != nil {
 		logger.WithError(err).Error("Error on upgrading to websocket")
@@ -55,7 +107,9 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	defer c.Close()
 
-	NewWebSocket(handler, &wsconn{c}, extractUserID(r.RequestURI)).Start()
+	ws := NewWebSocket(handler, &wsconn{Conn: c, maxMessageSize: handler.limits.MaxMessageSize}, userID)
+	ws.permissions = permissions
+	ws.Start()
 }
 
 // WSConnection is a wrapper interface for the needed functions of the websocket.Conn
@@ -70,6 +124,8 @@ type WSConnection interface {
 // implementing the interface WSConn for better testability
 type wsconn struct {
 	*websocket.Conn
+	// maxMessageSize limits the size of the received messages, if it is not 0
+	maxMessageSize int64
 }
 
 // Close the connection.
@@ -83,9 +139,27 @@ func (conn *wsconn) Send(bytes []byte) error {
 }
 
 // Receive bytes through the connection and possibly return an error.
+// A message larger than the maximum message size is skipped, and errMessageTooLarge is returned.
 func (conn *wsconn) Receive(bytes *[]byte) (err error) {
-	_, *bytes, err = conn.ReadMessage()
-	return err
+	if conn.maxMessageSize <= 0 {
+		_, *bytes, err = conn.ReadMessage()
+		return err
+	}
+	_, r, err := conn.NextReader()
+	if err != nil {
+		return err
+	}
+	if *bytes, err = ioutil.ReadAll(io.LimitReader(r, conn.maxMessageSize+1)); err != nil {
+		return err
+	}
+	if int64(len(*bytes)) > conn.maxMessageSize {
+		*bytes = nil
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return err
+		}
+		return errMessageTooLarge
+	}
+	return nil
 }
 
 // WebSocket struct represents a websocket.
@@ -96,11 +170,21 @@ type WebSocket struct {
 	userID        string
 	sendChannel   chan []byte
 	receivers     map[protocol.Path]*Receiver
+
+	// permissions are granted by the token of the connection, if the user was authenticated by one.
+	// They are checked in addition to the AccessManager of the router.
+	permissions auth.AccessManager
+
+	// commandLimiter limits the rate of the commands, if there is a command rate limit.
+	commandLimiter *rateLimiter
+	violations     int
+	// closing is set when the connection is closed because of the violated limits.
+	closing bool
 }
 
 // NewWebSocket returns a new WebSocket.
 func NewWebSocket(handler *WSHandler, wsConn WSConnection, userID string) *WebSocket {
-	return &WebSocket{
+	ws := &WebSocket{
 		WSHandler:     handler,
 		WSConnection:  wsConn,
 		applicationID: xid.New().String(),
@@ -108,6 +192,10 @@ func NewWebSocket(handler *WSHandler, wsConn WSConnection, userID string) *WebSo
 		sendChannel:   make(chan []byte, 10),
 		receivers:     make(map[protocol.Path]*Receiver),
 	}
+	if handler.limits.CommandRate > 0 {
+		ws.commandLimiter = newRateLimiter(handler.limits.CommandRate, handler.limits.CommandBurst)
+	}
+	return ws
 }
 
 // Start the WebSocket (the send and receive loops).
@@ -121,6 +209,11 @@ func (ws *WebSocket) Start() error {
 
 func (ws *WebSocket) sendLoop() {
 	for raw := range ws.sendChannel {
+		// nil is sent after the last notification, when the connection is closed because of the violated limits
+		if raw == nil {
+			ws.cleanAndClose()
+			break
+		}
 		if !ws.checkAccess(raw) {
 			continue
 		}
@@ -146,12 +239,20 @@ func (ws *WebSocket) checkAccess(raw []byte) bool {
 			"path":   path,
 		}).Debug("Received msg")
 
-		return len(path) == 0 || ws.accessManager.IsAllowed(auth.READ, ws.userID, path)
+		return len(path) == 0 || ws.isAllowed(auth.READ, path)
 
 	}
 	return true
 }
 
+// isAllowed checks the permissions of the token of the connection if there is one, else the AccessManager.
+func (ws *WebSocket) isAllowed(accessType auth.AccessType, path protocol.Path) bool {
+	if ws.permissions != nil {
+		return ws.permissions.IsAllowed(accessType, ws.userID, path)
+	}
+	return ws.accessManager.IsAllowed(accessType, ws.userID, path)
+}
+
 func getPathFromRawMessage(raw []byte) protocol.Path {
 	i := strings.Index(string(raw), ",")
 	return protocol.Path(raw[:i])
@@ -161,15 +262,31 @@ func (ws *WebSocket) receiveLoop() {
 	var message []byte
 	for {
 		err := ws.Receive(&message)
+		if err == errMessageTooLarge {
+			if !ws.closing {
+				ws.violate(limitMessageSize, "the maximum message size is %d bytes", ws.limits.MaxMessageSize)
+			}
+			continue
+		}
 		if err != nil {
 
 			logger.WithFields(log.Fields{
 				"applicationID": ws.applicationID,
 			}).Debug("Closed connnection by application")
 
-			ws.cleanAndClose()
+			// the send loop closes the connection, if it is closing because of the violated limits
+			if !ws.closing {
+				ws.cleanAndClose()
+			}
 			break
 		}
+		if ws.closing {
+			continue
+		}
+		if ws.commandLimiter != nil && !ws.commandLimiter.allow() {
+			ws.violate(limitCommandRate, "the maximum rate is %v commands per second", ws.limits.CommandRate)
+			continue
+		}
 
 		//protocol.Debug("websocket_connector, raw message received: %v", string(message))
 		cmd, err := protocol.ParseCmd(message)
@@ -212,6 +329,15 @@ func (ws *WebSocket) handleReceiveCmd(cmd *protocol.Cmd) {
 		ws.sendError(protocol.ERROR_BAD_REQUEST, err.Error())
 		return
 	}
+	if ws.permissions != nil && !ws.permissions.IsAllowed(auth.READ, ws.userID, rec.path) {
+		ws.sendError(protocol.ERROR_SUBSCRIBED_TO, "%v %v", rec.path,
+			&router.PermissionDeniedError{UserID: ws.userID, AccessType: auth.READ, Path: rec.path})
+		return
+	}
+	if _, exists := ws.receivers[rec.path]; !exists && ws.limits.MaxSubscriptions > 0 && len(ws.receivers) >= ws.limits.MaxSubscriptions {
+		ws.violate(limitSubscriptions, "%v the maximum is %d subscriptions per connection", rec.path, ws.limits.MaxSubscriptions)
+		return
+	}
 	ws.receivers[rec.path] = rec
 	rec.Start()
 }
@@ -240,17 +366,70 @@ func (ws *WebSocket) handleSendCmd(cmd *protocol.Cmd) {
 	}
 
 	args := strings.SplitN(cmd.Arg, " ", 2)
+	ack := &protocol.SendAck{Path: protocol.Path(args[0])}
+	if len(args) > 1 {
+		ack.PublisherMessageID = strings.TrimSpace(args[1])
+	}
 	msg := &protocol.Message{
-		Path:          protocol.Path(args[0]),
+		Path:          ack.Path,
 		ApplicationID: ws.applicationID,
 		UserID:        ws.userID,
 		HeaderJSON:    cmd.HeaderJSON,
 		Body:          cmd.Body,
 	}
 
-	ws.router.HandleMessage(msg)
+	// the audit topic is reserved for the audit events, and the permissions granted by a token are checked here
+	if audit.CheckPublish(msg.Path) != nil ||
+		(ws.permissions != nil && !ws.permissions.IsAllowed(auth.WRITE, ws.userID, msg.Path)) {
+		ws.sendSendError(ack, &router.PermissionDeniedError{UserID: ws.userID, AccessType: auth.WRITE, Path: msg.Path})
+		return
+	}
 
-	ws.sendOK(protocol.SUCCESS_SEND, "")
+	if err := ws.router.HandleMessage(msg); err != nil {
+		logger.WithError(err).WithField("path", msg.Path).Error("Error handling sent message")
+		ws.sendSendError(ack, err)
+		return
+	}
+
+	ack.SequenceID = msg.ID
+	ack.Time = msg.Time
+	ws.sendAck(protocol.SUCCESS_SEND, false, ack.PublisherMessageID, ack)
+}
+
+// sendSendError notifies the client of a rejected message, with the type of the error.
+func (ws *WebSocket) sendSendError(ack *protocol.SendAck, err error) {
+	name := protocol.ERROR_SEND
+	switch err.(type) {
+	case *router.PermissionDeniedError:
+		ack.ErrorType = protocol.SEND_ERROR_PERMISSION_DENIED
+	case *router.ModuleStoppingError:
+		ack.ErrorType = protocol.SEND_ERROR_STOPPING
+	case *store.QuotaExceededError:
+		name = protocol.ERROR_QUOTA_EXCEEDED
+		ack.ErrorType = protocol.SEND_ERROR_QUOTA_EXCEEDED
+	default:
+		ack.ErrorType = protocol.SEND_ERROR_STORAGE
+	}
+	arg := err.Error()
+	if ack.PublisherMessageID != "" {
+		arg = ack.PublisherMessageID + " " + arg
+	}
+	ws.sendAck(name, true, arg, ack)
+}
+
+// sendAck sends the notification answering a send command, with the SendAck as json data.
+func (ws *WebSocket) sendAck(name string, isError bool, arg string, ack *protocol.SendAck) {
+	data, err := json.Marshal(ack)
+	if err != nil {
+		logger.WithError(err).Error("Error encoding the send notification")
+	}
+	n := &protocol.NotificationMessage{
+		Name:    name,
+		Arg:     arg,
+		Json:    string(data),
+		IsError: isError,
+	}
+	ws.sendChannel <- n.Bytes()
 }
 
 func (ws *WebSocket) cleanAndClose() {
@@ -267,6 +446,26 @@ func (ws *WebSocket) cleanAndClose() {
 	ws.Close()
 }
 
+// violate notifies the client of the exceeded limit, and closes the connection after too many violations.
+func (ws *WebSocket) violate(limit string, argPattern string, params ...interface{}) {
+	mTotalLimitViolations[limit].Add(1)
+	ws.violations++
+	logger.WithFields(log.Fields{
+		"userId":        ws.userID,
+		"applicationID": ws.applicationID,
+		"limit":         limit,
+		"violations":    ws.violations,
+	}).Warn("Websocket limit exceeded")
+	ws.sendError(protocol.ERROR_LIMIT_EXCEEDED, limit+" "+argPattern, params...)
+
+	if ws.limits.MaxViolations > 0 && ws.violations >= ws.limits.MaxViolations {
+		mTotalLimitDisconnects.Add(1)
+		ws.sendError(protocol.ERROR_LIMIT_EXCEEDED, "%s closing the connection after %d violated limits", limitViolations, ws.violations)
+		ws.closing = true
+		ws.sendChannel <- nil
+	}
+}
+
 func (ws *WebSocket) sendError(name string, argPattern string, params ...interface{}) {
 	n := &protocol.NotificationMessage{
 		Name:    name,
@@ -285,6 +484,15 @@ func (ws *WebSocket) sendOK(name string, argPattern string, params ...interface{
 	ws.sendChannel <- n.Bytes()
 }
 
+// remoteIP returns the IP address of the client, without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // Extracts the userID out of an URI or empty string if format not met
 // Example:
 // 		http://example.com/user/user01/ -> user01
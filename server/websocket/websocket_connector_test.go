@@ -2,6 +2,7 @@ package websocket
 
 import (
 	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/audit"
 	"github.com/smancke/guble/server/auth"
 	"github.com/smancke/guble/server/router"
 	"github.com/smancke/guble/server/store"
@@ -10,7 +11,10 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"sync"
 	"testing"
@@ -69,7 +73,94 @@ func Test_SendMessage(t *testing.T) {
 	wsconn, routerMock, messageStore := createDefaultMocks(commands)
 
 	routerMock.EXPECT().HandleMessage(messageMatcher{path: "/path", message: "Hello, this is a test", header: `{"key": "value"}`})
-	wsconn.EXPECT().Send([]byte("#send"))
+	wsconn.EXPECT().Send([]byte("#send\n" + `{"path":"/path"}`))
+
+	runNewWebSocket(wsconn, routerMock, messageStore, nil)
+}
+
+func Test_SendMessageWithPublisherMessageID(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	commands := []string{"> /path id-42\n{}\nHello"}
+	wsconn, routerMock, messageStore := createDefaultMocks(commands)
+
+	// the id and time are assigned, when the message is stored
+	routerMock.EXPECT().HandleMessage(messageMatcher{path: "/path", message: "Hello", header: "{}"}).
+		Do(func(msg *protocol.Message) {
+			msg.ID = 7
+			msg.Time = 1420110000
+		})
+	wsconn.EXPECT().Send([]byte("#send id-42\n" +
+		`{"publisherMessageId":"id-42","path":"/path","sequenceId":7,"messagePublishingTime":1420110000}`))
+
+	runNewWebSocket(wsconn, routerMock, messageStore, nil)
+}
+
+func Test_SendMessageWithError(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	commands := []string{"> /path\n{}\nHello"}
+	wsconn, routerMock, messageStore := createDefaultMocks(commands)
+
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Return(&router.ModuleStoppingError{Name: "router"})
+	wsconn.EXPECT().Send([]byte("!" + protocol.ERROR_SEND + " Service router is stopping\n" +
+		`{"path":"/path","errorType":"stopping"}`))
+
+	runNewWebSocket(wsconn, routerMock, messageStore, nil)
+}
+
+func Test_SendMessageWithStorageError(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	commands := []string{"> /path id-42\n{}\nHello"}
+	wsconn, routerMock, messageStore := createDefaultMocks(commands)
+
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Return(errors.New("disk full"))
+	wsconn.EXPECT().Send([]byte("!" + protocol.ERROR_SEND + " id-42 disk full\n" +
+		`{"publisherMessageId":"id-42","path":"/path","errorType":"storage"}`))
+
+	runNewWebSocket(wsconn, routerMock, messageStore, nil)
+}
+
+// auditTopicRecorder is an audit.Recorder publishing the events to the topic /audit.
+type auditTopicRecorder struct{}
+
+func (auditTopicRecorder) Record(e *audit.Event) {}
+
+func (auditTopicRecorder) Topic() protocol.Path {
+	return "/audit"
+}
+
+func Test_SendMessageToAuditTopic(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	audit.SetRecorder(auditTopicRecorder{})
+	defer audit.SetRecorder(nil)
+
+	commands := []string{"> /audit\n{}\n{\"action\":\"fake\"}"}
+	wsconn, routerMock, messageStore := createDefaultMocks(commands)
+
+	// the message is not handled by the router
+	wsconn.EXPECT().Send([]byte("!" + protocol.ERROR_SEND +
+		" Access Denied for user=[testuser] on path=[/audit] for Operation=[write]\n" +
+		`{"path":"/audit","errorType":"permission-denied"}`))
+
+	runNewWebSocket(wsconn, routerMock, messageStore, nil)
+}
+
+func Test_SendMessageWithQuotaExceeded(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	commands := []string{"> /path\n{}\nHello"}
+	wsconn, routerMock, messageStore := createDefaultMocks(commands)
+
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Return(&store.QuotaExceededError{Partition: "path", Resource: "messages", Limit: 10})
+	wsconn.EXPECT().Send([]byte("!" + protocol.ERROR_QUOTA_EXCEEDED + " Quota of 10 messages exceeded for partition path\n" +
+		`{"path":"/path","errorType":"quota-exceeded"}`))
 
 	runNewWebSocket(wsconn, routerMock, messageStore, nil)
 }
@@ -121,6 +212,63 @@ func Test_AnIncomingMessageIsNotAllowed(t *testing.T) {
 	time.Sleep(time.Millisecond * 2)
 }
 
+func Test_CommandsNotAllowedByToken(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	commands := []string{"> /path\n{}\nHello", "+ /foo"}
+	wsconn, routerMock, _ := createDefaultMocks(commands)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	doneGroup := func(bytes []byte) error {
+		wg.Done()
+		return nil
+	}
+	wsconn.EXPECT().Send([]byte("!" + protocol.ERROR_SEND +
+		" Access Denied for user=[testuser] on path=[/path] for Operation=[write]\n" +
+		`{"path":"/path","errorType":"permission-denied"}`)).Do(doneGroup)
+	wsconn.EXPECT().Send([]byte("!" + protocol.ERROR_SUBSCRIBED_TO +
+		" /foo Access Denied for user=[testuser] on path=[/foo] for Operation=[read]")).Do(doneGroup)
+
+	websocket := NewWebSocket(
+		testWSHandler(routerMock, auth.NewAllowAllAccessManager(true)),
+		wsconn,
+		"testuser",
+	)
+	// the token of the connection grants nothing
+	websocket.permissions = auth.NewAllowAllAccessManager(false)
+	go websocket.Start()
+	wg.Wait()
+}
+
+// testAuthenticator accepts only the token "valid", for the user "tokenuser".
+type testAuthenticator struct {
+	auth.AllowAllAccessManager
+}
+
+func (testAuthenticator) Authenticate(token string) (string, auth.AccessManager, error) {
+	if token != "valid" {
+		return "", nil, fmt.Errorf("invalid token")
+	}
+	return "tokenuser", auth.NewAllowAllAccessManager(true), nil
+}
+
+func Test_ServeHTTPRequiresToken(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	handler := testWSHandler(NewMockRouter(testutil.MockCtrl), testAuthenticator{auth.NewAllowAllAccessManager(true)})
+
+	for _, uri := range []string{"/prefix/user/marvin", "/prefix/user/marvin?access_token=invalid"} {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		handler.ServeHTTP(recorder, req)
+		a.Equal(http.StatusUnauthorized, recorder.Code, uri)
+	}
+}
+
 func Test_BadCommands(t *testing.T) {
 	_, finish := testutil.NewMockCtrl(t)
 	defer finish()
@@ -153,6 +301,59 @@ func Test_BadCommands(t *testing.T) {
 	assert.Equal(t, len(badRequests), counter, "expected number of bad requests does not match")
 }
 
+func Test_SubscriptionLimitClosesConnection(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	commands := []string{"+ /foo", "+ /bar", "+ /baz"}
+	wsconn, routerMock, _ := createDefaultMocks(commands)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	doneGroup := func(bytes []byte) error {
+		wg.Done()
+		return nil
+	}
+	// the subscription of /foo runs concurrently, and may be stopped before it is completed
+	routerMock.EXPECT().Subscribe(routeMatcher{"/foo"}).Return(nil, nil).AnyTimes()
+	routerMock.EXPECT().Unsubscribe(routeMatcher{"/foo"}).AnyTimes()
+	wsconn.EXPECT().Send([]byte("#" + protocol.SUCCESS_SUBSCRIBED_TO + " /foo")).AnyTimes()
+	wsconn.EXPECT().Send([]byte("!" + protocol.ERROR_LIMIT_EXCEEDED +
+		" subscriptions /bar the maximum is 1 subscriptions per connection")).Do(doneGroup)
+	wsconn.EXPECT().Send([]byte("!" + protocol.ERROR_LIMIT_EXCEEDED +
+		" violations closing the connection after 1 violated limits")).Do(doneGroup)
+	wsconn.EXPECT().Close().Do(func() { wg.Done() })
+
+	handler := testWSHandler(routerMock, auth.NewAllowAllAccessManager(true))
+	handler.SetLimits(Limits{MaxSubscriptions: 1, MaxViolations: 1})
+	go NewWebSocket(handler, wsconn, "testuser").Start()
+	wg.Wait()
+}
+
+func Test_CommandRateLimit(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	commands := []string{"> /path\n{}\nHello", "> /path\n{}\nHello"}
+	wsconn, routerMock, _ := createDefaultMocks(commands)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	doneGroup := func(bytes []byte) error {
+		wg.Done()
+		return nil
+	}
+	routerMock.EXPECT().HandleMessage(gomock.Any())
+	wsconn.EXPECT().Send([]byte("#" + protocol.SUCCESS_SEND + "\n" + `{"path":"/path"}`)).Do(doneGroup)
+	wsconn.EXPECT().Send([]byte("!" + protocol.ERROR_LIMIT_EXCEEDED +
+		" command-rate the maximum rate is 0.01 commands per second")).Do(doneGroup)
+
+	handler := testWSHandler(routerMock, auth.NewAllowAllAccessManager(true))
+	handler.SetLimits(Limits{CommandRate: 0.01, CommandBurst: 1})
+	go NewWebSocket(handler, wsconn, "testuser").Start()
+	wg.Wait()
+}
+
 func TestExtractUserId(t *testing.T) {
 	assert.Equal(t, "marvin", extractUserID("/foo/user/marvin"))
 	assert.Equal(t, "marvin", extractUserID("/user/marvin"))
@@ -0,0 +1,16 @@
+package websocket
+
+import (
+	"github.com/smancke/guble/server/metrics"
+)
+
+var (
+	mTotalLimitViolations = map[string]metrics.Int{
+		limitConnectionsPerUser: metrics.NewInt("websocket.total_limit_violations_connections_per_user"),
+		limitConnectionsPerIP:   metrics.NewInt("websocket.total_limit_violations_connections_per_ip"),
+		limitSubscriptions:      metrics.NewInt("websocket.total_limit_violations_subscriptions"),
+		limitMessageSize:        metrics.NewInt("websocket.total_limit_violations_message_size"),
+		limitCommandRate:        metrics.NewInt("websocket.total_limit_violations_command_rate"),
+	}
+	mTotalLimitDisconnects = metrics.NewInt("websocket.total_limit_disconnects")
+)